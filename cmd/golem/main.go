@@ -3,12 +3,18 @@ package main
 import (
 	"context"
 	"fmt"
+	"log"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
 	"github.com/dylanlott/orderbook/pkg/accounts"
+	"github.com/dylanlott/orderbook/pkg/fix"
+	"github.com/dylanlott/orderbook/pkg/itch"
+	"github.com/dylanlott/orderbook/pkg/margin"
 	"github.com/dylanlott/orderbook/pkg/orderbook"
+	"github.com/dylanlott/orderbook/pkg/ouch"
 	"github.com/dylanlott/orderbook/pkg/server"
 )
 
@@ -27,19 +33,164 @@ func main() {
 			ctx := context.Background()
 
 			// setup an accounts manager
-			accts := &accounts.InMemoryManager{}
+			accts := accounts.NewAccountManager("")
 
 			// setup channels for wrapping our market
 			in := make(chan *orderbook.Order)
+			writes := make(chan orderbook.OpWrite)
+			cancels := make(chan orderbook.OpCancel)
+			amends := make(chan orderbook.OpAmend)
+			reads := make(chan orderbook.OpRead)
+			matches := make(chan *orderbook.Match)
 			out := make(chan *orderbook.Match)
-			status := make(chan []*orderbook.Order)
+			levels := make(chan orderbook.LevelDelta)
+			deltas := make(chan orderbook.LevelDelta)
+			changes := make(chan orderbook.OrderEvent)
+			events := make(chan orderbook.OrderEvent)
 			fills := make(chan []*orderbook.Order)
-
-			// Run the book
-			go orderbook.Run(ctx, accts, in, out, fills, status)
+			refused := make(chan orderbook.WriteResult)
+			rejects := make(chan orderbook.WriteResult)
 
 			// start the server to bolt up to the engine
-			engine := server.NewServer(accts, in, out, fills, status)
+			engine := server.NewServer(accts, writes, cancels, amends, reads, out, fills, deltas, events, rejects)
+			engine.SetAdminToken(viper.GetString("admin-token"))
+			engine.SetFees(&orderbook.FeeSchedule{Tiers: []orderbook.Tier{{
+				Rates: orderbook.Rates{Maker: viper.GetFloat64("maker-fee"), Taker: viper.GetFloat64("taker-fee")},
+			}}})
+			if dir := viper.GetString("history"); dir != "" {
+				if err := engine.LoadHistory(dir); err != nil {
+					return err
+				}
+			}
+
+			// lend on margin if there's a leverage to lend at, liquidating
+			// through the same channels as every other order
+			if leverage := viper.GetFloat64("margin-leverage"); leverage > 0 {
+				lender := margin.NewEngine(accts, margin.Config{
+					Quote:       engine.Market().Quote,
+					MaxLeverage: leverage,
+					Maintenance: viper.GetFloat64("margin-maintenance"),
+					Slippage:    viper.GetFloat64("margin-slippage"),
+				})
+				if err := lender.AddMarket(engine.Market(), writes, cancels); err != nil {
+					return err
+				}
+				engine.SetMargin(lender)
+				liquidations := make(chan margin.Liquidation)
+				go lender.Run(ctx, time.Second, liquidations)
+				go func() {
+					for l := range liquidations {
+						log.Printf("[LIQUIDATED]: %s at equity %v against maintenance %v: %+v", l.Account, l.Equity, l.Maintenance, l)
+					}
+				}()
+			}
+
+			// Run the book, which settles every match through accts and
+			// charges its fees.
+			go orderbook.Run(ctx, engine.Market(), accts, in, writes, cancels, amends, reads, matches, fills, levels, changes, refused)
+
+			// start the FIX gateway if it's been given an address
+			var gateway *fix.Acceptor
+			if addr := viper.GetString("fix"); addr != "" {
+				gateway = fix.NewAcceptor(fix.Config{
+					CompID: viper.GetString("fix-comp-id"),
+					Symbol: engine.Market().Symbol,
+					Dir:    viper.GetString("fix-store"),
+					// accounts log on with the passwords under fix-passwords
+					// in the config file
+					Passwords: viper.GetStringMapString("fix-passwords"),
+				}, accts, in, cancels)
+				go func() {
+					if err := gateway.ListenAndServe(addr); err != nil {
+						log.Printf("FIX gateway stopped: %v", err)
+					}
+				}()
+			}
+
+			// and the binary order entry server
+			var entry *ouch.Server
+			if addr := viper.GetString("ouch"); addr != "" {
+				// accounts log in with the secrets under ouch-secrets in
+				// the config file
+				entry = ouch.NewServer(engine.Market().Symbol, accts, viper.GetStringMapString("ouch-secrets"), in, cancels)
+				go func() {
+					if err := entry.ListenAndServe(addr); err != nil {
+						log.Printf("order entry server stopped: %v", err)
+					}
+				}()
+			}
+
+			// and the UDP market data feed
+			var feed *itch.Publisher
+			if addrs := viper.GetStringSlice("itch"); len(addrs) > 0 {
+				var err error
+				feed, err = itch.NewPublisher(itch.Config{
+					Session: viper.GetString("itch-session"),
+					Symbol:  engine.Market().Symbol,
+					Addrs:   addrs,
+				})
+				if err != nil {
+					return err
+				}
+				go feed.Heartbeats(ctx, time.Second)
+				if addr := viper.GetString("itch-retransmit"); addr != "" {
+					go func() {
+						if err := feed.ListenAndServe(addr); err != nil {
+							log.Printf("retransmission server stopped: %v", err)
+						}
+					}()
+				}
+			}
+
+			// every match is reported by the order entry servers and the
+			// feed and then the HTTP server
+			go func() {
+				for m := range matches {
+					if gateway != nil {
+						gateway.Match(*m)
+					}
+					if entry != nil {
+						entry.Match(*m)
+					}
+					if feed != nil {
+						feed.Match(*m)
+					}
+					out <- m
+				}
+			}()
+
+			// and every order the book refused, like ones that can't be funded
+			go func() {
+				for r := range refused {
+					if gateway != nil {
+						gateway.Reject(r)
+					}
+					if entry != nil {
+						entry.Reject(r)
+					}
+					rejects <- r
+				}
+			}()
+
+			// and so is every change to the book's levels
+			go func() {
+				for d := range levels {
+					if feed != nil {
+						feed.Delta(d)
+					}
+					deltas <- d
+				}
+			}()
+
+			// and so is the book's market-by-order feed
+			go func() {
+				for e := range changes {
+					if feed != nil {
+						feed.Event(e)
+					}
+					events <- e
+				}
+			}()
 
 			// run the server
 			return engine.Run()
@@ -50,6 +201,24 @@ func main() {
 	viper.BindPFlag("config", rootCmd.PersistentFlags().Lookup("config"))
 	viper.SetDefault("config", "$HOME/.golem.yaml")
 
+	rootCmd.Flags().String("fix", "", "address to take FIX sessions on, e.g. :9878 (off if empty)")
+	rootCmd.Flags().String("fix-comp-id", "GOLEM", "CompID of the FIX gateway")
+	rootCmd.Flags().String("fix-store", "fix", "directory to keep FIX sessions in")
+	rootCmd.Flags().String("ouch", "", "address to take binary order entry connections on, e.g. :9879 (off if empty)")
+	rootCmd.Flags().StringSlice("itch", nil, "UDP addresses to publish market data to, e.g. 239.1.1.1:9880 (off if empty)")
+	rootCmd.Flags().String("itch-session", "GOLEM", "session name of the market data feed")
+	rootCmd.Flags().String("itch-retransmit", "", "address to serve market data retransmission on, e.g. :9881 (off if empty)")
+	rootCmd.Flags().String("history", "history", "directory to keep trades and candles in (kept in memory only if empty)")
+	rootCmd.Flags().String("admin-token", "", "bearer token of admin requests (admin requests are refused if empty)")
+	rootCmd.Flags().Float64("maker-fee", 0.001, "fee charged to makers as a fraction of notional, negative for a rebate")
+	rootCmd.Flags().Float64("taker-fee", 0.002, "fee charged to takers as a fraction of notional")
+	rootCmd.Flags().Float64("margin-leverage", 0, "most leverage accounts can trade at (no margin if 0)")
+	rootCmd.Flags().Float64("margin-maintenance", 0.05, "fraction of its positions an account's equity has to stay above to avoid liquidation")
+	rootCmd.Flags().Float64("margin-slippage", 0.05, "how far through the mark liquidation orders are priced, as a fraction of it")
+	for _, name := range []string{"fix", "fix-comp-id", "fix-store", "ouch", "itch", "itch-session", "itch-retransmit", "history", "admin-token", "maker-fee", "taker-fee", "margin-leverage", "margin-maintenance", "margin-slippage"} {
+		viper.BindPFlag(name, rootCmd.Flags().Lookup(name))
+	}
+
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
 	}
@@ -3,36 +3,112 @@ package accounts
 import (
 	"fmt"
 	"log"
+	"math"
 	"sync"
 )
 
+// USD is the quote asset used by engines that only deal in a single currency.
+const USD = "USD"
+
+// epsilon is the relative error that's tolerated when comparing balances,
+// e.g. when the fills drawn from a hold add up to a hair more than the hold.
+// TODO: upgrade from float64 to integer-only handling
+const epsilon = 1e-9
+
+// exceeds reports whether a is greater than b by more than float rounding.
+func exceeds(a, b float64) bool {
+	return a-b > epsilon*math.Max(1, math.Abs(b))
+}
+
 // Transaction specifies an interface for transactions between Accounts.
 type Transaction interface {
-	Tx(fromID string, toID string, amount float64) ([]Account, error)
+	// Tx moves a single asset from one account to another.
+	Tx(fromID string, toID string, asset string, amount float64) ([]Account, error)
+	// Exchange applies a set of transfers as one unit. Either every
+	// transfer is applied or none of them are.
+	Exchange(transfers ...Transfer) ([]Account, error)
+}
+
+// Reserver places holds on account balances. Held funds can't be spent
+// by anything except a Transfer that draws on that hold.
+type Reserver interface {
+	// Hold reserves amount of asset in an account under holdID.
+	Hold(holdID string, accountID string, asset string, amount float64) error
+	// Release frees whatever remains of a hold and returns that amount.
+	Release(holdID string) (float64, error)
+}
+
+// Lender extends credit to accounts that trade on margin. Its methods are
+// called while the AccountManager is locked, so they must not call back
+// into it.
+type Lender interface {
+	// BuyingPower returns how much of asset an account can hold under
+	// holdID for an order and whether the account trades on margin at all.
+	// It replaces the available balance of margin accounts.
+	BuyingPower(acct *UserAccount, holdID string, asset string) (float64, bool)
+	// Withdrawable returns how much of asset a margin account can withdraw
+	// without leaving what it has borrowed undercollateralized.
+	Withdrawable(acct *UserAccount, asset string) float64
 }
 
 // AccountManager defines a simple CRUD interface for managing accounts.
 type AccountManager interface {
 	Transaction
+	Reserver
+	Funder
+
+	// SetLender lets accounts borrow from a Lender to trade on margin.
+	SetLender(l Lender)
 
 	Get(id string) (Account, error)
-	Create(id string, balance float64) (Account, error)
+	Create(id string, balances map[string]float64) (Account, error)
 	Delete(id string) error
+
+	// Ledger returns the journal that every balance is derived from.
+	Ledger() *Ledger
 }
 
 // Account relates a user to a balance sheet in our system.
-// Filling an Order will add or subtract from the account's Balance
+// Filling an Order will add or subtract from the account's balances.
 type Account interface {
 	// UserID returns a unique ID for the acocunt.
 	UserID() string
-	// Balance returns the balance of the account.
-	Balance() float64
+	// Balance returns the balance of the account in the given asset.
+	Balance(asset string) float64
+	// Available returns the balance of asset that isn't held.
+	Available(asset string) float64
+}
+
+// Transfer is a single leg of an Exchange. It moves Amount of Asset
+// from the From account to the To account. If Hold is set the amount is
+// drawn from that hold instead of the From account's available balance.
+// Kind and Memo describe the transfer in the ledger. Kind defaults to
+// KindTransfer. Overdraw lets the transfer take the From account below
+// what it has, for obligations it can't refuse like funding payments.
+type Transfer struct {
+	From     string
+	To       string
+	Asset    string
+	Amount   float64
+	Hold     string
+	Kind     string
+	Memo     string
+	Overdraw bool
+}
+
+// Hold is a reservation of part of an account's balance.
+type Hold struct {
+	ID      string
+	Account string
+	Asset   string
+	Amount  float64
 }
 
 // UserAccount fulfills the Account interface with a typical user implementation
 type UserAccount struct {
-	Email          string
-	CurrentBalance float64
+	Email    string
+	Balances map[string]float64
+	Held     map[string]float64
 }
 
 // UserID returns the unique identifier for a UserAccount which is Email
@@ -40,16 +116,48 @@ func (u *UserAccount) UserID() string {
 	return u.Email
 }
 
-// Balance returns the account balance in dollars as float64
-func (u *UserAccount) Balance() float64 {
-	return u.CurrentBalance
+// Balance returns the account balance for asset as float64
+func (u *UserAccount) Balance(asset string) float64 {
+	return u.Balances[asset]
+}
+
+// Available returns the account balance for asset less any holds on it.
+func (u *UserAccount) Available(asset string) float64 {
+	return u.Balances[asset] - u.Held[asset]
+}
+
+// copy returns a UserAccount with its own copy of the balances and holds.
+func (u *UserAccount) copy() *UserAccount {
+	c := &UserAccount{Email: u.Email, Balances: make(map[string]float64, len(u.Balances))}
+	for asset, amount := range u.Balances {
+		c.Balances[asset] = amount
+	}
+	if u.Held != nil {
+		c.Held = make(map[string]float64, len(u.Held))
+		for asset, amount := range u.Held {
+			c.Held[asset] = amount
+		}
+	}
+	return c
 }
 
 // InMemoryManager is an in memory account manager for testing purposes.
+// Balances are never changed directly. Every change is posted to its
+// Ledger and the Accounts are kept up to date as a view of the ledger.
 type InMemoryManager struct {
 	sync.Mutex
 
+	// Accounts holds a view of each user's balances. Accounts that are put
+	// in here by hand with balances already set are brought onto the ledger
+	// with an opening entry the first time they're used.
 	Accounts map[string]*UserAccount
+
+	ledger  *Ledger
+	opened  map[string]bool
+	holds   map[string]*Hold
+	funding map[string]*FundingRequest
+	limits  map[string]map[string]float64
+	lender  Lender
 }
 
 func NewAccountManager(path string) AccountManager {
@@ -62,61 +170,363 @@ func NewAccountManager(path string) AccountManager {
 	}
 }
 
-// Get returns an account
+// Ledger returns the journal behind the InMemoryManager.
+func (i *InMemoryManager) Ledger() *Ledger {
+	i.Lock()
+	defer i.Unlock()
+	i.init()
+	return i.ledger
+}
+
+// Get returns a copy of an account taken under the lock, so it can be
+// read while the account keeps changing.
 func (i *InMemoryManager) Get(id string) (Account, error) {
 	i.Lock()
 	defer i.Unlock()
-	if v, ok := i.Accounts[id]; ok {
-		return v, nil
+	acct, err := i.account(id)
+	if err != nil {
+		return nil, err
 	}
-	return nil, fmt.Errorf("failed to find account %s", id)
+	return acct.(*UserAccount).copy(), nil
 }
 
-// Create makes a new account
-func (i *InMemoryManager) Create(email string, balance float64) (Account, error) {
-	a := &UserAccount{
-		Email:          email,
-		CurrentBalance: balance,
+// Create makes a new account and deposits its starting balances.
+func (i *InMemoryManager) Create(email string, balances map[string]float64) (Account, error) {
+	if IsSystem(email) {
+		return nil, fmt.Errorf("account %s is reserved for the exchange", email)
 	}
+
 	i.Lock()
 	defer i.Unlock()
+	i.init()
+
+	a := &UserAccount{
+		Email:    email,
+		Balances: i.ledger.Balances(email),
+	}
 	i.Accounts[email] = a
-	return a, nil
+	i.opened[email] = true
+
+	var deposits []Transfer
+	for asset, amount := range balances {
+		deposits = append(deposits, Transfer{
+			From:   ExternalAccount,
+			To:     email,
+			Asset:  asset,
+			Amount: amount,
+			Kind:   KindDeposit,
+			Memo:   "initial balance",
+		})
+	}
+	if len(deposits) > 0 {
+		if _, err := i.ledger.Post(journal(deposits)...); err != nil {
+			delete(i.Accounts, email)
+			return nil, err
+		}
+		a.Balances = i.ledger.Balances(email)
+	}
+	return a.copy(), nil
+}
+
+// Tx transacts a single asset across accounts in the InMemoryManager.
+func (i *InMemoryManager) Tx(from string, to string, asset string, amount float64) ([]Account, error) {
+	return i.Exchange(Transfer{From: from, To: to, Asset: asset, Amount: amount})
 }
 
-// Tx transacts across accounts in the InMemoryManager.
-func (i *InMemoryManager) Tx(from string, to string, amount float64) ([]Account, error) {
+// Exchange applies every transfer or none of them. Balances are checked
+// against the net effect of all transfers, so an account may spend an
+// asset that it receives in the same Exchange. The transfers are posted
+// to the ledger as one entry per kind. It returns copies of the accounts
+// that it touched as they were once it was done.
+func (i *InMemoryManager) Exchange(transfers ...Transfer) ([]Account, error) {
 	i.Lock()
 	defer i.Unlock()
-	fromAcct, ok := i.Accounts[from]
-	if !ok {
-		return nil, fmt.Errorf("account %s does not exist", from)
+	return i.exchange(transfers)
+}
+
+// exchange applies transfers. Callers must hold the lock.
+func (i *InMemoryManager) exchange(transfers []Transfer) ([]Account, error) {
+	i.init()
+
+	// work out the resulting balances before touching any account
+	type key struct{ id, asset string }
+	net := map[key]float64{}
+	held := map[key]float64{}
+	overdrawn := map[key]bool{}
+	drawn := map[string]float64{}
+	touched := []*UserAccount{}
+	seen := map[string]bool{}
+	for _, t := range transfers {
+		if t.Amount < 0 {
+			return nil, fmt.Errorf("invalid transfer amount %v of %s", t.Amount, t.Asset)
+		}
+		for _, id := range []string{t.From, t.To} {
+			acct, err := i.user(id)
+			if err != nil {
+				return nil, err
+			}
+			if acct != nil && !seen[id] {
+				seen[id] = true
+				touched = append(touched, acct)
+			}
+		}
+		if t.Hold != "" {
+			h, ok := i.holds[t.Hold]
+			if !ok {
+				return nil, fmt.Errorf("hold %s does not exist", t.Hold)
+			}
+			if h.Account != t.From || h.Asset != t.Asset {
+				return nil, fmt.Errorf("hold %s can't pay %s from %s", t.Hold, t.Asset, t.From)
+			}
+			drawn[t.Hold] += t.Amount
+			if exceeds(drawn[t.Hold], h.Amount) {
+				return nil, fmt.Errorf("insufficient funds in hold %s", t.Hold)
+			}
+			held[key{t.From, t.Asset}] -= t.Amount
+		}
+		if t.Overdraw {
+			overdrawn[key{t.From, t.Asset}] = true
+		}
+		net[key{t.From, t.Asset}] -= t.Amount
+		net[key{t.To, t.Asset}] += t.Amount
 	}
 
-	toAcct, ok := i.Accounts[to]
-	if !ok {
-		return nil, fmt.Errorf("account %s does not exist", to)
+	for k, delta := range net {
+		if IsSystem(k.id) || overdrawn[k] {
+			continue
+		}
+		// an account's holds can only be more than its balance if a Lender
+		// approved them, and spending can't make that shortfall any larger
+		acct := i.Accounts[k.id]
+		shortfall := math.Max(0, acct.Held[k.asset]-acct.Balance(k.asset))
+		if exceeds(acct.Held[k.asset]+held[k], acct.Balance(k.asset)+delta+shortfall) {
+			return nil, fmt.Errorf("insufficient %s balance in %s", k.asset, k.id)
+		}
 	}
 
-	if fromAcct.Balance() < amount {
-		return nil, fmt.Errorf("insufficient balance %v in %v", amount, fromAcct)
+	// everything checks out so let's post it
+	if _, err := i.ledger.Post(journal(transfers)...); err != nil {
+		return nil, err
+	}
+	for _, acct := range touched {
+		acct.Balances = i.ledger.Balances(acct.Email)
+	}
+	for k, delta := range held {
+		i.Accounts[k.id].Held[k.asset] += delta
+	}
+	for id, amount := range drawn {
+		i.holds[id].Amount -= amount
 	}
 
-	// everything checks out so let's do the math now
-	fromAcct.CurrentBalance = fromAcct.CurrentBalance - amount
-	toAcct.CurrentBalance = toAcct.CurrentBalance + amount
+	for _, t := range transfers {
+		log.Printf("transaction: moved %v %s from %s to account %s", t.Amount, t.Asset, t.From, t.To)
+	}
 
-	// save the udpated account balances to our InMemoryManager.
-	i.Accounts[from] = fromAcct
-	i.Accounts[to] = toAcct
+	updated := make([]Account, 0, len(touched))
+	for _, acct := range touched {
+		updated = append(updated, acct.copy())
+	}
+	return updated, nil
+}
 
-	log.Printf("transaction: moved %v from %s to account %s", amount, from, to)
+// Hold reserves amount of asset from an account's available balance, or
+// from its buying power if it trades on margin.
+func (i *InMemoryManager) Hold(holdID string, accountID string, asset string, amount float64) error {
+	i.Lock()
+	defer i.Unlock()
+	return i.hold(holdID, accountID, asset, amount, true)
+}
 
-	return []Account{fromAcct, toAcct}, nil
+// SetLender lets accounts borrow from l to trade on margin.
+func (i *InMemoryManager) SetLender(l Lender) {
+	i.Lock()
+	defer i.Unlock()
+	i.lender = l
 }
 
-// Delete removes the account at key id in the accounts map.
+// hold places a hold. Holds for orders can be backed by the Lender and
+// holds for withdrawals can't. Callers must hold the lock.
+func (i *InMemoryManager) hold(holdID string, accountID string, asset string, amount float64, order bool) error {
+	acct, err := i.user(accountID)
+	if err != nil {
+		return err
+	}
+	if acct == nil {
+		return fmt.Errorf("can't hold funds in exchange account %s", accountID)
+	}
+	if _, ok := i.holds[holdID]; ok {
+		return fmt.Errorf("hold %s already exists", holdID)
+	}
+	if amount < 0 {
+		return fmt.Errorf("invalid hold amount %v of %s", amount, asset)
+	}
+	if exceeds(amount, i.available(acct, holdID, asset, order)) {
+		return fmt.Errorf("insufficient %s available in %s to hold %v", asset, accountID, amount)
+	}
+
+	if acct.Held == nil {
+		acct.Held = make(map[string]float64)
+	}
+	i.holds[holdID] = &Hold{
+		ID:      holdID,
+		Account: accountID,
+		Asset:   asset,
+		Amount:  amount,
+	}
+	acct.Held[asset] += amount
+	return nil
+}
+
+// Release removes a hold and returns the amount that was still held.
+func (i *InMemoryManager) Release(holdID string) (float64, error) {
+	i.Lock()
+	defer i.Unlock()
+	return i.release(holdID)
+}
+
+// release removes a hold. Callers must hold the lock.
+func (i *InMemoryManager) release(holdID string) (float64, error) {
+	h, ok := i.holds[holdID]
+	if !ok {
+		return 0, fmt.Errorf("hold %s does not exist", holdID)
+	}
+	delete(i.holds, holdID)
+	if acct, ok := i.Accounts[h.Account]; ok {
+		acct.Held[h.Asset] -= h.Amount
+	}
+	return h.Amount, nil
+}
+
+// Delete removes the account at key id in the accounts map. Whatever it
+// still has is paid out to the external account with a closing entry, so
+// it leaves nothing behind in the ledger except its history. An account
+// with holds, like those of its open orders or pending withdrawals, can't
+// be deleted until they're released.
 func (i *InMemoryManager) Delete(id string) error {
+	i.Lock()
+	defer i.Unlock()
+	acct, err := i.user(id)
+	if err != nil || acct == nil {
+		return nil
+	}
+
+	for holdID, h := range i.holds {
+		if h.Account == id {
+			return fmt.Errorf("account %s still has funds on hold under %s", id, holdID)
+		}
+	}
+	var closing []Transfer
+	for asset, amount := range i.ledger.Balances(id) {
+		if amount == 0 {
+			continue
+		}
+		t := Transfer{From: id, To: ExternalAccount, Asset: asset, Amount: amount, Kind: KindClosing}
+		if amount < 0 {
+			t.From, t.To, t.Amount = ExternalAccount, id, -amount
+		}
+		closing = append(closing, t)
+	}
+	if len(closing) > 0 {
+		if _, err := i.ledger.Post(journal(closing)...); err != nil {
+			return fmt.Errorf("failed to close account %s: %v", id, err)
+		}
+	}
+
 	delete(i.Accounts, id)
+	delete(i.opened, id)
+	delete(i.limits, id)
 	return nil
 }
+
+// init sets up the ledger and internal maps so that the zero value
+// of an InMemoryManager is ready to use. Callers must hold the lock.
+func (i *InMemoryManager) init() {
+	if i.ledger == nil {
+		i.ledger = NewLedger()
+	}
+	if i.Accounts == nil {
+		i.Accounts = make(map[string]*UserAccount)
+	}
+	if i.opened == nil {
+		i.opened = make(map[string]bool)
+	}
+	if i.holds == nil {
+		i.holds = make(map[string]*Hold)
+	}
+	if i.funding == nil {
+		i.funding = make(map[string]*FundingRequest)
+	}
+	if i.limits == nil {
+		i.limits = make(map[string]map[string]float64)
+	}
+}
+
+// available returns how much of asset a new hold can reserve in acct.
+// Callers must hold the lock.
+func (i *InMemoryManager) available(acct *UserAccount, holdID string, asset string, order bool) float64 {
+	if i.lender == nil {
+		return acct.Available(asset)
+	}
+	power, margin := i.lender.BuyingPower(acct, holdID, asset)
+	switch {
+	case !margin:
+		return acct.Available(asset)
+	case order:
+		return power
+	default:
+		return math.Min(acct.Available(asset), i.lender.Withdrawable(acct, asset))
+	}
+}
+
+// account returns a view of any account, including the exchange's own.
+// Callers must hold the lock.
+func (i *InMemoryManager) account(id string) (Account, error) {
+	acct, err := i.user(id)
+	if err != nil {
+		return nil, err
+	}
+	if acct == nil {
+		return &UserAccount{
+			Email:    id,
+			Balances: i.ledger.Balances(id),
+		}, nil
+	}
+	return acct, nil
+}
+
+// user returns the UserAccount for id, opening it on the ledger if it was
+// added to Accounts by hand. It returns nil without an error for the
+// exchange's own accounts. Callers must hold the lock.
+func (i *InMemoryManager) user(id string) (*UserAccount, error) {
+	i.init()
+	if IsSystem(id) {
+		return nil, nil
+	}
+	acct, ok := i.Accounts[id]
+	if !ok {
+		return nil, fmt.Errorf("account %s does not exist", id)
+	}
+	if i.opened[id] {
+		return acct, nil
+	}
+
+	var opening []Transfer
+	for asset, amount := range acct.Balances {
+		if amount == 0 {
+			continue
+		}
+		t := Transfer{To: id, From: ExternalAccount, Asset: asset, Amount: amount, Kind: KindOpening}
+		if amount < 0 {
+			t.From, t.To, t.Amount = id, ExternalAccount, -amount
+		}
+		opening = append(opening, t)
+	}
+	if len(opening) > 0 {
+		if _, err := i.ledger.Post(journal(opening)...); err != nil {
+			return nil, err
+		}
+	}
+	acct.Balances = i.ledger.Balances(id)
+	i.opened[id] = true
+	return acct, nil
+}
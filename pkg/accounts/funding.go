@@ -0,0 +1,259 @@
+package accounts
+
+import (
+	"fmt"
+	"time"
+)
+
+// States that a FundingRequest moves through. Requests start out pending,
+// are approved and then completed, or are rejected along the way.
+const (
+	StatePending   = "pending"
+	StateApproved  = "approved"
+	StateCompleted = "completed"
+	StateRejected  = "rejected"
+)
+
+// withdrawalWindow is the rolling period that withdrawal limits apply to.
+var withdrawalWindow = 24 * time.Hour
+
+// FundingRequest is a deposit into or a withdrawal out of an account.
+// Kind is either KindDeposit or KindWithdrawal.
+type FundingRequest struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	Account   string    `json:"account"`
+	Asset     string    `json:"asset"`
+	Amount    float64   `json:"amount"`
+	State     string    `json:"state"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Funder moves funds into and out of accounts. Nothing is posted to the
+// ledger until a request is completed, and a withdrawal holds its funds
+// from the moment it's requested so they can't be spent on orders.
+type Funder interface {
+	// Deposit requests that amount of asset be credited to an account.
+	Deposit(accountID string, asset string, amount float64) (FundingRequest, error)
+	// Withdraw requests that amount of asset be paid out of an account.
+	// It fails if the account's available balance, which excludes the
+	// reservations of its open orders, or its withdrawal limit can't cover it.
+	Withdraw(accountID string, asset string, amount float64) (FundingRequest, error)
+	// Approve moves a pending request to approved.
+	Approve(requestID string) (FundingRequest, error)
+	// Complete posts an approved request to the ledger.
+	Complete(requestID string) (FundingRequest, error)
+	// Reject cancels a request that hasn't completed yet.
+	Reject(requestID string, reason string) (FundingRequest, error)
+	// FundingRequest returns a request by ID.
+	FundingRequest(requestID string) (FundingRequest, error)
+	// SetWithdrawalLimit caps how much of asset an account can withdraw
+	// over a rolling 24 hours. A limit of zero removes the cap.
+	SetWithdrawalLimit(accountID string, asset string, limit float64) error
+}
+
+// Deposit opens a pending deposit request.
+func (i *InMemoryManager) Deposit(accountID string, asset string, amount float64) (FundingRequest, error) {
+	i.Lock()
+	defer i.Unlock()
+
+	r, err := i.request(KindDeposit, accountID, asset, amount)
+	if err != nil {
+		return FundingRequest{}, err
+	}
+	return *r, nil
+}
+
+// Withdraw opens a pending withdrawal request and holds its funds.
+func (i *InMemoryManager) Withdraw(accountID string, asset string, amount float64) (FundingRequest, error) {
+	i.Lock()
+	defer i.Unlock()
+
+	if limit := i.limits[accountID][asset]; limit > 0 {
+		used := i.withdrawn(accountID, asset, time.Now().Add(-withdrawalWindow))
+		if exceeds(used+amount, limit) {
+			return FundingRequest{}, fmt.Errorf("withdrawal of %v %s exceeds the limit of %v, %v already withdrawn",
+				amount, asset, limit, used)
+		}
+	}
+
+	r, err := i.request(KindWithdrawal, accountID, asset, amount)
+	if err != nil {
+		return FundingRequest{}, err
+	}
+	if err := i.hold(r.ID, accountID, asset, amount, false); err != nil {
+		delete(i.funding, r.ID)
+		return FundingRequest{}, fmt.Errorf("failed to withdraw: %v", err)
+	}
+	return *r, nil
+}
+
+// Approve moves a pending request to approved.
+func (i *InMemoryManager) Approve(requestID string) (FundingRequest, error) {
+	i.Lock()
+	defer i.Unlock()
+
+	r, err := i.transition(requestID, StatePending, StateApproved)
+	if err != nil {
+		return FundingRequest{}, err
+	}
+	return *r, nil
+}
+
+// Complete posts an approved request to the ledger. Deposits are paid
+// in from the ExternalAccount and withdrawals are paid out to it from
+// the funds they've held.
+func (i *InMemoryManager) Complete(requestID string) (FundingRequest, error) {
+	i.Lock()
+	defer i.Unlock()
+
+	r, ok := i.funding[requestID]
+	if !ok {
+		return FundingRequest{}, fmt.Errorf("funding request %s does not exist", requestID)
+	}
+	if r.State != StateApproved {
+		return FundingRequest{}, fmt.Errorf("funding request %s is %s, not %s", requestID, r.State, StateApproved)
+	}
+
+	t := Transfer{
+		From:   ExternalAccount,
+		To:     r.Account,
+		Asset:  r.Asset,
+		Amount: r.Amount,
+		Kind:   r.Kind,
+		Memo:   r.ID,
+	}
+	if r.Kind == KindWithdrawal {
+		t.From, t.To, t.Hold = r.Account, ExternalAccount, r.ID
+	}
+	if _, err := i.exchange([]Transfer{t}); err != nil {
+		return FundingRequest{}, fmt.Errorf("failed to complete %s: %v", r.ID, err)
+	}
+	if r.Kind == KindWithdrawal {
+		if _, err := i.release(r.ID); err != nil {
+			return FundingRequest{}, err
+		}
+	}
+
+	r.State = StateCompleted
+	r.UpdatedAt = time.Now()
+	return *r, nil
+}
+
+// Reject cancels a request that hasn't been completed and releases the
+// funds held by a withdrawal.
+func (i *InMemoryManager) Reject(requestID string, reason string) (FundingRequest, error) {
+	i.Lock()
+	defer i.Unlock()
+
+	r, ok := i.funding[requestID]
+	if !ok {
+		return FundingRequest{}, fmt.Errorf("funding request %s does not exist", requestID)
+	}
+	if r.State != StatePending && r.State != StateApproved {
+		return FundingRequest{}, fmt.Errorf("funding request %s is already %s", requestID, r.State)
+	}
+	if r.Kind == KindWithdrawal {
+		if _, err := i.release(r.ID); err != nil {
+			return FundingRequest{}, err
+		}
+	}
+
+	r.State = StateRejected
+	r.Reason = reason
+	r.UpdatedAt = time.Now()
+	return *r, nil
+}
+
+// FundingRequest returns a request by ID.
+func (i *InMemoryManager) FundingRequest(requestID string) (FundingRequest, error) {
+	i.Lock()
+	defer i.Unlock()
+
+	r, ok := i.funding[requestID]
+	if !ok {
+		return FundingRequest{}, fmt.Errorf("funding request %s does not exist", requestID)
+	}
+	return *r, nil
+}
+
+// SetWithdrawalLimit caps an account's withdrawals of asset.
+func (i *InMemoryManager) SetWithdrawalLimit(accountID string, asset string, limit float64) error {
+	i.Lock()
+	defer i.Unlock()
+
+	if _, err := i.user(accountID); err != nil {
+		return err
+	}
+	if limit < 0 {
+		return fmt.Errorf("invalid withdrawal limit %v", limit)
+	}
+	if i.limits[accountID] == nil {
+		i.limits[accountID] = make(map[string]float64)
+	}
+	i.limits[accountID][asset] = limit
+	return nil
+}
+
+// request validates and records a new pending request.
+// Callers must hold the lock.
+func (i *InMemoryManager) request(kind, accountID, asset string, amount float64) (*FundingRequest, error) {
+	acct, err := i.user(accountID)
+	if err != nil {
+		return nil, err
+	}
+	if acct == nil {
+		return nil, fmt.Errorf("can't fund exchange account %s", accountID)
+	}
+	if asset == "" || amount <= 0 {
+		return nil, fmt.Errorf("invalid %s of %v %q", kind, amount, asset)
+	}
+
+	now := time.Now()
+	r := &FundingRequest{
+		ID:        fmt.Sprintf("%s-%d", kind, len(i.funding)+1),
+		Kind:      kind,
+		Account:   accountID,
+		Asset:     asset,
+		Amount:    amount,
+		State:     StatePending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	i.funding[r.ID] = r
+	return r, nil
+}
+
+// transition moves a request from one state to another.
+// Callers must hold the lock.
+func (i *InMemoryManager) transition(requestID, from, to string) (*FundingRequest, error) {
+	i.init()
+	r, ok := i.funding[requestID]
+	if !ok {
+		return nil, fmt.Errorf("funding request %s does not exist", requestID)
+	}
+	if r.State != from {
+		return nil, fmt.Errorf("funding request %s is %s, not %s", requestID, r.State, from)
+	}
+	r.State = to
+	r.UpdatedAt = time.Now()
+	return r, nil
+}
+
+// withdrawn sums the withdrawals of asset an account has requested since
+// a point in time that haven't been rejected. Callers must hold the lock.
+func (i *InMemoryManager) withdrawn(accountID, asset string, since time.Time) float64 {
+	var total float64
+	for _, r := range i.funding {
+		if r.Kind != KindWithdrawal || r.Account != accountID || r.Asset != asset {
+			continue
+		}
+		if r.State == StateRejected || r.CreatedAt.Before(since) {
+			continue
+		}
+		total += r.Amount
+	}
+	return total
+}
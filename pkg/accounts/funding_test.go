@@ -0,0 +1,92 @@
+package accounts
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestDeposit(t *testing.T) {
+	is := is.New(t)
+	acc := NewAccountManager("")
+	_, err := acc.Create("alice", nil)
+	is.NoErr(err)
+
+	r, err := acc.Deposit("alice", USD, 100)
+	is.NoErr(err)
+	is.Equal(r.State, StatePending)
+
+	// nothing moves until the deposit completes
+	_, err = acc.Complete(r.ID)
+	is.True(err != nil)
+	_, err = acc.Approve(r.ID)
+	is.NoErr(err)
+	is.Equal(acc.Ledger().Balance("alice", USD), float64(0))
+
+	r, err = acc.Complete(r.ID)
+	is.NoErr(err)
+	is.Equal(r.State, StateCompleted)
+	is.Equal(acc.Ledger().Balance("alice", USD), float64(100))
+	is.Equal(acc.Ledger().Balance(ExternalAccount, USD), float64(-100))
+
+	entries := acc.Ledger().Entries()
+	is.Equal(entries[len(entries)-1].Kind, KindDeposit)
+
+	// completed requests can't be rejected
+	_, err = acc.Reject(r.ID, "too late")
+	is.True(err != nil)
+}
+
+func TestWithdraw(t *testing.T) {
+	is := is.New(t)
+	acc := NewAccountManager("")
+	_, err := acc.Create("alice", map[string]float64{USD: 100})
+	is.NoErr(err)
+
+	// an open order holds 60, so only 40 can be withdrawn
+	is.NoErr(acc.Hold("order", "alice", USD, 60))
+	_, err = acc.Withdraw("alice", USD, 50)
+	is.True(err != nil)
+
+	r, err := acc.Withdraw("alice", USD, 30)
+	is.NoErr(err)
+	alice, err := acc.Get("alice")
+	is.NoErr(err)
+	is.Equal(alice.Available(USD), float64(10))
+
+	// rejecting a withdrawal releases its funds
+	_, err = acc.Reject(r.ID, "suspicious")
+	is.NoErr(err)
+	alice, err = acc.Get("alice")
+	is.NoErr(err)
+	is.Equal(alice.Available(USD), float64(40))
+
+	r, err = acc.Withdraw("alice", USD, 40)
+	is.NoErr(err)
+	_, err = acc.Approve(r.ID)
+	is.NoErr(err)
+	_, err = acc.Complete(r.ID)
+	is.NoErr(err)
+	alice, err = acc.Get("alice")
+	is.NoErr(err)
+	is.Equal(alice.Balance(USD), float64(60))
+	is.Equal(alice.Available(USD), float64(0))
+}
+
+func TestWithdrawalLimit(t *testing.T) {
+	is := is.New(t)
+	acc := NewAccountManager("")
+	_, err := acc.Create("alice", map[string]float64{USD: 100})
+	is.NoErr(err)
+	is.NoErr(acc.SetWithdrawalLimit("alice", USD, 50))
+
+	_, err = acc.Withdraw("alice", USD, 30)
+	is.NoErr(err)
+	_, err = acc.Withdraw("alice", USD, 30)
+	is.True(err != nil) // 60 over the last day
+
+	// a limit of zero removes the cap
+	is.NoErr(acc.SetWithdrawalLimit("alice", USD, 0))
+	_, err = acc.Withdraw("alice", USD, 30)
+	is.NoErr(err)
+}
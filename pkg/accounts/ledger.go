@@ -0,0 +1,253 @@
+package accounts
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of journal entries.
+const (
+	KindTransfer   = "transfer"
+	KindMatch      = "match"
+	KindFee        = "fee"
+	KindDeposit    = "deposit"
+	KindWithdrawal = "withdrawal"
+	KindOpening    = "opening"
+	KindClosing    = "closing"
+	KindInsurance  = "insurance"
+	KindADL        = "adl"
+	KindFunding    = "funding"
+	KindSettlement = "settlement"
+)
+
+// Accounts owned by the exchange itself. They only exist in the ledger
+// and, unlike user accounts, they're allowed to go negative.
+const (
+	// ExternalAccount is the world outside of the exchange. Deposits come
+	// from it and withdrawals go to it.
+	ExternalAccount = "exchange:external"
+	// FeeAccount collects trading fees and pays out rebates.
+	FeeAccount = "exchange:fees"
+	// InsuranceAccount covers the losses of liquidated accounts that
+	// close out at worse than their bankruptcy price.
+	InsuranceAccount = "exchange:insurance"
+	// FundingAccount collects funding payments from one side of a
+	// perpetual market and pays them out to the other.
+	FundingAccount = "exchange:funding"
+	// SettlementAccount takes back the contracts of an expired futures
+	// market and pays or collects their final value.
+	SettlementAccount = "exchange:settlement"
+	// CollateralAccount backs the contracts of binary markets. It's paid
+	// the full payout of every pair of YES and NO contracts it mints and
+	// pays the winning side out of it when the market resolves.
+	CollateralAccount = "exchange:collateral"
+)
+
+// PoolAccount returns the account that holds the reserves of a market's
+// liquidity pool.
+func PoolAccount(symbol string) string {
+	return "exchange:pool:" + symbol
+}
+
+// IsSystem reports whether id names an account owned by the exchange.
+func IsSystem(id string) bool {
+	return strings.HasPrefix(id, "exchange:")
+}
+
+// Posting is a single line of a journal entry. A debit increases the
+// account's balance of Asset and a credit decreases it.
+type Posting struct {
+	Account string
+	Asset   string
+	Debit   float64
+	Credit  float64
+}
+
+// Entry is a balanced journal entry. For every asset in an Entry the
+// debits equal the credits. Entries are never changed once they're posted.
+type Entry struct {
+	ID       uint64
+	Time     time.Time
+	Kind     string
+	Memo     string
+	Postings []Posting
+}
+
+// Ledger is an append-only double-entry journal. Account balances are
+// derived from the entries posted to it.
+type Ledger struct {
+	sync.RWMutex
+
+	entries  []Entry
+	balances map[string]map[string]float64
+	// posted indexes the entries that each account has postings in.
+	posted map[string][]int
+}
+
+// NewLedger returns an empty Ledger.
+func NewLedger() *Ledger {
+	return &Ledger{
+		balances: make(map[string]map[string]float64),
+		posted:   make(map[string][]int),
+	}
+}
+
+// Post appends entries to the journal. Every entry is checked before any
+// of them are posted, so either all of them are recorded or none are.
+func (l *Ledger) Post(entries ...Entry) ([]Entry, error) {
+	for _, e := range entries {
+		if err := e.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	posted := make([]Entry, 0, len(entries))
+	for _, e := range entries {
+		e.ID = uint64(len(l.entries) + 1)
+		if e.Time.IsZero() {
+			e.Time = now
+		}
+		e.Postings = append([]Posting(nil), e.Postings...)
+		for _, p := range e.Postings {
+			if l.balances[p.Account] == nil {
+				l.balances[p.Account] = make(map[string]float64)
+			}
+			l.balances[p.Account][p.Asset] += p.Debit - p.Credit
+			if n := len(l.posted[p.Account]); n == 0 || l.posted[p.Account][n-1] != len(l.entries) {
+				l.posted[p.Account] = append(l.posted[p.Account], len(l.entries))
+			}
+		}
+		l.entries = append(l.entries, e)
+		posted = append(posted, e.copy())
+	}
+	return posted, nil
+}
+
+// Balance returns the balance of asset in account.
+func (l *Ledger) Balance(account string, asset string) float64 {
+	l.RLock()
+	defer l.RUnlock()
+	return l.balances[account][asset]
+}
+
+// Balances returns every asset balance of account.
+func (l *Ledger) Balances(account string) map[string]float64 {
+	l.RLock()
+	defer l.RUnlock()
+	balances := make(map[string]float64, len(l.balances[account]))
+	for asset, amount := range l.balances[account] {
+		balances[asset] = amount
+	}
+	return balances
+}
+
+// Holders returns the balance of asset of every account that has some.
+func (l *Ledger) Holders(asset string) map[string]float64 {
+	l.RLock()
+	defer l.RUnlock()
+	holders := make(map[string]float64)
+	for account, balances := range l.balances {
+		if amount := balances[asset]; amount != 0 {
+			holders[account] = amount
+		}
+	}
+	return holders
+}
+
+// Entries returns a copy of every entry in the journal in the order
+// they were posted.
+func (l *Ledger) Entries() []Entry {
+	l.RLock()
+	defer l.RUnlock()
+	entries := make([]Entry, len(l.entries))
+	for i, e := range l.entries {
+		entries[i] = e.copy()
+	}
+	return entries
+}
+
+// copy returns the entry with its own copy of its postings, so that
+// changing it doesn't change the journal.
+func (e Entry) copy() Entry {
+	e.Postings = append([]Posting(nil), e.Postings...)
+	return e
+}
+
+// TrialBalance sums every account's balance per asset. Since every
+// entry balances, each asset should sum to zero.
+func (l *Ledger) TrialBalance() map[string]float64 {
+	l.RLock()
+	defer l.RUnlock()
+	totals := make(map[string]float64)
+	for _, balances := range l.balances {
+		for asset, amount := range balances {
+			totals[asset] += amount
+		}
+	}
+	return totals
+}
+
+// validate checks that the entry's debits equal its credits in every asset.
+func (e Entry) validate() error {
+	if len(e.Postings) == 0 {
+		return fmt.Errorf("%s entry has no postings", e.Kind)
+	}
+	assets := map[string]bool{}
+	debits := map[string]float64{}
+	credits := map[string]float64{}
+	for _, p := range e.Postings {
+		if p.Account == "" || p.Asset == "" {
+			return fmt.Errorf("%s entry has a posting without an account or asset: %+v", e.Kind, p)
+		}
+		if p.Debit < 0 || p.Credit < 0 {
+			return fmt.Errorf("%s entry has a negative posting: %+v", e.Kind, p)
+		}
+		assets[p.Asset] = true
+		debits[p.Asset] += p.Debit
+		credits[p.Asset] += p.Credit
+	}
+	for asset := range assets {
+		if math.Abs(debits[asset]-credits[asset]) > epsilon*math.Max(1, debits[asset]) {
+			return fmt.Errorf("%s entry doesn't balance in %s: debits %v credits %v",
+				e.Kind, asset, debits[asset], credits[asset])
+		}
+	}
+	return nil
+}
+
+// journal turns a set of transfers into balanced entries, one for each
+// kind and memo, in the order they first appear.
+func journal(transfers []Transfer) []Entry {
+	type key struct{ kind, memo string }
+	var order []key
+	grouped := map[key]*Entry{}
+	for _, t := range transfers {
+		kind := t.Kind
+		if kind == "" {
+			kind = KindTransfer
+		}
+		k := key{kind, t.Memo}
+		e, ok := grouped[k]
+		if !ok {
+			e = &Entry{Kind: kind, Memo: t.Memo}
+			grouped[k] = e
+			order = append(order, k)
+		}
+		e.Postings = append(e.Postings,
+			Posting{Account: t.To, Asset: t.Asset, Debit: t.Amount},
+			Posting{Account: t.From, Asset: t.Asset, Credit: t.Amount},
+		)
+	}
+	entries := make([]Entry, 0, len(order))
+	for _, k := range order {
+		entries = append(entries, *grouped[k])
+	}
+	return entries
+}
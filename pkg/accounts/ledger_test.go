@@ -0,0 +1,149 @@
+package accounts
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestLedgerPostsEveryChange(t *testing.T) {
+	is := is.New(t)
+	acc := &InMemoryManager{
+		Accounts: map[string]*UserAccount{
+			// added by hand, so it's opened on the ledger when it's first used
+			"bob": {Email: "bob", Balances: map[string]float64{"BTC": 2}},
+		},
+	}
+	_, err := acc.Create("alice", map[string]float64{USD: 100})
+	is.NoErr(err)
+
+	_, err = acc.Exchange(
+		Transfer{From: "alice", To: "bob", Asset: USD, Amount: 50, Kind: KindMatch},
+		Transfer{From: "bob", To: "alice", Asset: "BTC", Amount: 1, Kind: KindMatch},
+		Transfer{From: "alice", To: FeeAccount, Asset: USD, Amount: 1, Kind: KindFee},
+	)
+	is.NoErr(err)
+
+	entries := acc.Ledger().Entries()
+	is.Equal(len(entries), 4)
+	is.Equal(entries[0].Kind, KindDeposit)
+	is.Equal(entries[1].Kind, KindOpening)
+	is.Equal(entries[2].Kind, KindMatch)
+	is.Equal(entries[3].Kind, KindFee)
+	for _, e := range entries {
+		is.NoErr(e.validate())
+	}
+
+	// balances are views of the ledger
+	alice, err := acc.Get("alice")
+	is.NoErr(err)
+	is.Equal(alice.Balance(USD), float64(49))
+	is.Equal(alice.Balance("BTC"), float64(1))
+	fees, err := acc.Get(FeeAccount)
+	is.NoErr(err)
+	is.Equal(fees.Balance(USD), float64(1))
+
+	for _, total := range acc.Ledger().TrialBalance() {
+		is.Equal(total, float64(0)) // every asset nets to zero
+	}
+
+	// changing a copy of an entry doesn't change the journal
+	entries[2].Postings[0].Debit = 1000
+	is.Equal(acc.Ledger().Entries()[2].Postings[0].Debit, float64(50))
+}
+
+func TestLedgerRejectsUnbalancedEntries(t *testing.T) {
+	is := is.New(t)
+	l := NewLedger()
+	_, err := l.Post(
+		Entry{Kind: KindTransfer, Postings: []Posting{
+			{Account: "a", Asset: USD, Debit: 10},
+			{Account: "b", Asset: USD, Credit: 10},
+		}},
+		Entry{Kind: KindTransfer, Postings: []Posting{
+			{Account: "a", Asset: USD, Debit: 10},
+			{Account: "b", Asset: "BTC", Credit: 10},
+		}},
+	)
+	is.True(err != nil)
+	is.Equal(len(l.Entries()), 0) // nothing is posted
+	is.Equal(l.Balance("a", USD), float64(0))
+}
+
+func TestExchangeIsAllOrNothing(t *testing.T) {
+	is := is.New(t)
+	acc := NewAccountManager("")
+	_, err := acc.Create("alice", map[string]float64{USD: 10})
+	is.NoErr(err)
+	_, err = acc.Create("bob", map[string]float64{"BTC": 1})
+	is.NoErr(err)
+
+	_, err = acc.Exchange(
+		Transfer{From: "alice", To: "bob", Asset: USD, Amount: 20},
+		Transfer{From: "bob", To: "alice", Asset: "BTC", Amount: 1},
+	)
+	is.True(err != nil)
+	is.Equal(len(acc.Ledger().Entries()), 2) // just the two deposits
+
+	bob, err := acc.Get("bob")
+	is.NoErr(err)
+	is.Equal(bob.Balance("BTC"), float64(1))
+}
+
+func TestExchangeOverdraw(t *testing.T) {
+	is := is.New(t)
+	acc := NewAccountManager("")
+	_, err := acc.Create("alice", map[string]float64{USD: 10})
+	is.NoErr(err)
+
+	_, err = acc.Exchange(Transfer{From: "alice", To: FundingAccount, Asset: USD, Amount: 15})
+	is.True(err != nil)
+	_, err = acc.Exchange(Transfer{From: "alice", To: FundingAccount, Asset: USD, Amount: 15, Overdraw: true})
+	is.NoErr(err)
+	is.Equal(acc.Ledger().Balance("alice", USD), float64(-5))
+	is.Equal(acc.Ledger().Holders(USD), map[string]float64{
+		"alice":         -5,
+		FundingAccount:  15,
+		ExternalAccount: -10,
+	})
+}
+
+func TestDeleteClosesAccount(t *testing.T) {
+	is := is.New(t)
+	acc := NewAccountManager("")
+	_, err := acc.Create("alice", map[string]float64{USD: 100, "BTC": 2})
+	is.NoErr(err)
+	is.NoErr(acc.Hold("order:BTC-USD:1", "alice", USD, 40))
+
+	// a copy doesn't change with the account
+	alice, err := acc.Get("alice")
+	is.NoErr(err)
+	touched, err := acc.Tx("alice", FeeAccount, USD, 10)
+	is.NoErr(err)
+	is.Equal(alice.Balance(USD), float64(100))
+	_, err = acc.Tx("alice", FeeAccount, USD, 10)
+	is.NoErr(err)
+	is.Equal(touched[0].Balance(USD), float64(90)) // and neither does what Tx returns
+
+	// not while it has funds on hold
+	is.True(acc.Delete("alice") != nil)
+	_, err = acc.Get("alice")
+	is.NoErr(err)
+
+	_, err = acc.Release("order:BTC-USD:1")
+	is.NoErr(err)
+	is.NoErr(acc.Delete("alice"))
+	_, err = acc.Get("alice")
+	is.True(err != nil)
+	is.Equal(acc.Ledger().Balances("alice"), map[string]float64{USD: 0, "BTC": 0})
+	for _, total := range acc.Ledger().TrialBalance() {
+		is.Equal(total, float64(0))
+	}
+
+	// the account can be opened again from nothing
+	_, err = acc.Create("alice", nil)
+	is.NoErr(err)
+	alice, err = acc.Get("alice")
+	is.NoErr(err)
+	is.Equal(alice.Available(USD), float64(0))
+}
@@ -0,0 +1,184 @@
+package accounts
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// DefaultLimit is the page size used when a Query doesn't set one.
+const DefaultLimit = 100
+
+// MaxLimit is the largest page a Query can ask for.
+const MaxLimit = 1000
+
+// Activity is one journal entry as seen from a single account: how much of
+// an asset it moved into or out of the account and the balance it left.
+type Activity struct {
+	EntryID uint64    `json:"entryID"`
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Memo    string    `json:"memo"`
+	Asset   string    `json:"asset"`
+	Amount  float64   `json:"amount"`
+	Balance float64   `json:"balance"`
+}
+
+// Query filters and pages through an account's activity.
+// Zero values don't filter anything.
+type Query struct {
+	// Kinds limits the activity to the given entry kinds.
+	Kinds []string
+	// Asset limits the activity to a single asset.
+	Asset string
+	// From and To limit the activity to entries posted in [From, To).
+	From time.Time
+	To   time.Time
+	// Offset and Limit select a page of the matching activity.
+	Offset int
+	Limit  int
+}
+
+// Statement is a page of an account's activity, oldest first. Next is the
+// offset of the page after it, or 0 if it's the last.
+type Statement struct {
+	Account  string     `json:"account"`
+	Total    int        `json:"total"`
+	Offset   int        `json:"offset"`
+	Limit    int        `json:"limit"`
+	Next     int        `json:"next,omitempty"`
+	Activity []Activity `json:"transactions"`
+}
+
+// History returns the activity of account that matches q. Balances are
+// running balances over the account's whole history, so they're correct
+// no matter how the activity is filtered. Only the entries that the
+// account has postings in are read.
+func (l *Ledger) History(account string, q Query) Statement {
+	if q.Limit <= 0 {
+		q.Limit = DefaultLimit
+	}
+	if q.Limit > MaxLimit {
+		q.Limit = MaxLimit
+	}
+	if q.Offset < 0 {
+		q.Offset = 0
+	}
+	kinds := map[string]bool{}
+	for _, k := range q.Kinds {
+		kinds[k] = true
+	}
+
+	statement := Statement{
+		Account:  account,
+		Offset:   q.Offset,
+		Limit:    q.Limit,
+		Activity: []Activity{},
+	}
+	balances := map[string]float64{}
+
+	l.RLock()
+	defer l.RUnlock()
+	for _, i := range l.posted[account] {
+		e := &l.entries[i]
+		// net the account's postings in each asset of the entry
+		var assets []string
+		amounts := map[string]float64{}
+		for _, p := range e.Postings {
+			if p.Account != account {
+				continue
+			}
+			if _, ok := amounts[p.Asset]; !ok {
+				assets = append(assets, p.Asset)
+			}
+			amounts[p.Asset] += p.Debit - p.Credit
+		}
+
+		for _, asset := range assets {
+			balances[asset] += amounts[asset]
+
+			switch {
+			case len(kinds) > 0 && !kinds[e.Kind]:
+				continue
+			case q.Asset != "" && q.Asset != asset:
+				continue
+			case !q.From.IsZero() && e.Time.Before(q.From):
+				continue
+			case !q.To.IsZero() && !e.Time.Before(q.To):
+				continue
+			}
+
+			if statement.Total >= q.Offset && len(statement.Activity) < q.Limit {
+				statement.Activity = append(statement.Activity, Activity{
+					EntryID: e.ID,
+					Time:    e.Time,
+					Kind:    e.Kind,
+					Memo:    e.Memo,
+					Asset:   asset,
+					Amount:  amounts[asset],
+					Balance: balances[asset],
+				})
+			}
+			statement.Total++
+		}
+	}
+	if end := statement.Offset + len(statement.Activity); end < statement.Total {
+		statement.Next = end
+	}
+	return statement
+}
+
+// WriteCSV writes a statement's activity to w as CSV with a header row.
+func WriteCSV(w io.Writer, s Statement) error {
+	out := NewCSVWriter(w)
+	if err := out.Write(s); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// CSVWriter writes the activity of statements as CSV under a single header
+// row, so that a long statement can be written out a page at a time.
+type CSVWriter struct {
+	out    *csv.Writer
+	header bool
+}
+
+// NewCSVWriter returns a CSVWriter that writes to w.
+func NewCSVWriter(w io.Writer) *CSVWriter {
+	return &CSVWriter{out: csv.NewWriter(w)}
+}
+
+// Write writes a statement's activity, after the header row if it's the
+// first statement written.
+func (c *CSVWriter) Write(s Statement) error {
+	if !c.header {
+		if err := c.out.Write([]string{"entry", "time", "kind", "memo", "asset", "amount", "balance"}); err != nil {
+			return err
+		}
+		c.header = true
+	}
+	for _, a := range s.Activity {
+		err := c.out.Write([]string{
+			strconv.FormatUint(a.EntryID, 10),
+			a.Time.UTC().Format(time.RFC3339Nano),
+			a.Kind,
+			a.Memo,
+			a.Asset,
+			strconv.FormatFloat(a.Amount, 'f', -1, 64),
+			strconv.FormatFloat(a.Balance, 'f', -1, 64),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to write statement: %v", err)
+		}
+	}
+	return nil
+}
+
+// Flush writes out whatever is buffered.
+func (c *CSVWriter) Flush() error {
+	c.out.Flush()
+	return c.out.Error()
+}
@@ -0,0 +1,56 @@
+package accounts
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestHistory(t *testing.T) {
+	is := is.New(t)
+	acc := NewAccountManager("")
+	_, err := acc.Create("alice", map[string]float64{USD: 100})
+	is.NoErr(err)
+	_, err = acc.Create("bob", map[string]float64{"BTC": 5})
+	is.NoErr(err)
+
+	for i := 0; i < 3; i++ {
+		_, err = acc.Exchange(
+			Transfer{From: "alice", To: "bob", Asset: USD, Amount: 10, Kind: KindMatch, Memo: "fill"},
+			Transfer{From: "bob", To: "alice", Asset: "BTC", Amount: 1, Kind: KindMatch, Memo: "fill"},
+			Transfer{From: "alice", To: FeeAccount, Asset: USD, Amount: 1, Kind: KindFee, Memo: "fee"},
+		)
+		is.NoErr(err)
+	}
+
+	// everything, oldest first, with running balances
+	all := acc.Ledger().History("alice", Query{})
+	is.Equal(all.Total, 10) // a deposit then a USD fill, a BTC fill and a fee three times
+	is.Equal(all.Activity[0].Kind, KindDeposit)
+	last := all.Activity[len(all.Activity)-1]
+	is.Equal(last.Kind, KindFee)
+	is.Equal(last.Amount, float64(-1))
+	is.Equal(last.Balance, float64(67))
+
+	// filtered by kind and asset, then paged
+	fills := acc.Ledger().History("alice", Query{Kinds: []string{KindMatch}, Asset: "BTC", Offset: 1, Limit: 1})
+	is.Equal(fills.Total, 3)
+	is.Equal(len(fills.Activity), 1)
+	is.Equal(fills.Activity[0].Balance, float64(2))
+	is.Equal(fills.Next, 2)
+	is.Equal(all.Next, 0)
+
+	// nothing was posted in the future
+	future := acc.Ledger().History("alice", Query{From: time.Now().Add(time.Hour)})
+	is.Equal(future.Total, 0)
+
+	buf := &bytes.Buffer{}
+	is.NoErr(WriteCSV(buf, fills))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	is.Equal(len(lines), 2)
+	is.Equal(lines[0], "entry,time,kind,memo,asset,amount,balance")
+	is.True(strings.HasSuffix(lines[1], ",match,fill,BTC,1,2"))
+}
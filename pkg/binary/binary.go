@@ -0,0 +1,155 @@
+// Package binary resolves binary outcome markets.
+//
+// A binary market trades a YES and a NO contract on an event, priced
+// between 0 and 1 of the quote asset. The orderbook mints a YES and a NO
+// contract whenever a YES buyer and a NO buyer together pay the full
+// payout for them, so every contract out there is backed by the exchange's
+// collateral account. Trading stops at the market's Expiry and an admin
+// then resolves the outcome: every winning contract pays out 1 of the
+// quote asset and every losing one pays nothing.
+package binary
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dylanlott/orderbook/pkg/accounts"
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+)
+
+// Resolution is the outcome of a market and what it paid out.
+type Resolution struct {
+	Symbol  string    `json:"symbol"`
+	Time    time.Time `json:"time"`
+	Outcome string    `json:"outcome"`
+	Payouts []Payout  `json:"payouts"`
+}
+
+// Payout is what an account's contracts paid out.
+type Payout struct {
+	Account string  `json:"account"`
+	Yes     float64 `json:"yes"`
+	No      float64 `json:"no"`
+	Amount  float64 `json:"amount"`
+}
+
+// Engine resolves a binary market.
+type Engine struct {
+	sync.RWMutex
+
+	market     orderbook.Market
+	accts      accounts.AccountManager
+	cancels    chan orderbook.OpCancel
+	resolution *Resolution
+}
+
+// NewEngine returns an Engine for a binary market that's run by
+// orderbook.Start or orderbook.Run with the given cancel channel. The
+// market must have an expiry for trading to stop at.
+func NewEngine(accts accounts.AccountManager, market orderbook.Market, cancels chan orderbook.OpCancel) (*Engine, error) {
+	if !market.Binary() {
+		return nil, fmt.Errorf("%s is not a binary market", market.Symbol)
+	}
+	if market.Expiry.IsZero() {
+		return nil, fmt.Errorf("%s has no expiry", market.Symbol)
+	}
+	return &Engine{
+		market:  market,
+		accts:   accts,
+		cancels: cancels,
+	}, nil
+}
+
+// Resolution returns the market's resolution once it's resolved.
+func (e *Engine) Resolution() (Resolution, bool) {
+	e.RLock()
+	defer e.RUnlock()
+	if e.resolution == nil {
+		return Resolution{}, false
+	}
+	return *e.resolution, true
+}
+
+// Resolve settles the market at outcome once it's stopped trading. Every
+// contract is handed back to the collateral account, which pays out the
+// winning ones, and the whole resolution is posted to the ledger as one
+// settlement entry.
+func (e *Engine) Resolve(outcome string) (Resolution, error) {
+	e.Lock()
+	defer e.Unlock()
+
+	now := time.Now()
+	switch {
+	case e.resolution != nil:
+		return Resolution{}, fmt.Errorf("%s already resolved %s", e.market.Symbol, e.resolution.Outcome)
+	case !e.market.Expired(now):
+		return Resolution{}, fmt.Errorf("%s trades until %v", e.market.Symbol, e.market.Expiry)
+	case outcome != orderbook.Yes && outcome != orderbook.No:
+		return Resolution{}, fmt.Errorf("invalid outcome %q", outcome)
+	}
+
+	// contracts held by open orders can't be handed back
+	result := make(chan orderbook.CancelResult)
+	e.cancels <- orderbook.OpCancel{Result: result}
+	if r := <-result; r.Err != nil {
+		return Resolution{}, fmt.Errorf("failed to cancel %s orders: %v", e.market.Symbol, r.Err)
+	}
+
+	ledger := e.accts.Ledger()
+	yes, no := ledger.Holders(e.market.Base), ledger.Holders(e.market.No)
+	payouts := map[string]*Payout{}
+	for _, holders := range []map[string]float64{yes, no} {
+		for id := range holders {
+			if !accounts.IsSystem(id) {
+				payouts[id] = &Payout{Account: id, Yes: yes[id], No: no[id]}
+			}
+		}
+	}
+	var accts []string
+	for id := range payouts {
+		accts = append(accts, id)
+	}
+	sort.Strings(accts)
+
+	r := Resolution{
+		Symbol:  e.market.Symbol,
+		Time:    now,
+		Outcome: outcome,
+		Payouts: []Payout{},
+	}
+	memo := fmt.Sprintf("%s resolved %s", r.Symbol, outcome)
+	var transfers []accounts.Transfer
+	for _, id := range accts {
+		p := payouts[id]
+		p.Amount = p.Yes
+		if outcome == orderbook.No {
+			p.Amount = p.No
+		}
+		r.Payouts = append(r.Payouts, *p)
+
+		for _, t := range []accounts.Transfer{
+			{From: id, To: accounts.CollateralAccount, Asset: e.market.Base, Amount: p.Yes},
+			{From: id, To: accounts.CollateralAccount, Asset: e.market.No, Amount: p.No},
+			{From: accounts.CollateralAccount, To: id, Asset: e.market.Quote, Amount: p.Amount},
+		} {
+			if t.Amount == 0 {
+				continue
+			}
+			if t.Amount < 0 {
+				t.From, t.To, t.Amount, t.Overdraw = t.To, t.From, -t.Amount, true
+			}
+			t.Kind, t.Memo = accounts.KindSettlement, memo
+			transfers = append(transfers, t)
+		}
+	}
+	if len(transfers) > 0 {
+		if _, err := e.accts.Exchange(transfers...); err != nil {
+			return Resolution{}, fmt.Errorf("failed to resolve %s: %v", r.Symbol, err)
+		}
+	}
+
+	e.resolution = &r
+	return r, nil
+}
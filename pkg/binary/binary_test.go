@@ -0,0 +1,101 @@
+package binary
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dylanlott/orderbook/pkg/accounts"
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+	"github.com/matryer/is"
+)
+
+func TestResolve(t *testing.T) {
+	is := is.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	market := orderbook.Market{Symbol: "RAIN", Base: "RAIN-YES", No: "RAIN-NO", Quote: accounts.USD, Expiry: time.Now().Add(200 * time.Millisecond)}
+	_, err := NewEngine(nil, orderbook.Market{Symbol: "BTC-USD", Expiry: market.Expiry}, nil)
+	is.True(err != nil) // not binary
+
+	acc := accounts.NewAccountManager("")
+	for _, id := range []string{"alice", "bob", "carol"} {
+		_, err := acc.Create(id, map[string]float64{accounts.USD: 100})
+		is.NoErr(err)
+	}
+
+	writes := make(chan orderbook.OpWrite)
+	cancels := make(chan orderbook.OpCancel)
+	fills := make(chan orderbook.FillResult, 100)
+	errs := make(chan error, 100)
+	go orderbook.Start(ctx, market, acc, writes, cancels, nil, fills, nil, errs)
+
+	engine, err := NewEngine(acc, market, cancels)
+	is.NoErr(err)
+	is.True(write(writes, orderbook.Order{ID: "x1", AccountID: "alice", Side: "buy", Price: 100, Open: 1}).Err != nil)
+	is.True(write(writes, orderbook.Order{ID: "x2", AccountID: "alice", Side: "buy", Outcome: "maybe", Price: 50, Open: 1}).Err != nil)
+
+	// a YES buy at 60 and a NO buy at 45 mint 10 pairs at 60 / 40
+	is.NoErr(write(writes, orderbook.Order{ID: "a1", AccountID: "alice", Side: "buy", Price: 60, Open: 10}).Err)
+	r := write(writes, orderbook.Order{ID: "b1", AccountID: "bob", Side: "buy", Outcome: orderbook.No, Price: 45, Open: 10})
+	is.NoErr(r.Err)
+	is.Equal(r.Order.Side, "sell") // a NO buy at 45 is a YES sell at 55
+	is.Equal(r.Order.Price, uint64(55))
+	is.Equal(r.Order.Filled, uint64(10))
+
+	ledger := acc.Ledger()
+	is.Equal(ledger.Balance("alice", market.Base), float64(10))
+	is.Equal(ledger.Balance("alice", accounts.USD), float64(94))
+	is.Equal(ledger.Balance("bob", market.No), float64(10))
+	is.Equal(ledger.Balance("bob", accounts.USD), float64(96))
+	is.Equal(ledger.Balance(accounts.CollateralAccount, accounts.USD), float64(10))
+
+	// alice sells YES to carol the ordinary way
+	is.NoErr(write(writes, orderbook.Order{ID: "a2", AccountID: "alice", Side: "sell", Price: 75, Open: 4}).Err)
+	is.NoErr(write(writes, orderbook.Order{ID: "c1", AccountID: "carol", Side: "buy", Price: 75, Open: 4}).Err)
+	is.Equal(ledger.Balance("carol", market.Base), float64(4))
+
+	// a NO sell at 25 and a YES sell at 75 burn 2 pairs
+	is.NoErr(write(writes, orderbook.Order{ID: "b2", AccountID: "bob", Side: "sell", Outcome: orderbook.No, Price: 25, Open: 2}).Err)
+	is.NoErr(write(writes, orderbook.Order{ID: "a3", AccountID: "alice", Side: "sell", Price: 75, Open: 2}).Err)
+	is.Equal(ledger.Balance(accounts.CollateralAccount, accounts.USD), float64(8))
+	is.Equal(ledger.Balance(accounts.CollateralAccount, market.Base), float64(-8))
+	is.Equal(ledger.Balance(accounts.CollateralAccount, market.No), float64(-8))
+
+	// carol's NO bid is still open when trading stops
+	is.NoErr(write(writes, orderbook.Order{ID: "c2", AccountID: "carol", Side: "buy", Outcome: orderbook.No, Price: 30, Open: 1}).Err)
+	_, err = engine.Resolve(orderbook.Yes)
+	is.True(err != nil) // still trading
+	time.Sleep(time.Until(market.Expiry))
+	_, err = engine.Resolve("maybe")
+	is.True(err != nil)
+
+	res, err := engine.Resolve(orderbook.Yes)
+	is.NoErr(err)
+	is.Equal(res.Payouts, []Payout{
+		{Account: "alice", Yes: 4, Amount: 4},
+		{Account: "bob", No: 8},
+		{Account: "carol", Yes: 4, Amount: 4},
+	})
+	_, err = engine.Resolve(orderbook.No)
+	is.True(err != nil) // already resolved
+
+	for id, usd := range map[string]float64{"alice": 102.5, "bob": 96.5, "carol": 101} {
+		is.Equal(ledger.Balance(id, accounts.USD), usd)
+		is.Equal(ledger.Balance(id, market.Base), float64(0))
+		is.Equal(ledger.Balance(id, market.No), float64(0))
+	}
+	for _, asset := range []string{accounts.USD, market.Base, market.No} {
+		is.Equal(ledger.Balance(accounts.CollateralAccount, asset), float64(0))
+	}
+	a, err := acc.Get("carol")
+	is.NoErr(err)
+	is.Equal(a.Available(accounts.USD), float64(101))
+}
+
+func write(writes chan orderbook.OpWrite, o orderbook.Order) orderbook.WriteResult {
+	result := make(chan orderbook.WriteResult)
+	writes <- orderbook.OpWrite{Order: o, Result: result}
+	return <-result
+}
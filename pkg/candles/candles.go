@@ -0,0 +1,307 @@
+// Package candles aggregates a market's trades into OHLCV candles at fixed
+// intervals, for charts and backtests.
+//
+// An Aggregator keeps the latest candles of each interval in memory and,
+// if it's given a directory, saves every candle there once it closes. The
+// candle that's still open is only in memory, so after a restart it's
+// rebuilt from the trades that the saved candles don't cover yet.
+package candles
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+)
+
+// Intervals are the intervals that trades can be aggregated at, by name.
+var Intervals = map[string]time.Duration{
+	"1s": time.Second,
+	"1m": time.Minute,
+	"5m": 5 * time.Minute,
+	"1h": time.Hour,
+	"1d": 24 * time.Hour,
+}
+
+// Candle is the trades of one interval. Time is when the interval started
+// and prices are in hundredths. Intervals without a trade have no candle.
+type Candle struct {
+	Time        time.Time `json:"time"`
+	Open        uint64    `json:"open"`
+	High        uint64    `json:"high"`
+	Low         uint64    `json:"low"`
+	Close       uint64    `json:"close"`
+	Volume      uint64    `json:"volume"`
+	QuoteVolume uint64    `json:"quote_volume"`
+	Trades      int       `json:"trades"`
+}
+
+// Config configures an Aggregator.
+type Config struct {
+	// Intervals are the names of the intervals to aggregate. They default
+	// to every one of Intervals.
+	Intervals []string
+	// Limit is how many of the latest candles of each interval are kept
+	// in memory. It defaults to 1000.
+	Limit int
+	// Dir is the directory that closed candles are saved in, one file per
+	// interval. Candles aren't saved if it's empty.
+	Dir string
+}
+
+// Aggregator aggregates trades into candles. It's safe for concurrent use.
+type Aggregator struct {
+	sync.RWMutex
+
+	limit  int
+	dir    string
+	series map[string]*series
+}
+
+// series is the candles of one interval.
+type series struct {
+	interval time.Duration
+	// candles are the latest candles, oldest first. The last one is
+	// still open, unless it was read back from the file.
+	candles []Candle
+	open    bool
+	// saved is when the last saved candle closed. Trades before it are
+	// already in saved candles.
+	saved time.Time
+	file  *os.File
+}
+
+// New returns an Aggregator. If cfg has a directory, the candles saved in
+// it are read back.
+func New(cfg Config) (*Aggregator, error) {
+	if len(cfg.Intervals) == 0 {
+		for name := range Intervals {
+			cfg.Intervals = append(cfg.Intervals, name)
+		}
+	}
+	if cfg.Limit == 0 {
+		cfg.Limit = 1000
+	}
+	if cfg.Dir != "" {
+		if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create candle store: %v", err)
+		}
+	}
+
+	a := &Aggregator{limit: cfg.Limit, dir: cfg.Dir, series: make(map[string]*series)}
+	for _, name := range cfg.Intervals {
+		interval, ok := Intervals[name]
+		if !ok {
+			a.Close()
+			return nil, fmt.Errorf("unknown interval %q", name)
+		}
+		s := &series{interval: interval}
+		a.series[name] = s
+		if cfg.Dir == "" {
+			continue
+		}
+		if err := s.load(a.path(name), a.limit); err != nil {
+			a.Close()
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Close closes the files that candles are saved in.
+func (a *Aggregator) Close() error {
+	a.Lock()
+	defer a.Unlock()
+	for _, s := range a.series {
+		if s.file != nil {
+			s.file.Close()
+			s.file = nil
+		}
+	}
+	return nil
+}
+
+// Add adds a trade to the candle of its interval in every series. Trades
+// have to be added in the order they were made, and ones that are already
+// in saved candles are skipped.
+func (a *Aggregator) Add(t orderbook.TapeTrade) error {
+	a.Lock()
+	defer a.Unlock()
+	for name, s := range a.series {
+		if err := s.add(t, a.limit); err != nil {
+			return fmt.Errorf("failed to save %s candle: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Rebuild adds trades from a market's history, like the ones on its tape
+// after a restart.
+func (a *Aggregator) Rebuild(trades []orderbook.TapeTrade) error {
+	for _, t := range trades {
+		if err := a.Add(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Candles returns an interval's candles that started from from up to but
+// not including to, oldest first, and no more than limit of them. Candles
+// that are no longer in memory are read from where they were saved.
+func (a *Aggregator) Candles(interval string, from, to time.Time, limit int) ([]Candle, error) {
+	a.RLock()
+	defer a.RUnlock()
+
+	s, ok := a.series[interval]
+	if !ok {
+		return nil, fmt.Errorf("interval %q isn't aggregated", interval)
+	}
+	candles := []Candle{}
+	in := func(c Candle) bool {
+		return !c.Time.Before(from) && c.Time.Before(to) && len(candles) < limit
+	}
+
+	if a.dir != "" && (len(s.candles) == 0 || from.Before(s.candles[0].Time)) {
+		// only the candles before the ones in memory are read, since
+		// the last of them may not be saved yet
+		var first time.Time
+		if len(s.candles) > 0 {
+			first = s.candles[0].Time
+		}
+		err := read(a.path(interval), func(c Candle) bool {
+			if !first.IsZero() && !c.Time.Before(first) {
+				return false
+			}
+			if in(c) {
+				candles = append(candles, c)
+			}
+			return c.Time.Before(to) && len(candles) < limit
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	i := sort.Search(len(s.candles), func(i int) bool { return !s.candles[i].Time.Before(from) })
+	for ; i < len(s.candles) && in(s.candles[i]); i++ {
+		candles = append(candles, s.candles[i])
+	}
+	return candles, nil
+}
+
+// path returns the file an interval's candles are saved in.
+func (a *Aggregator) path(interval string) string {
+	return filepath.Join(a.dir, interval+".candles")
+}
+
+// load reads back the latest of the candles saved in a file and keeps
+// saving them there.
+func (s *series) load(path string, limit int) error {
+	err := read(path, func(c Candle) bool {
+		s.candles = append(s.candles, c)
+		if len(s.candles) > limit {
+			s.candles = s.candles[len(s.candles)-limit:]
+		}
+		return true
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if n := len(s.candles); n > 0 {
+		s.saved = s.candles[n-1].Time.Add(s.interval)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open candle store: %v", err)
+	}
+	s.file = f
+	return nil
+}
+
+// add adds a trade to its candle. A trade in a later interval than the
+// open candle closes it and saves it.
+func (s *series) add(t orderbook.TapeTrade, limit int) error {
+	if t.Time.Before(s.saved) {
+		return nil
+	}
+	start := t.Time.Truncate(s.interval)
+	if n := len(s.candles); n > 0 && !s.candles[n-1].Time.Before(start) {
+		c := &s.candles[n-1]
+		if t.Price > c.High {
+			c.High = t.Price
+		}
+		if t.Price < c.Low {
+			c.Low = t.Price
+		}
+		c.Close = t.Price
+		c.Volume += t.Quantity
+		c.QuoteVolume += t.Price * t.Quantity
+		c.Trades++
+		return nil
+	}
+
+	var err error
+	if n := len(s.candles); n > 0 && s.open {
+		err = s.save(s.candles[n-1])
+	}
+	s.open = true
+	s.candles = append(s.candles, Candle{
+		Time:        start,
+		Open:        t.Price,
+		High:        t.Price,
+		Low:         t.Price,
+		Close:       t.Price,
+		Volume:      t.Quantity,
+		QuoteVolume: t.Price * t.Quantity,
+		Trades:      1,
+	})
+	if len(s.candles) > limit {
+		s.candles = s.candles[len(s.candles)-limit:]
+	}
+	return err
+}
+
+// save saves a candle that closed.
+func (s *series) save(c Candle) error {
+	s.saved = c.Time.Add(s.interval)
+	if s.file == nil {
+		return nil
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Write(append(b, '\n'))
+	return err
+}
+
+// read calls fn with each candle saved in a file, oldest first, until it
+// returns false.
+func read(path string, fn func(Candle) bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var c Candle
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			return fmt.Errorf("failed to read candle %q: %v", scanner.Text(), err)
+		}
+		if !fn(c) {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read candles: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package candles
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+	"github.com/matryer/is"
+)
+
+func TestAggregator(t *testing.T) {
+	is := is.New(t)
+	dir := t.TempDir()
+	start := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+	trades := []orderbook.TapeTrade{
+		{ID: 1, Price: 1000, Quantity: 2, Time: start.Add(10 * time.Second)},
+		{ID: 2, Price: 1050, Quantity: 1, Time: start.Add(20 * time.Second)},
+		{ID: 3, Price: 990, Quantity: 1, Time: start.Add(50 * time.Second)},
+		{ID: 4, Price: 1010, Quantity: 3, Time: start.Add(70 * time.Second)},
+		{ID: 5, Price: 1020, Quantity: 1, Time: start.Add(4 * time.Minute)},
+		{ID: 6, Price: 1030, Quantity: 1, Time: start.Add(5 * time.Minute)},
+	}
+
+	a, err := New(Config{Intervals: []string{"1m", "5m"}, Limit: 2, Dir: dir})
+	is.NoErr(err)
+	is.NoErr(a.Rebuild(trades[:5]))
+
+	all := func(a *Aggregator, interval string) []Candle {
+		candles, err := a.Candles(interval, time.Time{}, start.Add(time.Hour), 100)
+		is.NoErr(err)
+		return candles
+	}
+	// the first minute is only on disk by now
+	minutes := all(a, "1m")
+	is.Equal(minutes, []Candle{
+		{Time: start, Open: 1000, High: 1050, Low: 990, Close: 990, Volume: 4, QuoteVolume: 4040, Trades: 3},
+		{Time: start.Add(time.Minute), Open: 1010, High: 1010, Low: 1010, Close: 1010, Volume: 3, QuoteVolume: 3030, Trades: 1},
+		{Time: start.Add(4 * time.Minute), Open: 1020, High: 1020, Low: 1020, Close: 1020, Volume: 1, QuoteVolume: 1020, Trades: 1},
+	})
+	five := all(a, "5m")
+	is.Equal(len(five), 1)
+	is.Equal(five[0].Volume, uint64(8))
+
+	// from, to and limit pick out candles
+	candles, err := a.Candles("1m", start.Add(time.Minute), start.Add(4*time.Minute), 100)
+	is.NoErr(err)
+	is.Equal(candles, minutes[1:2])
+	candles, err = a.Candles("1m", start, start.Add(time.Hour), 2)
+	is.NoErr(err)
+	is.Equal(candles, minutes[:2])
+	_, err = a.Candles("1h", start, start.Add(time.Hour), 10)
+	is.True(err != nil)
+	is.NoErr(a.Close())
+
+	// after a restart the open candles are rebuilt from every trade
+	// without counting the saved ones twice
+	a, err = New(Config{Intervals: []string{"1m", "5m"}, Limit: 2, Dir: dir})
+	is.NoErr(err)
+	defer a.Close()
+	is.NoErr(a.Rebuild(trades))
+	minutes = append(minutes, Candle{Time: start.Add(5 * time.Minute), Open: 1030, High: 1030, Low: 1030, Close: 1030, Volume: 1, QuoteVolume: 1030, Trades: 1})
+	is.Equal(all(a, "1m"), minutes)
+	five = all(a, "5m")
+	is.Equal(len(five), 2)
+	is.Equal(five[0].Volume, uint64(8))
+
+	_, err = New(Config{Intervals: []string{"2m"}})
+	is.True(err != nil)
+}
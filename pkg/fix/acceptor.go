@@ -0,0 +1,489 @@
+package fix
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dylanlott/orderbook/pkg/accounts"
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+)
+
+// Values of ExecType.
+const (
+	execNew      = "0"
+	execCanceled = "4"
+	execReplaced = "5"
+	execRejected = "8"
+	execTrade    = "F"
+)
+
+// Values of OrdStatus.
+const (
+	statusNew      = "0"
+	statusPartial  = "1"
+	statusFilled   = "2"
+	statusCanceled = "4"
+	statusRejected = "8"
+)
+
+// Config configures an Acceptor.
+type Config struct {
+	// CompID is the gateway's CompID, which counterparties send as their
+	// TargetCompID.
+	CompID string
+	// Symbol is the market that orders are taken for.
+	Symbol string
+	// Dir is where sessions are stored. Sessions are kept in memory and
+	// lost when the process exits if it's empty.
+	Dir string
+	// Passwords holds the password of every account that can log on. A
+	// Logon carries the account as its Username and its password as its
+	// Password. Accounts without a password can't log on.
+	Passwords map[string]string
+}
+
+// Acceptor is a FIX gateway to a book run with orderbook.Run. Orders are
+// sent on in and canceled on cancels. The gateway doesn't see the book's
+// matches by itself, so every match has to be passed to Match for orders
+// to be reported as they're filled, and every order the book rejects to
+// Reject.
+type Acceptor struct {
+	sync.Mutex
+
+	cfg      Config
+	accounts accounts.AccountManager
+	in       chan *orderbook.Order
+	cancels  chan orderbook.OpCancel
+
+	sessions map[string]*session
+	// orders holds every order entered through the gateway by the ID of
+	// its order in the book and by its account and ClOrdID.
+	orders   map[string]*order
+	clOrdIDs map[string]*order
+	execID   string
+	execs    int
+}
+
+// order is an order entered through the gateway.
+type order struct {
+	account string
+	symbol  string
+	side    string
+	// id is the OrderID that the order is reported with. It stays the same
+	// when the order is replaced, but ref, the ID of its order in the
+	// book, doesn't.
+	id          string
+	ref         string
+	clOrdID     string
+	origClOrdID string
+	status      string
+	quantity    uint64
+	price       uint64
+	filled      uint64
+	// value is the total value of the order's fills, to work out its
+	// average price.
+	value uint64
+}
+
+// NewAcceptor returns an Acceptor that takes sessions for the accounts
+// in accts and sends their orders to a book.
+func NewAcceptor(cfg Config, accts accounts.AccountManager, in chan *orderbook.Order, cancels chan orderbook.OpCancel) *Acceptor {
+	return &Acceptor{
+		cfg:      cfg,
+		accounts: accts,
+		in:       in,
+		cancels:  cancels,
+		sessions: make(map[string]*session),
+		orders:   make(map[string]*order),
+		clOrdIDs: make(map[string]*order),
+		// exec IDs are unique across restarts as well as within one
+		execID: strconv.FormatInt(time.Now().UnixNano(), 36),
+	}
+}
+
+// ListenAndServe takes sessions on a TCP address.
+func (a *Acceptor) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for FIX sessions: %v", err)
+	}
+	return a.Serve(l)
+}
+
+// Serve takes sessions on a listener until it's closed.
+func (a *Acceptor) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go a.handle(conn)
+	}
+}
+
+// session returns a counterparty's session, opening its store the first
+// time it logs on.
+func (a *Acceptor) session(compID string) (*session, error) {
+	a.Lock()
+	defer a.Unlock()
+	if s, ok := a.sessions[compID]; ok {
+		return s, nil
+	}
+
+	var store Store = NewMemoryStore()
+	if a.cfg.Dir != "" {
+		fs, err := NewFileStore(a.cfg.Dir, a.cfg.CompID+"-"+compID)
+		if err != nil {
+			return nil, err
+		}
+		store = fs
+	}
+	s := &session{compID: compID, ourID: a.cfg.CompID, store: store}
+	a.sessions[compID] = s
+	return s, nil
+}
+
+// Match reports a match to the accounts of its orders that were entered
+// through the gateway.
+func (a *Acceptor) Match(m orderbook.Match) {
+	a.Lock()
+	defer a.Unlock()
+	for _, o := range []*orderbook.Order{m.Buy, m.Sell} {
+		ord, ok := a.orders[o.ID]
+		if !ok {
+			continue
+		}
+		ord.filled += m.Quantity
+		ord.value += m.Price * m.Quantity
+		if ord.status != statusCanceled {
+			ord.status = statusPartial
+			if ord.filled >= ord.quantity {
+				ord.status = statusFilled
+			}
+		}
+		report := a.report(ord, execTrade, "").
+			Set(TagLastQty, strconv.FormatUint(m.Quantity, 10)).
+			Set(TagLastPx, formatPrice(m.Price))
+		a.deliver(ord.account, report)
+	}
+}
+
+// Reject reports an order that the book wouldn't take, like one that its
+// account can't fund, if it was entered through the gateway. Orders are
+// reported as new when they're sent to the book, so the rejection comes
+// after that.
+func (a *Acceptor) Reject(r orderbook.WriteResult) {
+	a.Lock()
+	defer a.Unlock()
+	ord, ok := a.orders[r.Order.ID]
+	if !ok || ord.ref != r.Order.ID {
+		return
+	}
+	ord.status = statusRejected
+	a.deliver(ord.account, a.report(ord, execRejected, r.Err.Error()))
+}
+
+// newOrder enters a NewOrderSingle into the book. Only limit orders for
+// the gateway's symbol are taken.
+func (a *Acceptor) newOrder(s *session, m *Message) {
+	o := &order{
+		account: s.compID,
+		symbol:  m.Get(TagSymbol),
+		clOrdID: m.Get(TagClOrdID),
+		status:  statusNew,
+	}
+	var err error
+	o.side, o.quantity, o.price, err = a.parseOrder(s, m)
+	if err == nil && o.clOrdID == "" {
+		err = fmt.Errorf("ClOrdID is required")
+	}
+
+	a.Lock()
+	if err == nil && a.clOrdIDs[key(o.account, o.clOrdID)] != nil {
+		err = fmt.Errorf("ClOrdID %s was already used", o.clOrdID)
+	}
+	if err != nil {
+		o.status = statusRejected
+		a.deliver(o.account, a.report(o, execRejected, err.Error()))
+		a.Unlock()
+		return
+	}
+	o.id = ref(o.account, o.clOrdID)
+	o.ref = o.id
+	a.orders[o.ref] = o
+	a.clOrdIDs[key(o.account, o.clOrdID)] = o
+	a.deliver(o.account, a.report(o, execNew, ""))
+	entered := o.entry(0)
+	a.Unlock()
+
+	a.in <- entered
+}
+
+// cancel cancels an order for an OrderCancelRequest.
+func (a *Acceptor) cancel(s *session, m *Message) {
+	clOrdID, origClOrdID := m.Get(TagClOrdID), m.Get(TagOrigClOrdID)
+	o, err := a.lookup(s.compID, clOrdID, origClOrdID)
+	if err != nil {
+		a.Lock()
+		a.cancelReject(s.compID, o, clOrdID, origClOrdID, "1", err)
+		a.Unlock()
+		return
+	}
+
+	_, err = a.cancelRef(s.compID, o)
+	a.Lock()
+	defer a.Unlock()
+	if err != nil {
+		a.cancelReject(s.compID, o, clOrdID, origClOrdID, "1", err)
+		return
+	}
+	o.status = statusCanceled
+	a.rename(o, clOrdID)
+	a.deliver(o.account, a.report(o, execCanceled, ""))
+}
+
+// replace replaces an order with a new price or quantity for an
+// OrderCancelReplaceRequest. The order loses its place in the queue.
+// OrderQty is the order's new total quantity, including what's already
+// been filled, and an order that's already been filled that much is
+// canceled instead.
+func (a *Acceptor) replace(s *session, m *Message) {
+	clOrdID, origClOrdID := m.Get(TagClOrdID), m.Get(TagOrigClOrdID)
+	o, err := a.lookup(s.compID, clOrdID, origClOrdID)
+	var side string
+	var quantity, price uint64
+	if err == nil {
+		side, quantity, price, err = a.parseOrder(s, m)
+	}
+	if err == nil && side != o.side {
+		err = fmt.Errorf("an order's side can't be replaced")
+	}
+	if err != nil {
+		a.Lock()
+		a.cancelReject(s.compID, o, clOrdID, origClOrdID, "2", err)
+		a.Unlock()
+		return
+	}
+
+	canceled, err := a.cancelRef(s.compID, o)
+	a.Lock()
+	if err != nil {
+		a.cancelReject(s.compID, o, clOrdID, origClOrdID, "2", err)
+		a.Unlock()
+		return
+	}
+	a.rename(o, clOrdID)
+	if quantity <= canceled.Filled {
+		o.status = statusCanceled
+		a.deliver(o.account, a.report(o, execCanceled, "already filled more than the new quantity"))
+		a.Unlock()
+		return
+	}
+	o.quantity, o.price = quantity, price
+	o.ref = ref(o.account, clOrdID)
+	a.orders[o.ref] = o
+	a.deliver(o.account, a.report(o, execReplaced, ""))
+	entered := o.entry(canceled.Filled)
+	a.Unlock()
+
+	a.in <- entered
+}
+
+// lookup finds the order that a cancel or replace is for and checks that
+// its new ClOrdID hasn't been used. It's returned along with an error if
+// it can't be canceled.
+func (a *Acceptor) lookup(account, clOrdID, origClOrdID string) (*order, error) {
+	a.Lock()
+	defer a.Unlock()
+	o := a.clOrdIDs[key(account, origClOrdID)]
+	switch {
+	case o == nil:
+		return nil, fmt.Errorf("unknown order %s", origClOrdID)
+	case clOrdID == "" || a.clOrdIDs[key(account, clOrdID)] != nil:
+		return o, fmt.Errorf("ClOrdID %q can't be used", clOrdID)
+	case o.status == statusFilled || o.status == statusCanceled:
+		return o, fmt.Errorf("order %s is closed", origClOrdID)
+	}
+	return o, nil
+}
+
+// cancelRef takes an order out of the book. It returns the order as it
+// was in the book.
+func (a *Acceptor) cancelRef(account string, o *order) (orderbook.Order, error) {
+	a.Lock()
+	id := o.ref
+	a.Unlock()
+
+	result := make(chan orderbook.CancelResult, 1)
+	a.cancels <- orderbook.OpCancel{OrderID: id, AccountID: account, Result: result}
+	r := <-result
+	return r.Order, r.Err
+}
+
+// rename moves an order to a new ClOrdID. The acceptor must be locked by
+// the caller.
+func (a *Acceptor) rename(o *order, clOrdID string) {
+	o.origClOrdID, o.clOrdID = o.clOrdID, clOrdID
+	a.clOrdIDs[key(o.account, clOrdID)] = o
+}
+
+// parseOrder reads the side, quantity and price of an order and checks
+// that it's a limit order for the gateway's symbol and the session's
+// account.
+func (a *Acceptor) parseOrder(s *session, m *Message) (string, uint64, uint64, error) {
+	if symbol := m.Get(TagSymbol); symbol != a.cfg.Symbol {
+		return "", 0, 0, fmt.Errorf("unknown symbol %q", symbol)
+	}
+	if account := m.Get(TagAccount); account != "" && account != s.compID {
+		return "", 0, 0, fmt.Errorf("session can't trade for account %q", account)
+	}
+	if ordType := m.Get(TagOrdType); ordType != "2" {
+		return "", 0, 0, fmt.Errorf("only limit orders are supported, got OrdType %q", ordType)
+	}
+	var side string
+	switch m.Get(TagSide) {
+	case "1":
+		side = "buy"
+	case "2":
+		side = "sell"
+	default:
+		return "", 0, 0, fmt.Errorf("invalid side %q", m.Get(TagSide))
+	}
+	quantity, err := strconv.ParseUint(m.Get(TagOrderQty), 10, 64)
+	if err != nil || quantity == 0 {
+		return "", 0, 0, fmt.Errorf("OrderQty must be a positive whole number")
+	}
+	price, err := parsePrice(m.Get(TagPrice))
+	if err != nil {
+		return "", 0, 0, err
+	}
+	return side, quantity, price, nil
+}
+
+// report builds an ExecutionReport of an order. The acceptor must be
+// locked by the caller.
+func (a *Acceptor) report(o *order, execType, text string) *Message {
+	a.execs++
+	m := NewMessage(MsgExecutionReport).
+		Set(TagOrderID, o.id).
+		Set(TagClOrdID, o.clOrdID)
+	if o.origClOrdID != "" {
+		m.Set(TagOrigClOrdID, o.origClOrdID)
+	}
+	m.Set(TagExecID, fmt.Sprintf("%s-%d", a.execID, a.execs)).
+		Set(TagExecType, execType).
+		Set(TagOrdStatus, o.status).
+		Set(TagAccount, o.account).
+		Set(TagSymbol, o.symbol).
+		Set(TagSide, fixSide(o.side)).
+		Set(TagOrderQty, strconv.FormatUint(o.quantity, 10)).
+		Set(TagOrdType, "2").
+		Set(TagPrice, formatPrice(o.price))
+
+	leaves := uint64(0)
+	if (o.status == statusNew || o.status == statusPartial) && o.quantity > o.filled {
+		leaves = o.quantity - o.filled
+	}
+	avg := 0.0
+	if o.filled > 0 {
+		avg = float64(o.value) / float64(o.filled) / 100
+	}
+	m.Set(TagLeavesQty, strconv.FormatUint(leaves, 10)).
+		Set(TagCumQty, strconv.FormatUint(o.filled, 10)).
+		Set(TagAvgPx, strconv.FormatFloat(avg, 'f', -1, 64))
+	if o.id == "" {
+		m.Set(TagOrderID, "NONE")
+	}
+	if text != "" {
+		m.Set(TagText, text)
+	}
+	return m
+}
+
+// cancelReject rejects a cancel or replace of an order, which is nil if
+// it's unknown. The acceptor must be locked by the caller.
+func (a *Acceptor) cancelReject(account string, o *order, clOrdID, origClOrdID, responseTo string, err error) {
+	m := NewMessage(MsgOrderCancelReject).
+		Set(TagOrderID, "NONE").
+		Set(TagClOrdID, clOrdID).
+		Set(TagOrigClOrdID, origClOrdID).
+		Set(TagOrdStatus, statusRejected).
+		Set(TagCxlRejResponseTo, responseTo).
+		Set(TagText, err.Error())
+	if o != nil {
+		m.Set(TagOrderID, o.id).Set(TagOrdStatus, o.status)
+	}
+	a.deliver(account, m)
+}
+
+// deliver sends a message to an account's session. The acceptor must be
+// locked by the caller, so that reports go out in the order that their
+// orders changed. The message is only queued for the session's
+// connection, so a counterparty that's slow to read doesn't hold up the
+// acceptor.
+func (a *Acceptor) deliver(account string, m *Message) {
+	s, ok := a.sessions[account]
+	if !ok {
+		return
+	}
+	if err := s.send(m); err != nil {
+		log.Printf("fix: failed to send to %s: %v", account, err)
+	}
+}
+
+// entry returns the order to enter into the book for an order, with what
+// it's already been filled in the book.
+func (o *order) entry(filled uint64) *orderbook.Order {
+	return &orderbook.Order{
+		ID:        o.ref,
+		AccountID: o.account,
+		Kind:      "limit",
+		Side:      o.side,
+		Price:     o.price,
+		Open:      o.quantity,
+		Filled:    filled,
+	}
+}
+
+// key identifies a ClOrdID of an account.
+func key(account, clOrdID string) string {
+	return account + "\x00" + clOrdID
+}
+
+// ref returns the ID of the book order for a ClOrdID of an account.
+func ref(account, clOrdID string) string {
+	return "fix:" + account + ":" + clOrdID
+}
+
+// fixSide returns the FIX Side of a side of the book.
+func fixSide(side string) string {
+	if side == "buy" {
+		return "1"
+	}
+	return "2"
+}
+
+// parsePrice parses a price with up to two decimal places into the
+// hundredths that the book is priced in.
+func parsePrice(v string) (uint64, error) {
+	whole, frac, _ := strings.Cut(v, ".")
+	if len(frac) > 2 {
+		return 0, fmt.Errorf("price %q has more than two decimal places", v)
+	}
+	frac += strings.Repeat("0", 2-len(frac))
+	price, err := strconv.ParseUint(whole+frac, 10, 64)
+	if err != nil || price == 0 {
+		return 0, fmt.Errorf("price must be a positive number, got %q", v)
+	}
+	return price, nil
+}
+
+// formatPrice formats a price in hundredths as a decimal.
+func formatPrice(price uint64) string {
+	return fmt.Sprintf("%d.%02d", price/100, price%100)
+}
@@ -0,0 +1,328 @@
+package fix
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dylanlott/orderbook/pkg/accounts"
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+	"github.com/matryer/is"
+)
+
+func TestMessage(t *testing.T) {
+	is := is.New(t)
+	m := NewMessage(MsgNewOrderSingle).
+		Set(TagClOrdID, "a1").
+		SetInt(TagMsgSeqNum, 2).
+		Set(TagSenderCompID, "alice").
+		Set(TagPrice, "10.25")
+	b := m.Bytes()
+	is.True(strings.HasPrefix(string(b), "8=FIX.4.4\x019="))
+	is.True(strings.Contains(string(b), "\x0135=D\x0149=alice\x0134=2\x0111=a1\x0144=10.25\x0110=")) // header first
+
+	parsed, err := Parse(b)
+	is.NoErr(err)
+	is.Equal(parsed.Bytes(), b)
+	is.Equal(parsed.Type(), MsgNewOrderSingle)
+	is.Equal(parsed.Get(TagClOrdID), "a1")
+	seq, err := parsed.Int(TagMsgSeqNum)
+	is.NoErr(err)
+	is.Equal(seq, 2)
+
+	read, err := ReadMessage(bufio.NewReader(strings.NewReader(string(b) + string(b))))
+	is.NoErr(err)
+	is.Equal(read, b)
+
+	_, err = Parse([]byte(strings.Replace(string(b), "a1", "a2", 1)))
+	is.True(err != nil) // checksum
+	_, err = Parse([]byte(strings.Replace(string(b), "a1", "a12", 1)))
+	is.True(err != nil) // body length
+	_, err = Parse([]byte("8=FIX.4.2\x019=5\x0135=0\x0110=000\x01"))
+	is.True(err != nil)
+
+	price, err := parsePrice("10.5")
+	is.NoErr(err)
+	is.Equal(price, uint64(1050))
+	is.Equal(formatPrice(price), "10.50")
+	_, err = parsePrice("10.505")
+	is.True(err != nil)
+}
+
+func TestAcceptor(t *testing.T) {
+	is := is.New(t)
+	dir := t.TempDir()
+	addr := startAcceptor(t, dir)
+
+	// a counterparty has to know its account's password
+	for _, password := range []string{"", "bob-pw"} {
+		m := dialWith(t, addr, "alice", 0, password).expect(MsgLogout)
+		is.True(strings.Contains(m.Get(TagText), "Password"))
+	}
+
+	alice := dial(t, addr, "alice", 0)
+	alice.expect(MsgLogon)
+	bob := dial(t, addr, "bob", 0)
+	bob.expect(MsgLogon)
+	dup := dial(t, addr, "alice", 0)
+	is.True(strings.Contains(dup.expect(MsgLogout).Get(TagText), "already logged on"))
+
+	alice.send(orderMessage(MsgNewOrderSingle, "a1", "2", "10", "10.00"))
+	r := alice.expect(MsgExecutionReport)
+	is.Equal(r.Get(TagExecType), execNew)
+	is.Equal(r.Get(TagLeavesQty), "10")
+	alice.send(orderMessage(MsgNewOrderSingle, "a1", "2", "10", "10.00"))
+	is.Equal(alice.expect(MsgExecutionReport).Get(TagExecType), execRejected) // ClOrdID was used
+	alice.send(orderMessage(MsgNewOrderSingle, "a9", "2", "10", "10.001"))
+	is.Equal(alice.expect(MsgExecutionReport).Get(TagOrdStatus), statusRejected)
+
+	// bob takes 4 of alice's 10
+	bob.send(orderMessage(MsgNewOrderSingle, "b1", "1", "4", "10.50"))
+	is.Equal(bob.expect(MsgExecutionReport).Get(TagExecType), execNew)
+	r = bob.expect(MsgExecutionReport)
+	is.Equal(r.Get(TagExecType), execTrade)
+	is.Equal(r.Get(TagOrdStatus), statusFilled)
+	is.Equal(r.Get(TagLastPx), "10.00")
+	r = alice.expect(MsgExecutionReport)
+	is.Equal(r.Get(TagOrdStatus), statusPartial)
+	is.Equal(r.Get(TagLeavesQty), "6")
+	is.Equal(r.Get(TagCumQty), "4")
+	is.Equal(r.Get(TagAvgPx), "10")
+
+	// the book rejects an order that bob can't pay for after it's new
+	bob.send(orderMessage(MsgNewOrderSingle, "b2", "1", "1000000000", "10.50"))
+	is.Equal(bob.expect(MsgExecutionReport).Get(TagExecType), execNew)
+	r = bob.expect(MsgExecutionReport)
+	is.Equal(r.Get(TagExecType), execRejected)
+	is.Equal(r.Get(TagLeavesQty), "0")
+	is.True(strings.Contains(r.Get(TagText), "insufficient"))
+
+	// alice replaces what's left and then cancels it
+	alice.send(orderMessage(MsgOrderCancelReplaceRequest, "a2", "2", "8", "10.10").Set(TagOrigClOrdID, "a1"))
+	r = alice.expect(MsgExecutionReport)
+	is.Equal(r.Get(TagExecType), execReplaced)
+	is.Equal(r.Get(TagOrigClOrdID), "a1")
+	is.Equal(r.Get(TagOrderID), "fix:alice:a1") // the OrderID doesn't change
+	is.Equal(r.Get(TagLeavesQty), "4")
+	is.Equal(r.Get(TagPrice), "10.10")
+	alice.send(orderMessage(MsgOrderCancelRequest, "a3", "2", "", "").Set(TagOrigClOrdID, "a2"))
+	r = alice.expect(MsgExecutionReport)
+	is.Equal(r.Get(TagExecType), execCanceled)
+	is.Equal(r.Get(TagLeavesQty), "0")
+	is.Equal(r.Get(TagCumQty), "4")
+	alice.send(orderMessage(MsgOrderCancelRequest, "a4", "2", "", "").Set(TagOrigClOrdID, "a3"))
+	r = alice.expect(MsgOrderCancelReject)
+	is.Equal(r.Get(TagOrdStatus), statusCanceled)
+
+	// a resend fills the gap of the logon and repeats the reports
+	alice.send(NewMessage(MsgResendRequest).SetInt(TagBeginSeqNo, 1).SetInt(TagEndSeqNo, 0))
+	r = alice.expect(MsgSequenceReset)
+	is.Equal(r.Get(TagMsgSeqNum), "1")
+	is.Equal(r.Get(TagNewSeqNo), "2")
+	for seq := 2; seq <= 8; seq++ {
+		r = alice.read()
+		is.Equal(r.Get(TagPossDupFlag), "Y")
+		is.True(r.Has(TagOrigSendingTime))
+		n, _ := r.Int(TagMsgSeqNum)
+		is.Equal(n, seq)
+	}
+
+	// a gap is asked for and filled
+	alice.seq += 5
+	alice.send(NewMessage(MsgHeartbeat))
+	r = alice.expect(MsgResendRequest)
+	is.Equal(r.Get(TagBeginSeqNo), "9")
+	alice.sendAt(NewMessage(MsgSequenceReset).Set(TagGapFillFlag, "Y").SetInt(TagNewSeqNo, alice.seq+1), 9)
+	alice.send(NewMessage(MsgTestRequest).Set(TagTestReqID, "ping"))
+	is.Equal(alice.expect(MsgHeartbeat).Get(TagTestReqID), "ping")
+
+	// a message that's out of sequence ends the session
+	alice.sendAt(NewMessage(MsgHeartbeat), 2)
+	alice.expect(MsgLogout)
+	alice.conn.Close()
+
+	// the session picks up where it left off after a restart
+	addr = startAcceptor(t, dir)
+	again := dial(t, addr, "alice", alice.seq)
+	r = again.expect(MsgLogon)
+	is.Equal(r.Get(TagMsgSeqNum), "12")
+	again.send(NewMessage(MsgResendRequest).SetInt(TagBeginSeqNo, 2).SetInt(TagEndSeqNo, 2))
+	r = again.expect(MsgExecutionReport)
+	is.Equal(r.Get(TagClOrdID), "a1")
+	is.Equal(r.Get(TagMsgSeqNum), "2")
+
+	// a logon that's behind is turned away
+	late := dial(t, addr, "bob", 0)
+	is.True(strings.Contains(late.expect(MsgLogout).Get(TagText), "too low"))
+}
+
+// startAcceptor serves an Acceptor for alice and bob in front of a book
+// and returns its address.
+func startAcceptor(t *testing.T, dir string) string {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	accts := accounts.NewAccountManager("")
+	for _, id := range []string{"alice", "bob"} {
+		if _, err := accts.Create(id, map[string]float64{"BTC": 1e6, accounts.USD: 1e9}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	in := make(chan *orderbook.Order)
+	cancels := make(chan orderbook.OpCancel)
+	out := make(chan *orderbook.Match)
+	rejects := make(chan orderbook.WriteResult)
+	market := orderbook.Market{Symbol: "BTC-USD", Base: "BTC", Quote: accounts.USD}
+	go orderbook.Run(ctx, market, accts, in, nil, cancels, nil, nil, out, nil, nil, nil, rejects)
+
+	cfg := Config{CompID: "GOLEM", Symbol: "BTC-USD", Dir: dir, Passwords: map[string]string{"alice": "alice-pw", "bob": "bob-pw"}}
+	a := NewAcceptor(cfg, accts, in, cancels)
+	go func() {
+		for {
+			select {
+			case m := <-out:
+				a.Match(*m)
+			case r := <-rejects:
+				a.Reject(r)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go a.Serve(l)
+	return l.Addr().String()
+}
+
+// testClient is a counterparty that logs on to an Acceptor.
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	r      *bufio.Reader
+	compID string
+	seq    int
+}
+
+// dial connects to an Acceptor and sends a Logon with the sequence number
+// after seq and the account's password.
+func dial(t *testing.T, addr, compID string, seq int) *testClient {
+	t.Helper()
+	return dialWith(t, addr, compID, seq, compID+"-pw")
+}
+
+// dialWith connects to an Acceptor and sends a Logon with the sequence
+// number after seq and a password.
+func dialWith(t *testing.T, addr, compID string, seq int, password string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &testClient{t: t, conn: conn, r: bufio.NewReader(conn), compID: compID, seq: seq}
+	c.send(NewMessage(MsgLogon).
+		Set(TagEncryptMethod, "0").
+		SetInt(TagHeartBtInt, 30).
+		Set(TagUsername, compID).
+		Set(TagPassword, password))
+	return c
+}
+
+// send sends a message with the client's next sequence number.
+func (c *testClient) send(m *Message) {
+	c.seq++
+	c.sendAt(m, c.seq)
+}
+
+// sendAt sends a message with a sequence number.
+func (c *testClient) sendAt(m *Message, seq int) {
+	c.t.Helper()
+	m.Set(TagSenderCompID, c.compID).
+		Set(TagTargetCompID, "GOLEM").
+		SetInt(TagMsgSeqNum, seq).
+		Set(TagSendingTime, time.Now().UTC().Format(timeFormat))
+	if _, err := c.conn.Write(m.Bytes()); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// read reads the next message.
+func (c *testClient) read() *Message {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	raw, err := ReadMessage(c.r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	m, err := Parse(raw)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return m
+}
+
+// expect reads the next message and checks its type.
+func (c *testClient) expect(msgType string) *Message {
+	c.t.Helper()
+	m := c.read()
+	if m.Type() != msgType {
+		c.t.Fatalf("expected MsgType %s, got %s", msgType, m)
+	}
+	return m
+}
+
+// orderMessage builds an order message for BTC-USD.
+func orderMessage(msgType, clOrdID, side, quantity, price string) *Message {
+	m := NewMessage(msgType).
+		Set(TagClOrdID, clOrdID).
+		Set(TagSymbol, "BTC-USD").
+		Set(TagSide, side).
+		Set(TagOrdType, "2")
+	if quantity != "" {
+		m.Set(TagOrderQty, quantity).Set(TagPrice, price)
+	}
+	return m
+}
+
+func TestSessionQueue(t *testing.T) {
+	is := is.New(t)
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	s := &session{compID: "alice", conn: conn, queue: make(chan []byte, 2), written: make(chan struct{})}
+
+	// writes are queued without waiting for the counterparty to read them
+	is.NoErr(s.write([]byte("1"), false))
+	is.NoErr(s.write([]byte("2"), false))
+	// and a counterparty that falls too far behind is disconnected
+	is.True(s.write([]byte("3"), false) != nil)
+	_, err := conn.Write([]byte("x"))
+	is.True(err != nil)
+
+	// what's queued is written out before the connection is taken off
+	conn, peer = net.Pipe()
+	defer peer.Close()
+	s = &session{compID: "alice", conn: conn, queue: make(chan []byte, 2), written: make(chan struct{})}
+	go writer(conn, s.queue, s.written)
+	is.NoErr(s.write([]byte("1"), false))
+	is.NoErr(s.write([]byte("2"), false))
+	read := make(chan string)
+	go func() {
+		b := make([]byte, 2)
+		n, _ := io.ReadFull(peer, b)
+		read <- string(b[:n])
+	}()
+	s.detach()
+	is.Equal(<-read, "12")
+	is.True(s.conn == nil)
+	is.NoErr(s.write([]byte("3"), false)) // nothing is queued once it's disconnected
+}
@@ -0,0 +1,299 @@
+// Package fix is a FIX 4.4 order entry gateway. Its Acceptor takes
+// sessions from counterparties over TCP and turns their orders, cancels
+// and replaces into operations on an orderbook, reporting back with
+// execution reports. Sessions keep their sequence numbers and every
+// message they're sent in a Store, so that they can be resent when a
+// counterparty misses them.
+package fix
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// BeginString is the version of FIX that the gateway speaks.
+const BeginString = "FIX.4.4"
+
+// soh separates the fields of a message.
+const soh = '\x01'
+
+// Tags of the fields that the gateway reads or writes.
+const (
+	TagAccount             = 1
+	TagAvgPx               = 6
+	TagBeginSeqNo          = 7
+	TagBeginString         = 8
+	TagBodyLength          = 9
+	TagCheckSum            = 10
+	TagClOrdID             = 11
+	TagCumQty              = 14
+	TagEndSeqNo            = 16
+	TagExecID              = 17
+	TagLastPx              = 31
+	TagLastQty             = 32
+	TagMsgSeqNum           = 34
+	TagMsgType             = 35
+	TagNewSeqNo            = 36
+	TagOrderID             = 37
+	TagOrderQty            = 38
+	TagOrdStatus           = 39
+	TagOrdType             = 40
+	TagOrigClOrdID         = 41
+	TagPossDupFlag         = 43
+	TagPrice               = 44
+	TagRefSeqNum           = 45
+	TagSenderCompID        = 49
+	TagSendingTime         = 52
+	TagSide                = 54
+	TagSymbol              = 55
+	TagTargetCompID        = 56
+	TagText                = 58
+	TagEncryptMethod       = 98
+	TagHeartBtInt          = 108
+	TagTestReqID           = 112
+	TagOrigSendingTime     = 122
+	TagGapFillFlag         = 123
+	TagResetSeqNumFlag     = 141
+	TagExecType            = 150
+	TagLeavesQty           = 151
+	TagRefMsgType          = 372
+	TagSessionRejectReason = 373
+	TagCxlRejResponseTo    = 434
+	TagUsername            = 553
+	TagPassword            = 554
+)
+
+// Types of message.
+const (
+	MsgHeartbeat                 = "0"
+	MsgTestRequest               = "1"
+	MsgResendRequest             = "2"
+	MsgReject                    = "3"
+	MsgSequenceReset             = "4"
+	MsgLogout                    = "5"
+	MsgExecutionReport           = "8"
+	MsgOrderCancelReject         = "9"
+	MsgLogon                     = "A"
+	MsgNewOrderSingle            = "D"
+	MsgOrderCancelRequest        = "F"
+	MsgOrderCancelReplaceRequest = "G"
+)
+
+// admin reports whether a type of message belongs to the session rather
+// than the application. Admin messages aren't resent; they're skipped
+// over with a gap fill instead.
+func admin(msgType string) bool {
+	switch msgType {
+	case MsgHeartbeat, MsgTestRequest, MsgResendRequest, MsgReject, MsgSequenceReset, MsgLogout, MsgLogon:
+		return true
+	}
+	return false
+}
+
+// field is a tag and its value.
+type field struct {
+	tag   int
+	value string
+}
+
+// Message is a FIX message. It holds every field but the BeginString,
+// BodyLength and CheckSum, which are worked out when it's encoded.
+type Message struct {
+	fields []field
+}
+
+// NewMessage returns an empty message of a type.
+func NewMessage(msgType string) *Message {
+	m := &Message{}
+	m.Set(TagMsgType, msgType)
+	return m
+}
+
+// Type returns the message's MsgType.
+func (m *Message) Type() string {
+	return m.Get(TagMsgType)
+}
+
+// Get returns the value of a field, or "" if the message doesn't have it.
+func (m *Message) Get(tag int) string {
+	for _, f := range m.fields {
+		if f.tag == tag {
+			return f.value
+		}
+	}
+	return ""
+}
+
+// Has reports whether the message has a field.
+func (m *Message) Has(tag int) bool {
+	for _, f := range m.fields {
+		if f.tag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Int returns the value of a field as an integer.
+func (m *Message) Int(tag int) (int, error) {
+	v := m.Get(tag)
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("tag %d must be an integer, got %q", tag, v)
+	}
+	return i, nil
+}
+
+// Set sets a field, replacing it if the message already has it.
+func (m *Message) Set(tag int, value string) *Message {
+	for i, f := range m.fields {
+		if f.tag == tag {
+			m.fields[i].value = value
+			return m
+		}
+	}
+	m.fields = append(m.fields, field{tag: tag, value: value})
+	return m
+}
+
+// SetInt sets a field to an integer.
+func (m *Message) SetInt(tag int, value int) *Message {
+	return m.Set(tag, strconv.Itoa(value))
+}
+
+// headerTags are the fields of the standard header that follow the
+// MsgType, in the order they're encoded.
+var headerTags = []int{TagSenderCompID, TagTargetCompID, TagMsgSeqNum, TagPossDupFlag, TagSendingTime, TagOrigSendingTime}
+
+// Bytes encodes the message. The standard header comes first and the rest
+// of the fields follow in the order they were set.
+func (m *Message) Bytes() []byte {
+	var body bytes.Buffer
+	header := map[int]bool{TagMsgType: true}
+	writeField(&body, TagMsgType, m.Type())
+	for _, tag := range headerTags {
+		header[tag] = true
+		if m.Has(tag) {
+			writeField(&body, tag, m.Get(tag))
+		}
+	}
+	for _, f := range m.fields {
+		if !header[f.tag] {
+			writeField(&body, f.tag, f.value)
+		}
+	}
+
+	var b bytes.Buffer
+	writeField(&b, TagBeginString, BeginString)
+	writeField(&b, TagBodyLength, strconv.Itoa(body.Len()))
+	b.Write(body.Bytes())
+	writeField(&b, TagCheckSum, fmt.Sprintf("%03d", checksum(b.Bytes())))
+	return b.Bytes()
+}
+
+// String returns the encoded message with its fields separated by | so
+// that it can be read in logs.
+func (m *Message) String() string {
+	return string(bytes.ReplaceAll(m.Bytes(), []byte{soh}, []byte{'|'}))
+}
+
+func writeField(b *bytes.Buffer, tag int, value string) {
+	b.WriteString(strconv.Itoa(tag))
+	b.WriteByte('=')
+	b.WriteString(value)
+	b.WriteByte(soh)
+}
+
+// checksum is the sum of a message's bytes up to its CheckSum, mod 256.
+func checksum(b []byte) int {
+	sum := 0
+	for _, c := range b {
+		sum += int(c)
+	}
+	return sum % 256
+}
+
+// Parse decodes a message, checking its BeginString, BodyLength and CheckSum.
+func Parse(b []byte) (*Message, error) {
+	raw := b
+	var fields []field
+	var bodyStart, trailer int
+	for pos := 0; pos < len(raw); {
+		end := bytes.IndexByte(raw[pos:], soh)
+		if end < 0 {
+			return nil, fmt.Errorf("field %q isn't terminated", raw[pos:])
+		}
+		f := raw[pos : pos+end]
+		eq := bytes.IndexByte(f, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("field %q has no tag", f)
+		}
+		tag, err := strconv.Atoi(string(f[:eq]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag %q", f[:eq])
+		}
+		fields = append(fields, field{tag: tag, value: string(f[eq+1:])})
+		if tag == TagBodyLength && len(fields) == 2 {
+			bodyStart = pos + end + 1
+		}
+		if tag == TagCheckSum {
+			trailer = pos
+		}
+		pos += end + 1
+	}
+
+	n := len(fields)
+	if n < 4 || fields[0].tag != TagBeginString || fields[1].tag != TagBodyLength ||
+		fields[2].tag != TagMsgType || fields[n-1].tag != TagCheckSum {
+		return nil, fmt.Errorf("message must start with tags 8, 9 and 35 and end with tag 10")
+	}
+	if fields[0].value != BeginString {
+		return nil, fmt.Errorf("unsupported BeginString %q", fields[0].value)
+	}
+	if length, err := strconv.Atoi(fields[1].value); err != nil || length != trailer-bodyStart {
+		return nil, fmt.Errorf("BodyLength %s doesn't match the body's %d bytes", fields[1].value, trailer-bodyStart)
+	}
+	if sum := fmt.Sprintf("%03d", checksum(raw[:trailer])); sum != fields[n-1].value {
+		return nil, fmt.Errorf("CheckSum %s doesn't match %s", fields[n-1].value, sum)
+	}
+	return &Message{fields: fields[2 : n-1]}, nil
+}
+
+// maxBodyLength caps the size of a message that ReadMessage will read.
+const maxBodyLength = 1 << 16
+
+// ReadMessage reads the next message off a stream without decoding it.
+func ReadMessage(r *bufio.Reader) ([]byte, error) {
+	begin, err := r.ReadBytes(soh)
+	if err != nil {
+		return nil, err
+	}
+	length, err := r.ReadBytes(soh)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(length, []byte("9=")) {
+		return nil, fmt.Errorf("expected BodyLength, got %q", length)
+	}
+	n, err := strconv.Atoi(string(length[2 : len(length)-1]))
+	if err != nil || n < 0 || n > maxBodyLength {
+		return nil, fmt.Errorf("invalid BodyLength %q", length)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	trailer, err := r.ReadBytes(soh)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, 0, len(begin)+len(length)+n+len(trailer))
+	msg = append(msg, begin...)
+	msg = append(msg, length...)
+	msg = append(msg, body...)
+	return append(msg, trailer...), nil
+}
@@ -0,0 +1,436 @@
+package fix
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// logonTimeout is how long a new connection has to log on.
+var logonTimeout = 10 * time.Second
+
+// writeWait is how long a write to a counterparty can take.
+var writeWait = 5 * time.Second
+
+// sendBuffer is how many messages can be queued for a counterparty.
+// Counterparties that fall further behind than that are disconnected,
+// and ask for what they missed once they log on again.
+var sendBuffer = 1024
+
+// timeFormat is the format of a UTCTimestamp.
+const timeFormat = "20060102-15:04:05.000"
+
+// session is the conversation between the gateway and one counterparty.
+// It outlives the counterparty's connections, so that whatever it's sent
+// while it's disconnected can be resent once it logs on again.
+type session struct {
+	sync.Mutex
+
+	// compID is the counterparty's CompID, which is the account that it
+	// trades for, and ourID is the gateway's.
+	compID string
+	ourID  string
+	store  Store
+
+	// conn is the counterparty's connection, if it's logged on, and queue
+	// holds the messages waiting to be written to it.
+	conn      net.Conn
+	queue     chan []byte
+	heartbeat time.Duration
+	lastSent  time.Time
+	lastRecv  time.Time
+	// written is closed once everything queued for conn is written.
+	written chan struct{}
+	// resending is set once the session has asked for messages it missed
+	// and is waiting for them.
+	resending bool
+}
+
+// header stamps a message with the session's standard header.
+func (s *session) header(m *Message, seq int) {
+	m.Set(TagSenderCompID, s.ourID).
+		Set(TagTargetCompID, s.compID).
+		SetInt(TagMsgSeqNum, seq).
+		Set(TagSendingTime, time.Now().UTC().Format(timeFormat))
+}
+
+// send sends a message with the session's next sequence number and saves
+// it. Messages that are sent while the counterparty is disconnected are
+// only saved, and they're resent when it asks for them.
+func (s *session) send(m *Message) error {
+	s.Lock()
+	defer s.Unlock()
+	seq := s.store.NextSenderSeq()
+	s.header(m, seq)
+	b := m.Bytes()
+	if err := s.store.Save(seq, b); err != nil {
+		return err
+	}
+	return s.write(b, false)
+}
+
+// write queues an encoded message for the counterparty if it's connected.
+// If its queue is full the counterparty is disconnected, unless wait is
+// set, in which case the message waits for room as long as a write could
+// take. The session must be locked by the caller.
+func (s *session) write(b []byte, wait bool) error {
+	if s.conn == nil {
+		return nil
+	}
+	select {
+	case s.queue <- b:
+		s.lastSent = time.Now()
+		return nil
+	default:
+	}
+	if wait {
+		t := time.NewTimer(writeWait)
+		defer t.Stop()
+		select {
+		case s.queue <- b:
+			s.lastSent = time.Now()
+			return nil
+		case <-t.C:
+		}
+	}
+	s.conn.Close()
+	return fmt.Errorf("%s fell too far behind", s.compID)
+}
+
+// writer writes what's queued for a connection until the queue is closed.
+// A connection that can't be written to is closed and the rest of the
+// queue is dropped.
+func writer(conn net.Conn, queue chan []byte, done chan struct{}) {
+	defer close(done)
+	failed := false
+	for b := range queue {
+		if failed {
+			continue
+		}
+		conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if _, err := conn.Write(b); err != nil {
+			conn.Close()
+			failed = true
+		}
+	}
+}
+
+// detach takes the session's connection off it once whatever's queued for
+// the connection, like a Logout, is written out.
+func (s *session) detach() {
+	s.Lock()
+	queue, written := s.queue, s.written
+	s.conn, s.queue, s.written = nil, nil, nil
+	s.Unlock()
+	if queue != nil {
+		close(queue)
+		<-written
+	}
+}
+
+// resend answers a ResendRequest. Application messages are resent as
+// possible duplicates with their original sending time and the session
+// messages between them are skipped over with gap fills.
+func (s *session) resend(begin, end int) error {
+	s.Lock()
+	defer s.Unlock()
+
+	next := s.store.NextSenderSeq()
+	if end == 0 || end >= next {
+		end = next - 1
+	}
+	msgs, err := s.store.Messages(begin, end)
+	if err != nil {
+		return err
+	}
+
+	gap := 0
+	fill := func(to int) error {
+		if gap == 0 {
+			return nil
+		}
+		m := NewMessage(MsgSequenceReset)
+		s.header(m, gap)
+		m.Set(TagPossDupFlag, "Y").Set(TagGapFillFlag, "Y").SetInt(TagNewSeqNo, to)
+		gap = 0
+		return s.write(m.Bytes(), true)
+	}
+	for seq := begin; seq <= end; seq++ {
+		raw, ok := msgs[seq]
+		var m *Message
+		if ok {
+			m, err = Parse(raw)
+		}
+		if !ok || err != nil || admin(m.Type()) {
+			if gap == 0 {
+				gap = seq
+			}
+			continue
+		}
+		if err := fill(seq); err != nil {
+			return err
+		}
+		m.Set(TagPossDupFlag, "Y").
+			Set(TagOrigSendingTime, m.Get(TagSendingTime)).
+			Set(TagSendingTime, time.Now().UTC().Format(timeFormat))
+		if err := s.write(m.Bytes(), true); err != nil {
+			return err
+		}
+	}
+	return fill(end + 1)
+}
+
+// handle serves a connection from logon to logout.
+func (a *Acceptor) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(logonTimeout))
+	raw, err := ReadMessage(r)
+	if err != nil {
+		return
+	}
+	m, err := Parse(raw)
+	if err != nil {
+		return
+	}
+	s, err := a.logon(conn, m)
+	if err != nil {
+		log.Printf("fix: rejected logon from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	defer s.detach()
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.keepalive(conn, done)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(3 * s.heartbeat))
+		raw, err := ReadMessage(r)
+		if err != nil {
+			return
+		}
+		s.Lock()
+		s.lastRecv = time.Now()
+		s.Unlock()
+
+		m, err := Parse(raw)
+		if err != nil {
+			// a garbled message is ignored without taking up its sequence number
+			log.Printf("fix: dropped message from %s: %v", s.compID, err)
+			continue
+		}
+		if !a.process(s, m) {
+			return
+		}
+	}
+}
+
+// keepalive sends a Heartbeat whenever the session has been quiet for a
+// heartbeat interval and a TestRequest once the counterparty has been
+// quiet for two. A counterparty that's quiet for three is disconnected
+// by the read deadline.
+func (s *session) keepalive(conn net.Conn, done chan struct{}) {
+	t := time.NewTicker(s.heartbeat / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-t.C:
+			s.Lock()
+			quiet, idle := now.Sub(s.lastSent), now.Sub(s.lastRecv)
+			s.Unlock()
+			switch {
+			case idle >= 2*s.heartbeat:
+				s.send(NewMessage(MsgTestRequest).Set(TagTestReqID, now.UTC().Format(timeFormat)))
+			case quiet >= s.heartbeat:
+				s.send(NewMessage(MsgHeartbeat))
+			}
+		}
+	}
+}
+
+// logon checks a Logon and attaches the connection to the counterparty's
+// session. The counterparty's SenderCompID names the account it trades
+// for, and its Username and Password have to match the account's. If the Logon's sequence number is higher than expected the
+// messages in between are asked for.
+func (a *Acceptor) logon(conn net.Conn, m *Message) (*session, error) {
+	reject := func(err error) (*session, error) {
+		out := NewMessage(MsgLogout).
+			Set(TagSenderCompID, a.cfg.CompID).
+			Set(TagTargetCompID, m.Get(TagSenderCompID)).
+			SetInt(TagMsgSeqNum, 1).
+			Set(TagSendingTime, time.Now().UTC().Format(timeFormat)).
+			Set(TagText, err.Error())
+		conn.SetWriteDeadline(time.Now().Add(writeWait))
+		conn.Write(out.Bytes())
+		return nil, err
+	}
+
+	if m.Type() != MsgLogon {
+		return reject(fmt.Errorf("expected a Logon, got MsgType %s", m.Type()))
+	}
+	if target := m.Get(TagTargetCompID); target != a.cfg.CompID {
+		return reject(fmt.Errorf("unknown TargetCompID %q", target))
+	}
+	sender := m.Get(TagSenderCompID)
+	if _, err := a.accounts.Get(sender); err != nil {
+		return reject(fmt.Errorf("unknown SenderCompID %q", sender))
+	}
+	password, ok := a.cfg.Passwords[sender]
+	if !ok || password == "" || m.Get(TagUsername) != sender ||
+		subtle.ConstantTimeCompare([]byte(m.Get(TagPassword)), []byte(password)) != 1 {
+		return reject(fmt.Errorf("invalid Username or Password"))
+	}
+	heartbeat, err := m.Int(TagHeartBtInt)
+	if err != nil || heartbeat <= 0 {
+		return reject(fmt.Errorf("HeartBtInt must be a positive number of seconds"))
+	}
+	seq, err := m.Int(TagMsgSeqNum)
+	if err != nil {
+		return reject(err)
+	}
+
+	s, err := a.session(sender)
+	if err != nil {
+		return reject(err)
+	}
+	s.Lock()
+	if s.conn != nil {
+		s.Unlock()
+		return reject(fmt.Errorf("%s is already logged on", sender))
+	}
+	reset := m.Get(TagResetSeqNumFlag) == "Y"
+	if reset {
+		if err := s.store.Reset(); err != nil {
+			s.Unlock()
+			return reject(err)
+		}
+	}
+	expected := s.store.NextTargetSeq()
+	if seq < expected {
+		s.Unlock()
+		return reject(fmt.Errorf("MsgSeqNum too low, expected %d but got %d", expected, seq))
+	}
+	s.conn = conn
+	s.queue = make(chan []byte, sendBuffer)
+	s.written = make(chan struct{})
+	go writer(conn, s.queue, s.written)
+	s.heartbeat = time.Duration(heartbeat) * time.Second
+	s.lastRecv = time.Now()
+	s.resending = seq > expected
+	s.Unlock()
+
+	reply := NewMessage(MsgLogon).Set(TagEncryptMethod, "0").SetInt(TagHeartBtInt, heartbeat)
+	if reset {
+		reply.Set(TagResetSeqNumFlag, "Y")
+	}
+	err = s.send(reply)
+	if err == nil && seq > expected {
+		err = s.send(NewMessage(MsgResendRequest).SetInt(TagBeginSeqNo, expected).SetInt(TagEndSeqNo, 0))
+	} else if err == nil {
+		err = s.store.SetNextTargetSeq(seq + 1)
+	}
+	if err != nil {
+		s.detach()
+		return nil, err
+	}
+	return s, nil
+}
+
+// process handles a message from a counterparty that's logged on. It
+// returns false once the session should be disconnected.
+func (a *Acceptor) process(s *session, m *Message) bool {
+	seq, err := m.Int(TagMsgSeqNum)
+	if err != nil {
+		s.send(NewMessage(MsgReject).Set(TagRefMsgType, m.Type()).Set(TagText, err.Error()))
+		return true
+	}
+
+	expected := s.store.NextTargetSeq()
+	if m.Type() == MsgSequenceReset {
+		// gap fills and resets both move the expected sequence number on,
+		// but never back
+		if next, err := m.Int(TagNewSeqNo); err == nil && next > expected {
+			s.store.SetNextTargetSeq(next)
+		}
+		return true
+	}
+
+	switch {
+	case seq < expected:
+		if m.Get(TagPossDupFlag) == "Y" {
+			return true
+		}
+		s.send(NewMessage(MsgLogout).Set(TagText, fmt.Sprintf("MsgSeqNum too low, expected %d but got %d", expected, seq)))
+		return false
+	case seq > expected:
+		// the message will be resent along with the ones before it, but a
+		// counterparty that's asking for messages or logging out is
+		// answered right away
+		s.Lock()
+		resending := s.resending
+		s.resending = true
+		s.Unlock()
+		if !resending {
+			s.send(NewMessage(MsgResendRequest).SetInt(TagBeginSeqNo, expected).SetInt(TagEndSeqNo, 0))
+		}
+		switch m.Type() {
+		case MsgResendRequest:
+			a.resend(s, m)
+		case MsgLogout:
+			s.send(NewMessage(MsgLogout))
+			return false
+		}
+		return true
+	}
+
+	s.Lock()
+	s.resending = false
+	s.Unlock()
+	if err := s.store.SetNextTargetSeq(seq + 1); err != nil {
+		log.Printf("fix: %v", err)
+	}
+
+	switch m.Type() {
+	case MsgHeartbeat, MsgReject:
+	case MsgTestRequest:
+		s.send(NewMessage(MsgHeartbeat).Set(TagTestReqID, m.Get(TagTestReqID)))
+	case MsgResendRequest:
+		a.resend(s, m)
+	case MsgLogout:
+		s.send(NewMessage(MsgLogout))
+		return false
+	case MsgNewOrderSingle:
+		a.newOrder(s, m)
+	case MsgOrderCancelRequest:
+		a.cancel(s, m)
+	case MsgOrderCancelReplaceRequest:
+		a.replace(s, m)
+	default:
+		s.send(NewMessage(MsgReject).
+			SetInt(TagRefSeqNum, seq).
+			Set(TagRefMsgType, m.Type()).
+			Set(TagText, fmt.Sprintf("unsupported MsgType %s", m.Type())))
+	}
+	return true
+}
+
+// resend answers a ResendRequest from a counterparty.
+func (a *Acceptor) resend(s *session, m *Message) {
+	begin, err := m.Int(TagBeginSeqNo)
+	if err != nil {
+		s.send(NewMessage(MsgReject).Set(TagRefMsgType, m.Type()).Set(TagText, err.Error()))
+		return
+	}
+	end, _ := m.Int(TagEndSeqNo)
+	if err := s.resend(begin, end); err != nil {
+		log.Printf("fix: failed to resend to %s: %v", s.compID, err)
+	}
+}
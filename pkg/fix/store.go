@@ -0,0 +1,208 @@
+package fix
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Store keeps a session's sequence numbers and the messages it was sent,
+// so that a session can pick up where it left off and resend what its
+// counterparty missed.
+type Store interface {
+	// NextSenderSeq is the sequence number of the next message sent.
+	NextSenderSeq() int
+	// NextTargetSeq is the sequence number expected of the next message
+	// received.
+	NextTargetSeq() int
+	SetNextTargetSeq(seq int) error
+	// Save saves a message that was sent with a sequence number, which
+	// makes the next sender sequence number the one after it.
+	Save(seq int, msg []byte) error
+	// Messages returns the messages sent from begin to end, inclusive, by
+	// sequence number.
+	Messages(begin, end int) (map[int][]byte, error)
+	// Reset forgets every message and starts both sequence numbers over
+	// at 1.
+	Reset() error
+}
+
+// MemoryStore is a Store that's lost when the process exits.
+type MemoryStore struct {
+	sync.Mutex
+
+	sender   int
+	target   int
+	messages map[int][]byte
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sender: 1, target: 1, messages: make(map[int][]byte)}
+}
+
+// NextSenderSeq implements Store.
+func (s *MemoryStore) NextSenderSeq() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.sender
+}
+
+// NextTargetSeq implements Store.
+func (s *MemoryStore) NextTargetSeq() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.target
+}
+
+// SetNextTargetSeq implements Store.
+func (s *MemoryStore) SetNextTargetSeq(seq int) error {
+	s.Lock()
+	defer s.Unlock()
+	s.target = seq
+	return nil
+}
+
+// Save implements Store.
+func (s *MemoryStore) Save(seq int, msg []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	s.messages[seq] = msg
+	s.sender = seq + 1
+	return nil
+}
+
+// Messages implements Store.
+func (s *MemoryStore) Messages(begin, end int) (map[int][]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	msgs := make(map[int][]byte)
+	for seq, msg := range s.messages {
+		if seq >= begin && seq <= end {
+			msgs[seq] = msg
+		}
+	}
+	return msgs, nil
+}
+
+// Reset implements Store.
+func (s *MemoryStore) Reset() error {
+	s.Lock()
+	defer s.Unlock()
+	s.sender, s.target = 1, 1
+	s.messages = make(map[int][]byte)
+	return nil
+}
+
+// FileStore is a Store that's kept in a directory so that it outlives the
+// process. A session's messages are appended to name.messages, one per
+// line, and its sequence numbers are kept in name.seqs.
+type FileStore struct {
+	*MemoryStore
+
+	seqs     string
+	messages *os.File
+}
+
+// NewFileStore opens the store called name in dir, creating it if it
+// doesn't exist yet.
+func NewFileStore(dir, name string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create store: %v", err)
+	}
+	s := &FileStore{
+		MemoryStore: NewMemoryStore(),
+		seqs:        filepath.Join(dir, name+".seqs"),
+	}
+
+	if b, err := os.ReadFile(s.seqs); err == nil {
+		if _, err := fmt.Sscanf(string(b), "%d %d", &s.sender, &s.target); err != nil {
+			return nil, fmt.Errorf("failed to read sequence numbers from %s: %v", s.seqs, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read sequence numbers: %v", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, name+".messages"), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open messages: %v", err)
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, maxBodyLength), 2*maxBodyLength)
+	for scanner.Scan() {
+		msg := []byte(scanner.Text())
+		m, err := Parse(msg)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to read message %q: %v", scanner.Text(), err)
+		}
+		seq, err := m.Int(TagMsgSeqNum)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		s.MemoryStore.messages[seq] = msg
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read messages: %v", err)
+	}
+	s.messages = f
+	return s, nil
+}
+
+// SetNextTargetSeq implements Store.
+func (s *FileStore) SetNextTargetSeq(seq int) error {
+	s.Lock()
+	defer s.Unlock()
+	s.target = seq
+	return s.writeSeqs()
+}
+
+// Save implements Store.
+func (s *FileStore) Save(seq int, msg []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	if strings.ContainsRune(string(msg), '\n') {
+		return fmt.Errorf("message %d can't be stored, it has a newline in it", seq)
+	}
+	if _, err := s.messages.Write(append(append([]byte{}, msg...), '\n')); err != nil {
+		return fmt.Errorf("failed to save message %d: %v", seq, err)
+	}
+	s.MemoryStore.messages[seq] = msg
+	s.sender = seq + 1
+	return s.writeSeqs()
+}
+
+// Reset implements Store.
+func (s *FileStore) Reset() error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.messages.Truncate(0); err != nil {
+		return fmt.Errorf("failed to reset messages: %v", err)
+	}
+	s.sender, s.target = 1, 1
+	s.MemoryStore.messages = make(map[int][]byte)
+	return s.writeSeqs()
+}
+
+// Close closes the store's files.
+func (s *FileStore) Close() error {
+	return s.messages.Close()
+}
+
+// writeSeqs saves the sequence numbers. The store must be locked by the
+// caller.
+func (s *FileStore) writeSeqs() error {
+	tmp := s.seqs + ".tmp"
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", s.sender, s.target)), 0o644); err != nil {
+		return fmt.Errorf("failed to save sequence numbers: %v", err)
+	}
+	if err := os.Rename(tmp, s.seqs); err != nil {
+		return fmt.Errorf("failed to save sequence numbers: %v", err)
+	}
+	return nil
+}
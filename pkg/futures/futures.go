@@ -0,0 +1,230 @@
+// Package futures runs dated futures markets on top of an orderbook.
+//
+// A futures market trades a contract asset, like BTC-DEC, that expires at
+// a set time. Its orderbook.Market carries the expiry, so the book stops
+// taking orders and cancels the ones that are left when it passes. After
+// that every open position is cash settled at a final price, which comes
+// from an admin or from an index source: longs hand their contracts back
+// to the exchange and are paid their value, and shorts are handed the
+// contracts they owe and pay for them. Until then the engine publishes
+// the market's open interest.
+package futures
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dylanlott/orderbook/pkg/accounts"
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+)
+
+// State is where a futures market is in its life.
+type State string
+
+const (
+	// Trading markets take orders.
+	Trading State = "trading"
+	// Expired markets have stopped trading but haven't settled yet.
+	Expired State = "expired"
+	// Settled markets have paid out every position.
+	Settled State = "settled"
+)
+
+// Index is a source of the price that a contract settles at.
+type Index interface {
+	Price() (float64, error)
+}
+
+// OpenInterest is the number of contracts held open in a market at a time.
+type OpenInterest struct {
+	Symbol    string    `json:"symbol"`
+	Time      time.Time `json:"time"`
+	Contracts float64   `json:"contracts"`
+}
+
+// Settlement is the final settlement of a market.
+type Settlement struct {
+	Symbol string    `json:"symbol"`
+	Time   time.Time `json:"time"`
+	Price  float64   `json:"price"`
+	// Positions is what each account was paid for its position, negative
+	// for what it paid.
+	Positions []Position `json:"positions"`
+}
+
+// Position is an account's position at settlement and what it was paid.
+type Position struct {
+	Account  string  `json:"account"`
+	Quantity float64 `json:"quantity"`
+	Amount   float64 `json:"amount"`
+}
+
+// Engine expires and settles a futures market.
+type Engine struct {
+	sync.RWMutex
+
+	market     orderbook.Market
+	accts      accounts.AccountManager
+	cancels    chan orderbook.OpCancel
+	settlement *Settlement
+}
+
+// NewEngine returns an Engine for a futures market that's run by
+// orderbook.Start or orderbook.Run with the given cancel channel. The
+// market must have an expiry.
+func NewEngine(accts accounts.AccountManager, market orderbook.Market, cancels chan orderbook.OpCancel) (*Engine, error) {
+	if market.Expiry.IsZero() {
+		return nil, fmt.Errorf("%s has no expiry", market.Symbol)
+	}
+	return &Engine{
+		market:  market,
+		accts:   accts,
+		cancels: cancels,
+	}, nil
+}
+
+// State returns the market's state at now.
+func (e *Engine) State(now time.Time) State {
+	e.RLock()
+	defer e.RUnlock()
+	switch {
+	case e.settlement != nil:
+		return Settled
+	case e.market.Expired(now):
+		return Expired
+	default:
+		return Trading
+	}
+}
+
+// OpenInterest returns the number of contracts that are held long, which
+// is the same as the number held short.
+func (e *Engine) OpenInterest() OpenInterest {
+	oi := OpenInterest{Symbol: e.market.Symbol, Time: time.Now()}
+	for id, balance := range e.accts.Ledger().Holders(e.market.Base) {
+		if !accounts.IsSystem(id) && balance > 0 {
+			oi.Contracts += balance
+		}
+	}
+	return oi
+}
+
+// Settlement returns the market's settlement once it's settled.
+func (e *Engine) Settlement() (Settlement, bool) {
+	e.RLock()
+	defer e.RUnlock()
+	if e.settlement == nil {
+		return Settlement{}, false
+	}
+	return *e.settlement, true
+}
+
+// Run publishes open interest every interval until the market expires and
+// then settles it at the index price, retrying every interval until it
+// succeeds or ctx is done. With a nil index the market waits for an admin
+// to call Settle instead.
+func (e *Engine) Run(ctx context.Context, interval time.Duration, index Index, interest chan OpenInterest, settlements chan Settlement, errs chan error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			switch e.State(now) {
+			case Settled:
+				return
+			case Trading:
+				interest <- e.OpenInterest()
+				continue
+			}
+			if index == nil {
+				continue
+			}
+			price, err := index.Price()
+			if err != nil {
+				errs <- fmt.Errorf("failed to get %s settlement price: %v", e.market.Symbol, err)
+				continue
+			}
+			s, err := e.Settle(price)
+			if err != nil {
+				errs <- err
+				continue
+			}
+			settlements <- s
+			return
+		}
+	}
+}
+
+// Settle cancels whatever is left in the expired market's book and
+// settles every open position at price, in the quote asset. The whole
+// settlement is posted to the ledger as one settlement entry.
+func (e *Engine) Settle(price float64) (Settlement, error) {
+	e.Lock()
+	defer e.Unlock()
+
+	now := time.Now()
+	switch {
+	case e.settlement != nil:
+		return Settlement{}, fmt.Errorf("%s is already settled", e.market.Symbol)
+	case !e.market.Expired(now):
+		return Settlement{}, fmt.Errorf("%s doesn't expire until %v", e.market.Symbol, e.market.Expiry)
+	case price <= 0:
+		return Settlement{}, fmt.Errorf("invalid %s settlement price %v", e.market.Symbol, price)
+	}
+
+	// the book cancels everything itself at expiry, but positions can't
+	// settle while any of them are still held by an order
+	result := make(chan orderbook.CancelResult)
+	e.cancels <- orderbook.OpCancel{Result: result}
+	if r := <-result; r.Err != nil {
+		return Settlement{}, fmt.Errorf("failed to cancel %s orders: %v", e.market.Symbol, r.Err)
+	}
+
+	s := Settlement{
+		Symbol:    e.market.Symbol,
+		Time:      now,
+		Price:     price,
+		Positions: []Position{},
+	}
+	var accts []string
+	holders := e.accts.Ledger().Holders(e.market.Base)
+	for id := range holders {
+		if !accounts.IsSystem(id) {
+			accts = append(accts, id)
+		}
+	}
+	sort.Strings(accts)
+
+	memo := fmt.Sprintf("%s settlement at %v", s.Symbol, price)
+	var transfers []accounts.Transfer
+	for _, id := range accts {
+		quantity := holders[id]
+		amount := quantity * price
+		s.Positions = append(s.Positions, Position{Account: id, Quantity: quantity, Amount: amount})
+		contracts := accounts.Transfer{From: id, To: accounts.SettlementAccount, Asset: e.market.Base, Amount: quantity}
+		value := accounts.Transfer{From: accounts.SettlementAccount, To: id, Asset: e.market.Quote, Amount: amount}
+		if quantity < 0 {
+			contracts.From, contracts.To, contracts.Amount = accounts.SettlementAccount, id, -quantity
+			value.From, value.To, value.Amount = id, accounts.SettlementAccount, -amount
+			value.Overdraw = true
+		}
+		for _, t := range []accounts.Transfer{contracts, value} {
+			t.Kind, t.Memo = accounts.KindSettlement, memo
+			transfers = append(transfers, t)
+		}
+	}
+	if len(transfers) > 0 {
+		if _, err := e.accts.Exchange(transfers...); err != nil {
+			return Settlement{}, fmt.Errorf("failed to settle %s: %v", s.Symbol, err)
+		}
+	}
+
+	e.settlement = &s
+	return s, nil
+}
@@ -0,0 +1,83 @@
+package futures
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dylanlott/orderbook/pkg/accounts"
+	"github.com/dylanlott/orderbook/pkg/margin"
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+	"github.com/matryer/is"
+)
+
+func TestSettle(t *testing.T) {
+	is := is.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	market := orderbook.Market{Symbol: "BTC-DEC", Base: "BTC-DEC", Quote: accounts.USD, Expiry: time.Now().Add(200 * time.Millisecond)}
+	_, err := NewEngine(nil, orderbook.Market{Symbol: "BTC-PERP"}, nil)
+	is.True(err != nil) // no expiry
+
+	acc := accounts.NewAccountManager("")
+	for _, id := range []string{"long", "short"} {
+		_, err := acc.Create(id, map[string]float64{accounts.USD: 1000})
+		is.NoErr(err)
+	}
+	lender := margin.NewEngine(acc, margin.Config{Quote: accounts.USD, MaxLeverage: 5, Maintenance: 0.05})
+	lender.SetMark(market.Base, 100)
+	is.NoErr(lender.Enable("short", 5))
+
+	writes := make(chan orderbook.OpWrite)
+	cancels := make(chan orderbook.OpCancel)
+	fills := make(chan orderbook.FillResult, 100)
+	errs := make(chan error, 100)
+	go orderbook.Start(ctx, market, acc, writes, cancels, nil, fills, nil, errs)
+
+	engine, err := NewEngine(acc, market, cancels)
+	is.NoErr(err)
+
+	// short sells 2 contracts to long and leaves another in the book
+	is.NoErr(write(writes, orderbook.Order{ID: "s1", AccountID: "short", Side: "sell", Price: 10000, Open: 3}).Err)
+	is.NoErr(write(writes, orderbook.Order{ID: "l1", AccountID: "long", Side: "buy", Price: 10000, Open: 2}).Err)
+	is.Equal(engine.OpenInterest().Contracts, float64(2))
+	is.Equal(engine.State(time.Now()), Trading)
+	_, err = engine.Settle(110)
+	is.True(err != nil) // not expired yet
+
+	// the market stops taking orders at expiry
+	time.Sleep(time.Until(market.Expiry))
+	is.Equal(engine.State(time.Now()), Expired)
+	is.True(write(writes, orderbook.Order{ID: "l2", AccountID: "long", Side: "buy", Price: 10000, Open: 1}).Err != nil)
+
+	s, err := engine.Settle(110)
+	is.NoErr(err)
+	is.Equal(s.Positions, []Position{
+		{Account: "long", Quantity: 2, Amount: 220},
+		{Account: "short", Quantity: -2, Amount: -220},
+	})
+	is.Equal(engine.State(time.Now()), Settled)
+	is.Equal(engine.OpenInterest().Contracts, float64(0))
+	_, err = engine.Settle(110)
+	is.True(err != nil) // already settled
+
+	// positions are closed at the final price and the resting order is gone
+	ledger := acc.Ledger()
+	is.Equal(ledger.Balance("long", market.Base), float64(0))
+	is.Equal(ledger.Balance("short", market.Base), float64(0))
+	is.Equal(ledger.Balance("long", accounts.USD), float64(1020))
+	is.Equal(ledger.Balance("short", accounts.USD), float64(980))
+	is.Equal(ledger.Balance(accounts.SettlementAccount, accounts.USD), float64(0))
+	entries := ledger.Entries()
+	is.Equal(entries[len(entries)-1].Kind, accounts.KindSettlement)
+	result := make(chan orderbook.CancelResult)
+	cancels <- orderbook.OpCancel{Result: result}
+	is.Equal(len((<-result).Orders), 0)
+}
+
+func write(writes chan orderbook.OpWrite, o orderbook.Order) orderbook.WriteResult {
+	result := make(chan orderbook.WriteResult)
+	writes <- orderbook.OpWrite{Order: o, Result: result}
+	return <-result
+}
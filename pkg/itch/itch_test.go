@@ -0,0 +1,100 @@
+package itch
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+	"github.com/matryer/is"
+)
+
+func TestPublisher(t *testing.T) {
+	is := is.New(t)
+	feed, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	is.NoErr(err)
+	defer feed.Close()
+
+	p, err := NewPublisher(Config{
+		Session:   "GOLEM",
+		Symbol:    "BTC-USD",
+		Addrs:     []string{feed.LocalAddr().String()},
+		MaxPacket: 100,
+		Retain:    3,
+	})
+	is.NoErr(err)
+	defer p.Close()
+
+	read := func() Packet {
+		t.Helper()
+		b := make([]byte, 1500)
+		feed.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := feed.Read(b)
+		is.NoErr(err)
+		pkt, err := ParsePacket(b[:n])
+		is.NoErr(err)
+		is.Equal(pkt.Session, "GOLEM")
+		return pkt
+	}
+
+	p.Delta(orderbook.LevelDelta{Seq: 7, Side: "buy", Price: 1000, Quantity: 10, Orders: 2})
+	pkt := read()
+	is.Equal(pkt.Sequence, uint64(1))
+	is.Equal(len(pkt.Messages), 1)
+	level := pkt.Messages[0].(*Level)
+	is.Equal(level.Symbol.String(), "BTC-USD")
+	is.Equal(level.Seq, uint64(7))
+	is.Equal(level.Side, Buy)
+	is.Equal(level.Quantity, uint64(10))
+	is.Equal(level.Orders, uint32(2))
+
+	p.Match(orderbook.Match{Price: 1000, Quantity: 4, Time: time.Unix(0, 42)})
+	pkt = read()
+	is.Equal(pkt.Sequence, uint64(2))
+	trade := pkt.Messages[0].(*Trade)
+	is.Equal(trade.Timestamp, uint64(42))
+	is.Equal(trade.Match, uint64(1))
+	is.Equal(trade.Quantity, uint64(4))
+
+	// messages that don't fit in one packet are split across two
+	p.Event(orderbook.OrderEvent{Symbol: "BTC-USD", Kind: orderbook.EventAdd, Ref: 1, Side: "sell", Price: 1010, Quantity: 3})
+	pkt = read()
+	is.Equal(pkt.Sequence, uint64(3))
+	is.Equal(pkt.Messages[0].(*AddOrder).Side, Sell)
+	p.Publish(&CancelOrder{Ref: 1, Quantity: 1}, &CancelOrder{Ref: 1, Quantity: 1}, &OrderExecuted{Ref: 1, Quantity: 1})
+	first, second := read(), read()
+	is.Equal(first.Sequence, uint64(4))
+	is.Equal(second.Sequence, first.Sequence+uint64(len(first.Messages)))
+	is.Equal(len(first.Messages)+len(second.Messages), 3)
+
+	p.Heartbeat()
+	pkt = read()
+	is.Equal(pkt.Sequence, uint64(7))
+	is.Equal(len(pkt.Messages), 0)
+
+	// only the last three messages are kept for retransmission
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoErr(err)
+	defer l.Close()
+	go p.Serve(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	is.NoErr(err)
+	defer conn.Close()
+
+	pkt, err = Retransmit(conn, "GOLEM", 1, 10)
+	is.NoErr(err)
+	is.Equal(pkt.Sequence, uint64(4))
+	is.Equal(len(pkt.Messages), 2) // as many as fit in a packet
+	pkt, err = Retransmit(conn, "GOLEM", 6, 10)
+	is.NoErr(err)
+	is.Equal(pkt.Sequence, uint64(6))
+	is.Equal(len(pkt.Messages), 1)
+	is.Equal(*pkt.Messages[0].(*OrderExecuted), OrderExecuted{Ref: 1, Quantity: 1})
+	pkt, err = Retransmit(conn, "GOLEM", 9, 1)
+	is.NoErr(err)
+	is.Equal(pkt.Sequence, uint64(7))
+	is.Equal(len(pkt.Messages), 0)
+
+	_, err = Retransmit(conn, "OTHER", 1, 1)
+	is.True(err != nil)
+}
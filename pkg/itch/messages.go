@@ -0,0 +1,268 @@
+// Package itch publishes a book's market data as a binary feed in the
+// style of ITCH, over UDP to as many local consumers as are listening.
+//
+// Messages are numbered from 1 and sent in packets in the style of
+// MoldUDP64. Every packet carries the session name, the sequence number
+// of its first message and how many messages it holds, so a consumer can
+// tell when it's missed some. Missed messages can be asked for again
+// from the publisher's TCP retransmission service, which keeps the most
+// recent ones.
+package itch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+)
+
+// Types of message.
+const (
+	TypeTrade         byte = 'P'
+	TypeLevel         byte = 'L'
+	TypeAddOrder      byte = 'A'
+	TypeModifyOrder   byte = 'U'
+	TypeCancelOrder   byte = 'X'
+	TypeOrderExecuted byte = 'E'
+)
+
+// Sides of the book.
+const (
+	Buy  byte = 'B'
+	Sell byte = 'S'
+)
+
+// Symbol names a market, padded with spaces.
+type Symbol [8]byte
+
+// NewSymbol returns a symbol padded with spaces. Symbols longer than
+// eight bytes are cut short.
+func NewSymbol(s string) Symbol {
+	var sym Symbol
+	n := copy(sym[:], s)
+	for i := n; i < len(sym); i++ {
+		sym[i] = ' '
+	}
+	return sym
+}
+
+func (s Symbol) String() string { return strings.TrimRight(string(s[:]), " ") }
+
+// Message is a message of the feed. Timestamps are nanoseconds since the
+// Unix epoch and prices are in hundredths, like the book's.
+type Message interface {
+	Type() byte
+}
+
+// Trade is a match in the book.
+type Trade struct {
+	Timestamp uint64
+	Symbol    Symbol
+	Quantity  uint64
+	Price     uint64
+	Match     uint64
+}
+
+// Level is the new state of a price level, from the book's level deltas.
+// A level with no orders left has been removed. Seq is the delta's
+// sequence number.
+type Level struct {
+	Timestamp uint64
+	Symbol    Symbol
+	Seq       uint64
+	Side      byte
+	Price     uint64
+	Quantity  uint64
+	Orders    uint32
+}
+
+// AddOrder is an order that started resting in the book, from its
+// market-by-order feed.
+type AddOrder struct {
+	Timestamp uint64
+	Symbol    Symbol
+	Ref       uint64
+	Side      byte
+	Price     uint64
+	Quantity  uint64
+}
+
+// ModifyOrder is a resting order whose price or quantity changed.
+// Quantity is what's left of it.
+type ModifyOrder struct {
+	Timestamp uint64
+	Symbol    Symbol
+	Ref       uint64
+	Price     uint64
+	Quantity  uint64
+}
+
+// CancelOrder is quantity taken out of the book without being filled.
+type CancelOrder struct {
+	Timestamp uint64
+	Symbol    Symbol
+	Ref       uint64
+	Quantity  uint64
+}
+
+// OrderExecuted is quantity of a resting order that was filled.
+type OrderExecuted struct {
+	Timestamp uint64
+	Symbol    Symbol
+	Ref       uint64
+	Quantity  uint64
+}
+
+func (Trade) Type() byte         { return TypeTrade }
+func (Level) Type() byte         { return TypeLevel }
+func (AddOrder) Type() byte      { return TypeAddOrder }
+func (ModifyOrder) Type() byte   { return TypeModifyOrder }
+func (CancelOrder) Type() byte   { return TypeCancelOrder }
+func (OrderExecuted) Type() byte { return TypeOrderExecuted }
+
+// empty returns an empty message of a type.
+func empty(t byte) (Message, error) {
+	switch t {
+	case TypeTrade:
+		return &Trade{}, nil
+	case TypeLevel:
+		return &Level{}, nil
+	case TypeAddOrder:
+		return &AddOrder{}, nil
+	case TypeModifyOrder:
+		return &ModifyOrder{}, nil
+	case TypeCancelOrder:
+		return &CancelOrder{}, nil
+	case TypeOrderExecuted:
+		return &OrderExecuted{}, nil
+	}
+	return nil, fmt.Errorf("unknown message type %q", t)
+}
+
+// encode encodes a message as its type followed by its fields.
+func encode(m Message) []byte {
+	var b bytes.Buffer
+	b.WriteByte(m.Type())
+	binary.Write(&b, binary.BigEndian, m)
+	return b.Bytes()
+}
+
+// decode decodes a message that was encoded with encode.
+func decode(b []byte) (Message, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty message")
+	}
+	m, err := empty(b[0])
+	if err != nil {
+		return nil, err
+	}
+	if size := binary.Size(m); size != len(b)-1 {
+		return nil, fmt.Errorf("message %q must be %d bytes, got %d", b[0], size, len(b)-1)
+	}
+	if err := binary.Read(bytes.NewReader(b[1:]), binary.BigEndian, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// side returns the feed's side of a side of the book.
+func side(s string) byte {
+	if s == "buy" {
+		return Buy
+	}
+	return Sell
+}
+
+// FromEvent returns the message for an event of a book's market-by-order
+// feed.
+func FromEvent(e orderbook.OrderEvent) (Message, error) {
+	ts, symbol := uint64(e.Time.UnixNano()), NewSymbol(e.Symbol)
+	switch e.Kind {
+	case orderbook.EventAdd:
+		return &AddOrder{Timestamp: ts, Symbol: symbol, Ref: e.Ref, Side: side(e.Side), Price: e.Price, Quantity: e.Quantity}, nil
+	case orderbook.EventModify:
+		return &ModifyOrder{Timestamp: ts, Symbol: symbol, Ref: e.Ref, Price: e.Price, Quantity: e.Quantity}, nil
+	case orderbook.EventCancel:
+		return &CancelOrder{Timestamp: ts, Symbol: symbol, Ref: e.Ref, Quantity: e.Quantity}, nil
+	case orderbook.EventExecute:
+		return &OrderExecuted{Timestamp: ts, Symbol: symbol, Ref: e.Ref, Quantity: e.Quantity}, nil
+	}
+	return nil, fmt.Errorf("unknown event kind %q", e.Kind)
+}
+
+// Packet is a packet of the feed. Sequence is the sequence number of its
+// first message, or of the next message to be published if it's empty.
+type Packet struct {
+	Session  string
+	Sequence uint64
+	Messages []Message
+}
+
+// packetHeader is the fixed part of a packet. Each of its messages
+// follows with a two byte length in front of it.
+type packetHeader struct {
+	Session  [10]byte
+	Sequence uint64
+	Count    uint16
+}
+
+// headerSize is the size of a packet's header.
+var headerSize = binary.Size(packetHeader{})
+
+// session pads a session name to the size of a packet's session.
+func session(name string) [10]byte {
+	var s [10]byte
+	n := copy(s[:], name)
+	for i := n; i < len(s); i++ {
+		s[i] = ' '
+	}
+	return s
+}
+
+// packet encodes a packet of encoded messages.
+func packet(name [10]byte, seq uint64, msgs [][]byte) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, packetHeader{Session: name, Sequence: seq, Count: uint16(len(msgs))})
+	for _, m := range msgs {
+		binary.Write(&b, binary.BigEndian, uint16(len(m)))
+		b.Write(m)
+	}
+	return b.Bytes()
+}
+
+// ParsePacket decodes a packet.
+func ParsePacket(b []byte) (Packet, error) {
+	r := bytes.NewReader(b)
+	var h packetHeader
+	if err := binary.Read(r, binary.BigEndian, &h); err != nil {
+		return Packet{}, fmt.Errorf("failed to read packet header: %v", err)
+	}
+	p := Packet{Session: strings.TrimRight(string(h.Session[:]), " "), Sequence: h.Sequence}
+	for i := 0; i < int(h.Count); i++ {
+		var n uint16
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			return Packet{}, fmt.Errorf("failed to read message %d: %v", h.Sequence+uint64(i), err)
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return Packet{}, fmt.Errorf("failed to read message %d: %v", h.Sequence+uint64(i), err)
+		}
+		m, err := decode(msg)
+		if err != nil {
+			return Packet{}, err
+		}
+		p.Messages = append(p.Messages, m)
+	}
+	if r.Len() > 0 {
+		return Packet{}, fmt.Errorf("packet has %d bytes after its messages", r.Len())
+	}
+	return p, nil
+}
+
+func now() uint64 {
+	return uint64(time.Now().UnixNano())
+}
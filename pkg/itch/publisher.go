@@ -0,0 +1,307 @@
+package itch
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+)
+
+// writeWait is how long a write to a retransmission client can take.
+var writeWait = 5 * time.Second
+
+// Config configures a Publisher.
+type Config struct {
+	// Session names the feed in every packet. Only its first ten bytes
+	// are sent.
+	Session string
+	// Symbol is the market that the publisher's levels and trades are for.
+	Symbol string
+	// Addrs are the UDP addresses that packets are sent to. They can be
+	// multicast groups or unicast addresses.
+	Addrs []string
+	// MaxPacket is the most bytes that a packet can be. It defaults to
+	// 1400, to fit in an Ethernet frame.
+	MaxPacket int
+	// Retain is how many of the latest messages are kept for
+	// retransmission. It defaults to 100000.
+	Retain int
+}
+
+// Publisher publishes a book's messages to a set of UDP addresses, and
+// retransmits the ones it's kept to consumers that missed them.
+type Publisher struct {
+	sync.Mutex
+
+	session [10]byte
+	symbol  Symbol
+	max     int
+	retain  int
+	conns   []*net.UDPConn
+
+	// next is the sequence number of the next message to be published.
+	next uint64
+	// retained holds the encoded messages before next, up to retain of
+	// them.
+	retained [][]byte
+	matches  uint64
+}
+
+// NewPublisher returns a Publisher that sends to the configured addresses.
+func NewPublisher(cfg Config) (*Publisher, error) {
+	if cfg.MaxPacket == 0 {
+		cfg.MaxPacket = 1400
+	}
+	if cfg.Retain == 0 {
+		cfg.Retain = 100000
+	}
+	p := &Publisher{
+		session: session(cfg.Session),
+		symbol:  NewSymbol(cfg.Symbol),
+		max:     cfg.MaxPacket,
+		retain:  cfg.Retain,
+		next:    1,
+	}
+	for _, addr := range cfg.Addrs {
+		udp, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("failed to resolve %s: %v", addr, err)
+		}
+		conn, err := net.DialUDP("udp", nil, udp)
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("failed to dial %s: %v", addr, err)
+		}
+		p.conns = append(p.conns, conn)
+	}
+	return p, nil
+}
+
+// Close stops sending packets.
+func (p *Publisher) Close() error {
+	p.Lock()
+	defer p.Unlock()
+	for _, c := range p.conns {
+		c.Close()
+	}
+	p.conns = nil
+	return nil
+}
+
+// Delta publishes a change to a price level of the book.
+func (p *Publisher) Delta(d orderbook.LevelDelta) {
+	p.Publish(&Level{
+		Timestamp: now(),
+		Symbol:    p.symbol,
+		Seq:       d.Seq,
+		Side:      side(d.Side),
+		Price:     d.Price,
+		Quantity:  d.Quantity,
+		Orders:    uint32(d.Orders),
+	})
+}
+
+// Match publishes a trade. Matches are numbered in the order they're
+// published.
+func (p *Publisher) Match(m orderbook.Match) {
+	p.Lock()
+	defer p.Unlock()
+	p.matches++
+	p.publish(&Trade{
+		Timestamp: uint64(m.Time.UnixNano()),
+		Symbol:    p.symbol,
+		Quantity:  m.Quantity,
+		Price:     m.Price,
+		Match:     p.matches,
+	})
+}
+
+// Event publishes an event of a book's market-by-order feed.
+func (p *Publisher) Event(e orderbook.OrderEvent) {
+	m, err := FromEvent(e)
+	if err != nil {
+		log.Printf("itch: %v", err)
+		return
+	}
+	p.Publish(m)
+}
+
+// Publish gives messages the next sequence numbers and sends them in as
+// few packets as they fit in.
+func (p *Publisher) Publish(msgs ...Message) {
+	p.Lock()
+	defer p.Unlock()
+	p.publish(msgs...)
+}
+
+// publish publishes messages. The publisher must be locked by the caller.
+func (p *Publisher) publish(msgs ...Message) {
+	var batch [][]byte
+	seq, size := p.next, headerSize
+	for _, m := range msgs {
+		b := encode(m)
+		if len(batch) > 0 && size+2+len(b) > p.max {
+			p.send(packet(p.session, seq, batch))
+			seq += uint64(len(batch))
+			batch, size = nil, headerSize
+		}
+		batch = append(batch, b)
+		size += 2 + len(b)
+		p.keep(b)
+	}
+	if len(batch) > 0 {
+		p.send(packet(p.session, seq, batch))
+	}
+}
+
+// Heartbeat sends an empty packet with the next sequence number, so that
+// consumers can tell they've missed messages even when the book is quiet.
+func (p *Publisher) Heartbeat() {
+	p.Lock()
+	defer p.Unlock()
+	p.send(packet(p.session, p.next, nil))
+}
+
+// Heartbeats sends a heartbeat every interval until ctx is done.
+func (p *Publisher) Heartbeats(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			p.Heartbeat()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// keep numbers a message and keeps it for retransmission. The publisher
+// must be locked by the caller.
+func (p *Publisher) keep(b []byte) {
+	p.next++
+	p.retained = append(p.retained, b)
+	if len(p.retained) > p.retain {
+		p.retained = p.retained[len(p.retained)-p.retain:]
+	}
+}
+
+// send sends a packet to every address. Consumers that aren't listening
+// are the consumers' problem, so errors are only logged. The publisher
+// must be locked by the caller.
+func (p *Publisher) send(b []byte) {
+	for _, c := range p.conns {
+		if _, err := c.Write(b); err != nil {
+			log.Printf("itch: failed to send to %s: %v", c.RemoteAddr(), err)
+		}
+	}
+}
+
+// request asks for Count messages from Sequence on.
+type request struct {
+	Session  [10]byte
+	Sequence uint64
+	Count    uint16
+}
+
+// ListenAndServe serves retransmission requests on a TCP address.
+func (p *Publisher) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for retransmission: %v", err)
+	}
+	return p.Serve(l)
+}
+
+// Serve serves retransmission requests on a listener until it's closed.
+// A client can make any number of requests on a connection, and each is
+// answered with a single packet, framed by a two byte length.
+func (p *Publisher) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go p.handle(c)
+	}
+}
+
+// handle answers a client's requests until it hangs up or asks for
+// another session.
+func (p *Publisher) handle(c net.Conn) {
+	defer c.Close()
+	for {
+		var req request
+		if err := binary.Read(c, binary.BigEndian, &req); err != nil {
+			return
+		}
+		if req.Session != p.session {
+			log.Printf("itch: %s asked for session %q", c.RemoteAddr(), req.Session[:])
+			return
+		}
+		b := p.retransmit(req.Sequence, req.Count)
+		c.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := binary.Write(c, binary.BigEndian, uint16(len(b))); err != nil {
+			return
+		}
+		if _, err := c.Write(b); err != nil {
+			return
+		}
+	}
+}
+
+// retransmit returns a packet of as many of the requested messages as fit
+// in one. Messages that are no longer kept are skipped, so the packet
+// starts at the first one that is. A packet with no messages has the
+// sequence number of where they'd have started.
+func (p *Publisher) retransmit(seq uint64, count uint16) []byte {
+	p.Lock()
+	defer p.Unlock()
+
+	first := p.next - uint64(len(p.retained))
+	if seq < first {
+		seq = first
+	}
+	end := seq + uint64(count)
+	if end > p.next {
+		end = p.next
+	}
+	var batch [][]byte
+	size := headerSize
+	for s := seq; s < end; s++ {
+		b := p.retained[s-first]
+		if size+2+len(b) > p.max {
+			break
+		}
+		batch = append(batch, b)
+		size += 2 + len(b)
+	}
+	if seq > p.next {
+		seq = p.next
+	}
+	return packet(p.session, seq, batch)
+}
+
+// Retransmit asks a publisher's retransmission service for count messages
+// of a session from seq on, over a connection to it.
+func Retransmit(rw io.ReadWriter, sessionName string, seq uint64, count uint16) (Packet, error) {
+	if err := binary.Write(rw, binary.BigEndian, request{Session: session(sessionName), Sequence: seq, Count: count}); err != nil {
+		return Packet{}, fmt.Errorf("failed to send request: %v", err)
+	}
+	var n uint16
+	if err := binary.Read(rw, binary.BigEndian, &n); err != nil {
+		return Packet{}, fmt.Errorf("failed to read response: %v", err)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rw, b); err != nil {
+		return Packet{}, fmt.Errorf("failed to read response: %v", err)
+	}
+	return ParsePacket(b)
+}
@@ -0,0 +1,168 @@
+package margin
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/dylanlott/orderbook/pkg/accounts"
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+)
+
+// Deleverage is part of a liquidated position that was closed against
+// another account's opposing position at the bankruptcy price.
+type Deleverage struct {
+	Account  string  `json:"account"`
+	Symbol   string  `json:"symbol"`
+	Side     string  `json:"side"`
+	Quantity float64 `json:"quantity"`
+	Price    float64 `json:"price"`
+}
+
+// cover pays a liquidated account's negative equity out of the insurance
+// fund, as far as the fund goes.
+func (e *Engine) cover(l *Liquidation) {
+	balances := e.accts.Ledger().Balances(l.Account)
+	e.RLock()
+	v, err := e.value(balances, nil)
+	e.RUnlock()
+	if err != nil || v.equity >= 0 {
+		return
+	}
+
+	fund := e.accts.Ledger().Balance(accounts.InsuranceAccount, e.config.Quote)
+	amount := math.Min(-v.equity, fund)
+	if amount <= 0 {
+		return
+	}
+	_, err = e.accts.Exchange(accounts.Transfer{
+		From:   accounts.InsuranceAccount,
+		To:     l.Account,
+		Asset:  e.config.Quote,
+		Amount: amount,
+		Kind:   accounts.KindInsurance,
+		Memo:   fmt.Sprintf("liquidation of %s", l.Account),
+	})
+	if err != nil {
+		l.fail(fmt.Errorf("failed to pay %s from the insurance fund: %v", l.Account, err))
+		return
+	}
+	l.Insurance += amount
+}
+
+// deleverage closes what's left of a liquidated account's position in a
+// market against the opposing positions of other margin accounts, at the
+// price that leaves the liquidated account with no equity. The most
+// profitable and most leveraged positions are closed first.
+func (e *Engine) deleverage(l *Liquidation, m market) {
+	balances := e.accts.Ledger().Balances(l.Account)
+
+	e.RLock()
+	size := balances[m.Base]
+	mark, ok := e.marks[m.Base]
+	v, err := e.value(balances, nil)
+	if !ok || err != nil || math.Abs(size) < 1 {
+		e.RUnlock()
+		return
+	}
+	bankruptcy := mark - v.equity/size
+	ranked := e.rank(l.Account, m, size, mark)
+	e.RUnlock()
+
+	memo := fmt.Sprintf("deleverage %s in %s", l.Account, m.Symbol)
+	remaining := math.Abs(size)
+	for _, c := range ranked {
+		quantity := math.Floor(math.Min(remaining, c.size))
+		if quantity < 1 {
+			break
+		}
+
+		buyer, seller := c.account, l.Account
+		if size < 0 {
+			buyer, seller = l.Account, c.account
+		}
+		_, err := e.accts.Exchange(
+			accounts.Transfer{From: seller, To: buyer, Asset: m.Base, Amount: quantity, Kind: accounts.KindADL, Memo: memo},
+			accounts.Transfer{From: buyer, To: seller, Asset: m.Quote, Amount: quantity * bankruptcy, Kind: accounts.KindADL, Memo: memo},
+		)
+		if err != nil {
+			l.fail(fmt.Errorf("failed to deleverage %s against %s: %v", l.Account, c.account, err))
+			continue
+		}
+
+		side := "sell"
+		if buyer == c.account {
+			side = "buy"
+		}
+		l.Deleveraged = append(l.Deleveraged, Deleverage{
+			Account:  c.account,
+			Symbol:   m.Symbol,
+			Side:     side,
+			Quantity: quantity,
+			Price:    bankruptcy,
+		})
+		if e.positions != nil {
+			e.positions.Apply(m.Symbol, orderbook.Match{
+				Buy:      &orderbook.Order{AccountID: buyer, Side: "buy"},
+				Sell:     &orderbook.Order{AccountID: seller, Side: "sell"},
+				Price:    uint64(math.Round(bankruptcy * 100)),
+				Quantity: uint64(quantity),
+				Time:     time.Now(),
+			})
+		}
+		remaining -= quantity
+	}
+}
+
+type candidate struct {
+	account string
+	size    float64
+	score   float64
+}
+
+// rank orders the margin accounts whose positions in a market oppose a
+// position of size and are in profit at mark. They're ranked by their
+// profit as a fraction of their entry cost times their leverage, highest
+// first. Ranking needs the engine's positions. The engine must be locked.
+func (e *Engine) rank(liquidated string, m market, size, mark float64) []candidate {
+	if e.positions == nil {
+		return nil
+	}
+
+	var ranked []candidate
+	for id := range e.leverage {
+		if id == liquidated {
+			continue
+		}
+		balances := e.accts.Ledger().Balances(id)
+		theirs := balances[m.Base]
+		if theirs == 0 || (theirs > 0) == (size > 0) {
+			continue
+		}
+		v, err := e.value(balances, nil)
+		if err != nil || v.equity <= 0 {
+			continue
+		}
+		p, ok := e.positions.Position(id, m.Symbol)
+		if !ok || p.Quantity == 0 || p.AvgPrice <= 0 {
+			continue
+		}
+		profit := p.Unrealized(mark) / (math.Abs(float64(p.Quantity)) * p.AvgPrice)
+		if profit <= 0 {
+			continue
+		}
+		ranked = append(ranked, candidate{
+			account: id,
+			size:    math.Abs(theirs),
+			score:   profit * v.positions / v.equity,
+		})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score > ranked[j].score
+		}
+		return ranked[i].account < ranked[j].account
+	})
+	return ranked
+}
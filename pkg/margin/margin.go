@@ -0,0 +1,446 @@
+// Package margin lets accounts trade with leverage and liquidates the
+// ones whose equity falls below their maintenance margin.
+//
+// A margin account borrows by letting its balances go negative. Its equity
+// is the value of all of its balances at their mark prices and its
+// positions are the absolute value of every balance that isn't the quote
+// asset. An account trading at a leverage of L needs equity of 1/L of its
+// positions and open orders to open more of them, which is its initial
+// margin, and equity of Maintenance of its positions to keep them.
+package margin
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dylanlott/orderbook/pkg/accounts"
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+	"github.com/dylanlott/orderbook/pkg/positions"
+)
+
+// Config sets the margin rules of an Engine.
+type Config struct {
+	// Quote is the asset that equity and margin are measured in.
+	Quote string
+	// MaxLeverage is the most leverage an account can trade at.
+	MaxLeverage float64
+	// Maintenance is the fraction of an account's positions that its
+	// equity has to stay above to avoid liquidation.
+	Maintenance float64
+	// Slippage is how far through the mark price liquidation orders are
+	// priced, as a fraction of it, so that they cross the book.
+	Slippage float64
+}
+
+// Status is an account's margin at the current mark prices.
+type Status struct {
+	Account     string  `json:"account"`
+	Leverage    float64 `json:"leverage"`
+	Equity      float64 `json:"equity"`
+	Positions   float64 `json:"positions"`
+	Initial     float64 `json:"initial"`
+	Maintenance float64 `json:"maintenance"`
+	Liquidating bool    `json:"liquidating"`
+}
+
+// Liquidation records an account being closed out. Every open order of
+// the account is canceled and orders are placed to close its positions.
+// Insurance is what the insurance fund paid towards its losses and
+// Deleveraged are the positions that were closed against other accounts.
+// Shortfall is whatever loss couldn't be covered by either.
+type Liquidation struct {
+	Account     string            `json:"account"`
+	Time        time.Time         `json:"time"`
+	Equity      float64           `json:"equity"`
+	Maintenance float64           `json:"maintenance"`
+	Canceled    []orderbook.Order `json:"canceled"`
+	Orders      []orderbook.Order `json:"orders"`
+	Insurance   float64           `json:"insurance"`
+	Deleveraged []Deleverage      `json:"deleveraged"`
+	Shortfall   float64           `json:"shortfall"`
+	Err         error             `json:"-"`
+}
+
+// fail records the first thing that went wrong with a liquidation.
+func (l *Liquidation) fail(err error) {
+	if l.Err == nil {
+		l.Err = err
+	}
+}
+
+// Engine is the Lender for margin accounts and the liquidation engine
+// that watches them. Liquidations go through the same write and cancel
+// channels as every other order in the markets that it's added to.
+type Engine struct {
+	sync.RWMutex
+
+	config    Config
+	accts     accounts.AccountManager
+	positions *positions.Tracker
+	leverage  map[string]float64
+	marks     map[string]float64
+	markets   []market
+
+	// liquidating is every account that's being liquidated and orders is
+	// the hold ID of every liquidation order that's being placed.
+	liquidating map[string]bool
+	orders      map[string]bool
+	seq         int
+}
+
+type market struct {
+	orderbook.Market
+	writes  chan orderbook.OpWrite
+	cancels chan orderbook.OpCancel
+}
+
+// NewEngine returns an Engine that lends to the margin accounts of accts.
+func NewEngine(accts accounts.AccountManager, config Config) *Engine {
+	e := &Engine{
+		config:      config,
+		accts:       accts,
+		leverage:    make(map[string]float64),
+		marks:       make(map[string]float64),
+		liquidating: make(map[string]bool),
+		orders:      make(map[string]bool),
+	}
+	accts.SetLender(e)
+	return e
+}
+
+// Enable lets an account trade on margin at the given leverage.
+func (e *Engine) Enable(accountID string, leverage float64) error {
+	if leverage < 1 || leverage > e.config.MaxLeverage {
+		return fmt.Errorf("leverage must be between 1 and %v, got %v", e.config.MaxLeverage, leverage)
+	}
+	if _, err := e.accts.Get(accountID); err != nil {
+		return err
+	}
+	e.Lock()
+	defer e.Unlock()
+	e.leverage[accountID] = leverage
+	return nil
+}
+
+// SetPositions gives the engine the positions of every account, which it
+// needs to rank accounts for auto-deleveraging. The tracker should be fed
+// every match of the engine's markets.
+func (e *Engine) SetPositions(t *positions.Tracker) {
+	e.Lock()
+	defer e.Unlock()
+	e.positions = t
+}
+
+// SetMark sets the price of an asset in the quote asset.
+func (e *Engine) SetMark(asset string, price float64) {
+	e.Lock()
+	defer e.Unlock()
+	e.marks[asset] = price
+}
+
+// AddMarket lets the engine cancel and place orders in a market that's
+// run by orderbook.Start or orderbook.Run with the given channels. Both
+// answer every write with how much of the order filled, which a
+// liquidation needs to know before it moves on.
+func (e *Engine) AddMarket(m orderbook.Market, writes chan orderbook.OpWrite, cancels chan orderbook.OpCancel) error {
+	if m.Quote != e.config.Quote {
+		return fmt.Errorf("market %s is quoted in %s, not %s", m.Symbol, m.Quote, e.config.Quote)
+	}
+	e.Lock()
+	defer e.Unlock()
+	e.markets = append(e.markets, market{Market: m, writes: writes, cancels: cancels})
+	return nil
+}
+
+// Status returns an account's margin at the current mark prices. Open
+// orders aren't included, since they can't be read safely from outside
+// of the account manager.
+func (e *Engine) Status(accountID string) (Status, error) {
+	balances := e.accts.Ledger().Balances(accountID)
+
+	e.RLock()
+	defer e.RUnlock()
+	leverage, ok := e.leverage[accountID]
+	if !ok {
+		return Status{}, fmt.Errorf("account %s doesn't trade on margin", accountID)
+	}
+	v, err := e.value(balances, nil)
+	if err != nil {
+		return Status{}, err
+	}
+	return Status{
+		Account:     accountID,
+		Leverage:    leverage,
+		Equity:      v.equity,
+		Positions:   v.positions,
+		Initial:     v.positions / leverage,
+		Maintenance: v.positions * e.config.Maintenance,
+		Liquidating: e.liquidating[accountID],
+	}, nil
+}
+
+// BuyingPower is how much of asset a margin account can hold for an order.
+// That's whatever it could buy with the equity it has left over once its
+// positions and orders are covered at its leverage, or what it already
+// has, whichever is more. Accounts that are being liquidated can't place
+// orders, except for the liquidation orders themselves which can always
+// be placed.
+func (e *Engine) BuyingPower(acct *accounts.UserAccount, holdID string, asset string) (float64, bool) {
+	e.RLock()
+	defer e.RUnlock()
+
+	leverage, ok := e.leverage[acct.Email]
+	switch {
+	case !ok:
+		return 0, false
+	case e.orders[holdID]:
+		return math.MaxFloat64, true
+	case e.liquidating[acct.Email]:
+		return 0, true
+	}
+
+	v, err := e.value(acct.Balances, acct.Held)
+	mark, ok := e.mark(asset)
+	if err != nil || !ok || mark == 0 {
+		return 0, true
+	}
+	power := (v.equity*leverage - v.positions - v.orders) / mark
+	return math.Max(acct.Available(asset), power), true
+}
+
+// Withdrawable is how much of asset a margin account can take out without
+// leaving less equity than its initial margin.
+func (e *Engine) Withdrawable(acct *accounts.UserAccount, asset string) float64 {
+	e.RLock()
+	defer e.RUnlock()
+
+	leverage, ok := e.leverage[acct.Email]
+	if !ok || e.liquidating[acct.Email] {
+		return 0
+	}
+	v, err := e.value(acct.Balances, acct.Held)
+	mark, ok := e.mark(asset)
+	if err != nil || !ok || mark == 0 {
+		return 0
+	}
+	free := v.equity - (v.positions+v.orders)/leverage
+	return math.Max(0, free/mark)
+}
+
+// Run checks every margin account each interval until ctx is done and
+// sends every liquidation it starts on liquidations.
+func (e *Engine) Run(ctx context.Context, interval time.Duration, liquidations chan Liquidation) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, l := range e.Check() {
+				liquidations <- l
+			}
+		}
+	}
+}
+
+// Check liquidates every margin account whose equity is below its
+// maintenance margin. Accounts stay in liquidation, and can't place
+// orders, until they're back above it or have no positions left.
+func (e *Engine) Check() []Liquidation {
+	e.RLock()
+	var ids []string
+	for id := range e.leverage {
+		ids = append(ids, id)
+	}
+	e.RUnlock()
+	sort.Strings(ids)
+
+	var liquidations []Liquidation
+	for _, id := range ids {
+		balances := e.accts.Ledger().Balances(id)
+
+		e.RLock()
+		v, err := e.value(balances, nil)
+		e.RUnlock()
+		if err != nil {
+			continue
+		}
+
+		maintenance := v.positions * e.config.Maintenance
+		if v.positions == 0 || v.equity >= maintenance {
+			e.Lock()
+			delete(e.liquidating, id)
+			e.Unlock()
+			continue
+		}
+		liquidations = append(liquidations, e.liquidate(id, v.equity, maintenance))
+	}
+	return liquidations
+}
+
+// liquidate cancels every open order of an account and places orders to
+// close each of its positions, priced through the mark so they fill but
+// no worse than the insurance fund can cover. Whatever those orders lose
+// past the account's bankruptcy price is paid by the insurance fund, and
+// whatever they can't close is deleveraged against other accounts.
+func (e *Engine) liquidate(id string, equity, maintenance float64) Liquidation {
+	e.Lock()
+	e.liquidating[id] = true
+	markets := append([]market(nil), e.markets...)
+	e.Unlock()
+
+	l := &Liquidation{
+		Account:     id,
+		Time:        time.Now(),
+		Equity:      equity,
+		Maintenance: maintenance,
+	}
+
+	for _, m := range markets {
+		result := make(chan orderbook.CancelResult)
+		m.cancels <- orderbook.OpCancel{AccountID: id, Result: result}
+		res := <-result
+		if res.Err != nil {
+			l.fail(fmt.Errorf("failed to cancel orders of %s in %s: %v", id, m.Symbol, res.Err))
+		}
+		l.Canceled = append(l.Canceled, res.Orders...)
+	}
+
+	for _, m := range markets {
+		o, ok := e.closeout(id, m)
+		if !ok {
+			continue
+		}
+
+		hold := orderbook.HoldID(m.Symbol, o.ID)
+		e.Lock()
+		e.orders[hold] = true
+		e.Unlock()
+
+		result := make(chan orderbook.WriteResult)
+		m.writes <- orderbook.OpWrite{Order: o, Result: result}
+		res := <-result
+
+		e.Lock()
+		delete(e.orders, hold)
+		e.Unlock()
+
+		if res.Err != nil {
+			l.fail(fmt.Errorf("failed to place liquidation order in %s: %v", m.Symbol, res.Err))
+			continue
+		}
+		l.Orders = append(l.Orders, res.Order)
+
+		// liquidation orders don't rest in the book
+		if res.Order.Filled < res.Order.Open {
+			cancel := make(chan orderbook.CancelResult)
+			m.cancels <- orderbook.OpCancel{OrderID: o.ID, Result: cancel}
+			if err := (<-cancel).Err; err != nil {
+				l.fail(fmt.Errorf("failed to cancel liquidation order %s: %v", o.ID, err))
+			}
+		}
+	}
+
+	e.cover(l)
+	for _, m := range markets {
+		e.deleverage(l, m)
+	}
+
+	e.RLock()
+	v, err := e.value(e.accts.Ledger().Balances(id), nil)
+	e.RUnlock()
+	if err == nil && v.equity < 0 {
+		l.Shortfall = -v.equity
+	}
+	return *l
+}
+
+// closeout returns the order that closes an account's position in a
+// market. It's priced through the mark by the engine's slippage, but never
+// past the price at which the account's losses would be more than its
+// equity and the insurance fund together.
+func (e *Engine) closeout(id string, m market) (orderbook.Order, bool) {
+	balances := e.accts.Ledger().Balances(id)
+	fund := math.Max(0, e.accts.Ledger().Balance(accounts.InsuranceAccount, e.config.Quote))
+
+	e.Lock()
+	defer e.Unlock()
+
+	size := balances[m.Base]
+	mark, ok := e.marks[m.Base]
+	if !ok || size == 0 {
+		return orderbook.Order{}, false
+	}
+	v, err := e.value(balances, nil)
+	if err != nil {
+		return orderbook.Order{}, false
+	}
+	// closing size at price leaves equity + size * (price - mark)
+	worst := mark - (v.equity+fund)/size
+
+	e.seq++
+	o := orderbook.Order{
+		ID:        fmt.Sprintf("liquidation-%s-%d", id, e.seq),
+		AccountID: id,
+		Kind:      "liquidation",
+		Side:      "sell",
+		Price:     uint64(math.Max(1, math.Ceil(math.Max(mark*(1-e.config.Slippage), worst)*100))),
+		Open:      uint64(math.Floor(size)),
+	}
+	if size < 0 {
+		o.Side = "buy"
+		o.Price = uint64(math.Max(0, math.Floor(math.Min(mark*(1+e.config.Slippage), worst)*100)))
+		o.Open = uint64(math.Ceil(-size))
+	}
+	return o, o.Open > 0 && o.Price > 0
+}
+
+// valuation is what an account is worth at the mark prices.
+type valuation struct {
+	equity    float64
+	positions float64
+	orders    float64
+}
+
+// value marks balances and holds to market. The engine must be locked.
+func (e *Engine) value(balances, held map[string]float64) (valuation, error) {
+	var v valuation
+	for asset, amount := range balances {
+		if amount == 0 {
+			continue
+		}
+		mark, ok := e.mark(asset)
+		if !ok {
+			return valuation{}, fmt.Errorf("no mark price for %s", asset)
+		}
+		v.equity += amount * mark
+		if asset != e.config.Quote {
+			v.positions += math.Abs(amount) * mark
+		}
+	}
+	for asset, amount := range held {
+		if amount == 0 {
+			continue
+		}
+		mark, ok := e.mark(asset)
+		if !ok {
+			return valuation{}, fmt.Errorf("no mark price for %s", asset)
+		}
+		v.orders += amount * mark
+	}
+	return v, nil
+}
+
+// mark returns the price of an asset. The engine must be locked.
+func (e *Engine) mark(asset string) (float64, bool) {
+	if asset == e.config.Quote {
+		return 1, true
+	}
+	mark, ok := e.marks[asset]
+	return mark, ok
+}
@@ -0,0 +1,209 @@
+package margin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dylanlott/orderbook/pkg/accounts"
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+	"github.com/dylanlott/orderbook/pkg/positions"
+	"github.com/matryer/is"
+)
+
+var btc = orderbook.Market{Symbol: "BTC-USD", Base: "BTC", Quote: accounts.USD}
+
+func TestLiquidation(t *testing.T) {
+	is := is.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	acc := accounts.NewAccountManager("")
+	for id, balances := range map[string]map[string]float64{
+		"trader": {accounts.USD: 100},
+		"maker":  {"BTC": 10},
+		"bidder": {accounts.USD: 1000},
+	} {
+		_, err := acc.Create(id, balances)
+		is.NoErr(err)
+	}
+
+	writes := make(chan orderbook.OpWrite)
+	cancels := make(chan orderbook.OpCancel)
+	fills := make(chan orderbook.FillResult, 100)
+	errs := make(chan error, 100)
+	go orderbook.Start(ctx, btc, acc, writes, cancels, nil, fills, nil, errs)
+
+	engine := NewEngine(acc, Config{Quote: accounts.USD, MaxLeverage: 10, Maintenance: 0.1, Slippage: 0.05})
+	is.NoErr(engine.AddMarket(btc, writes, cancels))
+	engine.SetMark("BTC", 100)
+	is.True(engine.Enable("trader", 20) != nil)
+	is.NoErr(engine.Enable("trader", 5))
+
+	// 100 of equity at 5x buys 400 of BTC and leaves room for another 100
+	is.NoErr(write(writes, orderbook.Order{ID: "m1", AccountID: "maker", Side: "sell", Price: 10000, Open: 4}).Err)
+	is.True(write(writes, orderbook.Order{ID: "t0", AccountID: "trader", Side: "buy", Price: 10000, Open: 6}).Err != nil)
+	is.NoErr(write(writes, orderbook.Order{ID: "t1", AccountID: "trader", Side: "buy", Price: 10000, Open: 4}).Err)
+	is.NoErr(write(writes, orderbook.Order{ID: "t2", AccountID: "trader", Side: "buy", Price: 5000, Open: 1}).Err)
+
+	status, err := engine.Status("trader")
+	is.NoErr(err)
+	is.Equal(status.Equity, float64(100))
+	is.Equal(status.Positions, float64(400))
+	is.Equal(acc.Ledger().Balance("trader", accounts.USD), float64(-300))
+
+	// borrowed funds can't be withdrawn
+	_, err = acc.Withdraw("trader", accounts.USD, 10)
+	is.True(err != nil)
+
+	// nothing happens while the account is above maintenance
+	is.Equal(len(engine.Check()), 0)
+
+	// at 80 the trader has 20 of equity against 32 of maintenance
+	is.NoErr(write(writes, orderbook.Order{ID: "b1", AccountID: "bidder", Side: "buy", Price: 7800, Open: 4}).Err)
+	engine.SetMark("BTC", 80)
+	liquidations := engine.Check()
+	is.Equal(len(liquidations), 1)
+	l := liquidations[0]
+	is.NoErr(l.Err)
+	is.Equal(l.Equity, float64(20))
+	is.Equal(len(l.Canceled), 1)
+	is.Equal(l.Canceled[0].ID, "t2")
+	is.Equal(len(l.Orders), 1)
+	is.Equal(l.Orders[0].Side, "sell")
+	is.Equal(l.Orders[0].Filled, uint64(4))
+
+	// the position was closed into the bid at 78
+	is.Equal(acc.Ledger().Balance("trader", "BTC"), float64(0))
+	is.Equal(acc.Ledger().Balance("trader", accounts.USD), float64(12))
+	is.Equal(len(engine.Check()), 0)
+	status, err = engine.Status("trader")
+	is.NoErr(err)
+	is.True(!status.Liquidating)
+}
+
+func TestLiquidationRun(t *testing.T) {
+	is := is.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	acc := accounts.NewAccountManager("")
+	for id, balances := range map[string]map[string]float64{
+		"trader": {accounts.USD: 100},
+		"maker":  {"BTC": 10},
+		"bidder": {accounts.USD: 1000},
+	} {
+		_, err := acc.Create(id, balances)
+		is.NoErr(err)
+	}
+
+	writes := make(chan orderbook.OpWrite)
+	cancels := make(chan orderbook.OpCancel)
+	go orderbook.Run(ctx, btc, acc, nil, writes, cancels, nil, nil, nil, nil, nil, nil, nil)
+
+	engine := NewEngine(acc, Config{Quote: accounts.USD, MaxLeverage: 10, Maintenance: 0.1, Slippage: 0.05})
+	is.NoErr(engine.AddMarket(btc, writes, cancels))
+	engine.SetMark("BTC", 100)
+	is.NoErr(engine.Enable("trader", 5))
+
+	// the trader borrows 300 to go long 4 and bids for another
+	is.NoErr(write(writes, orderbook.Order{ID: "m1", AccountID: "maker", Side: "sell", Price: 10000, Open: 4}).Err)
+	is.NoErr(write(writes, orderbook.Order{ID: "t1", AccountID: "trader", Side: "buy", Price: 10000, Open: 4}).Err)
+	is.NoErr(write(writes, orderbook.Order{ID: "t2", AccountID: "trader", Side: "buy", Price: 5000, Open: 1}).Err)
+	is.Equal(acc.Ledger().Balance("trader", accounts.USD), float64(-300))
+
+	// and is liquidated into the bid at 78 once BTC marks at 80
+	is.NoErr(write(writes, orderbook.Order{ID: "b1", AccountID: "bidder", Side: "buy", Price: 7800, Open: 4}).Err)
+	engine.SetMark("BTC", 80)
+	liquidations := engine.Check()
+	is.Equal(len(liquidations), 1)
+	l := liquidations[0]
+	is.NoErr(l.Err)
+	is.Equal(len(l.Canceled), 1)
+	is.Equal(l.Canceled[0].ID, "t2")
+	is.Equal(len(l.Orders), 1)
+	is.Equal(l.Orders[0].Filled, uint64(4))
+	is.Equal(acc.Ledger().Balance("trader", "BTC"), float64(0))
+	is.Equal(acc.Ledger().Balance("trader", accounts.USD), float64(12))
+	is.Equal(len(engine.Check()), 0)
+}
+
+func TestInsuranceAndDeleveraging(t *testing.T) {
+	is := is.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	acc := accounts.NewAccountManager("")
+	for id, balances := range map[string]map[string]float64{
+		"trader": {accounts.USD: 100},
+		"shorty": {accounts.USD: 1000},
+	} {
+		_, err := acc.Create(id, balances)
+		is.NoErr(err)
+	}
+	_, err := acc.Exchange(accounts.Transfer{From: accounts.ExternalAccount, To: accounts.InsuranceAccount, Asset: accounts.USD, Amount: 5})
+	is.NoErr(err)
+
+	writes := make(chan orderbook.OpWrite)
+	cancels := make(chan orderbook.OpCancel)
+	fills := make(chan orderbook.FillResult, 100)
+	errs := make(chan error, 100)
+	go orderbook.Start(ctx, btc, acc, writes, cancels, nil, fills, nil, errs)
+
+	tracker := positions.NewTracker()
+	engine := NewEngine(acc, Config{Quote: accounts.USD, MaxLeverage: 10, Maintenance: 0.1, Slippage: 0.05})
+	engine.SetPositions(tracker)
+	is.NoErr(engine.AddMarket(btc, writes, cancels))
+	engine.SetMark("BTC", 100)
+	is.NoErr(engine.Enable("trader", 5))
+	is.NoErr(engine.Enable("shorty", 5))
+
+	// the trader goes long 4 at 100 against shorty
+	is.NoErr(write(writes, orderbook.Order{ID: "s1", AccountID: "shorty", Side: "sell", Price: 10000, Open: 4}).Err)
+	is.NoErr(write(writes, orderbook.Order{ID: "t1", AccountID: "trader", Side: "buy", Price: 10000, Open: 4}).Err)
+	f := <-fills
+	tracker.Apply(btc.Symbol, orderbook.Match{Buy: f.Buy, Sell: f.Sell, Price: f.Price, Quantity: f.Filled})
+
+	// at 70 the trader is 20 under water and there's nothing to sell into,
+	// so the fund pays what it has and shorty takes over the position at
+	// the price where the trader has nothing left
+	engine.SetMark("BTC", 70)
+	liquidations := engine.Check()
+	is.Equal(len(liquidations), 1)
+	l := liquidations[0]
+	is.NoErr(l.Err)
+	is.Equal(l.Equity, float64(-20))
+	is.Equal(l.Orders[0].Price, uint64(7375))
+	is.Equal(l.Orders[0].Filled, uint64(0))
+	is.Equal(l.Insurance, float64(5))
+	is.Equal(l.Deleveraged, []Deleverage{{Account: "shorty", Symbol: "BTC-USD", Side: "buy", Quantity: 4, Price: 73.75}})
+	is.Equal(l.Shortfall, float64(0))
+
+	ledger := acc.Ledger()
+	is.Equal(ledger.Balance(accounts.InsuranceAccount, accounts.USD), float64(0))
+	is.Equal(ledger.Balance("trader", accounts.USD), float64(0))
+	is.Equal(ledger.Balance("trader", "BTC"), float64(0))
+	is.Equal(ledger.Balance("shorty", accounts.USD), float64(1105))
+	is.Equal(ledger.Balance("shorty", "BTC"), float64(0))
+	kinds := map[string]bool{}
+	for _, entry := range ledger.Entries() {
+		kinds[entry.Kind] = true
+	}
+	is.True(kinds[accounts.KindInsurance])
+	is.True(kinds[accounts.KindADL])
+
+	// shorty's position was closed at the bankruptcy price
+	p, _ := tracker.Position("shorty", btc.Symbol)
+	is.Equal(p.Quantity, int64(0))
+	is.Equal(p.Realized, float64(105))
+
+	// the liquidation order didn't rest in the book
+	result := make(chan orderbook.CancelResult)
+	cancels <- orderbook.OpCancel{AccountID: "trader", Result: result}
+	is.Equal(len((<-result).Orders), 0)
+}
+
+func write(writes chan orderbook.OpWrite, o orderbook.Order) orderbook.WriteResult {
+	result := make(chan orderbook.WriteResult)
+	writes <- orderbook.OpWrite{Order: o, Result: result}
+	return <-result
+}
@@ -4,8 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"math/rand"
-	"sync"
+	"sort"
 	"testing"
 	"time"
 
@@ -13,52 +12,118 @@ import (
 	"github.com/sasha-s/go-deadlock"
 )
 
+// expiryInterval is how often Start and Run sweep the book for expired
+// orders.
+var expiryInterval = time.Second
+
 // OpWrite inserts an order into the Book
 type OpWrite struct {
 	Order  Order
 	Result chan WriteResult
 }
 
+// OpCancel removes an order from the Book and releases
+// whatever is left of its reservation. If OrderID is empty every open
+// order of AccountID is canceled, and if that's empty too every order
+// in the book is. A cancel of an order ID that names an account only
+// cancels the order if it belongs to the account.
+type OpCancel struct {
+	OrderID   string
+	AccountID string
+	Result    chan CancelResult
+}
+
+// OpAmend changes the price or quantity of an open order. A zero Price or
+// Open keeps what the order has, and a Price is in the terms of the
+// order's Outcome like an order's. An amend that names an account only
+// amends the order if it belongs to the account. An order that's amended
+// to no more than it has filled is canceled, and one whose new price
+// crosses the book is matched again like a new order.
+type OpAmend struct {
+	OrderID   string
+	AccountID string
+	Price     uint64
+	Open      uint64
+	Result    chan WriteResult
+}
+
+// OpRead reads the top of the Book. If Levels isn't zero it reads that
+// many levels of depth grouped by Group as well, or every level if
+// Levels is negative. See Book.Depth.
+type OpRead struct {
+	Levels int
+	Group  uint64
+	Result chan ReadResult
+}
+
+// ReadResult is returned as the result of an OpRead. Bid and Ask are the
+// best buy and sell prices in the book, or zero if that side is empty.
+type ReadResult struct {
+	Bid   uint64
+	Ask   uint64
+	Depth Depth
+}
+
 // FillResult contains the buy and sell order that were
 // matched and filled. FillResult is only created after
 // everything has been committed to state.
 type FillResult struct {
-	Buy    *Order
-	Sell   *Order
-	Filled uint64
+	Buy      *Order
+	Sell     *Order
+	Filled   uint64
+	Price    uint64
+	Time     time.Time
+	Taker    string
+	MakerFee float64
+	TakerFee float64
 }
 
 // WriteResult is returned as the result of an OpWrite.
+// Err is set if the order was rejected and never entered the book.
 type WriteResult struct {
 	Order Order
 	Err   error
 }
 
+// CancelResult is returned as the result of an OpCancel.
+// Orders holds every order canceled by a cancel of more than one order.
+type CancelResult struct {
+	Order  Order
+	Orders []Order
+	Err    error
+}
+
 // Book holds buy and sell side orders. OpRead and OpWrite are applied to
 // to the book. Buy and sell side orders are binary trees of order lists.
 type Book struct {
 	// sync.RWMutex
 	deadlock.Mutex
 
+	market Market
+
 	buy  *Node
 	sell *Node
-}
 
-// Start sets up the order book and wraps it in a read and write channel for
-// receiving operations and output, match, and errs channels for
-// handling outputs from the machine.
-// The book itself is protected by this function and is intentionally never directly accessible.
-func Start(
-	ctx context.Context,
-	accts accounts.AccountManager,
-	writes chan OpWrite,
-	fills chan FillResult,
-	errs chan error,
-) {
-	matches := make(chan Match)
+	// orders indexes every open order in the book by ID.
+	orders map[string]*Order
 
-	// TODO: load the book in from a badger store.
-	book := &Book{
+	// volumes is what each account has traded recently, for fee tiers.
+	volumes volumes
+
+	// seq is the sequence number of the last event in the book's
+	// market-by-order feed and events are the ones that haven't been
+	// flushed yet. refs are the feed's reference numbers of resting
+	// orders and ref is the last one handed out.
+	seq    uint64
+	events []OrderEvent
+	ref    uint64
+	refs   map[string]uint64
+}
+
+// NewBook returns an empty Book for the given Market.
+func NewBook(market Market) *Book {
+	return &Book{
+		market: market,
 		buy: &Node{
 			Price:  0,
 			Orders: []*Order{},
@@ -71,14 +136,35 @@ func Start(
 			Right:  &Node{},
 			Left:   &Node{},
 		},
+		orders: make(map[string]*Order),
 	}
+}
 
-	go func() {
-		for m := range matches {
-			// execute on matches
-			log.Printf("[match]: %+v\n", m)
-		}
-	}()
+// Start sets up the order book and wraps it in a read and write channel for
+// receiving operations and output, match, and errs channels for
+// handling outputs from the machine.
+// The book itself is protected by this function and is intentionally never directly accessible.
+// Operations and outputs that aren't used can be given a nil channel.
+// Outputs are only sent on once the book is unlocked, so a slow consumer
+// holds up the next operation but never leaves the book locked.
+// Every change to the book is published on events as its market-by-order
+// feed, or dropped if events is nil.
+func Start(
+	ctx context.Context,
+	market Market,
+	accts accounts.AccountManager,
+	writes chan OpWrite,
+	cancels chan OpCancel,
+	reads chan OpRead,
+	fills chan FillResult,
+	events chan OrderEvent,
+	errs chan error,
+) {
+	// TODO: load the book in from a badger store.
+	book := NewBook(market)
+
+	expiry := time.NewTicker(expiryInterval)
+	defer expiry.Stop()
 
 	for {
 		select {
@@ -86,30 +172,325 @@ func Start(
 			// TODO: drain channels and cleanup
 			return
 		case w := <-writes:
-			if w.Order.Side == "buy" {
-				o := &w.Order
-				book.buy.Insert(o)
-				go AttemptFill(book, accts, o, matches, errs)
+			o := &w.Order
+			if err := book.insert(accts, o); err != nil {
 				w.Result <- WriteResult{
 					Order: *o,
-					Err:   nil,
+					Err:   err,
 				}
-			} else {
-				o := &w.Order
-				book.sell.Insert(o)
-				go AttemptFill(book, accts, o, matches, errs)
-				w.Result <- WriteResult{
-					Order: *o,
-					Err:   nil,
+				continue
+			}
+			matches, err := fill(book, accts, o)
+			book.rested(o)
+			for _, m := range matches {
+				// execute on matches
+				log.Printf("[match]: %+v\n", m)
+				if fills != nil {
+					fills <- FillResult{
+						Buy:      m.Buy,
+						Sell:     m.Sell,
+						Filled:   m.Quantity,
+						Price:    m.Price,
+						Time:     m.Time,
+						Taker:    m.Taker,
+						MakerFee: m.MakerFee,
+						TakerFee: m.TakerFee,
+					}
+				}
+			}
+			if err != nil && errs != nil {
+				errs <- err
+			}
+			book.flush(events)
+			book.Lock()
+			result := WriteResult{Order: *o}
+			book.Unlock()
+			w.Result <- result
+		case c := <-cancels:
+			result := book.cancelOp(accts, c)
+			book.flush(events)
+			c.Result <- result
+		case r := <-reads:
+			r.Result <- book.read(r)
+		case now := <-expiry.C:
+			for _, err := range book.expire(accts, now) {
+				if errs != nil {
+					errs <- err
 				}
 			}
+			book.flush(events)
+		}
+	}
+}
+
+// read returns the best prices on each side of the book and as much
+// depth as r asks for.
+func (b *Book) read(r OpRead) ReadResult {
+	b.Lock()
+	defer b.Unlock()
+
+	var result ReadResult
+	if r.Levels != 0 {
+		result.Depth = b.depth(r.Levels, r.Group)
+	}
+	if best := b.buy.Highest(); best != nil {
+		result.Bid = best.Price
+	}
+	if best := b.sell.Lowest(); best != nil {
+		result.Ask = best.Price
+	}
+	return result
+}
+
+// insert reserves the funds that an order needs and then adds it to the book.
+// Orders that can't be funded are rejected before they touch the book.
+func (b *Book) insert(acc accounts.AccountManager, o *Order) error {
+	if o.Side != "buy" && o.Side != "sell" {
+		return fmt.Errorf("invalid side %q for order %s", o.Side, o.ID)
+	}
+	if virtual(o) {
+		return fmt.Errorf("invalid kind %q for order %s", o.Kind, o.ID)
+	}
+	if b.market.Expired(time.Now()) {
+		return fmt.Errorf("%s expired at %v", b.market.Symbol, b.market.Expiry)
+	}
+	if err := b.normalize(o); err != nil {
+		return err
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if _, ok := b.orders[o.ID]; ok {
+		return fmt.Errorf("order %s already exists", o.ID)
+	}
+
+	asset, amount := b.reservation(o)
+	if err := acc.Hold(b.holdID(o), o.AccountID, asset, amount); err != nil {
+		return fmt.Errorf("failed to reserve funds for order %s: %v", o.ID, err)
+	}
+
+	b.side(o).Insert(o)
+	b.orders[o.ID] = o
+	return nil
+}
+
+// cancelOp applies a cancel to the book and returns its result.
+func (b *Book) cancelOp(acc accounts.AccountManager, c OpCancel) CancelResult {
+	if c.OrderID == "" {
+		orders, err := b.cancelAll(acc, c.AccountID)
+		return CancelResult{Orders: orders, Err: err}
+	}
+	o, err := b.cancel(acc, c.OrderID, c.AccountID)
+	return CancelResult{Order: o, Err: err}
+}
+
+// cancel removes an open order from the book. If accountID isn't empty
+// the order is only removed if it belongs to that account.
+func (b *Book) cancel(acc accounts.AccountManager, id string, accountID string) (Order, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	o, ok := b.orders[id]
+	if !ok || (accountID != "" && o.AccountID != accountID) {
+		return Order{}, fmt.Errorf("order %s is not open", id)
+	}
+	if err := b.remove(acc, o); err != nil {
+		return *o, err
+	}
+	return *o, nil
+}
+
+// amend applies an amend to an open order and returns it. An order that
+// keeps its price and only shrinks keeps its place in the queue, and
+// otherwise it goes to the back of the queue at its new price. Either way
+// its hold is swapped for one that fits what's left of it. If the new
+// price crosses the book amend reports that the order has to be matched
+// again, and it's published as a cancel until it rests again.
+func (b *Book) amend(acc accounts.AccountManager, a OpAmend) (*Order, bool, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	o, ok := b.orders[a.OrderID]
+	if !ok || (a.AccountID != "" && o.AccountID != a.AccountID) {
+		return nil, false, fmt.Errorf("order %s is not open", a.OrderID)
+	}
+	amended := *o
+	if a.Price != 0 {
+		amended.Price = a.Price
+		if b.market.Binary() {
+			if a.Price >= payout {
+				return nil, false, fmt.Errorf("invalid price %d for order %s: binary contracts trade between 0 and %d", a.Price, o.ID, payout)
+			}
+			if o.Outcome == No {
+				amended.Price = payout - a.Price
+			}
+		}
+	}
+	if a.Open != 0 {
+		amended.Open = a.Open
+	}
+
+	if amended.Open <= o.Filled {
+		// nothing is left to rest, so the amend cancels it
+		return o, false, b.remove(acc, o)
+	}
+
+	hold := b.holdID(o)
+	left, err := acc.Release(hold)
+	if err != nil {
+		return o, false, fmt.Errorf("failed to release hold for order %s: %v", o.ID, err)
+	}
+	asset, amount := b.reservation(&amended)
+	if err := acc.Hold(hold, o.AccountID, asset, amount); err != nil {
+		asset, _ := b.reservation(o)
+		if err := acc.Hold(hold, o.AccountID, asset, left); err != nil {
+			log.Printf("failed to restore hold for order %s: %v", o.ID, err)
+		}
+		return o, false, fmt.Errorf("failed to reserve funds for order %s: %v", o.ID, err)
+	}
+
+	if amended.Price != o.Price && b.crosses(&amended) {
+		// it leaves the feed like a cancel and comes back in as an add
+		// if anything is left of it once it's done matching
+		b.side(o).RemoveOrder(o)
+		b.emit(EventCancel, o, o.Price, o.Open-o.Filled)
+		o.Price, o.Open = amended.Price, amended.Open
+		b.side(o).Insert(o)
+		return o, true, nil
+	}
+	if amended.Price != o.Price || amended.Open > o.Open {
+		b.side(o).RemoveOrder(o)
+		o.Price = amended.Price
+		b.side(o).Insert(o)
+	}
+	o.Open = amended.Open
+	b.emit(EventModify, o, o.Price, o.Open-o.Filled)
+	return o, false, nil
+}
+
+// crosses reports whether an order would match if it came into the book
+// now. An order could match a market's pool at any price, so it's always
+// matched again if the market has one. The book must be locked by the
+// caller.
+func (b *Book) crosses(o *Order) bool {
+	if b.market.Pool != nil {
+		return true
+	}
+	if o.Side == "buy" {
+		best := b.sell.Lowest()
+		return best != nil && best.Price <= o.Price
+	}
+	best := b.buy.Highest()
+	return best != nil && best.Price >= o.Price
+}
+
+// cancelAll removes every open order of an account from the book, or
+// every order if accountID is empty, and returns them sorted by ID.
+func (b *Book) cancelAll(acc accounts.AccountManager, accountID string) ([]Order, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.removeAll(acc, accountID)
+}
+
+// removeAll does the work of cancelAll. The book must be locked by the caller.
+func (b *Book) removeAll(acc accounts.AccountManager, accountID string) ([]Order, error) {
+	var open []*Order
+	for _, o := range b.orders {
+		if accountID == "" || o.AccountID == accountID {
+			open = append(open, o)
+		}
+	}
+	sort.Slice(open, func(i, j int) bool {
+		return open[i].ID < open[j].ID
+	})
+
+	canceled := []Order{}
+	for _, o := range open {
+		if err := b.remove(acc, o); err != nil {
+			return canceled, err
+		}
+		canceled = append(canceled, *o)
+	}
+	return canceled, nil
+}
+
+// expire removes every order whose ExpiresAt has passed, or every order
+// in the book once the market itself has expired.
+func (b *Book) expire(acc accounts.AccountManager, now time.Time) []error {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.market.Expired(now) {
+		if _, err := b.removeAll(acc, ""); err != nil {
+			return []error{err}
+		}
+		return nil
+	}
+
+	var errs []error
+	for _, o := range b.orders {
+		if o.ExpiresAt.IsZero() || now.Before(o.ExpiresAt) {
+			continue
+		}
+		if err := b.remove(acc, o); err != nil {
+			errs = append(errs, err)
 		}
 	}
+	return errs
 }
 
-// AttemptFill attempts to fill an order until it's completed.
+// remove takes an order out of the book and releases whatever is
+// left of its reservation. The book must be locked by the caller.
+func (b *Book) remove(acc accounts.AccountManager, o *Order) error {
+	if ok := b.side(o).RemoveOrder(o); !ok {
+		return fmt.Errorf("failed to remove order from the %s side: %+v", o.Side, o)
+	}
+	delete(b.orders, o.ID)
+	b.emit(EventCancel, o, o.Price, o.Open-o.Filled)
+	if _, err := acc.Release(b.holdID(o)); err != nil {
+		return fmt.Errorf("failed to release hold for order %s: %v", o.ID, err)
+	}
+	return nil
+}
+
+// HoldID returns the ID of the hold that an order in a market's book
+// reserves its funds under. Holds are named after the market as well as
+// the order, so that they can't collide with another book's orders or
+// with holds that aren't for orders, like withdrawals'.
+func HoldID(symbol, orderID string) string {
+	return fmt.Sprintf("order:%s:%s", symbol, orderID)
+}
+
+// reservation returns the asset and amount that an order holds while it's
+// open. Buyers hold the quote value of what they still want at their limit
+// price plus the most they could pay in fees. That's at the highest rate of
+// the market's fee schedule, since an account's tier can change while its
+// order rests, and whatever it didn't pay is released with the rest of the
+// hold once the order is done. Sellers hold the base amount that they
+// still have to deliver and pay their fees out of what they're paid. In a
+// binary market NO orders are buyers and sellers of NO contracts, whichever
+// side of the book they rest on.
+func (b *Book) reservation(o *Order) (string, float64) {
+	if holdsQuote(o) {
+		rate := b.market.Fees.maxRate(o.AccountID)
+		return b.market.Quote, value(o, o.Price, o.Open-o.Filled) * (1 + rate)
+	}
+	return b.contract(o), float64(o.Open - o.Filled)
+}
+
+// side returns the tree that an order belongs in.
+func (b *Book) side(o *Order) *Node {
+	if o.Side == "buy" {
+		return b.buy
+	}
+	return b.sell
+}
+
+// AttemptFill matches an order against the opposite side of the book until
+// it's filled or the best opposing price no longer crosses. Whatever is left
+// of the order rests in the book to be filled by later orders.
 // * For simplicity, AttemptFill controls the book mutex.
-// It loops until the order is filled.
 func AttemptFill(
 	book *Book,
 	acc accounts.AccountManager,
@@ -117,243 +498,339 @@ func AttemptFill(
 	matches chan Match,
 	errs chan error,
 ) {
-	for {
-		book.Lock()
+	book.Lock()
+	defer book.Unlock()
+
+	for fillorder.Filled < fillorder.Open {
+		// the order was canceled or expired out from under us
+		if _, ok := book.orders[fillorder.ID]; !ok {
+			return
+		}
+
+		var best *Node
 		if fillorder.Side == "buy" {
-			wanted := fillorder.Open - fillorder.Filled
+			best = book.sell.Lowest()
+		} else {
+			best = book.buy.Highest()
+		}
 
-			low := book.sell.FindMin()
-			if len(low.Orders) == 0 {
-				book.Unlock()
-				continue
+		// the pool fills first for as long as it beats the book
+		if match := book.pool(acc, fillorder, best); match != nil {
+			if err := commit(book, acc, match, matches); err != nil {
+				errs <- err
+				return
 			}
+			continue
+		}
+		if best == nil {
+			return
+		}
 
-			bookorder := low.Orders[0] // select highest time priority by first price-valid match
-			available := bookorder.Open - bookorder.Filled
+		bookorder := best.Orders[0] // select highest time priority by first price-valid match
 
-			match := &Match{
-				Buy:  fillorder,
-				Sell: bookorder,
-			}
+		match := &Match{
+			Buy:   fillorder,
+			Sell:  bookorder,
+			Price: bookorder.Price,
+			Time:  time.Now(),
+			Taker: fillorder.Side,
+		}
+		if fillorder.Side == "sell" {
+			match.Buy, match.Sell = bookorder, fillorder
+		}
+		if match.Buy.Price < match.Sell.Price {
+			return
+		}
 
-			switch {
-			case wanted > available:
-				greedy(book, acc, match, matches, errs)
-				book.Unlock()
-				continue
-			case wanted < available:
-				humble(book, acc, match, matches, errs)
-				book.Unlock()
-				return
+		wanted := fillorder.Open - fillorder.Filled
+		available := bookorder.Open - bookorder.Filled
+
+		var err error
+		switch {
+		case wanted > available:
+			err = greedy(book, acc, match, matches)
+		case wanted < available:
+			err = humble(book, acc, match, matches)
+		default:
+			err = exact(book, acc, match, matches)
+		}
+		if err != nil {
+			errs <- err
+			return
+		}
+	}
+}
+
+// fill matches an order that just entered the book with AttemptFill and
+// returns the matches it made, which are already settled, along with the
+// error that a match failed with, if one did. A match that fails is rolled
+// back and ends the fill. Matches are collected here while AttemptFill
+// holds the book's lock and only handed on once it's done, so whoever
+// consumes them can never stall the book.
+func fill(book *Book, accts accounts.AccountManager, o *Order) ([]Match, error) {
+	matchCh := make(chan Match)
+	errs := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		AttemptFill(book, accts, o, matchCh, errs)
+		close(done)
+	}()
+
+	var matches []Match
+	for {
+		select {
+		case m := <-matchCh:
+			matches = append(matches, m)
+		case <-done:
+			select {
+			case err := <-errs:
+				return matches, err
 			default:
-				exact(book, acc, match, matches, errs)
-				book.Unlock()
-				return
+				return matches, nil
 			}
 		}
-
-		book.Unlock()
 	}
 }
 
 // greedy, humble, and exact are the three order handlers for different scenarios
 // of supply and demand between a match on price. These functions shouldn't handle
 // locking or unlocking, that should all be handled in the AttemptFill function.
+// Each of them is described from the point of view of the fill order, which
+// can be on either side of the match, and each of them commits its match as a
+// single unit.
 
-// exact is a buy order that wants the exact available amount from the sell order
-func exact(book *Book, acc accounts.AccountManager, match *Match, matchCh chan Match, errs chan error) {
+// exact is a fill order that wants the exact amount available from the book order.
+// Both orders are filled and leave the book.
+func exact(book *Book, acc accounts.AccountManager, match *Match, matchCh chan Match) error {
 	available := match.Sell.Open - match.Sell.Filled
 	wanted := match.Buy.Open - match.Buy.Filled
 
-	if wanted == 0 {
-		matchCh <- *match
-		return
-	}
-
 	if available != wanted {
-		log.Fatalf("should not happen, this is a bug - match: %+v", match)
-	}
-
-	amount := float64((available * match.Sell.Price) / 100)
-
-	_, err := acc.Tx(match.Buy.AccountID, match.Sell.AccountID, amount)
-	if err != nil {
-		errs <- fmt.Errorf("failed to transfer: %v", err)
-		return
+		return fmt.Errorf("should not happen, this is a bug - match: %+v", match)
 	}
 
-	match.Buy.Filled += available
-	match.Sell.Filled += available
-
-	match.Buy.History = append(match.Buy.History, *match)
-	match.Sell.History = append(match.Sell.History, *match)
-
-	if ok := book.buy.RemoveOrder(match.Buy); !ok {
-		errs <- fmt.Errorf("failed to remove over from tree %+v", match.Buy)
-		log.Fatalf("failed to remove order from tree %+v", match.Buy)
-	}
-	if ok := book.sell.RemoveOrder(match.Sell); !ok {
-		errs <- fmt.Errorf("failed to remove over from tree %+v", match.Sell)
-		log.Fatalf("failed to remove order from tree %+v", match.Sell)
-	}
-
-	matchCh <- *match
+	match.Quantity = available
+	return commit(book, acc, match, matchCh)
 }
 
-// humble fills a buy order that wants less than is available from the seller
+// humble fills an order that wants less than is available from the book order.
+// The fill order is filled and the book order stays in the book with the rest.
 func humble(
 	book *Book,
 	acc accounts.AccountManager,
 	match *Match,
 	matchCh chan Match,
-	errs chan error,
-) {
+) error {
 	// we know it's a humble fill, so we're taking less than the total available.
-	wanted := match.Buy.Open - match.Buy.Filled
-	amount := float64((wanted * match.Sell.Price) / 100)
-	balances, err := acc.Tx(match.Buy.AccountID, match.Sell.AccountID, amount)
-	if err != nil {
-		errs <- fmt.Errorf("failed to transfer: %v", err)
-		return
-	}
-	log.Printf("[TX] updated balances: %+v", balances)
-
-	match.Buy.Filled += wanted
-	match.Sell.Filled += wanted
-
-	match.Buy.History = append(match.Buy.History, *match)
-	match.Sell.History = append(match.Sell.History, *match)
-
-	if ok := book.buy.RemoveOrder(match.Buy); !ok {
-		errs <- fmt.Errorf("failed to remove order from buy side: %+v", match.Buy)
-	}
-
-	matchCh <- *match
+	match.Quantity = min(match.Buy.Open-match.Buy.Filled, match.Sell.Open-match.Sell.Filled)
+	return commit(book, acc, match, matchCh)
 }
 
-// greedy is a buy order that wants more than is available from the sell order.
+// greedy is a fill order that wants more than is available from the book order.
+// The book order is filled and the fill order goes looking for more.
 func greedy(
 	book *Book,
 	acc accounts.AccountManager,
 	match *Match,
 	matchCh chan Match,
-	errs chan error,
-) {
+) error {
 	// a greedy fill takes all that's available.
-	available := match.Sell.Open - match.Sell.Filled
+	match.Quantity = min(match.Buy.Open-match.Buy.Filled, match.Sell.Open-match.Sell.Filled)
+	return commit(book, acc, match, matchCh)
+}
 
-	amount := float64((available * match.Sell.Price) / 100)
+// commit applies a match to the book as one unit: both orders are updated,
+// orders that are now filled are taken out of the tree and the balances are
+// exchanged. The exchange goes last because it's the only step that can't be
+// undone, so if it fails everything before it is rolled back and the book
+// looks exactly like it did before the match.
+// Once the match is committed the holds of filled orders are released and
+// the match counts towards both accounts' fee tiers.
+func commit(book *Book, acc accounts.AccountManager, match *Match, matchCh chan Match) error {
+	match.Total = match.Quantity * match.Price
+	book.fees(match)
 
-	_, err := acc.Tx(match.Buy.AccountID, match.Sell.AccountID, amount)
+	rollback, err := book.stage(match)
 	if err != nil {
-		errs <- fmt.Errorf("failed to transfer: %v", err)
-		return
+		return err
 	}
 
-	match.Sell.Filled += available
-	match.Buy.Filled += available
+	balances, err := settle(book, acc, match)
+	if err != nil {
+		rollback()
+		return fmt.Errorf("failed to transfer: %v", err)
+	}
+	log.Printf("[TX] updated balances: %+v", balances)
 
-	match.Price = match.Sell.Price
-	match.Quantity = available
+	maker := match.Sell
+	if match.Taker == "sell" {
+		maker = match.Buy
+	}
+	switch {
+	case virtual(maker):
+	case maker.Filled < maker.Open:
+		book.emit(EventModify, maker, maker.Price, maker.Open-maker.Filled)
+	default:
+		book.emit(EventExecute, maker, maker.Price, match.Quantity)
+	}
 
-	match.Buy.History = append(match.Buy.History, *match)
-	match.Sell.History = append(match.Sell.History, *match)
+	for _, o := range []*Order{match.Buy, match.Sell} {
+		book.volumes.add(o.AccountID, value(o, match.Price, match.Quantity), match.Time)
+	}
 
-	if ok := book.sell.RemoveOrder(match.Sell); !ok {
-		errs <- fmt.Errorf("failed to remove sell order from the books %+v", match.Sell)
-		return
+	// the match is committed at this point, so a failed release only
+	// leaves funds held and doesn't undo it.
+	var releaseErr error
+	for _, o := range []*Order{match.Buy, match.Sell} {
+		if o.Filled < o.Open || virtual(o) {
+			continue
+		}
+		if _, err := acc.Release(book.holdID(o)); err != nil {
+			releaseErr = fmt.Errorf("failed to release hold for order %s: %v", o.ID, err)
+		}
 	}
 
 	matchCh <- *match
+	return releaseErr
 }
 
-// TESTS
-
-var numOps = 10_000
-var bufferSize = 1000
+// stage fills both orders of a match and removes the ones that are done
+// from the book. It returns a function that puts the orders and the book
+// back the way they were. If staging fails part-way it rolls itself back.
+func (b *Book) stage(match *Match) (func(), error) {
+	var undo []func()
+	rollback := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
 
-func TestAttemptFillRun(t *testing.T) {
-	ctx := context.Background()
-	wg := &sync.WaitGroup{}
+	for _, o := range []*Order{match.Buy, match.Sell} {
+		o := o
+		filled, history := o.Filled, o.History
+		undo = append(undo, func() {
+			o.Filled, o.History = filled, history
+		})
 
-	accts := &accounts.InMemoryManager{}
-	writes := make(chan OpWrite, bufferSize)
-	errs := make(chan error, bufferSize)
-	fills := make(chan FillResult, bufferSize)
+		o.Filled += match.Quantity
+		o.History = append(o.History, *match)
 
-	go func() {
-		for err := range errs {
-			t.Logf("[error]: %+v", err)
+		if o.Filled < o.Open || virtual(o) {
+			continue
 		}
-	}()
 
-	go func() {
-		for fill := range fills {
-			t.Logf("[fill]: %+v", fill)
+		// keep the node's exact order list so time priority survives a rollback
+		node := b.side(o).Find(o.Price)
+		orders := append([]*Order(nil), node.Orders...)
+		if ok := b.side(o).RemoveOrder(o); !ok {
+			rollback()
+			return nil, fmt.Errorf("failed to remove order from the %s side: %+v", o.Side, o)
 		}
-	}()
+		delete(b.orders, o.ID)
+		undo = append(undo, func() {
+			node.Orders = orders
+			b.orders[o.ID] = o
+		})
+	}
 
-	go Start(ctx, accts, writes, fills, errs)
-
-	for i := 0; i < numOps; i++ {
-		// BUY WRITE
-		buyWrite := OpWrite{
-			Order: Order{
-				ID:     fmt.Sprintf("%v", i),
-				Kind:   "limit",
-				Side:   "buy",
-				Price:  uint64(rand.Intn(100)),
-				Open:   100,
-				Filled: 0,
-				Metadata: map[string]string{
-					"createdAt": fmt.Sprintf("%v", time.Now()),
-				},
-			},
-			Result: make(chan WriteResult),
+	return rollback, nil
+}
+
+// settle exchanges a match's quantity of the book's base asset for its
+// price in the quote asset and charges the match's fees. The buyer pays
+// the seller and the seller delivers to the buyer in a single Exchange, so
+// neither leg can happen without the other. Both legs and the buyer's fee
+// are drawn from the reservations the orders made when they were placed,
+// and the seller's fee comes out of what it's paid. Fees are paid to and
+// rebates are paid by the exchange's fee account. Binary matches settle
+// through the exchange's collateral account instead, see legs.
+func settle(book *Book, acc accounts.AccountManager, match *Match) ([]accounts.Account, error) {
+	buy, sell := match.Buy, match.Sell
+	memo := fmt.Sprintf("%s buy %s sell %s", book.market.Symbol, buy.ID, sell.ID)
+	transfers := []accounts.Transfer{
+		{
+			From:   buy.AccountID,
+			To:     sell.AccountID,
+			Asset:  book.market.Quote,
+			Amount: notional(match.Price, match.Quantity),
+			Hold:   book.holdID(buy),
+			Kind:   accounts.KindMatch,
+			Memo:   memo,
+		},
+		{
+			From:   sell.AccountID,
+			To:     buy.AccountID,
+			Asset:  book.market.Base,
+			Amount: float64(match.Quantity),
+			Hold:   book.holdID(sell),
+			Kind:   accounts.KindMatch,
+			Memo:   memo,
+		},
+	}
+	if book.market.Binary() {
+		transfers = book.legs(match, memo)
+	}
+
+	maker, taker := buy, sell
+	if match.Taker == "buy" {
+		maker, taker = sell, buy
+	}
+	for _, f := range []struct {
+		order *Order
+		fee   float64
+	}{{maker, match.MakerFee}, {taker, match.TakerFee}} {
+		t := accounts.Transfer{
+			From:   f.order.AccountID,
+			To:     accounts.FeeAccount,
+			Asset:  book.market.Quote,
+			Amount: f.fee,
+			Kind:   accounts.KindFee,
+			Memo:   memo,
 		}
-		go func() {
-			<-buyWrite.Result
-			wg.Done()
-		}()
-		wg.Add(1)
-		writes <- buyWrite
-
-		// SELL WRITE
-		sellWrite := OpWrite{
-			Order: Order{
-				ID:     fmt.Sprintf("%v", i),
-				Kind:   "limit",
-				Side:   "sell",
-				Price:  uint64(rand.Intn(100)),
-				Open:   100,
-				Filled: 0,
-				Metadata: map[string]string{
-					"createdAt": fmt.Sprintf("%v", time.Now()),
-				},
-			},
-			Result: make(chan WriteResult),
+		switch {
+		case f.fee > 0 && holdsQuote(f.order):
+			t.Hold = book.holdID(f.order)
+		case f.fee < 0:
+			t.From, t.To, t.Amount = accounts.FeeAccount, f.order.AccountID, -f.fee
+		case f.fee == 0:
+			continue
 		}
-		go func() {
-			<-sellWrite.Result
-			wg.Done()
-		}()
-		wg.Add(1)
-		writes <- sellWrite
+		transfers = append(transfers, t)
 	}
 
-	wg.Wait()
+	return acc.Exchange(transfers...)
+}
+
+// notional returns the quote value of quantity units at price.
+// Prices are denominated in hundredths of the quote asset.
+func notional(price, quantity uint64) float64 {
+	return float64(price*quantity) / 100
+}
+
+// min returns the smaller of two quantities.
+func min(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
 }
 
+// TESTS
+
+var numOps = 10_000
+var bufferSize = 1000
+var testMarket = Market{Symbol: "BTC-USD", Base: "BTC", Quote: accounts.USD}
+
 func TestAttemptFill(t *testing.T) {
 	acc := &accounts.InMemoryManager{
 		Accounts: map[string]*accounts.UserAccount{
 			"foo@test.com": {
-				Email:          "foo@test.com",
-				CurrentBalance: 1000.0,
+				Email:    "foo@test.com",
+				Balances: map[string]float64{"USD": 1000.0},
 			},
 			"bar@test.com": {
-				Email:          "bar@test.com",
-				CurrentBalance: 1000.0,
+				Email:    "bar@test.com",
+				Balances: map[string]float64{"BTC": 1000.0},
 			},
 		},
 	}
@@ -392,6 +869,7 @@ func TestAttemptFill(t *testing.T) {
 			name: "should fill exact",
 			args: args{
 				book: &Book{
+					market: testMarket,
 					buy: &Node{
 						Price:  10,
 						Orders: []*Order{},
@@ -427,6 +905,7 @@ func TestAttemptFill(t *testing.T) {
 			name: "should fill greedy",
 			args: args{
 				book: &Book{
+					market: testMarket,
 					buy: &Node{
 						Price:  10,
 						Orders: []*Order{},
@@ -500,6 +979,7 @@ func TestAttemptFill(t *testing.T) {
 			name: "should fill humble",
 			args: args{
 				book: &Book{
+					market: testMarket,
 					buy: &Node{
 						Price:  10,
 						Orders: []*Order{},
@@ -0,0 +1,141 @@
+package orderbook
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dylanlott/orderbook/pkg/accounts"
+)
+
+func TestAttemptFillRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+
+	accts := accounts.NewAccountManager("")
+	if _, err := accts.Create("buyer", map[string]float64{testMarket.Quote: 1e7}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := accts.Create("seller", map[string]float64{testMarket.Base: 1e7}); err != nil {
+		t.Fatal(err)
+	}
+	writes := make(chan OpWrite, bufferSize)
+	cancels := make(chan OpCancel, bufferSize)
+	errs := make(chan error, bufferSize)
+	fills := make(chan FillResult, bufferSize)
+
+	go func() {
+		for err := range errs {
+			t.Errorf("[error]: %+v", err)
+		}
+	}()
+
+	// every fill is at the maker's price, which the taker's limit crosses
+	var filled uint64
+	var paid float64
+	consumed := make(chan struct{})
+	go func() {
+		for fill := range fills {
+			maker, taker := fill.Sell, fill.Buy
+			if fill.Taker == "sell" {
+				maker, taker = fill.Buy, fill.Sell
+			}
+			if fill.Price != maker.Price || fill.Buy.Price < fill.Sell.Price || fill.Filled == 0 {
+				t.Errorf("bad fill of %s by %s: %+v", maker.ID, taker.ID, fill)
+			}
+			filled += fill.Filled
+			paid += notional(fill.Price, fill.Filled)
+		}
+		close(consumed)
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		Start(ctx, testMarket, accts, writes, cancels, nil, fills, nil, errs)
+		close(done)
+	}()
+
+	for i := 0; i < numOps; i++ {
+		// BUY WRITE
+		buyWrite := OpWrite{
+			Order: Order{
+				ID:        fmt.Sprintf("%v", i),
+				AccountID: "buyer",
+				Kind:      "limit",
+				Side:      "buy",
+				Price:     uint64(rand.Intn(100)),
+				Open:      100,
+				Filled:    0,
+				Metadata: map[string]string{
+					"createdAt": fmt.Sprintf("%v", time.Now()),
+				},
+			},
+			Result: make(chan WriteResult),
+		}
+		go func() {
+			if r := <-buyWrite.Result; r.Err != nil {
+				t.Errorf("order %s was rejected: %v", r.Order.ID, r.Err)
+			}
+			wg.Done()
+		}()
+		wg.Add(1)
+		writes <- buyWrite
+
+		// SELL WRITE
+		sellWrite := OpWrite{
+			Order: Order{
+				ID:        fmt.Sprintf("%v-sell", i),
+				AccountID: "seller",
+				Kind:      "limit",
+				Side:      "sell",
+				Price:     uint64(rand.Intn(100)),
+				Open:      100,
+				Filled:    0,
+				Metadata: map[string]string{
+					"createdAt": fmt.Sprintf("%v", time.Now()),
+				},
+			},
+			Result: make(chan WriteResult),
+		}
+		go func() {
+			if r := <-sellWrite.Result; r.Err != nil {
+				t.Errorf("order %s was rejected: %v", r.Order.ID, r.Err)
+			}
+			wg.Done()
+		}()
+		wg.Add(1)
+		writes <- sellWrite
+	}
+
+	wg.Wait()
+	cancel()
+	<-done
+	close(fills)
+	<-consumed
+
+	// the orders crossed and every fill was settled
+	if filled == 0 {
+		t.Fatal("no orders were filled")
+	}
+	for _, want := range []struct {
+		account, asset string
+		balance        float64
+	}{
+		{"buyer", testMarket.Base, float64(filled)},
+		{"buyer", testMarket.Quote, 1e7 - paid},
+		{"seller", testMarket.Base, 1e7 - float64(filled)},
+		{"seller", testMarket.Quote, paid},
+	} {
+		a, err := accts.Get(want.account)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := a.Balance(want.asset); math.Abs(got-want.balance) > 1e-6 {
+			t.Errorf("%s has %v %s, want %v", want.account, got, want.asset, want.balance)
+		}
+	}
+}
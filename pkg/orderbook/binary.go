@@ -0,0 +1,112 @@
+package orderbook
+
+import (
+	"fmt"
+
+	"github.com/dylanlott/orderbook/pkg/accounts"
+)
+
+// Outcomes of a binary market that an order can trade.
+const (
+	Yes = "yes"
+	No  = "no"
+)
+
+// payout is the price of a binary contract that pays out, which is one
+// of the quote asset. A YES and a NO contract are together always worth it.
+const payout uint64 = 100
+
+// Binary reports whether the market trades binary outcome contracts. A
+// binary market's Base is its YES contract and No is its NO contract.
+func (m Market) Binary() bool {
+	return m.No != ""
+}
+
+// normalize checks an order against the book's market and puts NO orders
+// in YES terms. A buy of NO at p is the same as a sell of YES at 100-p, so
+// a NO order is flipped to the other side at the complementary price and
+// keeps its Outcome to remember what it trades.
+func (b *Book) normalize(o *Order) error {
+	if !b.market.Binary() {
+		if o.Outcome != "" {
+			return fmt.Errorf("%s is not a binary market", b.market.Symbol)
+		}
+		return nil
+	}
+	if o.Outcome == "" {
+		o.Outcome = Yes
+	}
+	if o.Outcome != Yes && o.Outcome != No {
+		return fmt.Errorf("invalid outcome %q for order %s", o.Outcome, o.ID)
+	}
+	if o.Price == 0 || o.Price >= payout {
+		return fmt.Errorf("invalid price %d for order %s: binary contracts trade between 0 and %d", o.Price, o.ID, payout)
+	}
+	if o.Outcome == No {
+		o.Price = payout - o.Price
+		if o.Side == "buy" {
+			o.Side = "sell"
+		} else {
+			o.Side = "buy"
+		}
+	}
+	return nil
+}
+
+// holdsQuote reports whether an order pays for what it trades in the
+// quote asset, as opposed to delivering contracts. NO orders sit on the
+// opposite side of the book from what they do.
+func holdsQuote(o *Order) bool {
+	return (o.Side == "buy") != (o.Outcome == No)
+}
+
+// contract returns the asset that an order trades.
+func (b *Book) contract(o *Order) string {
+	if o.Outcome == No {
+		return b.market.No
+	}
+	return b.market.Base
+}
+
+// value returns what quantity of an order is worth at a price in the
+// book's YES terms, from the point of view of the order.
+func value(o *Order, price, quantity uint64) float64 {
+	if o.Outcome == No {
+		return notional(payout-price, quantity)
+	}
+	return notional(price, quantity)
+}
+
+// legs returns the transfers of a binary match. Every order trades with
+// the exchange's collateral account instead of with each other: buyers pay
+// it and are given contracts and sellers hand it contracts and are paid.
+// When a YES and a NO buyer match, that mints a pair of contracts backed
+// by the full payout, and when a YES and a NO seller match it burns one.
+func (b *Book) legs(match *Match, memo string) []accounts.Transfer {
+	var transfers []accounts.Transfer
+	for _, o := range []*Order{match.Buy, match.Sell} {
+		paid := accounts.Transfer{
+			From:   o.AccountID,
+			To:     accounts.CollateralAccount,
+			Asset:  b.market.Quote,
+			Amount: value(o, match.Price, match.Quantity),
+			Hold:   b.holdID(o),
+			Kind:   accounts.KindMatch,
+			Memo:   memo,
+		}
+		delivered := accounts.Transfer{
+			From:   accounts.CollateralAccount,
+			To:     o.AccountID,
+			Asset:  b.contract(o),
+			Amount: float64(match.Quantity),
+			Kind:   accounts.KindMatch,
+			Memo:   memo,
+		}
+		if !holdsQuote(o) {
+			paid.From, paid.To, paid.Hold = accounts.CollateralAccount, o.AccountID, ""
+			delivered.From, delivered.To, delivered.Hold = o.AccountID, accounts.CollateralAccount, b.holdID(o)
+		}
+		transfers = append(transfers, paid, delivered)
+	}
+	return transfers
+}
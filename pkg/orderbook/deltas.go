@@ -0,0 +1,215 @@
+package orderbook
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// LevelDelta is the new state of one price level of a book. A level with
+// nothing left at it has been removed from the book. Every delta of a
+// book has the next sequence number, starting at 1.
+type LevelDelta struct {
+	Seq      uint64 `json:"seq"`
+	Side     string `json:"side"`
+	Price    uint64 `json:"price"`
+	Quantity uint64 `json:"quantity"`
+	Orders   int    `json:"orders"`
+}
+
+// levelKey names a price level on a side of a book.
+type levelKey struct {
+	side  string
+	price uint64
+}
+
+// levelTracker keeps the totals of a book's price levels as orders come
+// and go and turns the levels that changed into deltas.
+type levelTracker struct {
+	seq     uint64
+	levels  map[levelKey]*Level
+	touched []levelKey
+}
+
+// set sets a level on a side to what it is now.
+func (t *levelTracker) set(side string, level Level) {
+	if t.levels == nil {
+		t.levels = make(map[levelKey]*Level)
+	}
+	k := levelKey{side: side, price: level.Price}
+	t.levels[k] = &level
+	t.touched = append(t.touched, k)
+}
+
+// deltas returns a delta for every level that changed since the last
+// call, in the order they were first changed, and forgets levels that
+// are now empty.
+func (t *levelTracker) deltas() []LevelDelta {
+	var deltas []LevelDelta
+	seen := map[levelKey]bool{}
+	for _, k := range t.touched {
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		level := t.levels[k]
+		t.seq++
+		deltas = append(deltas, LevelDelta{
+			Seq:      t.seq,
+			Side:     k.side,
+			Price:    k.price,
+			Quantity: level.Quantity,
+			Orders:   level.Orders,
+		})
+		if level.Orders == 0 {
+			delete(t.levels, k)
+		}
+	}
+	t.touched = nil
+	return deltas
+}
+
+// levels turns events that the book drained into deltas of the levels
+// that they changed. Events are how the book tells which of its levels
+// changed; the deltas carry each level as it is in the tree.
+func (b *Book) levels(t *levelTracker, events []OrderEvent) []LevelDelta {
+	for _, e := range events {
+		t.set(e.Side, b.level(e.Side, e.Price))
+	}
+	return t.deltas()
+}
+
+// level returns the open quantity and orders at a price on a side of the book.
+func (b *Book) level(side string, price uint64) Level {
+	b.Lock()
+	defer b.Unlock()
+
+	tree := b.sell
+	if side == "buy" {
+		tree = b.buy
+	}
+	level := Level{Price: price}
+	for _, o := range tree.Find(price).Orders {
+		level.Quantity += o.Open - o.Filled
+		level.Orders++
+	}
+	return level
+}
+
+// DepthView rebuilds a book's depth from its level deltas. It's safe for
+// concurrent use.
+//
+// A client that misses a delta loads a snapshot of the book with Load,
+// which is tagged with the sequence number it reflects, and goes on
+// applying deltas from there. Deltas that the snapshot already reflects
+// are skipped.
+type DepthView struct {
+	sync.RWMutex
+
+	seq    uint64
+	levels map[levelKey]Level
+}
+
+// NewDepthView returns an empty DepthView that expects deltas from the
+// first one.
+func NewDepthView() *DepthView {
+	return &DepthView{levels: make(map[levelKey]Level)}
+}
+
+// Seq returns the sequence number of the last delta applied.
+func (v *DepthView) Seq() uint64 {
+	v.RLock()
+	defer v.RUnlock()
+	return v.seq
+}
+
+// Apply applies the next delta. It returns an error without applying
+// anything if deltas were missed.
+func (v *DepthView) Apply(d LevelDelta) error {
+	v.Lock()
+	defer v.Unlock()
+
+	switch {
+	case d.Seq <= v.seq:
+		return nil
+	case d.Seq > v.seq+1:
+		return fmt.Errorf("missed deltas %d to %d", v.seq+1, d.Seq-1)
+	}
+
+	k := levelKey{side: d.Side, price: d.Price}
+	if d.Orders == 0 {
+		delete(v.levels, k)
+	} else {
+		v.levels[k] = Level{Price: d.Price, Quantity: d.Quantity, Orders: d.Orders}
+	}
+	v.seq = d.Seq
+	return nil
+}
+
+// Load replaces the view with an ungrouped snapshot of every level.
+func (v *DepthView) Load(snapshot Depth) {
+	v.Lock()
+	defer v.Unlock()
+
+	v.seq = snapshot.Seq
+	v.levels = make(map[levelKey]Level)
+	for side, levels := range map[string][]Level{"buy": snapshot.Bids, "sell": snapshot.Asks} {
+		for _, level := range levels {
+			v.levels[levelKey{side: side, price: level.Price}] = level
+		}
+	}
+}
+
+// Top returns the best bid and ask, or zero for a side that's empty.
+func (v *DepthView) Top() (uint64, uint64) {
+	v.RLock()
+	defer v.RUnlock()
+
+	var bid, ask uint64
+	for k := range v.levels {
+		if k.side == "buy" && k.price > bid {
+			bid = k.price
+		}
+		if k.side == "sell" && (ask == 0 || k.price < ask) {
+			ask = k.price
+		}
+	}
+	return bid, ask
+}
+
+// Snapshot returns the view's depth tagged with the sequence number of
+// the last delta applied. It takes a limit and group like Book.Depth.
+func (v *DepthView) Snapshot(limit int, group uint64) Depth {
+	v.RLock()
+	defer v.RUnlock()
+
+	var bids, asks []Level
+	for k, level := range v.levels {
+		if k.side == "buy" {
+			bids = append(bids, level)
+		} else {
+			asks = append(asks, level)
+		}
+	}
+	sort.Slice(bids, func(i, j int) bool { return bids[i].Price > bids[j].Price })
+	sort.Slice(asks, func(i, j int) bool { return asks[i].Price < asks[j].Price })
+
+	if group == 0 {
+		group = 1
+	}
+	grouped := Depth{Seq: v.seq}
+	for _, side := range []struct {
+		levels []Level
+		into   *[]Level
+		down   bool
+	}{{bids, &grouped.Bids, true}, {asks, &grouped.Asks, false}} {
+		l := &levels{limit: limit, group: group, down: side.down, levels: []Level{}}
+		for _, level := range side.levels {
+			if !l.add(level) {
+				break
+			}
+		}
+		*side.into = l.levels
+	}
+	return grouped
+}
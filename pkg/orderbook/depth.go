@@ -0,0 +1,86 @@
+package orderbook
+
+// Level is one price level of a book's aggregated depth.
+type Level struct {
+	Price    uint64 `json:"price"`
+	Quantity uint64 `json:"quantity"` // total open quantity at the price
+	Orders   int    `json:"orders"`   // number of open orders at the price
+}
+
+// Depth is a book's open quantity aggregated by price, best price first
+// on each side. Seq is the sequence number of the last change to the book
+// that it reflects, in whichever feed the book publishes.
+type Depth struct {
+	Seq  uint64  `json:"seq"`
+	Bids []Level `json:"bids"`
+	Asks []Level `json:"asks"`
+}
+
+// depth returns up to limit levels of each side of the book, or all of
+// them if limit isn't positive. A group above 1 merges prices into levels
+// that many hundredths wide: bids are rounded down and asks up, so a
+// grouped level never looks better than the orders in it. The book must be
+// locked by the caller.
+func (b *Book) depth(limit int, group uint64) Depth {
+	if group == 0 {
+		group = 1
+	}
+	bids := &levels{limit: limit, group: group, down: true, levels: []Level{}}
+	b.buy.walk(true, bids.node)
+	asks := &levels{limit: limit, group: group, levels: []Level{}}
+	b.sell.walk(false, asks.node)
+	return Depth{Seq: b.seq, Bids: bids.levels, Asks: asks.levels}
+}
+
+// levels collects the nodes of a side into grouped levels, best first.
+type levels struct {
+	limit  int
+	group  uint64
+	down   bool // round prices down to the group, for bids
+	levels []Level
+}
+
+// node adds the orders of a node to the levels.
+func (l *levels) node(n *Node) bool {
+	if len(n.Orders) == 0 {
+		return true
+	}
+	level := Level{Price: n.Price, Orders: len(n.Orders)}
+	for _, o := range n.Orders {
+		level.Quantity += o.Open - o.Filled
+	}
+	return l.add(level)
+}
+
+// add adds a level to the levels, which must be added best first. It
+// returns false once the limit is reached and no more levels are wanted.
+func (l *levels) add(level Level) bool {
+	price := level.Price / l.group * l.group
+	if !l.down && price < level.Price {
+		price += l.group
+	}
+
+	if last := len(l.levels) - 1; last < 0 || l.levels[last].Price != price {
+		if l.limit > 0 && len(l.levels) == l.limit {
+			return false
+		}
+		l.levels = append(l.levels, Level{Price: price})
+	}
+	grouped := &l.levels[len(l.levels)-1]
+	grouped.Quantity += level.Quantity
+	grouped.Orders += level.Orders
+	return true
+}
+
+// walk visits the nodes of the tree in price order, highest first if desc
+// is true, until visit returns false. It returns false if it was stopped.
+func (n *Node) walk(desc bool, visit func(*Node) bool) bool {
+	if n == nil {
+		return true
+	}
+	first, last := n.Left, n.Right
+	if desc {
+		first, last = n.Right, n.Left
+	}
+	return first.walk(desc, visit) && visit(n) && last.walk(desc, visit)
+}
@@ -0,0 +1,163 @@
+package orderbook
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+// restore returns a Book of testMarket holding orders as they are, without
+// reserving anything for them. Filled orders are left out.
+func restore(orders []*Order) *Book {
+	b := NewBook(testMarket)
+	for _, o := range orders {
+		if o.Filled >= o.Open {
+			continue
+		}
+		b.side(o).Insert(o)
+		b.orders[o.ID] = o
+	}
+	return b
+}
+
+func TestDepth(t *testing.T) {
+	is := is.New(t)
+	book := restore([]*Order{
+		{ID: "b1", Side: "buy", Price: 990, Open: 5, Filled: 2},
+		{ID: "b2", Side: "buy", Price: 1000, Open: 1},
+		{ID: "b3", Side: "buy", Price: 990, Open: 4},
+		{ID: "b4", Side: "buy", Price: 975, Open: 2},
+		{ID: "b5", Side: "buy", Price: 1005, Open: 2, Filled: 2}, // filled
+		{ID: "s1", Side: "sell", Price: 1010, Open: 3},
+		{ID: "s2", Side: "sell", Price: 1025, Open: 1},
+		{ID: "s3", Side: "sell", Price: 1011, Open: 2},
+	})
+
+	is.Equal(book.depth(0, 0), Depth{
+		Bids: []Level{{Price: 1000, Quantity: 1, Orders: 1}, {Price: 990, Quantity: 7, Orders: 2}, {Price: 975, Quantity: 2, Orders: 1}},
+		Asks: []Level{{Price: 1010, Quantity: 3, Orders: 1}, {Price: 1011, Quantity: 2, Orders: 1}, {Price: 1025, Quantity: 1, Orders: 1}},
+	})
+
+	// a limit keeps the best levels
+	depth := book.depth(1, 1)
+	is.Equal(depth.Bids, []Level{{Price: 1000, Quantity: 1, Orders: 1}})
+	is.Equal(depth.Asks, []Level{{Price: 1010, Quantity: 3, Orders: 1}})
+
+	// grouping rounds bids down and asks up
+	is.Equal(book.depth(2, 20), Depth{
+		Bids: []Level{{Price: 1000, Quantity: 1, Orders: 1}, {Price: 980, Quantity: 7, Orders: 2}},
+		Asks: []Level{{Price: 1020, Quantity: 5, Orders: 2}, {Price: 1040, Quantity: 1, Orders: 1}},
+	})
+
+	empty := NewBook(testMarket).depth(10, 1)
+	is.Equal(len(empty.Bids), 0)
+	is.True(empty.Asks != nil)
+}
+
+func TestRunDeltas(t *testing.T) {
+	is := is.New(t)
+	in := make(chan *Order)
+	out := make(chan *Match, bufferSize)
+	fills := make(chan []*Order, bufferSize)
+	deltas := make(chan LevelDelta, bufferSize)
+	reads := make(chan OpRead)
+	done := make(chan struct{})
+	go func() {
+		Run(context.Background(), testMarket, fundedAccounts(t, "alice", "bob"), in, nil, nil, nil, reads, out, fills, deltas, nil, nil)
+		close(done)
+	}()
+
+	orders := []*Order{
+		{ID: "s1", AccountID: "alice", Side: "sell", Price: 1000, Open: 10},
+		{ID: "s2", AccountID: "alice", Side: "sell", Price: 1000, Open: 5},
+		{ID: "s3", AccountID: "alice", Side: "sell", Price: 1010, Open: 3},
+		{ID: "b1", AccountID: "bob", Side: "buy", Price: 990, Open: 2},
+		{ID: "b2", AccountID: "bob", Side: "buy", Price: 1000, Open: 12},
+		{ID: "b3", AccountID: "bob", Side: "buy", Price: 1010, Open: 7},
+	}
+	for _, o := range orders {
+		in <- o
+	}
+	result := make(chan ReadResult, 1)
+	reads <- OpRead{Levels: -1, Group: 1, Result: result}
+	read := <-result
+	close(in)
+	<-done
+	close(deltas)
+
+	// a view that joins late recovers from a snapshot of one that didn't
+	view, late := NewDepthView(), NewDepthView()
+	var missed []LevelDelta
+	for d := range deltas {
+		is.NoErr(view.Apply(d))
+		if d.Seq == 4 {
+			is.True(late.Apply(d) != nil) // the late view missed 1 to 3
+			late.Load(view.Snapshot(0, 1))
+		}
+		missed = append(missed, d)
+	}
+	for _, d := range missed {
+		is.NoErr(late.Apply(d)) // deltas in the snapshot are skipped
+	}
+
+	want := restore(orders).depth(0, 1)
+	want.Seq = view.Seq()
+	is.Equal(view.Snapshot(0, 1), want)
+	is.Equal(late.Snapshot(0, 1), want)
+	is.Equal(read.Depth, want) // reads are tagged with the last delta
+	// b3 took every ask and rests with what's left
+	is.Equal(len(want.Asks), 0)
+	is.Equal(want.Bids, []Level{{Price: 1010, Quantity: 1, Orders: 1}, {Price: 990, Quantity: 2, Orders: 1}})
+	is.Equal(view.Snapshot(1, 100).Bids, []Level{{Price: 1000, Quantity: 1, Orders: 1}})
+}
+
+func TestRunCancel(t *testing.T) {
+	is := is.New(t)
+	in := make(chan *Order)
+	cancels := make(chan OpCancel)
+	out := make(chan *Match, bufferSize)
+	fills := make(chan []*Order, bufferSize)
+	deltas := make(chan LevelDelta, bufferSize)
+	done := make(chan struct{})
+	go func() {
+		Run(context.Background(), testMarket, fundedAccounts(t, "alice", "bob"), in, nil, cancels, nil, nil, out, fills, deltas, nil, nil)
+		close(done)
+	}()
+
+	in <- &Order{ID: "a1", AccountID: "alice", Side: "buy", Price: 990, Open: 2}
+	in <- &Order{ID: "a2", AccountID: "alice", Side: "sell", Price: 1010, Open: 3}
+	in <- &Order{ID: "b1", AccountID: "bob", Side: "buy", Price: 990, Open: 1}
+	cancel := func(op OpCancel) CancelResult {
+		op.Result = make(chan CancelResult)
+		cancels <- op
+		return <-op.Result
+	}
+
+	// an order is only canceled for the account that placed it
+	is.True(cancel(OpCancel{OrderID: "a1", AccountID: "bob"}).Err != nil)
+	r := cancel(OpCancel{OrderID: "a1", AccountID: "alice"})
+	is.NoErr(r.Err)
+	is.Equal(r.Order.ID, "a1")
+	is.True(cancel(OpCancel{OrderID: "a1"}).Err != nil) // already canceled
+
+	r = cancel(OpCancel{AccountID: "alice"})
+	is.NoErr(r.Err)
+	is.Equal(len(r.Orders), 1)
+	is.Equal(r.Orders[0].ID, "a2")
+
+	// a canceled order is never matched
+	in <- &Order{ID: "b2", AccountID: "bob", Side: "buy", Price: 1010, Open: 1}
+	close(in)
+	<-done
+	close(deltas)
+	is.Equal(len(out), 0)
+
+	view := NewDepthView()
+	for d := range deltas {
+		is.NoErr(view.Apply(d))
+	}
+	depth := view.Snapshot(0, 1)
+	is.Equal(depth.Bids, []Level{{Price: 1010, Quantity: 1, Orders: 1}, {Price: 990, Quantity: 1, Orders: 1}})
+	is.Equal(len(depth.Asks), 0)
+}
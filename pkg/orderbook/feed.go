@@ -0,0 +1,232 @@
+package orderbook
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Kinds of OrderEvent.
+const (
+	// EventAdd is an order that starts resting in the book, at the back of
+	// the queue at its price.
+	EventAdd = "add"
+	// EventModify is a resting order whose price or quantity changed,
+	// because it was partly filled by an incoming order or amended. It
+	// keeps its place in the queue if only its quantity went down and goes
+	// to the back of the queue at its new price otherwise.
+	EventModify = "modify"
+	// EventCancel is a resting order that left the book without being
+	// filled, because it was canceled or it expired.
+	EventCancel = "cancel"
+	// EventExecute is the fill of a resting order by an incoming one that
+	// left nothing of it, so it leaves the book.
+	EventExecute = "execute"
+)
+
+// OrderEvent is one change to a book in its market-by-order feed. Orders
+// are identified by a reference number that's only meaningful within the
+// book, so nothing about who placed them is published. Every event of a
+// book has the next sequence number, starting at 1.
+type OrderEvent struct {
+	Seq    uint64    `json:"seq"`
+	Symbol string    `json:"symbol"`
+	Kind   string    `json:"kind"`
+	Ref    uint64    `json:"ref"`
+	Side   string    `json:"side"`
+	Price  uint64    `json:"price"`
+	Time   time.Time `json:"time"`
+	// Quantity is the quantity that was added, canceled or executed, or
+	// what's left of a modified order.
+	Quantity uint64 `json:"quantity"`
+}
+
+// emit records an event for a resting order. The book must be locked by
+// the caller.
+func (b *Book) emit(kind string, o *Order, price, quantity uint64) {
+	if b.refs == nil {
+		b.refs = make(map[string]uint64)
+	}
+	ref, ok := b.refs[o.ID]
+	if !ok {
+		b.ref++
+		ref = b.ref
+		b.refs[o.ID] = ref
+	}
+	if kind == EventCancel || (kind == EventExecute && o.Filled >= o.Open) {
+		delete(b.refs, o.ID)
+	}
+
+	b.seq++
+	b.events = append(b.events, OrderEvent{
+		Seq:      b.seq,
+		Symbol:   b.market.Symbol,
+		Kind:     kind,
+		Ref:      ref,
+		Side:     o.Side,
+		Price:    price,
+		Quantity: quantity,
+		Time:     time.Now(),
+	})
+}
+
+// rested records an add event for an order if it's resting in the book.
+// Incoming orders are only added once they're done matching.
+func (b *Book) rested(o *Order) {
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.orders[o.ID]; ok {
+		b.emit(EventAdd, o, o.Price, o.Open-o.Filled)
+	}
+}
+
+// drain returns every event recorded since the last drain, in order.
+func (b *Book) drain() []OrderEvent {
+	b.Lock()
+	defer b.Unlock()
+	pending := b.events
+	b.events = nil
+	return pending
+}
+
+// flush sends every event recorded since the last flush on events, in
+// order. Events are dropped if events is nil.
+func (b *Book) flush(events chan OrderEvent) {
+	pending := b.drain()
+	if events == nil {
+		return
+	}
+	for _, e := range pending {
+		events <- e
+	}
+}
+
+// QueuedOrder is an order resting in a MarketByOrder.
+type QueuedOrder struct {
+	Ref      uint64 `json:"ref"`
+	Side     string `json:"side"`
+	Price    uint64 `json:"price"`
+	Quantity uint64 `json:"quantity"`
+}
+
+// MarketByOrder rebuilds a book from its market-by-order feed, down to the
+// order of the queue at every price.
+type MarketByOrder struct {
+	// Seq is the sequence number of the last event applied.
+	Seq uint64
+
+	orders map[uint64]*QueuedOrder
+	queues map[string]map[uint64][]*QueuedOrder
+}
+
+// NewMarketByOrder returns an empty MarketByOrder that expects the feed
+// from its first event.
+func NewMarketByOrder() *MarketByOrder {
+	return &MarketByOrder{
+		orders: make(map[uint64]*QueuedOrder),
+		queues: map[string]map[uint64][]*QueuedOrder{
+			"buy":  make(map[uint64][]*QueuedOrder),
+			"sell": make(map[uint64][]*QueuedOrder),
+		},
+	}
+}
+
+// Apply applies the next event of the feed. Events that don't follow the
+// last one applied are rejected, so a gap in the feed is never applied
+// over.
+func (m *MarketByOrder) Apply(e OrderEvent) error {
+	if e.Seq != m.Seq+1 {
+		return fmt.Errorf("expected event %d, got %d", m.Seq+1, e.Seq)
+	}
+
+	switch e.Kind {
+	case EventAdd:
+		if _, ok := m.orders[e.Ref]; ok {
+			return fmt.Errorf("order %d was already added", e.Ref)
+		}
+		if _, ok := m.queues[e.Side]; !ok {
+			return fmt.Errorf("invalid side %q for order %d", e.Side, e.Ref)
+		}
+		o := &QueuedOrder{Ref: e.Ref, Side: e.Side, Price: e.Price, Quantity: e.Quantity}
+		m.orders[e.Ref] = o
+		m.queues[o.Side][o.Price] = append(m.queues[o.Side][o.Price], o)
+	case EventModify:
+		o, ok := m.orders[e.Ref]
+		if !ok {
+			return fmt.Errorf("order %d is not open", e.Ref)
+		}
+		if e.Price == o.Price && e.Quantity <= o.Quantity {
+			o.Quantity = e.Quantity
+			break
+		}
+		m.dequeue(o)
+		o.Price, o.Quantity = e.Price, e.Quantity
+		m.queues[o.Side][o.Price] = append(m.queues[o.Side][o.Price], o)
+	case EventCancel, EventExecute:
+		o, ok := m.orders[e.Ref]
+		if !ok {
+			return fmt.Errorf("order %d is not open", e.Ref)
+		}
+		if e.Quantity > o.Quantity {
+			return fmt.Errorf("order %d only has %d left, not %d", e.Ref, o.Quantity, e.Quantity)
+		}
+		o.Quantity -= e.Quantity
+		if e.Kind == EventCancel || o.Quantity == 0 {
+			m.dequeue(o)
+			delete(m.orders, o.Ref)
+		}
+	default:
+		return fmt.Errorf("invalid event kind %q", e.Kind)
+	}
+
+	m.Seq = e.Seq
+	return nil
+}
+
+// dequeue takes an order out of the queue at its price.
+func (m *MarketByOrder) dequeue(o *QueuedOrder) {
+	queue := m.queues[o.Side][o.Price]
+	for i, q := range queue {
+		if q == o {
+			queue = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) == 0 {
+		delete(m.queues[o.Side], o.Price)
+		return
+	}
+	m.queues[o.Side][o.Price] = queue
+}
+
+// Orders returns every resting order, bids from the highest price down and
+// then asks from the lowest price up, with the orders at each price first
+// in line first.
+func (m *MarketByOrder) Orders() []QueuedOrder {
+	orders := []QueuedOrder{}
+	for _, side := range []string{"buy", "sell"} {
+		var prices []uint64
+		for price := range m.queues[side] {
+			prices = append(prices, price)
+		}
+		sort.Slice(prices, func(i, j int) bool {
+			if side == "buy" {
+				return prices[i] > prices[j]
+			}
+			return prices[i] < prices[j]
+		})
+		for _, price := range prices {
+			orders = append(orders, m.Queue(side, price)...)
+		}
+	}
+	return orders
+}
+
+// Queue returns the orders resting on a side at a price, first in line first.
+func (m *MarketByOrder) Queue(side string, price uint64) []QueuedOrder {
+	queue := []QueuedOrder{}
+	for _, o := range m.queues[side][price] {
+		queue = append(queue, *o)
+	}
+	return queue
+}
@@ -0,0 +1,80 @@
+package orderbook
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dylanlott/orderbook/pkg/accounts"
+	"github.com/matryer/is"
+)
+
+func TestMarketByOrder(t *testing.T) {
+	is := is.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	acc := accounts.NewAccountManager("")
+	for id, balances := range map[string]map[string]float64{
+		"buyer":  {testMarket.Quote: 1000},
+		"seller": {testMarket.Base: 20},
+	} {
+		_, err := acc.Create(id, balances)
+		is.NoErr(err)
+	}
+	writes := make(chan OpWrite)
+	cancels := make(chan OpCancel)
+	reads := make(chan OpRead)
+	fills := make(chan FillResult, bufferSize)
+	events := make(chan OrderEvent, bufferSize)
+	errs := make(chan error, bufferSize)
+	go Start(ctx, testMarket, acc, writes, cancels, reads, fills, events, errs)
+
+	is.NoErr(write(writes, Order{ID: "s1", AccountID: "seller", Side: "sell", Price: 1000, Open: 10}).Err)
+	is.NoErr(write(writes, Order{ID: "s2", AccountID: "seller", Side: "sell", Price: 1000, Open: 5}).Err)
+	is.NoErr(write(writes, Order{ID: "s3", AccountID: "seller", Side: "sell", Price: 1010, Open: 3}).Err)
+	// b1 takes all of s1 and some of s2 and never rests
+	is.NoErr(write(writes, Order{ID: "b1", AccountID: "buyer", Side: "buy", Price: 1000, Open: 12}).Err)
+	is.NoErr(write(writes, Order{ID: "b2", AccountID: "buyer", Side: "buy", Price: 990, Open: 4}).Err)
+	result := make(chan CancelResult)
+	cancels <- OpCancel{OrderID: "s3", Result: result}
+	is.NoErr((<-result).Err)
+
+	var kinds []string
+	mbo := NewMarketByOrder()
+	for mbo.Seq < 7 {
+		e := <-events
+		is.Equal(e.Symbol, testMarket.Symbol)
+		is.NoErr(mbo.Apply(e))
+		kinds = append(kinds, e.Kind)
+	}
+	is.Equal(kinds, []string{EventAdd, EventAdd, EventAdd, EventExecute, EventModify, EventAdd, EventCancel})
+
+	is.Equal(mbo.Queue("sell", 1000), []QueuedOrder{{Ref: 2, Side: "sell", Price: 1000, Quantity: 3}})
+	is.Equal(len(mbo.Queue("sell", 1010)), 0)
+	is.Equal(mbo.Queue("buy", 990), []QueuedOrder{{Ref: 4, Side: "buy", Price: 990, Quantity: 4}})
+	is.Equal(mbo.Orders(), []QueuedOrder{
+		{Ref: 4, Side: "buy", Price: 990, Quantity: 4},
+		{Ref: 2, Side: "sell", Price: 1000, Quantity: 3},
+	})
+
+	// and that's what the book holds
+	read := make(chan ReadResult)
+	reads <- OpRead{Levels: -1, Result: read}
+	is.Equal((<-read).Depth, Depth{
+		Seq:  7,
+		Bids: []Level{{Price: 990, Quantity: 4, Orders: 1}},
+		Asks: []Level{{Price: 1000, Quantity: 3, Orders: 1}},
+	})
+
+	// gaps aren't applied over
+	is.True(mbo.Apply(OrderEvent{Seq: 9, Kind: EventCancel, Ref: 4, Quantity: 4}) != nil)
+	is.True(mbo.Apply(OrderEvent{Seq: 8, Kind: EventExecute, Ref: 4, Quantity: 5}) != nil)
+	is.Equal(mbo.Seq, uint64(7))
+
+	// modifies keep their place only if they shrink
+	is.NoErr(mbo.Apply(OrderEvent{Seq: 8, Kind: EventAdd, Ref: 5, Side: "buy", Price: 990, Quantity: 1}))
+	is.NoErr(mbo.Apply(OrderEvent{Seq: 9, Kind: EventModify, Ref: 4, Side: "buy", Price: 990, Quantity: 2}))
+	is.Equal(mbo.Queue("buy", 990)[0].Ref, uint64(4))
+	is.NoErr(mbo.Apply(OrderEvent{Seq: 10, Kind: EventModify, Ref: 4, Side: "buy", Price: 990, Quantity: 3}))
+	is.Equal(mbo.Queue("buy", 990), []QueuedOrder{{Ref: 5, Side: "buy", Price: 990, Quantity: 1}, {Ref: 4, Side: "buy", Price: 990, Quantity: 3}})
+}
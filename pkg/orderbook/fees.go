@@ -0,0 +1,126 @@
+package orderbook
+
+import (
+	"math"
+	"time"
+)
+
+// volumeWindow is the rolling period that fee tiers are measured over.
+var volumeWindow = 30 * 24 * time.Hour
+
+// Rates are the fees an account pays as a fraction of a match's notional
+// value, so 0.001 is 10 basis points. A negative Maker rate is a rebate
+// that the exchange pays to makers.
+type Rates struct {
+	Maker float64
+	Taker float64
+}
+
+// Tier applies its Rates to accounts that have traded at least Volume,
+// in the quote asset, over the last 30 days.
+type Tier struct {
+	Volume float64
+	Rates
+}
+
+// FeeSchedule is how a market charges for matches. The maker is the order
+// that was resting in the book and the taker is the order that crossed it.
+type FeeSchedule struct {
+	// Tiers must be sorted by ascending Volume. An account gets the rates
+	// of the last tier that its volume reaches, and pays nothing if it
+	// doesn't reach any of them.
+	Tiers []Tier
+	// Overrides replace the tiered rates of specific accounts.
+	Overrides map[string]Rates
+}
+
+// Rates returns the rates an account pays given its 30 day volume.
+func (f *FeeSchedule) Rates(accountID string, volume float64) Rates {
+	if f == nil {
+		return Rates{}
+	}
+	if r, ok := f.Overrides[accountID]; ok {
+		return r
+	}
+	var rates Rates
+	for _, t := range f.Tiers {
+		if volume < t.Volume {
+			break
+		}
+		rates = t.Rates
+	}
+	return rates
+}
+
+// maxRate returns the most an account can be charged as a fraction of
+// notional, as maker or taker, whatever tier its volume puts it in.
+func (f *FeeSchedule) maxRate(accountID string) float64 {
+	if f == nil {
+		return 0
+	}
+	if r, ok := f.Overrides[accountID]; ok {
+		return math.Max(0, math.Max(r.Maker, r.Taker))
+	}
+	var rate float64
+	for _, t := range f.Tiers {
+		rate = math.Max(rate, math.Max(t.Maker, t.Taker))
+	}
+	return rate
+}
+
+// volumes tracks how much each account has traded over the volumeWindow.
+type volumes struct {
+	fills map[string][]fillVolume
+}
+
+type fillVolume struct {
+	at     time.Time
+	amount float64
+}
+
+// add records amount of volume traded by an account.
+func (v *volumes) add(accountID string, amount float64, at time.Time) {
+	if v.fills == nil {
+		v.fills = make(map[string][]fillVolume)
+	}
+	v.fills[accountID] = append(v.fills[accountID], fillVolume{at: at, amount: amount})
+}
+
+// total returns an account's volume over the window ending at now and
+// forgets the fills that have fallen out of it.
+func (v *volumes) total(accountID string, now time.Time) float64 {
+	fills := v.fills[accountID]
+	since := now.Add(-volumeWindow)
+	for len(fills) > 0 && fills[0].at.Before(since) {
+		fills = fills[1:]
+	}
+	if len(fills) == 0 {
+		delete(v.fills, accountID)
+		return 0
+	}
+	v.fills[accountID] = fills
+
+	var total float64
+	for _, f := range fills {
+		total += f.amount
+	}
+	return total
+}
+
+// rates returns the rates an account currently pays in the book's market.
+func (b *Book) rates(accountID string) Rates {
+	return b.market.Fees.Rates(accountID, b.volumes.total(accountID, time.Now()))
+}
+
+// fees prices the maker and taker fees of a match in the quote asset.
+func (b *Book) fees(match *Match) {
+	maker, taker := match.Buy, match.Sell
+	if match.Taker == "buy" {
+		maker, taker = match.Sell, match.Buy
+	}
+	// the pool's price already includes its own fee
+	if !virtual(maker) {
+		match.MakerFee = value(maker, match.Price, match.Quantity) * b.rates(maker.AccountID).Maker
+	}
+	match.TakerFee = value(taker, match.Price, match.Quantity) * b.rates(taker.AccountID).Taker
+}
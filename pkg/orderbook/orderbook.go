@@ -7,6 +7,7 @@ import (
 	"context"
 	"log"
 	"sort"
+	"time"
 
 	"github.com/dylanlott/orderbook/pkg/accounts"
 )
@@ -22,6 +23,39 @@ type Order struct {
 	Filled    uint64
 	History   []Match
 	Metadata  map[string]string
+	// Outcome is the contract that an order trades in a binary market,
+	// Yes or No. NO orders are kept in YES terms once they're in the
+	// book, so a NO buy at p rests as a sell at 100-p.
+	Outcome string
+	// ExpiresAt is when an unfilled order is removed from the book.
+	// The zero value means the order rests until it's filled or canceled.
+	ExpiresAt time.Time
+}
+
+// Market names the pair of assets traded in a book. Base is the asset
+// being bought and sold and Quote is the asset that it's priced in.
+type Market struct {
+	Symbol string
+	Base   string
+	Quote  string
+	// Fees is the market's fee schedule. A nil schedule charges nothing.
+	Fees *FeeSchedule
+	// Pool is the market's liquidity pool, which fills orders whenever it
+	// has a better price than the book. A nil pool leaves it to the book.
+	Pool *Pool
+	// No is the NO contract of a binary market, whose Base is the YES
+	// contract. Binary contracts are priced between 0 and 100, one of the
+	// quote asset, which is what a contract pays out if it wins.
+	No string
+	// Expiry is when a dated market stops trading. Every open order is
+	// canceled at expiry and no more are accepted. The zero value never
+	// expires.
+	Expiry time.Time
+}
+
+// Expired reports whether the market has stopped trading at now.
+func (m Market) Expired(now time.Time) bool {
+	return !m.Expiry.IsZero() && !now.Before(m.Expiry)
 }
 
 // Match holds a buy and a sell side order at a quantity per price.
@@ -33,6 +67,10 @@ type Match struct {
 	Quantity uint64 // how many units were transferred from seller to buyer
 	Total    uint64 // total = price * quantity
 	History  []*Match
+	Time     time.Time // when the match was made
+	Taker    string    // side of the order that crossed the book
+	MakerFee float64   // paid by the maker in the quote asset, negative for a rebate
+	TakerFee float64   // paid by the taker in the quote asset
 }
 
 // Orderbook is the core interface of the library.
@@ -43,55 +81,173 @@ type Orderbook interface {
 	Match(buy []Order, sell []Order) []Match
 }
 
-// Run starts looping the MatchOrders function. It is a blocking function
-// and it is meant to completely own the buy and sell lists to prevent
-// external modification.
+// Run runs a Book of market and feeds it the orders that come in on in,
+// one at a time, the same way Start does. Every order reserves what it
+// needs from its account as it enters the book, so an order that can't be
+// funded is sent back on rejects and never matched. Orders can also be
+// written with writes, whose result is the order as it was once it's done
+// matching, or why it was rejected, like Start's. Every match is settled
+// through accts, fees and all, before it's sent on out, and the orders
+// that it filled are sent on fills. Every change to the book's price
+// levels is published on deltas, and every change to its orders on events
+// as its market-by-order feed. Orders that are still open can be taken
+// out of the book with cancels and changed with amends, and orders whose
+// ExpiresAt has passed are swept out of it like Start does. Reads are
+// answered like Start's, except that their depth is tagged with the
+// sequence number of the last level delta, so that a view built from the
+// deltas can be resynced from it. Outputs that aren't used can be nil.
+// Run returns once in is closed or ctx is done.
 func Run(
 	ctx context.Context,
-	accounts accounts.AccountManager,
+	market Market,
+	accts accounts.AccountManager,
 	in chan *Order,
+	writes chan OpWrite,
+	cancels chan OpCancel,
+	amends chan OpAmend,
+	reads chan OpRead,
 	out chan *Match,
 	fills chan []*Order,
-	status chan []*Order,
+	deltas chan LevelDelta,
+	events chan OrderEvent,
+	rejects chan WriteResult,
 ) {
-	// NB: buy and sell are not accessible anywhere but here for safety.
-	var buy, sell []*Order
-	handleMatches(ctx, accounts, buy, sell, in, out, fills, status)
+	// NB: the book is not accessible anywhere but here for safety.
+	book := NewBook(market)
+	handleMatches(ctx, book, accts, in, writes, cancels, amends, reads, out, fills, deltas, events, rejects)
 }
 
 // handleMatches is a blocking function that handles the matches.
 // It's meant to be called and held open while it matches orders.
 func handleMatches(
 	ctx context.Context,
+	book *Book,
 	accts accounts.AccountManager,
-	buy, sell []*Order,
 	in chan *Order,
+	writes chan OpWrite,
+	cancels chan OpCancel,
+	amends chan OpAmend,
+	reads chan OpRead,
 	out chan *Match,
 	fillsCh chan []*Order,
-	status chan []*Order,
+	deltas chan LevelDelta,
+	events chan OrderEvent,
+	rejects chan WriteResult,
 ) {
-	// feed off the orders that accumulated since the last loop
-	for o := range in {
-		if o.Side == "buy" {
-			buy = append(buy, o)
-		} else {
-			sell = append(sell, o)
+	var levels levelTracker
+
+	expiry := time.NewTicker(expiryInterval)
+	defer expiry.Stop()
+
+	// changed publishes everything the last operation changed in the book
+	changed := func() {
+		pending := book.drain()
+		publish(deltas, book.levels(&levels, pending))
+		if events != nil {
+			for _, e := range pending {
+				events <- e
+			}
 		}
-		// create the orderlist for state updates
-		orderlist := []*Order{}
-		orderlist = append(orderlist, buy...)
-		orderlist = append(orderlist, sell...)
-		status <- orderlist
-
-		matches, fills := MatchOrders(accts, buy, sell)
-		for _, match := range matches {
+	}
+
+	// match matches an order that's entered the book and sends its matches
+	// and the orders that they filled
+	match := func(o *Order) {
+		matches, err := fill(book, accts, o)
+		if err != nil {
+			log.Printf("[FILL FAILED]: order %s: %v", o.ID, err)
+		}
+		book.rested(o)
+
+		var fills []*Order
+		filled := map[*Order]bool{}
+		for i := range matches {
+			match := &matches[i]
 			log.Printf("[MATCH DETECTED]: %+v", match)
-			out <- match
+			if out != nil {
+				out <- match
+			}
+			for _, f := range []*Order{match.Buy, match.Sell} {
+				if f.Filled < f.Open || virtual(f) || filled[f] {
+					continue
+				}
+				filled[f] = true
+				fills = append(fills, f)
+			}
 		}
-		if len(fills) > 0 {
+		if len(fills) > 0 && fillsCh != nil {
 			fillsCh <- fills
 		}
 	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case op := <-cancels:
+			result := book.cancelOp(accts, op)
+			changed()
+			op.Result <- result
+		case now := <-expiry.C:
+			for _, err := range book.expire(accts, now) {
+				log.Printf("[EXPIRY FAILED]: %v", err)
+			}
+			changed()
+		case r := <-reads:
+			result := book.read(r)
+			result.Depth.Seq = levels.seq
+			r.Result <- result
+		case op := <-amends:
+			o, again, err := book.amend(accts, op)
+			if again {
+				// the amended order crosses, so it's matched like a new one
+				match(o)
+			}
+			result := WriteResult{Err: err}
+			if o != nil {
+				book.Lock()
+				result.Order = *o
+				book.Unlock()
+			}
+			changed()
+			op.Result <- result
+		case w := <-writes:
+			o := &w.Order
+			if err := book.insert(accts, o); err != nil {
+				w.Result <- WriteResult{Order: *o, Err: err}
+				continue
+			}
+			match(o)
+			changed()
+			book.Lock()
+			result := WriteResult{Order: *o}
+			book.Unlock()
+			w.Result <- result
+		case o, ok := <-in:
+			if !ok {
+				return
+			}
+			if err := book.insert(accts, o); err != nil {
+				log.Printf("[REJECTED]: %v", err)
+				if rejects != nil {
+					rejects <- WriteResult{Order: *o, Err: err}
+				}
+				continue
+			}
+			match(o)
+			changed()
+		}
+	}
+}
+
+// publish sends deltas on ch, unless it's nil.
+func publish(ch chan LevelDelta, deltas []LevelDelta) {
+	if ch == nil {
+		return
+	}
+	for _, d := range deltas {
+		ch <- d
+	}
 }
 
 // MatchOrders is an alternative approach to order matching that
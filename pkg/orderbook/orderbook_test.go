@@ -21,27 +21,36 @@ var numTestAccounts = 10
 func TestRunLoad(t *testing.T) {
 	in := make(chan *Order, 1)
 	out := make(chan *Match, 1)
-	status := make(chan []*Order, 1)
+	deltas := make(chan LevelDelta, 1)
 	fills := make(chan []*Order)
 
 	// Generate default random accounts for testing
 	accts, ids := newTestAccountManager(t, numTestAccounts)
 
 	// Start the server
-	go Run(context.Background(), accts, in, out, fills, status)
+	done := make(chan struct{})
+	go func() {
+		Run(context.Background(), testMarket, accts, in, nil, nil, nil, nil, out, fills, deltas, nil, nil)
+		close(done)
+	}()
 
-	// Consume the status updates
+	// Rebuild the book's depth from its deltas
+	view := NewDepthView()
 	go func() {
-		for state := range status {
-			_ = state
+		for d := range deltas {
+			if err := view.Apply(d); err != nil {
+				t.Error(err)
+			}
 		}
 	}()
 
 	// Consume fills
+	consumed := make(chan struct{})
 	go func() {
 		for fill := range fills {
 			t.Logf("[FILL]: %+v", fill)
 		}
+		close(consumed)
 	}()
 
 	// Consume matches
@@ -62,10 +71,19 @@ func TestRunLoad(t *testing.T) {
 		o.AccountID = gofakeit.RandomString(ids) // assign to a random account last of all
 		in <- o
 	}
+
+	// wait for the engine to drain before the test returns so that
+	// nothing logs to t after it's done.
+	close(in)
+	<-done
+	close(fills)
+	<-consumed
 }
 
 func TestMatchOrders(t *testing.T) {
 	buy, sell := newTestOrders(1000)
+	// random orders don't always cross, so one buy is priced above every sell
+	buy = append(buy, &Order{ID: "cross", Kind: "market", Side: "buy", Price: 10_000, Open: 1})
 	matches, fills := MatchOrders(&accounts.InMemoryManager{}, buy, sell)
 	require.NotEmpty(t, matches)
 	require.NotEmpty(t, fills)
@@ -77,19 +95,35 @@ func BenchmarkMatchOrders(b *testing.B) {
 }
 
 func BenchmarkAttemptFill(b *testing.B) {
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	wg := &sync.WaitGroup{}
 
-	accts := &accounts.InMemoryManager{}
+	accts := accounts.NewAccountManager("")
+	_, _ = accts.Create("bench", map[string]float64{
+		testMarket.Base:  1e15,
+		testMarket.Quote: 1e15,
+	})
 	writes := make(chan OpWrite, bufferSize)
+	cancels := make(chan OpCancel, bufferSize)
 	errs := make(chan error, bufferSize)
 	fills := make(chan FillResult, bufferSize)
 
-	go Start(ctx, accts, writes, fills, errs)
+	go func() {
+		for range fills {
+		}
+	}()
+	go func() {
+		for err := range errs {
+			b.Logf("[error]: %+v", err)
+		}
+	}()
+
+	go Start(ctx, testMarket, accts, writes, cancels, nil, fills, nil, errs)
 
 	for i := 0; i < b.N; i++ {
 		w := OpWrite{
-			Order:  newRandOrder(fmt.Sprintf("%d", i), ""),
+			Order:  newRandOrder(fmt.Sprintf("%d", i), "bench"),
 			Result: make(chan WriteResult),
 		}
 		go func() {
@@ -103,6 +137,286 @@ func BenchmarkAttemptFill(b *testing.B) {
 	wg.Wait()
 }
 
+func TestStartReservations(t *testing.T) {
+	acc := accounts.NewAccountManager("")
+	_, err := acc.Create("buyer", map[string]float64{testMarket.Quote: 100})
+	require.NoError(t, err)
+	_, err = acc.Create("seller", map[string]float64{testMarket.Base: 10})
+	require.NoError(t, err)
+
+	writes, cancels, fills := startTestEngine(t, testMarket, acc)
+
+	// the seller can only offer what they own
+	res := write(writes, Order{ID: "s1", AccountID: "seller", Side: "sell", Price: 900, Open: 11})
+	require.Error(t, res.Err)
+	res = write(writes, Order{ID: "s1", AccountID: "seller", Side: "sell", Price: 900, Open: 5})
+	require.NoError(t, res.Err)
+	assertAvailable(t, acc, "seller", testMarket.Base, 5)
+
+	// the buyer reserves 10 at their limit and fills 5 at the resting
+	// price. The rest of the reservation stays held until the order is done.
+	res = write(writes, Order{ID: "b1", AccountID: "buyer", Side: "buy", Price: 1000, Open: 10})
+	require.NoError(t, res.Err)
+	require.Equal(t, uint64(5), res.Order.Filled)
+	fill := <-fills
+	require.Equal(t, uint64(5), fill.Filled)
+
+	assertBalance(t, acc, "buyer", testMarket.Quote, 55)
+	assertBalance(t, acc, "buyer", testMarket.Base, 5)
+	assertAvailable(t, acc, "buyer", testMarket.Quote, 0)
+	assertBalance(t, acc, "seller", testMarket.Quote, 45)
+	assertBalance(t, acc, "seller", testMarket.Base, 5)
+
+	// nothing is left for a second order to reserve
+	res = write(writes, Order{ID: "b2", AccountID: "buyer", Side: "buy", Price: 1000, Open: 1})
+	require.Error(t, res.Err)
+
+	// canceling releases what remains
+	result := make(chan CancelResult)
+	cancels <- OpCancel{OrderID: "b1", Result: result}
+	require.NoError(t, (<-result).Err)
+	assertAvailable(t, acc, "buyer", testMarket.Quote, 55)
+
+	cancels <- OpCancel{OrderID: "b1", Result: result}
+	require.Error(t, (<-result).Err)
+}
+
+func TestAttemptFillRollback(t *testing.T) {
+	acc := accounts.NewAccountManager("")
+	_, err := acc.Create("buyer", map[string]float64{testMarket.Quote: 100})
+	require.NoError(t, err)
+	_, err = acc.Create("seller", map[string]float64{testMarket.Base: 10})
+	require.NoError(t, err)
+
+	book := NewBook(testMarket)
+	first := &Order{ID: "s1", AccountID: "seller", Side: "sell", Price: 900, Open: 5}
+	second := &Order{ID: "s2", AccountID: "seller", Side: "sell", Price: 900, Open: 5}
+	buy := &Order{ID: "b1", AccountID: "buyer", Side: "buy", Price: 1000, Open: 5}
+	require.NoError(t, book.insert(acc, first))
+	require.NoError(t, book.insert(acc, second))
+	require.NoError(t, book.insert(acc, buy))
+
+	// the seller's hold disappears so the balance transfer can't happen
+	_, err = acc.Release(HoldID(testMarket.Symbol, first.ID))
+	require.NoError(t, err)
+
+	matches := make(chan Match, 1)
+	errs := make(chan error, 1)
+	AttemptFill(book, acc, buy, matches, errs)
+	require.Error(t, <-errs)
+	require.Empty(t, matches)
+
+	// neither order was touched and both are still in the book in time order
+	require.Equal(t, uint64(0), buy.Filled)
+	require.Equal(t, uint64(0), first.Filled)
+	require.Empty(t, buy.History)
+	require.Empty(t, first.History)
+	require.Len(t, book.orders, 3)
+	require.Equal(t, []*Order{first, second}, book.sell.Find(900).Orders)
+	require.Equal(t, []*Order{buy}, book.buy.Find(1000).Orders)
+	assertBalance(t, acc, "buyer", testMarket.Quote, 100)
+	assertAvailable(t, acc, "buyer", testMarket.Quote, 50)
+}
+
+func TestBookExpire(t *testing.T) {
+	acc := accounts.NewAccountManager("")
+	_, err := acc.Create("buyer", map[string]float64{testMarket.Quote: 100})
+	require.NoError(t, err)
+
+	now := time.Now()
+	book := NewBook(testMarket)
+	require.NoError(t, book.insert(acc, &Order{ID: "gtc", AccountID: "buyer", Side: "buy", Price: 100, Open: 10}))
+	require.NoError(t, book.insert(acc, &Order{ID: "day", AccountID: "buyer", Side: "buy", Price: 100, Open: 10, ExpiresAt: now}))
+	assertAvailable(t, acc, "buyer", testMarket.Quote, 80)
+
+	require.Empty(t, book.expire(acc, now.Add(-time.Second)))
+	require.Len(t, book.orders, 2)
+
+	require.Empty(t, book.expire(acc, now))
+	require.Len(t, book.orders, 1)
+	require.Len(t, book.buy.List(), 1)
+	assertAvailable(t, acc, "buyer", testMarket.Quote, 90)
+}
+
+func TestStartFees(t *testing.T) {
+	market := testMarket
+	market.Fees = &FeeSchedule{
+		Tiers: []Tier{
+			{Volume: 0, Rates: Rates{Maker: -0.001, Taker: 0.002}},
+			{Volume: 100, Rates: Rates{Maker: 0, Taker: 0.001}},
+		},
+		Overrides: map[string]Rates{"vip": {}},
+	}
+
+	acc := accounts.NewAccountManager("")
+	for id, balances := range map[string]map[string]float64{
+		"buyer":  {testMarket.Quote: 200.4},
+		"seller": {testMarket.Base: 20},
+		"vip":    {testMarket.Quote: 100},
+	} {
+		_, err := acc.Create(id, balances)
+		require.NoError(t, err)
+	}
+	writes, _, fills := startTestEngine(t, market, acc)
+
+	// the resting seller is the maker and earns a rebate
+	require.NoError(t, write(writes, Order{ID: "s1", AccountID: "seller", Side: "sell", Price: 1000, Open: 10}).Err)
+	require.NoError(t, write(writes, Order{ID: "b1", AccountID: "buyer", Side: "buy", Price: 1000, Open: 10}).Err)
+	fill := <-fills
+	require.Equal(t, "buy", fill.Taker)
+	require.InDelta(t, -0.1, fill.MakerFee, 1e-9)
+	require.InDelta(t, 0.2, fill.TakerFee, 1e-9)
+	assertAvailable(t, acc, "buyer", testMarket.Quote, 100.2)
+	assertAvailable(t, acc, "seller", testMarket.Quote, 100.1)
+	require.InDelta(t, 0.1, acc.Ledger().Balance(accounts.FeeAccount, testMarket.Quote), 1e-9)
+
+	// both accounts have traded 100 and move up a tier, but buyers still
+	// hold at the schedule's highest rate
+	require.NoError(t, write(writes, Order{ID: "s2", AccountID: "seller", Side: "sell", Price: 1000, Open: 10}).Err)
+	require.NoError(t, write(writes, Order{ID: "b2", AccountID: "buyer", Side: "buy", Price: 1000, Open: 10}).Err)
+	fill = <-fills
+	require.InDelta(t, 0, fill.MakerFee, 1e-9)
+	require.InDelta(t, 0.1, fill.TakerFee, 1e-9)
+	assertAvailable(t, acc, "buyer", testMarket.Quote, 0.1)
+
+	// overrides replace the tiers
+	require.NoError(t, write(writes, Order{ID: "b3", AccountID: "vip", Side: "buy", Price: 1000, Open: 10}).Err)
+	require.NoError(t, write(writes, Order{ID: "s3", AccountID: "buyer", Side: "sell", Price: 1000, Open: 10}).Err)
+	fill = <-fills
+	require.Equal(t, "sell", fill.Taker)
+	require.InDelta(t, 0, fill.MakerFee, 1e-9)
+	require.InDelta(t, 0.1, fill.TakerFee, 1e-9)
+	assertAvailable(t, acc, "vip", testMarket.Quote, 0)
+	assertAvailable(t, acc, "buyer", testMarket.Quote, 100)
+
+	trial := acc.Ledger().TrialBalance()
+	require.InDelta(t, 0, trial[testMarket.Quote], 1e-9)
+}
+
+// TestStartFeesTierDrop checks that a resting buy still pays its fee when
+// its account drops to a tier with higher rates before it fills.
+func TestStartFeesTierDrop(t *testing.T) {
+	window := volumeWindow
+	volumeWindow = 100 * time.Millisecond
+	t.Cleanup(func() { volumeWindow = window })
+
+	market := testMarket
+	market.Fees = &FeeSchedule{
+		Tiers: []Tier{
+			{Volume: 0, Rates: Rates{Maker: 0.002, Taker: 0.002}},
+			{Volume: 100, Rates: Rates{Maker: 0, Taker: 0.001}},
+		},
+	}
+	acc := accounts.NewAccountManager("")
+	for id, balances := range map[string]map[string]float64{
+		"buyer":  {testMarket.Quote: 200.4},
+		"seller": {testMarket.Base: 20},
+	} {
+		_, err := acc.Create(id, balances)
+		require.NoError(t, err)
+	}
+	writes, _, fills := startTestEngine(t, market, acc)
+
+	// the buyer trades 100 and rests a bid as a maker who pays nothing
+	require.NoError(t, write(writes, Order{ID: "s1", AccountID: "seller", Side: "sell", Price: 1000, Open: 10}).Err)
+	require.NoError(t, write(writes, Order{ID: "b1", AccountID: "buyer", Side: "buy", Price: 1000, Open: 10}).Err)
+	<-fills
+	require.NoError(t, write(writes, Order{ID: "b2", AccountID: "buyer", Side: "buy", Price: 1000, Open: 10}).Err)
+	assertAvailable(t, acc, "buyer", testMarket.Quote, 0)
+
+	// until its volume falls out of the window and it pays 20 basis points
+	time.Sleep(2 * volumeWindow)
+	require.NoError(t, write(writes, Order{ID: "s2", AccountID: "seller", Side: "sell", Price: 1000, Open: 10}).Err)
+	fill := <-fills
+	require.Equal(t, "b2", fill.Buy.ID)
+	require.InDelta(t, 0.2, fill.MakerFee, 1e-9)
+	require.InDelta(t, 0, acc.Ledger().Balance("buyer", testMarket.Quote), 1e-9)
+	require.Equal(t, float64(20), acc.Ledger().Balance("buyer", testMarket.Base))
+}
+
+func TestStartPool(t *testing.T) {
+	market := testMarket
+	market.Pool = &Pool{Account: accounts.PoolAccount(market.Symbol)}
+
+	acc := accounts.NewAccountManager("")
+	for id, balances := range map[string]map[string]float64{
+		"buyer":  {testMarket.Quote: 1000},
+		"seller": {testMarket.Base: 5},
+		"dumper": {testMarket.Base: 3},
+	} {
+		_, err := acc.Create(id, balances)
+		require.NoError(t, err)
+	}
+	_, err := acc.Exchange(
+		accounts.Transfer{From: accounts.ExternalAccount, To: market.Pool.Account, Asset: testMarket.Base, Amount: 100},
+		accounts.Transfer{From: accounts.ExternalAccount, To: market.Pool.Account, Asset: testMarket.Quote, Amount: 10000},
+	)
+	require.NoError(t, err)
+	reserves := func() (float64, float64) {
+		ledger := acc.Ledger()
+		return ledger.Balance(market.Pool.Account, testMarket.Base), ledger.Balance(market.Pool.Account, testMarket.Quote)
+	}
+	writes, _, fills := startTestEngine(t, market, acc)
+
+	// nobody gets to pose as the pool
+	require.Error(t, write(writes, Order{ID: "p1", AccountID: "seller", Kind: poolKind, Side: "sell", Price: 100, Open: 1}).Err)
+
+	// the pool at 100 fills until it's as expensive as the ask at 105
+	require.NoError(t, write(writes, Order{ID: "s1", AccountID: "seller", Side: "sell", Price: 10500, Open: 5}).Err)
+	res := write(writes, Order{ID: "b1", AccountID: "buyer", Side: "buy", Price: 11000, Open: 5})
+	require.NoError(t, res.Err)
+	require.Equal(t, uint64(5), res.Order.Filled)
+	fill := <-fills
+	require.Equal(t, market.Pool.Account, fill.Sell.AccountID)
+	require.Equal(t, uint64(2), fill.Filled)
+	require.Equal(t, uint64(10205), fill.Price)
+	require.Zero(t, fill.MakerFee)
+	fill = <-fills
+	require.Equal(t, "s1", fill.Sell.ID)
+	require.Equal(t, uint64(3), fill.Filled)
+	assertAvailable(t, acc, "buyer", testMarket.Quote, 1000-204.1-315)
+
+	base, quote := reserves()
+	require.Equal(t, float64(98), base)
+	require.InDelta(t, 10204.1, quote, 1e-9)
+	k := base * quote
+	require.GreaterOrEqual(t, k, float64(100*10000))
+
+	// with no bids at all the pool takes the whole sell
+	res = write(writes, Order{ID: "d1", AccountID: "dumper", Side: "sell", Price: 9000, Open: 3})
+	require.NoError(t, res.Err)
+	require.Equal(t, uint64(3), res.Order.Filled)
+	fill = <-fills
+	require.Equal(t, market.Pool.Account, fill.Buy.AccountID)
+	require.Equal(t, uint64(10103), fill.Price)
+	assertAvailable(t, acc, "dumper", testMarket.Quote, 303.09)
+
+	base, quote = reserves()
+	require.Equal(t, float64(101), base)
+	require.GreaterOrEqual(t, base*quote, k)
+}
+
+// startTestEngine runs Start for market against acc until the test finishes.
+func startTestEngine(t *testing.T, market Market, acc accounts.AccountManager) (chan OpWrite, chan OpCancel, chan FillResult) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	writes := make(chan OpWrite)
+	cancels := make(chan OpCancel)
+	fills := make(chan FillResult, bufferSize)
+	errs := make(chan error, bufferSize)
+
+	go Start(ctx, market, acc, writes, cancels, nil, fills, nil, errs)
+	return writes, cancels, fills
+}
+
+// write submits an order and waits for its result.
+func write(writes chan OpWrite, o Order) WriteResult {
+	result := make(chan WriteResult)
+	writes <- OpWrite{Order: o, Result: result}
+	return <-result
+}
+
 // newTestAccountManager returns a new account manager and the set of
 // ids that it randomly generated.
 func newTestAccountManager(t *testing.T, num int) (accounts.AccountManager, []string) {
@@ -111,8 +425,10 @@ func newTestAccountManager(t *testing.T, num int) (accounts.AccountManager, []st
 
 	for i := 0; i < num; i++ {
 		email := gofakeit.Email()
-		balance := gofakeit.Float64()
-		_, err := acct.Create(email, balance)
+		_, err := acct.Create(email, map[string]float64{
+			testMarket.Base:  gofakeit.Float64Range(1e12, 1e13),
+			testMarket.Quote: gofakeit.Float64Range(1e12, 1e13),
+		})
 		ids = append(ids, email)
 		if err != nil {
 			t.Error(err)
@@ -121,6 +437,20 @@ func newTestAccountManager(t *testing.T, num int) (accounts.AccountManager, []st
 	return acct, ids
 }
 
+// fundedAccounts returns an account manager with an account for each of
+// ids that can afford any order in the tests.
+func fundedAccounts(t *testing.T, ids ...string) accounts.AccountManager {
+	acct := accounts.NewAccountManager("")
+	for _, id := range ids {
+		_, err := acct.Create(id, map[string]float64{
+			testMarket.Base:  1e9,
+			testMarket.Quote: 1e12,
+		})
+		require.NoError(t, err)
+	}
+	return acct
+}
+
 // newTestOrders creates a set of buy and sell orders with a random
 // price between minPrice and maxPrice, an open quantity between minOpen
 // and maxOpen, an equal chance to be owned by foo or bar,
@@ -180,3 +510,273 @@ func newRandOrder(id, account string) Order {
 
 	return o
 }
+
+func TestSettle(t *testing.T) {
+	acc := accounts.NewAccountManager("")
+	_, err := acc.Create("buyer", map[string]float64{testMarket.Quote: 100})
+	require.NoError(t, err)
+	_, err = acc.Create("seller", map[string]float64{testMarket.Base: 5})
+	require.NoError(t, err)
+
+	book := NewBook(testMarket)
+	buy := &Order{ID: "buy", AccountID: "buyer", Side: "buy", Price: 1000, Open: 10}
+	sell := &Order{ID: "sell", AccountID: "seller", Side: "sell", Price: 1000, Open: 5}
+	require.NoError(t, book.insert(acc, buy))
+	require.NoError(t, book.insert(acc, sell))
+
+	// both legs are applied together
+	_, err = settle(book, acc, &Match{Buy: buy, Sell: sell, Price: 1000, Quantity: 5})
+	require.NoError(t, err)
+	assertBalance(t, acc, "buyer", testMarket.Quote, 50)
+	assertBalance(t, acc, "buyer", testMarket.Base, 5)
+	assertBalance(t, acc, "seller", testMarket.Quote, 50)
+	assertBalance(t, acc, "seller", testMarket.Base, 0)
+
+	// the seller has nothing left to deliver, so the buyer isn't charged
+	_, err = settle(book, acc, &Match{Buy: buy, Sell: sell, Price: 1000, Quantity: 5})
+	require.Error(t, err)
+	assertBalance(t, acc, "buyer", testMarket.Quote, 50)
+	assertBalance(t, acc, "seller", testMarket.Quote, 50)
+}
+
+func TestRunSettles(t *testing.T) {
+	acc := accounts.NewAccountManager("")
+	_, err := acc.Create("buyer", map[string]float64{testMarket.Quote: 100})
+	require.NoError(t, err)
+	_, err = acc.Create("seller", map[string]float64{testMarket.Base: 10})
+	require.NoError(t, err)
+
+	in := make(chan *Order)
+	cancels := make(chan OpCancel)
+	out := make(chan *Match, bufferSize)
+	fills := make(chan []*Order, bufferSize)
+	rejects := make(chan WriteResult, bufferSize)
+	done := make(chan struct{})
+	go func() {
+		Run(context.Background(), testMarket, acc, in, nil, cancels, nil, nil, out, fills, nil, nil, rejects)
+		close(done)
+	}()
+
+	in <- &Order{ID: "s1", AccountID: "seller", Side: "sell", Price: 900, Open: 5}
+	in <- &Order{ID: "b1", AccountID: "buyer", Side: "buy", Price: 1000, Open: 10}
+	// the buyer's reservation is spent, so a second order can't be funded
+	in <- &Order{ID: "b2", AccountID: "buyer", Side: "buy", Price: 1000, Open: 1}
+	result := make(chan CancelResult)
+	cancels <- OpCancel{OrderID: "b1", AccountID: "buyer", Result: result}
+	require.NoError(t, (<-result).Err)
+	close(in)
+	<-done
+
+	// the match was settled at the resting price
+	match := <-out
+	require.Equal(t, uint64(900), match.Price)
+	require.Equal(t, uint64(5), match.Quantity)
+	require.Equal(t, "s1", (<-fills)[0].ID)
+	assertBalance(t, acc, "buyer", testMarket.Quote, 55)
+	assertBalance(t, acc, "buyer", testMarket.Base, 5)
+	assertBalance(t, acc, "seller", testMarket.Quote, 45)
+	assertBalance(t, acc, "seller", testMarket.Base, 5)
+
+	reject := <-rejects
+	require.Equal(t, "b2", reject.Order.ID)
+	require.Error(t, reject.Err)
+	require.Empty(t, rejects)
+	// canceling b1 released the rest of its reservation
+	assertAvailable(t, acc, "buyer", testMarket.Quote, 55)
+
+	// the match was posted to the ledger as one balanced exchange
+	var posted int
+	for _, e := range acc.Ledger().Entries() {
+		if e.Kind == accounts.KindMatch {
+			posted++
+		}
+	}
+	require.Equal(t, 1, posted)
+	for _, total := range acc.Ledger().TrialBalance() {
+		require.InDelta(t, 0, total, 1e-9)
+	}
+}
+
+func TestRunFees(t *testing.T) {
+	market := testMarket
+	market.Fees = &FeeSchedule{Tiers: []Tier{{Rates: Rates{Maker: 0.001, Taker: 0.002}}}}
+	acc := accounts.NewAccountManager("")
+	_, err := acc.Create("buyer", map[string]float64{testMarket.Quote: 100.2})
+	require.NoError(t, err)
+	_, err = acc.Create("seller", map[string]float64{testMarket.Base: 10})
+	require.NoError(t, err)
+
+	in := make(chan *Order)
+	out := make(chan *Match, bufferSize)
+	done := make(chan struct{})
+	go func() {
+		Run(context.Background(), market, acc, in, nil, nil, nil, nil, out, nil, nil, nil, nil)
+		close(done)
+	}()
+	in <- &Order{ID: "s1", AccountID: "seller", Side: "sell", Price: 1000, Open: 10}
+	in <- &Order{ID: "b1", AccountID: "buyer", Side: "buy", Price: 1000, Open: 10}
+	close(in)
+	<-done
+
+	// the served path charges the same fees as Start
+	match := <-out
+	require.InDelta(t, 0.1, match.MakerFee, 1e-9)
+	require.InDelta(t, 0.2, match.TakerFee, 1e-9)
+	require.InDelta(t, 0, acc.Ledger().Balance("buyer", testMarket.Quote), 1e-9)
+	require.InDelta(t, 99.9, acc.Ledger().Balance("seller", testMarket.Quote), 1e-9)
+	require.InDelta(t, 0.3, acc.Ledger().Balance(accounts.FeeAccount, testMarket.Quote), 1e-9)
+}
+
+func TestRunAmend(t *testing.T) {
+	acc := fundedAccounts(t, "buyer", "seller")
+	in := make(chan *Order)
+	amends := make(chan OpAmend)
+	events := make(chan OrderEvent, bufferSize)
+	done := make(chan struct{})
+	go func() {
+		Run(context.Background(), testMarket, acc, in, nil, nil, amends, nil, nil, nil, nil, events, nil)
+		close(done)
+	}()
+	amend := func(a OpAmend) WriteResult {
+		a.Result = make(chan WriteResult)
+		amends <- a
+		return <-a.Result
+	}
+
+	in <- &Order{ID: "s1", AccountID: "seller", Side: "sell", Price: 1010, Open: 10}
+	in <- &Order{ID: "s2", AccountID: "seller", Side: "sell", Price: 1010, Open: 5}
+	in <- &Order{ID: "b1", AccountID: "buyer", Side: "buy", Price: 1000, Open: 2}
+	// s1 shrinks and keeps its place, s2 moves up a level
+	require.NoError(t, amend(OpAmend{OrderID: "s1", AccountID: "seller", Open: 6}).Err)
+	require.NoError(t, amend(OpAmend{OrderID: "s2", AccountID: "seller", Price: 1020}).Err)
+	require.Error(t, amend(OpAmend{OrderID: "s2", AccountID: "buyer", Open: 1}).Err)
+	// a partial fill leaves s1 where it is
+	in <- &Order{ID: "b2", AccountID: "buyer", Side: "buy", Price: 1010, Open: 3}
+	// s1 crosses b1 at its new price and rests with what's left
+	r := amend(OpAmend{OrderID: "s1", AccountID: "seller", Price: 1000})
+	require.NoError(t, r.Err)
+	require.Equal(t, uint64(5), r.Order.Filled)
+	// and amending it to what it has filled cancels it
+	r = amend(OpAmend{OrderID: "s1", AccountID: "seller", Open: 5})
+	require.NoError(t, r.Err)
+	close(in)
+	<-done
+	close(events)
+
+	var kinds []string
+	mbo := NewMarketByOrder()
+	for e := range events {
+		require.NoError(t, mbo.Apply(e))
+		kinds = append(kinds, e.Kind)
+	}
+	require.Equal(t, []string{
+		EventAdd, EventAdd, EventAdd, // s1, s2, b1
+		EventModify, EventModify, // the amends
+		EventModify,                         // b2 takes 3 of s1
+		EventCancel, EventExecute, EventAdd, // s1 takes b1 and rests again
+		EventCancel,
+	}, kinds)
+	require.Equal(t, []QueuedOrder{{Ref: 2, Side: "sell", Price: 1020, Quantity: 5}}, mbo.Orders())
+
+	// only s2 is still held
+	seller, err := acc.Get("seller")
+	require.NoError(t, err)
+	require.Equal(t, seller.Balance(testMarket.Base)-5, seller.Available(testMarket.Base))
+}
+
+func TestHoldIDs(t *testing.T) {
+	acc := accounts.NewAccountManager("").(*accounts.InMemoryManager)
+	_, err := acc.Create("buyer", map[string]float64{testMarket.Quote: 100})
+	require.NoError(t, err)
+	w, err := acc.Withdraw("buyer", testMarket.Quote, 40)
+	require.NoError(t, err)
+
+	// an order named like the withdrawal, in two books, holds separately
+	other := testMarket
+	other.Symbol = "ETH-USD"
+	for _, book := range []*Book{NewBook(testMarket), NewBook(other)} {
+		o := &Order{ID: w.ID, AccountID: "buyer", Side: "buy", Price: 1000, Open: 2}
+		require.NoError(t, book.insert(acc, o))
+		require.Equal(t, "order:"+book.market.Symbol+":"+w.ID, book.holdID(o))
+	}
+	assertAvailable(t, acc, "buyer", testMarket.Quote, 20)
+
+	book := NewBook(testMarket)
+	require.NoError(t, book.insert(acc, &Order{ID: "b1", AccountID: "buyer", Side: "buy", Price: 1000, Open: 1}))
+	_, err = book.cancel(acc, "b1", "")
+	require.NoError(t, err)
+	assertAvailable(t, acc, "buyer", testMarket.Quote, 20)
+}
+
+func assertAvailable(t *testing.T, acc accounts.AccountManager, id, asset string, want float64) {
+	t.Helper()
+	a, err := acc.Get(id)
+	require.NoError(t, err)
+	require.InDelta(t, want, a.Available(asset), 1e-9)
+}
+
+func assertBalance(t *testing.T, acc accounts.AccountManager, id, asset string, want float64) {
+	t.Helper()
+	a, err := acc.Get(id)
+	require.NoError(t, err)
+	require.Equal(t, want, a.Balance(asset))
+}
+
+func TestRunExpire(t *testing.T) {
+	acc := accounts.NewAccountManager("")
+	_, err := acc.Create("buyer", map[string]float64{testMarket.Quote: 100})
+	require.NoError(t, err)
+	in := make(chan *Order)
+	events := make(chan OrderEvent, bufferSize)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Run(ctx, testMarket, acc, in, nil, nil, nil, nil, nil, nil, nil, events, nil)
+
+	in <- &Order{ID: "gtc", AccountID: "buyer", Side: "buy", Price: 100, Open: 10}
+	in <- &Order{ID: "day", AccountID: "buyer", Side: "buy", Price: 100, Open: 10, ExpiresAt: time.Now()}
+	require.Equal(t, EventAdd, (<-events).Kind)
+	require.Equal(t, EventAdd, (<-events).Kind)
+
+	// the served book sweeps out the expired order and releases its hold
+	select {
+	case e := <-events:
+		require.Equal(t, EventCancel, e.Kind)
+	case <-time.After(3 * expiryInterval):
+		t.Fatal("the expired order wasn't swept out of the book")
+	}
+	assertAvailable(t, acc, "buyer", testMarket.Quote, 90)
+}
+
+func TestRunMarketExpiry(t *testing.T) {
+	acc := fundedAccounts(t, "buyer", "seller")
+	market := testMarket
+	market.Expiry = time.Now().Add(100 * time.Millisecond)
+	in := make(chan *Order)
+	events := make(chan OrderEvent, bufferSize)
+	rejects := make(chan WriteResult, bufferSize)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Run(ctx, market, acc, in, nil, nil, nil, nil, nil, nil, nil, events, rejects)
+
+	in <- &Order{ID: "b1", AccountID: "buyer", Side: "buy", Price: 100, Open: 10}
+	in <- &Order{ID: "s1", AccountID: "seller", Side: "sell", Price: 110, Open: 10}
+	require.Equal(t, EventAdd, (<-events).Kind)
+	require.Equal(t, EventAdd, (<-events).Kind)
+
+	// every open order is canceled once the market expires
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-events:
+			require.Equal(t, EventCancel, e.Kind)
+		case <-time.After(3 * expiryInterval):
+			t.Fatal("the expired market's orders weren't canceled")
+		}
+	}
+	buyer, err := acc.Get("buyer")
+	require.NoError(t, err)
+	require.Equal(t, buyer.Balance(testMarket.Quote), buyer.Available(testMarket.Quote))
+
+	// and no more are taken
+	in <- &Order{ID: "b2", AccountID: "buyer", Side: "buy", Price: 100, Open: 10}
+	require.Contains(t, (<-rejects).Err.Error(), "expired")
+}
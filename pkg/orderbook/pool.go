@@ -0,0 +1,132 @@
+package orderbook
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/dylanlott/orderbook/pkg/accounts"
+)
+
+// poolKind is the Kind of the virtual orders that a pool fills with.
+const poolKind = "pool"
+
+// Pool is a constant-product liquidity pool that quotes into a market's
+// book. Its reserves are whatever Account holds of the market's base and
+// quote assets, so they're funded by transferring into it and they change
+// in the same exchange as the fills they make. The pool always prices
+// quantity so that the product of its reserves never goes down.
+type Pool struct {
+	// Account holds the pool's reserves, usually accounts.PoolAccount.
+	Account string
+	// Fee is the share of every fill that the pool keeps on top of its
+	// price, which grows its reserves.
+	Fee float64
+}
+
+// virtual reports whether an order was made up by the pool and never
+// rested in the book or held any funds.
+func virtual(o *Order) bool {
+	return o.Kind == poolKind
+}
+
+// holdID returns the hold that an order's transfers are drawn from, or
+// nothing for the pool's orders.
+func (b *Book) holdID(o *Order) string {
+	if virtual(o) {
+		return ""
+	}
+	return HoldID(b.market.Symbol, o.ID)
+}
+
+// pool returns a match of an order against the book's pool if the pool
+// has a better price than best, the best opposing node, or nil if it
+// doesn't. The pool fills as much as it can before its marginal price
+// reaches the best node's price or the order's limit, whichever is first.
+// Binary markets don't have pools.
+func (b *Book) pool(acc accounts.AccountManager, o *Order, best *Node) *Match {
+	pool := b.market.Pool
+	if pool == nil || b.market.Binary() {
+		return nil
+	}
+	bound := o.Price
+	if best != nil {
+		if o.Side == "buy" && best.Price < bound {
+			bound = best.Price
+		}
+		if o.Side == "sell" && best.Price > bound {
+			bound = best.Price
+		}
+	}
+	if bound == 0 {
+		return nil
+	}
+
+	ledger := acc.Ledger()
+	base := ledger.Balance(pool.Account, b.market.Base)
+	quote := ledger.Balance(pool.Account, b.market.Quote)
+	if base <= 0 || quote <= 0 {
+		return nil
+	}
+	quantity, price := quotePool(base, quote, pool.Fee, o.Side, o.Open-o.Filled, bound)
+	if quantity == 0 {
+		return nil
+	}
+
+	side := "sell"
+	if o.Side == "sell" {
+		side = "buy"
+	}
+	maker := &Order{
+		ID:        fmt.Sprintf("%s-%s-%d", poolKind, o.ID, len(o.History)),
+		AccountID: pool.Account,
+		Kind:      poolKind,
+		Side:      side,
+		Price:     price,
+		Open:      quantity,
+	}
+	match := &Match{Buy: o, Sell: maker, Price: price, Quantity: quantity, Time: time.Now(), Taker: o.Side}
+	if o.Side == "sell" {
+		match.Buy, match.Sell = maker, o
+	}
+	return match
+}
+
+// quotePool returns how much of wanted a pool with the given reserves
+// fills for an order on side and the price it fills at, without its
+// marginal price passing bound. The price is the average over the whole
+// quantity, rounded in the pool's favor.
+//
+// Buying n from a pool of base x and quote y costs y*n/(x-n), and leaves
+// it with a marginal price of x*y/(x-n)^2, and selling n to it pays
+// y*n/(x+n) and leaves it at x*y/(x+n)^2.
+func quotePool(x, y, fee float64, side string, wanted, bound uint64) (uint64, uint64) {
+	k, limit := x*y, float64(bound)/100
+	var n float64
+	if side == "buy" {
+		n = math.Floor(x - math.Sqrt(k*(1+fee)/limit))
+	} else {
+		n = math.Floor(math.Sqrt(k*(1-fee)/limit) - x)
+	}
+	if n <= 0 {
+		return 0, 0
+	}
+	quantity := min(uint64(n), wanted)
+
+	for ; quantity > 0; quantity-- {
+		q := float64(quantity)
+		var price uint64
+		if side == "buy" {
+			price = uint64(math.Ceil(y * q / (x - q) * (1 + fee) * 100 / q))
+			if price <= bound {
+				return quantity, price
+			}
+		} else {
+			price = uint64(math.Floor(y * q / (x + q) * (1 - fee) * 100 / q))
+			if price >= bound && price > 0 {
+				return quantity, price
+			}
+		}
+	}
+	return 0, 0
+}
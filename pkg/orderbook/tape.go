@@ -0,0 +1,204 @@
+package orderbook
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TapeTrade is a match as it's recorded on a Tape. Side is the side of
+// the order that crossed the book, and IDs count up from 1.
+type TapeTrade struct {
+	ID       uint64    `json:"id"`
+	Price    uint64    `json:"price"`
+	Quantity uint64    `json:"quantity"`
+	Side     string    `json:"side"`
+	Time     time.Time `json:"time"`
+}
+
+// TapeStats summarizes a tape's trades over a window of time. Open is the
+// price as the window started, which is the last trade before it or else
+// the first trade in it. High, Low, Volume and VWAP only count trades in
+// the window, and they're zero if there weren't any. Prices and
+// QuoteVolume are in hundredths and Change is Last less Open.
+type TapeStats struct {
+	Last          uint64  `json:"last"`
+	Open          uint64  `json:"open"`
+	High          uint64  `json:"high"`
+	Low           uint64  `json:"low"`
+	Volume        uint64  `json:"volume"`
+	QuoteVolume   uint64  `json:"quote_volume"`
+	VWAP          float64 `json:"vwap"`
+	Change        int64   `json:"change"`
+	ChangePercent float64 `json:"change_percent"`
+	Trades        int     `json:"trades"`
+}
+
+// Tape records every match of a book in the order it was made. It's safe
+// for concurrent use.
+type Tape struct {
+	sync.RWMutex
+
+	trades []TapeTrade
+	// file is where trades are appended if the tape was opened from one.
+	file *os.File
+}
+
+// NewTape returns an empty Tape that's lost when the process exits.
+func NewTape() *Tape {
+	return &Tape{}
+}
+
+// OpenTape returns a Tape that's kept in a file, one trade per line, so
+// that it outlives the process. The file is created if it doesn't exist
+// yet, and the trades in it are read back if it does.
+func OpenTape(path string) (*Tape, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create tape: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tape: %v", err)
+	}
+	t := &Tape{file: f}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var trade TapeTrade
+		if err := json.Unmarshal(scanner.Bytes(), &trade); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to read trade %q: %v", scanner.Text(), err)
+		}
+		t.trades = append(t.trades, trade)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read tape: %v", err)
+	}
+	return t, nil
+}
+
+// Close closes the tape's file, if it has one.
+func (t *Tape) Close() error {
+	t.Lock()
+	defer t.Unlock()
+	if t.file == nil {
+		return nil
+	}
+	return t.file.Close()
+}
+
+// Record adds a match to the tape and returns it as it was recorded. The
+// trade is on the tape even if it couldn't be saved to its file.
+func (t *Tape) Record(m Match) (TapeTrade, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	trade := TapeTrade{
+		ID:       uint64(len(t.trades)) + 1,
+		Price:    m.Price,
+		Quantity: m.Quantity,
+		Side:     m.Taker,
+		Time:     m.Time,
+	}
+	t.trades = append(t.trades, trade)
+	if t.file != nil {
+		b, err := json.Marshal(trade)
+		if err != nil {
+			return trade, fmt.Errorf("failed to save trade %d: %v", trade.ID, err)
+		}
+		if _, err := t.file.Write(append(b, '\n')); err != nil {
+			return trade, fmt.Errorf("failed to save trade %d: %v", trade.ID, err)
+		}
+	}
+	return trade, nil
+}
+
+// Last returns the last trade, or false if there hasn't been one.
+func (t *Tape) Last() (TapeTrade, bool) {
+	t.RLock()
+	defer t.RUnlock()
+
+	if len(t.trades) == 0 {
+		return TapeTrade{}, false
+	}
+	return t.trades[len(t.trades)-1], true
+}
+
+// Trades returns up to limit trades, newest first, starting with the one
+// before the trade with ID before. A before of 0 starts with the newest.
+func (t *Tape) Trades(before uint64, limit int) []TapeTrade {
+	t.RLock()
+	defer t.RUnlock()
+
+	end := uint64(len(t.trades))
+	if before > 0 && before-1 < end {
+		end = before - 1
+	}
+	trades := []TapeTrade{}
+	for i := int(end) - 1; i >= 0 && len(trades) < limit; i-- {
+		trades = append(trades, t.trades[i])
+	}
+	return trades
+}
+
+// Since returns the trades made at or after from, oldest first.
+func (t *Tape) Since(from time.Time) []TapeTrade {
+	t.RLock()
+	defer t.RUnlock()
+
+	first := sort.Search(len(t.trades), func(i int) bool {
+		return !t.trades[i].Time.Before(from)
+	})
+	return append([]TapeTrade{}, t.trades[first:]...)
+}
+
+// Stats summarizes the trades in the window that ends at now.
+func (t *Tape) Stats(now time.Time, window time.Duration) TapeStats {
+	t.RLock()
+	defer t.RUnlock()
+
+	var stats TapeStats
+	if len(t.trades) == 0 {
+		return stats
+	}
+	stats.Last = t.trades[len(t.trades)-1].Price
+
+	start := now.Add(-window)
+	first := sort.Search(len(t.trades), func(i int) bool {
+		return !t.trades[i].Time.Before(start)
+	})
+	switch {
+	case first > 0:
+		stats.Open = t.trades[first-1].Price
+	case first < len(t.trades):
+		stats.Open = t.trades[first].Price
+	}
+
+	for _, trade := range t.trades[first:] {
+		if trade.Time.After(now) {
+			break
+		}
+		if stats.Trades == 0 || trade.Price > stats.High {
+			stats.High = trade.Price
+		}
+		if stats.Trades == 0 || trade.Price < stats.Low {
+			stats.Low = trade.Price
+		}
+		stats.Volume += trade.Quantity
+		stats.QuoteVolume += trade.Price * trade.Quantity
+		stats.Trades++
+	}
+	if stats.Volume > 0 {
+		stats.VWAP = float64(stats.QuoteVolume) / float64(stats.Volume)
+	}
+	if stats.Open > 0 {
+		stats.Change = int64(stats.Last) - int64(stats.Open)
+		stats.ChangePercent = float64(stats.Change) / float64(stats.Open) * 100
+	}
+	return stats
+}
@@ -0,0 +1,110 @@
+package orderbook
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestTape(t *testing.T) {
+	is := is.New(t)
+	tape := NewTape()
+	now := time.Now()
+	_, ok := tape.Last()
+	is.True(!ok)
+	is.Equal(tape.Stats(now, 24*time.Hour), TapeStats{})
+	is.Equal(tape.Trades(0, 10), []TapeTrade{})
+
+	for _, m := range []Match{
+		{Price: 900, Quantity: 1, Taker: "buy", Time: now.Add(-25 * time.Hour)},
+		{Price: 1000, Quantity: 2, Taker: "sell", Time: now.Add(-3 * time.Hour)},
+		{Price: 1100, Quantity: 1, Taker: "buy", Time: now.Add(-2 * time.Hour)},
+		{Price: 950, Quantity: 1, Taker: "sell", Time: now.Add(-time.Hour)},
+	} {
+		_, err := tape.Record(m)
+		is.NoErr(err)
+	}
+	last, ok := tape.Last()
+	is.True(ok)
+	is.Equal(last.ID, uint64(4))
+	is.Equal(last.Side, "sell")
+
+	// the day opened at the last price before it and the trade before
+	// it doesn't count
+	stats := tape.Stats(now, 24*time.Hour)
+	is.Equal(stats, TapeStats{
+		Last:          950,
+		Open:          900,
+		High:          1100,
+		Low:           950,
+		Volume:        4,
+		QuoteVolume:   4050,
+		VWAP:          1012.5,
+		Change:        50,
+		ChangePercent: 50.0 / 900 * 100,
+		Trades:        3,
+	})
+	// a window with no trade before it opens at its first trade
+	stats = tape.Stats(now, 26*time.Hour)
+	is.Equal(stats.Open, uint64(900))
+	is.Equal(stats.Trades, 4)
+	// a quiet window only has the last price
+	stats = tape.Stats(now, time.Minute)
+	is.Equal(stats.Last, uint64(950))
+	is.Equal(stats.Open, uint64(950))
+	is.Equal(stats.Trades, 0)
+	is.Equal(stats.Change, int64(0))
+
+	// pages go back from the newest trade
+	page := tape.Trades(0, 3)
+	is.Equal(len(page), 3)
+	is.Equal(page[0].ID, uint64(4))
+	is.Equal(page[2].ID, uint64(2))
+	page = tape.Trades(page[2].ID, 3)
+	is.Equal(len(page), 1)
+	is.Equal(page[0].ID, uint64(1))
+	is.Equal(len(tape.Trades(1, 3)), 0)
+	is.Equal(len(tape.Trades(100, 10)), 4)
+	is.Equal(len(tape.Since(now.Add(-2*time.Hour))), 2)
+}
+
+func TestOpenTape(t *testing.T) {
+	is := is.New(t)
+	path := filepath.Join(t.TempDir(), "BTC-USD", "trades")
+	tape, err := OpenTape(path)
+	is.NoErr(err)
+	now := time.Now().UTC().Round(0)
+	for i := 1; i <= 3; i++ {
+		_, err := tape.Record(Match{Price: uint64(1000 * i), Quantity: 1, Taker: "buy", Time: now})
+		is.NoErr(err)
+	}
+	is.NoErr(tape.Close())
+
+	// the trades are read back and new ones carry on from them
+	tape, err = OpenTape(path)
+	is.NoErr(err)
+	defer tape.Close()
+	last, _ := tape.Last()
+	is.Equal(last, TapeTrade{ID: 3, Price: 3000, Quantity: 1, Side: "buy", Time: now})
+	trade, err := tape.Record(Match{Price: 4000, Quantity: 2, Taker: "sell", Time: now})
+	is.NoErr(err)
+	is.Equal(trade.ID, uint64(4))
+}
+
+func TestRunTaker(t *testing.T) {
+	is := is.New(t)
+	in := make(chan *Order)
+	out := make(chan *Match, bufferSize)
+	go Run(context.Background(), testMarket, fundedAccounts(t, "alice", "bob"), in, nil, nil, nil, nil, out, nil, nil, nil, nil)
+	defer close(in)
+
+	in <- &Order{ID: "b1", AccountID: "alice", Side: "buy", Price: 1000, Open: 2}
+	in <- &Order{ID: "s1", AccountID: "bob", Side: "sell", Price: 990, Open: 1}
+	in <- &Order{ID: "s2", AccountID: "bob", Side: "sell", Price: 1010, Open: 1}
+	in <- &Order{ID: "b2", AccountID: "alice", Side: "buy", Price: 1010, Open: 1}
+	is.Equal((<-out).Taker, "sell")
+	is.Equal((<-out).Taker, "buy")
+}
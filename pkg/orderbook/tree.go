@@ -53,7 +53,7 @@ func (n *Node) RemoveOrder(order *Order) bool {
 		for i, o := range found.Orders {
 			if order.ID == o.ID {
 				// slice the order out of the found nodes orderlist
-				n.Orders = append(found.Orders[:i], found.Orders[i+1:]...)
+				found.Orders = append(found.Orders[:i], found.Orders[i+1:]...)
 				return true
 			}
 		}
@@ -121,3 +121,31 @@ func (n *Node) FindMax() *Node {
 	}
 	return n.Right.FindMax()
 }
+
+// Lowest returns the lowest priced Node in the tree that has Orders.
+func (n *Node) Lowest() *Node {
+	if n == nil {
+		return nil
+	}
+	if low := n.Left.Lowest(); low != nil {
+		return low
+	}
+	if len(n.Orders) > 0 {
+		return n
+	}
+	return n.Right.Lowest()
+}
+
+// Highest returns the highest priced Node in the tree that has Orders.
+func (n *Node) Highest() *Node {
+	if n == nil {
+		return nil
+	}
+	if high := n.Right.Highest(); high != nil {
+		return high
+	}
+	if len(n.Orders) > 0 {
+		return n
+	}
+	return n.Left.Highest()
+}
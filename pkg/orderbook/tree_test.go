@@ -66,3 +66,17 @@ func TestNode_RemoveOrder(t *testing.T) {
 	seedRootTree(root)
 	is.True(root.RemoveOrder(&Order{ID: "5", Price: 12}))
 }
+
+func TestLowestHighest(t *testing.T) {
+	is := is.New(t)
+	root := NewNode(10)
+	seedRootTree(root)
+	root.Insert(&Order{ID: "7", Price: 1, Side: "buy"})
+	is.True(root.RemoveOrder(&Order{ID: "7", Price: 1}))
+
+	// the empty root and the emptied node are skipped
+	is.Equal(root.Lowest().Price, uint64(5))
+	is.Equal(root.Highest().Price, uint64(15))
+	is.Equal(len(root.Orders), 0)
+	is.Equal(len(root.Find(12).Orders), 3)
+}
@@ -0,0 +1,105 @@
+// Package client is a client of the ouch order entry protocol.
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/dylanlott/orderbook/pkg/ouch"
+)
+
+// Client is a connection to an ouch server that's logged in to an
+// account. Orders can be sent from any goroutine, but only one goroutine
+// should Receive.
+type Client struct {
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Dial connects to a server and logs in to an account with its secret.
+func Dial(addr, account, secret string) (*Client, error) {
+	a, err := ouch.NewAccount(account)
+	if err != nil {
+		return nil, err
+	}
+	sec, err := ouch.NewSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetNoDelay(true)
+	}
+	c := &Client{conn: conn, r: bufio.NewReader(conn)}
+	if err := c.send(ouch.Login{Account: a, Secret: sec}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	m, err := c.Receive()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, ok := m.(*ouch.LoggedIn); !ok {
+		conn.Close()
+		return nil, fmt.Errorf("failed to log in to %s", account)
+	}
+	return c, nil
+}
+
+// Enter enters a limit order for a symbol. Prices are in hundredths.
+func (c *Client) Enter(token, symbol string, side byte, quantity, price uint32) error {
+	t, err := ouch.NewToken(token)
+	if err != nil {
+		return err
+	}
+	s, err := ouch.NewSymbol(symbol)
+	if err != nil {
+		return err
+	}
+	return c.send(ouch.EnterOrder{Token: t, Side: side, Quantity: quantity, Symbol: s, Price: price})
+}
+
+// Replace replaces an order with a new one under a new token.
+func (c *Client) Replace(existing, replacement string, quantity, price uint32) error {
+	e, err := ouch.NewToken(existing)
+	if err != nil {
+		return err
+	}
+	r, err := ouch.NewToken(replacement)
+	if err != nil {
+		return err
+	}
+	return c.send(ouch.ReplaceOrder{Existing: e, Replacement: r, Quantity: quantity, Price: price})
+}
+
+// Cancel cancels an order.
+func (c *Client) Cancel(token string) error {
+	t, err := ouch.NewToken(token)
+	if err != nil {
+		return err
+	}
+	return c.send(ouch.CancelOrder{Token: t})
+}
+
+// Receive returns the next message from the server.
+func (c *Client) Receive() (ouch.Message, error) {
+	return ouch.Read(c.r)
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) send(m ouch.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ouch.Write(c.conn, m)
+}
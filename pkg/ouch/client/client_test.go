@@ -0,0 +1,161 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/dylanlott/orderbook/pkg/accounts"
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+	"github.com/dylanlott/orderbook/pkg/ouch"
+	"github.com/matryer/is"
+)
+
+func TestClient(t *testing.T) {
+	is := is.New(t)
+	addr := startServer(t)
+
+	_, err := Dial(addr, "mallory", "mallory-secret")
+	is.True(err != nil) // no such account
+	_, err = Dial(addr, "alice", "bob-secret")
+	is.True(err != nil) // wrong secret
+	alice, err := Dial(addr, "alice", "alice-secret")
+	is.NoErr(err)
+	defer alice.Close()
+	_, err = Dial(addr, "alice", "alice-secret")
+	is.True(err != nil) // already logged in
+	bob, err := Dial(addr, "bob", "bob-secret")
+	is.NoErr(err)
+	defer bob.Close()
+
+	is.NoErr(alice.Enter("a1", "BTC-USD", ouch.Sell, 10, 1000))
+	accepted := receive(t, alice).(*ouch.Accepted)
+	is.Equal(accepted.Token.String(), "a1")
+	is.Equal(accepted.Quantity, uint32(10))
+	is.NoErr(alice.Enter("a1", "BTC-USD", ouch.Sell, 10, 1000))
+	is.Equal(receive(t, alice).(*ouch.Rejected).Reason, ouch.ReasonDuplicateToken)
+	is.NoErr(alice.Enter("a2", "ETH-USD", ouch.Sell, 10, 1000))
+	is.Equal(receive(t, alice).(*ouch.Rejected).Reason, ouch.ReasonInvalidSymbol)
+	is.NoErr(alice.Enter("a3", "BTC-USD", 'Q', 10, 1000))
+	is.Equal(receive(t, alice).(*ouch.Rejected).Reason, ouch.ReasonInvalidSide)
+
+	// bob takes 4 of alice's 10
+	is.NoErr(bob.Enter("b1", "BTC-USD", ouch.Buy, 4, 1050))
+	is.Equal(receive(t, bob).Type(), ouch.TypeAccepted)
+	bought := receive(t, bob).(*ouch.Executed)
+	sold := receive(t, alice).(*ouch.Executed)
+	is.Equal(bought.Quantity, uint32(4))
+	is.Equal(bought.Price, uint32(1000))
+	is.Equal(sold.Token.String(), "a1")
+	is.Equal(sold.Match, bought.Match)
+
+	// an order that bob can't pay for is accepted and then refused by the book
+	is.NoErr(bob.Enter("b2", "BTC-USD", ouch.Buy, 4_000_000_000, 1050))
+	is.Equal(receive(t, bob).Type(), ouch.TypeAccepted)
+	refused := receive(t, bob).(*ouch.Canceled)
+	is.Equal(refused.Token.String(), "b2")
+	is.Equal(refused.Reason, ouch.ReasonRefused)
+	is.NoErr(bob.Cancel("b2"))
+	is.Equal(receive(t, bob).(*ouch.Rejected).Reason, ouch.ReasonUnknownToken)
+
+	// alice moves the rest up and then pulls it: a1 keeps its 10, 4 of
+	// which have filled
+	is.NoErr(alice.Replace("a1", "a4", 10, 1010))
+	replaced := receive(t, alice).(*ouch.Replaced)
+	is.Equal(replaced.Previous.String(), "a1")
+	is.Equal(replaced.Replacement.String(), "a4")
+	is.Equal(replaced.Price, uint32(1010))
+	is.Equal(replaced.Quantity, uint32(6))
+	is.NoErr(alice.Replace("a1", "a5", 6, 1010))
+	is.Equal(receive(t, alice).(*ouch.Rejected).Reason, ouch.ReasonUnknownToken) // a1 is gone
+	is.NoErr(alice.Cancel("a4"))
+	canceled := receive(t, alice).(*ouch.Canceled)
+	is.Equal(canceled.Quantity, uint32(6))
+	is.Equal(canceled.Reason, ouch.ReasonUserRequested)
+	is.NoErr(alice.Cancel("a4"))
+	is.Equal(receive(t, alice).(*ouch.Rejected).Reason, ouch.ReasonUnknownToken)
+
+	// a replacement of a partly filled order only rests what's left of it
+	is.NoErr(alice.Enter("a6", "BTC-USD", ouch.Sell, 10, 1000))
+	is.Equal(receive(t, alice).Type(), ouch.TypeAccepted)
+	is.NoErr(bob.Enter("b3", "BTC-USD", ouch.Buy, 4, 1000))
+	is.Equal(receive(t, bob).Type(), ouch.TypeAccepted)
+	is.Equal(receive(t, bob).Type(), ouch.TypeExecuted)
+	is.Equal(receive(t, alice).(*ouch.Executed).Quantity, uint32(4))
+	is.NoErr(alice.Replace("a6", "a7", 10, 1000))
+	is.Equal(receive(t, alice).(*ouch.Replaced).Quantity, uint32(6))
+	is.NoErr(bob.Enter("b4", "BTC-USD", ouch.Buy, 10, 1000))
+	is.Equal(receive(t, bob).Type(), ouch.TypeAccepted)
+	is.Equal(receive(t, bob).(*ouch.Executed).Quantity, uint32(6)) // not 10
+	sold = receive(t, alice).(*ouch.Executed)
+	is.Equal(sold.Token.String(), "a7")
+	is.Equal(sold.Quantity, uint32(6))
+	is.NoErr(bob.Cancel("b4"))
+	is.Equal(receive(t, bob).(*ouch.Canceled).Quantity, uint32(4))
+
+	// and one for no more than it has filled cancels it
+	is.NoErr(alice.Enter("a8", "BTC-USD", ouch.Sell, 10, 1000))
+	is.Equal(receive(t, alice).Type(), ouch.TypeAccepted)
+	is.NoErr(bob.Enter("b5", "BTC-USD", ouch.Buy, 4, 1000))
+	is.Equal(receive(t, bob).Type(), ouch.TypeAccepted)
+	is.Equal(receive(t, bob).Type(), ouch.TypeExecuted)
+	is.Equal(receive(t, alice).Type(), ouch.TypeExecuted)
+	is.NoErr(alice.Replace("a8", "a9", 4, 1000))
+	canceled = receive(t, alice).(*ouch.Canceled)
+	is.Equal(canceled.Token.String(), "a8")
+	is.NoErr(alice.Cancel("a9"))
+	is.Equal(receive(t, alice).(*ouch.Rejected).Reason, ouch.ReasonUnknownToken)
+}
+
+// startServer serves an ouch.Server for alice and bob in front of a book
+// and returns its address.
+func startServer(t *testing.T) string {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	accts := accounts.NewAccountManager("")
+	for _, id := range []string{"alice", "bob"} {
+		if _, err := accts.Create(id, map[string]float64{"BTC": 1e6, accounts.USD: 1e9}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	in := make(chan *orderbook.Order)
+	cancels := make(chan orderbook.OpCancel)
+	out := make(chan *orderbook.Match)
+	rejects := make(chan orderbook.WriteResult)
+	market := orderbook.Market{Symbol: "BTC-USD", Base: "BTC", Quote: accounts.USD}
+	go orderbook.Run(ctx, market, accts, in, nil, cancels, nil, nil, out, nil, nil, nil, rejects)
+
+	secrets := map[string]string{"alice": "alice-secret", "bob": "bob-secret"}
+	s := ouch.NewServer("BTC-USD", accts, secrets, in, cancels)
+	go func() {
+		for {
+			select {
+			case m := <-out:
+				s.Match(*m)
+			case r := <-rejects:
+				s.Reject(r)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.Serve(l)
+	return l.Addr().String()
+}
+
+func receive(t *testing.T, c *Client) ouch.Message {
+	t.Helper()
+	m, err := c.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
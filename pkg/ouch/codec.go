@@ -0,0 +1,287 @@
+// Package ouch is a compact binary order entry protocol in the style of
+// OUCH. Every message has a fixed layout of big-endian integers and
+// space-padded ASCII fields, framed by a two byte length, so that orders
+// can be entered without the cost of parsing JSON or FIX.
+//
+// A client logs in to an account with its secret, then enters, replaces and cancels
+// orders by a token of its own choosing. The server answers with
+// accepted, replaced, canceled and rejected messages, and with an
+// executed message for every fill.
+package ouch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Types of message. Clients send Login, EnterOrder, ReplaceOrder and
+// CancelOrder and the server sends the rest.
+const (
+	TypeLogin        byte = 'L'
+	TypeEnterOrder   byte = 'O'
+	TypeReplaceOrder byte = 'U'
+	TypeCancelOrder  byte = 'X'
+	TypeLoggedIn     byte = 'I'
+	TypeAccepted     byte = 'A'
+	TypeReplaced     byte = 'R'
+	TypeExecuted     byte = 'E'
+	TypeCanceled     byte = 'C'
+	TypeRejected     byte = 'J'
+)
+
+// Sides of an order.
+const (
+	Buy  byte = 'B'
+	Sell byte = 'S'
+)
+
+// Reasons that an order was rejected or canceled.
+const (
+	ReasonNotLoggedIn     byte = 'L'
+	ReasonInvalidSymbol   byte = 'S'
+	ReasonInvalidSide     byte = 'D'
+	ReasonInvalidQuantity byte = 'Z'
+	ReasonInvalidPrice    byte = 'X'
+	ReasonDuplicateToken  byte = 'T'
+	ReasonUnknownToken    byte = 'K'
+	ReasonUserRequested   byte = 'U'
+	// ReasonRefused is an accepted order that the book wouldn't take,
+	// usually because its account can't fund it.
+	ReasonRefused byte = 'R'
+)
+
+// Token is a client's name for one of its orders.
+type Token [14]byte
+
+// Symbol names a market.
+type Symbol [8]byte
+
+// Account names the account that a client trades for.
+type Account [16]byte
+
+// Secret is what a client logs in to an account with.
+type Secret [32]byte
+
+// NewToken returns a token padded with spaces.
+func NewToken(s string) (Token, error) {
+	var t Token
+	return t, pad(t[:], s)
+}
+
+// NewSymbol returns a symbol padded with spaces.
+func NewSymbol(s string) (Symbol, error) {
+	var sym Symbol
+	return sym, pad(sym[:], s)
+}
+
+// NewAccount returns an account padded with spaces.
+func NewAccount(s string) (Account, error) {
+	var a Account
+	return a, pad(a[:], s)
+}
+
+// NewSecret returns a secret padded with spaces.
+func NewSecret(s string) (Secret, error) {
+	var secret Secret
+	return secret, pad(secret[:], s)
+}
+
+func (t Token) String() string   { return strings.TrimRight(string(t[:]), " ") }
+func (s Symbol) String() string  { return strings.TrimRight(string(s[:]), " ") }
+func (a Account) String() string { return strings.TrimRight(string(a[:]), " ") }
+func (s Secret) String() string  { return strings.TrimRight(string(s[:]), " ") }
+
+// pad copies an ASCII string into a field and pads it with spaces.
+func pad(field []byte, s string) error {
+	if len(s) > len(field) {
+		return fmt.Errorf("%q is longer than %d bytes", s, len(field))
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] <= ' ' || s[i] > '~' {
+			return fmt.Errorf("%q must be printable ASCII without spaces", s)
+		}
+	}
+	copy(field, s)
+	for i := len(s); i < len(field); i++ {
+		field[i] = ' '
+	}
+	return nil
+}
+
+// Message is a message of the protocol.
+type Message interface {
+	Type() byte
+}
+
+// Login logs a connection in to an account with the account's secret. It
+// has to be the first message a client sends.
+type Login struct {
+	Account Account
+	Secret  Secret
+}
+
+// EnterOrder enters a limit order. Prices are in hundredths of the
+// market's quote asset.
+type EnterOrder struct {
+	Token    Token
+	Side     byte
+	Quantity uint32
+	Symbol   Symbol
+	Price    uint32
+}
+
+// ReplaceOrder replaces an order with one that has a new token, quantity
+// and price, which goes to the back of the queue. Quantity is the new
+// order's total quantity, including what the order has already filled,
+// and an order that's already filled that much is canceled instead.
+type ReplaceOrder struct {
+	Existing    Token
+	Replacement Token
+	Quantity    uint32
+	Price       uint32
+}
+
+// CancelOrder cancels whatever's left of an order.
+type CancelOrder struct {
+	Token Token
+}
+
+// LoggedIn accepts a Login.
+type LoggedIn struct {
+	Account Account
+}
+
+// Accepted accepts an order into the book. OrderRef is the server's
+// reference for it. Timestamps are nanoseconds since the Unix epoch.
+type Accepted struct {
+	Timestamp uint64
+	Token     Token
+	Side      byte
+	Quantity  uint32
+	Symbol    Symbol
+	Price     uint32
+	OrderRef  uint64
+}
+
+// Replaced accepts a ReplaceOrder. The previous order is no longer in
+// the book, and Quantity is what's left of the replacement to fill.
+type Replaced struct {
+	Timestamp   uint64
+	Replacement Token
+	Side        byte
+	Quantity    uint32
+	Symbol      Symbol
+	Price       uint32
+	OrderRef    uint64
+	Previous    Token
+}
+
+// Executed is a fill of an order. Both orders of a match are sent the
+// same match number.
+type Executed struct {
+	Timestamp uint64
+	Token     Token
+	Quantity  uint32
+	Price     uint32
+	Match     uint64
+}
+
+// Canceled takes what was left of an order out of the book.
+type Canceled struct {
+	Timestamp uint64
+	Token     Token
+	Quantity  uint32
+	Reason    byte
+}
+
+// Rejected rejects an order, replace or cancel.
+type Rejected struct {
+	Timestamp uint64
+	Token     Token
+	Reason    byte
+}
+
+func (Login) Type() byte        { return TypeLogin }
+func (EnterOrder) Type() byte   { return TypeEnterOrder }
+func (ReplaceOrder) Type() byte { return TypeReplaceOrder }
+func (CancelOrder) Type() byte  { return TypeCancelOrder }
+func (LoggedIn) Type() byte     { return TypeLoggedIn }
+func (Accepted) Type() byte     { return TypeAccepted }
+func (Replaced) Type() byte     { return TypeReplaced }
+func (Executed) Type() byte     { return TypeExecuted }
+func (Canceled) Type() byte     { return TypeCanceled }
+func (Rejected) Type() byte     { return TypeRejected }
+
+// empty returns an empty message of a type.
+func empty(t byte) (Message, error) {
+	switch t {
+	case TypeLogin:
+		return &Login{}, nil
+	case TypeEnterOrder:
+		return &EnterOrder{}, nil
+	case TypeReplaceOrder:
+		return &ReplaceOrder{}, nil
+	case TypeCancelOrder:
+		return &CancelOrder{}, nil
+	case TypeLoggedIn:
+		return &LoggedIn{}, nil
+	case TypeAccepted:
+		return &Accepted{}, nil
+	case TypeReplaced:
+		return &Replaced{}, nil
+	case TypeExecuted:
+		return &Executed{}, nil
+	case TypeCanceled:
+		return &Canceled{}, nil
+	case TypeRejected:
+		return &Rejected{}, nil
+	}
+	return nil, fmt.Errorf("unknown message type %q", t)
+}
+
+// Write writes a message with its length and type in front of it.
+func Write(w io.Writer, m Message) error {
+	size := binary.Size(m)
+	if size < 0 {
+		return fmt.Errorf("message %T has no fixed size", m)
+	}
+	var b bytes.Buffer
+	b.Grow(3 + size)
+	binary.Write(&b, binary.BigEndian, uint16(1+size))
+	b.WriteByte(m.Type())
+	if err := binary.Write(&b, binary.BigEndian, m); err != nil {
+		return err
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// Read reads the next message. Messages are returned as pointers to
+// their types, like *EnterOrder.
+func Read(r io.Reader) (Message, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return nil, fmt.Errorf("empty message")
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	m, err := empty(payload[0])
+	if err != nil {
+		return nil, err
+	}
+	if size := binary.Size(m); size != len(payload)-1 {
+		return nil, fmt.Errorf("message %q must be %d bytes, got %d", payload[0], size, len(payload)-1)
+	}
+	if err := binary.Read(bytes.NewReader(payload[1:]), binary.BigEndian, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
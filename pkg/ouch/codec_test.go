@@ -0,0 +1,66 @@
+package ouch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestCodec(t *testing.T) {
+	is := is.New(t)
+	token, err := NewToken("order-1")
+	is.NoErr(err)
+	is.Equal(token.String(), "order-1")
+	is.Equal(string(token[:]), "order-1       ")
+	symbol, err := NewSymbol("BTC-USD")
+	is.NoErr(err)
+	account, err := NewAccount("alice")
+	is.NoErr(err)
+	secret, err := NewSecret("hunter2")
+	is.NoErr(err)
+	is.Equal(secret.String(), "hunter2")
+	_, err = NewToken("much-too-long-token")
+	is.True(err != nil)
+	_, err = NewToken("with space")
+	is.True(err != nil)
+
+	messages := []Message{
+		&Login{Account: account, Secret: secret},
+		&EnterOrder{Token: token, Side: Buy, Quantity: 10, Symbol: symbol, Price: 1025},
+		&ReplaceOrder{Existing: token, Replacement: token, Quantity: 5, Price: 1030},
+		&CancelOrder{Token: token},
+		&LoggedIn{Account: account},
+		&Accepted{Timestamp: 1, Token: token, Side: Sell, Quantity: 10, Symbol: symbol, Price: 1025, OrderRef: 7},
+		&Replaced{Timestamp: 2, Replacement: token, Side: Buy, Quantity: 5, Symbol: symbol, Price: 1030, OrderRef: 8, Previous: token},
+		&Executed{Timestamp: 3, Token: token, Quantity: 4, Price: 1025, Match: 9},
+		&Canceled{Timestamp: 4, Token: token, Quantity: 6, Reason: ReasonUserRequested},
+		&Rejected{Timestamp: 5, Token: token, Reason: ReasonInvalidPrice},
+	}
+	var b bytes.Buffer
+	for _, m := range messages {
+		is.NoErr(Write(&b, m))
+	}
+	// every message is its fixed size with a length and type in front
+	first := binary.BigEndian.Uint16(b.Bytes())
+	is.Equal(int(first), 1+16+32)
+	is.Equal(b.Bytes()[2], TypeLogin)
+
+	for _, want := range messages {
+		got, err := Read(&b)
+		is.NoErr(err)
+		is.Equal(got, want)
+	}
+	_, err = Read(&b)
+	is.True(err != nil) // nothing left
+
+	// a message of the wrong size or an unknown type is an error
+	is.NoErr(Write(&b, &CancelOrder{Token: token}))
+	raw := b.Bytes()
+	raw[1]--
+	_, err = Read(bytes.NewReader(raw[:len(raw)-1]))
+	is.True(err != nil)
+	_, err = Read(bytes.NewReader([]byte{0, 1, '?'}))
+	is.True(err != nil)
+}
@@ -0,0 +1,442 @@
+package ouch
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dylanlott/orderbook/pkg/accounts"
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+)
+
+// writeWait is how long a write to a client can take.
+var writeWait = 5 * time.Second
+
+// sendBuffer is how many messages can be queued for a client. Clients
+// that fall further behind than that are disconnected.
+var sendBuffer = 1024
+
+// Server serves the protocol in front of a book run with orderbook.Run.
+// Orders are sent on in and canceled on cancels. Like the FIX gateway,
+// it has to be passed every match of the book to report executions and
+// every order the book rejects to Reject.
+type Server struct {
+	sync.Mutex
+
+	symbol   string
+	accounts accounts.AccountManager
+	secrets  map[string]string
+	in       chan *orderbook.Order
+	cancels  chan orderbook.OpCancel
+
+	// conns holds the connection that's logged in to each account.
+	conns map[string]*conn
+	// orders holds every order entered through the server by the ID of
+	// its order in the book.
+	orders  map[string]*order
+	refs    uint64
+	matches uint64
+}
+
+// order is an order entered through the server.
+type order struct {
+	account  string
+	token    Token
+	side     byte
+	quantity uint32
+	price    uint32
+	ref      uint64
+	open     bool
+	// filled is what the order it replaced had already filled.
+	filled uint32
+}
+
+// conn is a client's connection. Messages sent to it are queued and
+// written out in order by a goroutine of its own, so that a client
+// that's slow to read doesn't hold up the server.
+type conn struct {
+	sync.Mutex
+	net.Conn
+
+	queue   chan []byte
+	closed  bool
+	written chan struct{}
+}
+
+func newConn(c net.Conn) *conn {
+	cn := &conn{Conn: c, queue: make(chan []byte, sendBuffer), written: make(chan struct{})}
+	go cn.write()
+	return cn
+}
+
+// send queues a message for the client. A client whose queue is full is
+// disconnected.
+func (c *conn) send(m Message) error {
+	var b bytes.Buffer
+	if err := Write(&b, m); err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return fmt.Errorf("connection is closed")
+	}
+	select {
+	case c.queue <- b.Bytes():
+		return nil
+	default:
+		c.Conn.Close()
+		return fmt.Errorf("client fell too far behind")
+	}
+}
+
+// write writes what's queued for the client until the queue is closed. A
+// connection that can't be written to is closed and the rest of the queue
+// is dropped.
+func (c *conn) write() {
+	defer close(c.written)
+	failed := false
+	for b := range c.queue {
+		if failed {
+			continue
+		}
+		c.SetWriteDeadline(time.Now().Add(writeWait))
+		if _, err := c.Conn.Write(b); err != nil {
+			c.Conn.Close()
+			failed = true
+		}
+	}
+}
+
+// close closes the connection once whatever's queued for it is written
+// out.
+func (c *conn) close() {
+	c.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.queue)
+	}
+	c.Unlock()
+	<-c.written
+	c.Conn.Close()
+}
+
+// NewServer returns a Server that takes orders for a market's symbol
+// from the accounts in accts. secrets holds the secret that each account
+// logs in with. Accounts without a secret can't log in.
+func NewServer(symbol string, accts accounts.AccountManager, secrets map[string]string, in chan *orderbook.Order, cancels chan orderbook.OpCancel) *Server {
+	return &Server{
+		symbol:   symbol,
+		accounts: accts,
+		secrets:  secrets,
+		in:       in,
+		cancels:  cancels,
+		conns:    make(map[string]*conn),
+		orders:   make(map[string]*order),
+	}
+}
+
+// ListenAndServe serves clients on a TCP address.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for order entry: %v", err)
+	}
+	return s.Serve(l)
+}
+
+// Serve serves clients on a listener until it's closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		if tcp, ok := c.(*net.TCPConn); ok {
+			tcp.SetNoDelay(true)
+		}
+		go s.handle(newConn(c))
+	}
+}
+
+// handle serves a connection until it's closed. The first message has to
+// log it in to an account that isn't logged in already, with the
+// account's secret.
+func (s *Server) handle(c *conn) {
+	defer c.close()
+	r := bufio.NewReader(c)
+
+	m, err := Read(r)
+	if err != nil {
+		return
+	}
+	login, ok := m.(*Login)
+	if !ok {
+		c.send(Rejected{Timestamp: now(), Reason: ReasonNotLoggedIn})
+		return
+	}
+	account := login.Account.String()
+	if _, err := s.accounts.Get(account); err != nil {
+		c.send(Rejected{Timestamp: now(), Reason: ReasonNotLoggedIn})
+		return
+	}
+	secret, ok := s.secrets[account]
+	if !ok || secret == "" || subtle.ConstantTimeCompare([]byte(login.Secret.String()), []byte(secret)) != 1 {
+		c.send(Rejected{Timestamp: now(), Reason: ReasonNotLoggedIn})
+		return
+	}
+	s.Lock()
+	if _, ok := s.conns[account]; ok {
+		s.Unlock()
+		c.send(Rejected{Timestamp: now(), Reason: ReasonNotLoggedIn})
+		return
+	}
+	s.conns[account] = c
+	s.Unlock()
+	defer func() {
+		s.Lock()
+		delete(s.conns, account)
+		s.Unlock()
+	}()
+
+	if err := c.send(LoggedIn{Account: login.Account}); err != nil {
+		return
+	}
+	for {
+		m, err := Read(r)
+		if err != nil {
+			return
+		}
+		switch m := m.(type) {
+		case *EnterOrder:
+			s.enter(account, m)
+		case *ReplaceOrder:
+			s.replace(account, m)
+		case *CancelOrder:
+			s.cancel(account, m)
+		default:
+			log.Printf("ouch: %s sent an unexpected message %q", account, m.Type())
+			return
+		}
+	}
+}
+
+// enter enters an order into the book.
+func (s *Server) enter(account string, m *EnterOrder) {
+	s.Lock()
+	reason := s.check(account, m.Token, m.Side, m.Quantity, m.Price)
+	if m.Symbol.String() != s.symbol {
+		reason = ReasonInvalidSymbol
+	}
+	if reason != 0 {
+		s.deliver(account, Rejected{Timestamp: now(), Token: m.Token, Reason: reason})
+		s.Unlock()
+		return
+	}
+	o := s.add(account, m.Token, m.Side, m.Quantity, m.Price)
+	s.deliver(account, Accepted{
+		Timestamp: now(),
+		Token:     o.token,
+		Side:      o.side,
+		Quantity:  o.quantity,
+		Symbol:    m.Symbol,
+		Price:     o.price,
+		OrderRef:  o.ref,
+	})
+	s.Unlock()
+
+	s.in <- o.entry()
+}
+
+// replace replaces an order with a new one. The replacement carries over
+// what the order has already filled, and an order that's already filled
+// its new quantity is canceled instead.
+func (s *Server) replace(account string, m *ReplaceOrder) {
+	s.Lock()
+	existing, ok := s.orders[id(account, m.Existing)]
+	reason := ReasonUnknownToken
+	if ok && existing.open {
+		reason = s.check(account, m.Replacement, existing.side, m.Quantity, m.Price)
+	}
+	s.Unlock()
+	if reason != 0 {
+		s.Lock()
+		s.deliver(account, Rejected{Timestamp: now(), Token: m.Replacement, Reason: reason})
+		s.Unlock()
+		return
+	}
+
+	canceled, err := s.cancelOrder(account, m.Existing)
+	if err != nil {
+		s.Lock()
+		s.deliver(account, Rejected{Timestamp: now(), Token: m.Replacement, Reason: ReasonUnknownToken})
+		s.Unlock()
+		return
+	}
+
+	s.Lock()
+	existing.open = false
+	if r := s.check(account, m.Replacement, existing.side, m.Quantity, m.Price); r != 0 {
+		// the replacement token was taken while the order was canceled
+		s.deliver(account, Canceled{Timestamp: now(), Token: m.Existing, Reason: r})
+		s.Unlock()
+		return
+	}
+	if uint64(m.Quantity) <= canceled.Filled {
+		s.deliver(account, Canceled{Timestamp: now(), Token: m.Existing, Reason: ReasonUserRequested})
+		s.Unlock()
+		return
+	}
+	o := s.add(account, m.Replacement, existing.side, m.Quantity, m.Price)
+	o.filled = uint32(canceled.Filled)
+	symbol, _ := NewSymbol(s.symbol)
+	s.deliver(account, Replaced{
+		Timestamp:   now(),
+		Replacement: o.token,
+		Side:        o.side,
+		Quantity:    o.quantity - o.filled,
+		Symbol:      symbol,
+		Price:       o.price,
+		OrderRef:    o.ref,
+		Previous:    m.Existing,
+	})
+	s.Unlock()
+
+	s.in <- o.entry()
+}
+
+// cancel cancels an order.
+func (s *Server) cancel(account string, m *CancelOrder) {
+	canceled, err := s.cancelOrder(account, m.Token)
+	s.Lock()
+	defer s.Unlock()
+	if err != nil {
+		s.deliver(account, Rejected{Timestamp: now(), Token: m.Token, Reason: ReasonUnknownToken})
+		return
+	}
+	if o, ok := s.orders[id(account, m.Token)]; ok {
+		o.open = false
+	}
+	s.deliver(account, Canceled{
+		Timestamp: now(),
+		Token:     m.Token,
+		Quantity:  uint32(canceled.Open - canceled.Filled),
+		Reason:    ReasonUserRequested,
+	})
+}
+
+// cancelOrder takes an order out of the book and returns it as it was.
+func (s *Server) cancelOrder(account string, token Token) (orderbook.Order, error) {
+	result := make(chan orderbook.CancelResult, 1)
+	s.cancels <- orderbook.OpCancel{OrderID: id(account, token), AccountID: account, Result: result}
+	r := <-result
+	return r.Order, r.Err
+}
+
+// Match sends an executed message for each order of a match that was
+// entered through the server.
+func (s *Server) Match(m orderbook.Match) {
+	s.Lock()
+	defer s.Unlock()
+	s.matches++
+	for _, o := range []*orderbook.Order{m.Buy, m.Sell} {
+		ord, ok := s.orders[o.ID]
+		if !ok {
+			continue
+		}
+		s.deliver(ord.account, Executed{
+			Timestamp: uint64(m.Time.UnixNano()),
+			Token:     ord.token,
+			Quantity:  uint32(m.Quantity),
+			Price:     uint32(m.Price),
+			Match:     s.matches,
+		})
+	}
+}
+
+// Reject cancels an order that the book wouldn't take, like one that its
+// account can't fund, if it was entered through the server.
+func (s *Server) Reject(r orderbook.WriteResult) {
+	s.Lock()
+	defer s.Unlock()
+	o, ok := s.orders[r.Order.ID]
+	if !ok || !o.open {
+		return
+	}
+	o.open = false
+	s.deliver(o.account, Canceled{
+		Timestamp: now(),
+		Token:     o.token,
+		Quantity:  o.quantity - o.filled,
+		Reason:    ReasonRefused,
+	})
+}
+
+// check returns why an order can't be entered, or 0 if it can. The
+// server must be locked by the caller.
+func (s *Server) check(account string, token Token, side byte, quantity, price uint32) byte {
+	switch {
+	case side != Buy && side != Sell:
+		return ReasonInvalidSide
+	case quantity == 0:
+		return ReasonInvalidQuantity
+	case price == 0:
+		return ReasonInvalidPrice
+	}
+	if _, ok := s.orders[id(account, token)]; ok {
+		return ReasonDuplicateToken
+	}
+	return 0
+}
+
+// add records a new order. The server must be locked by the caller.
+func (s *Server) add(account string, token Token, side byte, quantity, price uint32) *order {
+	s.refs++
+	o := &order{account: account, token: token, side: side, quantity: quantity, price: price, ref: s.refs, open: true}
+	s.orders[id(account, token)] = o
+	return o
+}
+
+// deliver sends a message to an account's connection, if it's logged in.
+// The server must be locked by the caller, so that messages go out in the
+// order that their orders changed. The message is only queued, so a slow
+// client doesn't hold up the server.
+func (s *Server) deliver(account string, m Message) {
+	if c, ok := s.conns[account]; ok {
+		if err := c.send(m); err != nil {
+			log.Printf("ouch: failed to send to %s: %v", account, err)
+		}
+	}
+}
+
+// entry returns the book order for an order, with what the order it
+// replaced had already filled.
+func (o *order) entry() *orderbook.Order {
+	side := "buy"
+	if o.side == Sell {
+		side = "sell"
+	}
+	return &orderbook.Order{
+		ID:        id(o.account, o.token),
+		AccountID: o.account,
+		Kind:      "limit",
+		Side:      side,
+		Price:     uint64(o.price),
+		Open:      uint64(o.quantity),
+		Filled:    uint64(o.filled),
+	}
+}
+
+// id returns the ID of the book order for a token of an account.
+func id(account string, token Token) string {
+	return "ouch:" + account + ":" + token.String()
+}
+
+func now() uint64 {
+	return uint64(time.Now().UnixNano())
+}
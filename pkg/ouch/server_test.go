@@ -0,0 +1,184 @@
+package ouch
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dylanlott/orderbook/pkg/accounts"
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+	"github.com/matryer/is"
+)
+
+// smallBuffers is a listener whose connections have small socket buffers,
+// so that a client that doesn't read falls behind quickly.
+type smallBuffers struct {
+	net.Listener
+}
+
+func (l smallBuffers) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if tcp, ok := c.(*net.TCPConn); ok {
+		tcp.SetWriteBuffer(1024)
+	}
+	return c, err
+}
+
+// serve serves s for alice and bob, who log in with their names as their
+// secrets, and returns its address. Orders entered through it are taken
+// off in but never matched.
+func serve(t *testing.T) (*Server, string) {
+	t.Helper()
+	accts := accounts.NewAccountManager("")
+	for _, id := range []string{"alice", "bob"} {
+		if _, err := accts.Create(id, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	in := make(chan *orderbook.Order, 16)
+	s := NewServer("BTC-USD", accts, map[string]string{"alice": "alice", "bob": "bob"}, in, nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.Serve(smallBuffers{l})
+	return s, l.Addr().String()
+}
+
+// login connects to a server and sends a Login. It returns the connection
+// and the server's answer.
+func login(t *testing.T, addr, account, secret string) (net.Conn, *bufio.Reader, Message) {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	a, _ := NewAccount(account)
+	sec, _ := NewSecret(secret)
+	if err := Write(c, Login{Account: a, Secret: sec}); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	m, err := Read(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, r, m
+}
+
+// loggedIn waits for a server to have n connections logged in.
+func loggedIn(s *Server, n int) bool {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		s.Lock()
+		conns := len(s.conns)
+		s.Unlock()
+		if conns == n {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
+
+func TestServerLogin(t *testing.T) {
+	is := is.New(t)
+	s, addr := serve(t)
+
+	// a client needs an account and its secret
+	for _, creds := range [][2]string{{"mallory", "mallory"}, {"alice", ""}, {"alice", "bob"}} {
+		c, r, m := login(t, addr, creds[0], creds[1])
+		is.Equal(m.(*Rejected).Reason, ReasonNotLoggedIn)
+		_, err := Read(r)
+		is.True(err != nil) // and it's disconnected
+		c.Close()
+	}
+
+	_, _, m := login(t, addr, "alice", "alice")
+	is.Equal(m.(*LoggedIn).Account.String(), "alice")
+	_, _, m = login(t, addr, "alice", "alice")
+	is.Equal(m.(*Rejected).Reason, ReasonNotLoggedIn) // already logged in
+	is.True(loggedIn(s, 1))
+
+	// the first message has to be a Login
+	c, err := net.Dial("tcp", addr)
+	is.NoErr(err)
+	defer c.Close()
+	is.NoErr(Write(c, CancelOrder{}))
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	m, err = Read(c)
+	is.NoErr(err)
+	is.Equal(m.(*Rejected).Reason, ReasonNotLoggedIn)
+}
+
+func TestServerSlowClient(t *testing.T) {
+	is := is.New(t)
+	s, addr := serve(t)
+	alice, r, m := login(t, addr, "alice", "alice")
+	is.Equal(m.Type(), TypeLoggedIn)
+	bob, _, m := login(t, addr, "bob", "bob")
+	is.Equal(m.Type(), TypeLoggedIn)
+	defer bob.Close()
+
+	token, _ := NewToken("a1")
+	symbol, _ := NewSymbol("BTC-USD")
+	is.NoErr(Write(alice, EnterOrder{Token: token, Side: Sell, Quantity: 10, Symbol: symbol, Price: 1000}))
+	m, err := Read(r)
+	is.NoErr(err)
+	is.Equal(m.Type(), TypeAccepted)
+	o := <-s.in
+
+	// alice stops reading, but her executions don't hold up the server
+	matched := make(chan struct{})
+	go func() {
+		for i := 0; i < 20*sendBuffer; i++ {
+			s.Match(orderbook.Match{Sell: o, Buy: &orderbook.Order{ID: "elsewhere"}, Quantity: 1, Price: 1000})
+		}
+		close(matched)
+	}()
+	select {
+	case <-matched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a slow client held up matches")
+	}
+	// she's disconnected for falling behind and bob isn't
+	is.True(loggedIn(s, 1))
+	s.Lock()
+	_, ok := s.conns["bob"]
+	s.Unlock()
+	is.True(ok)
+}
+
+func TestConnQueue(t *testing.T) {
+	is := is.New(t)
+	c, peer := net.Pipe()
+	defer peer.Close()
+	cn := &conn{Conn: c, queue: make(chan []byte, 1), written: make(chan struct{})}
+
+	// sends are queued without waiting for the client to read them
+	is.NoErr(cn.send(Rejected{}))
+	is.True(cn.send(Rejected{}) != nil) // and a client that falls behind is disconnected
+	_, err := c.Write([]byte("x"))
+	is.True(err != nil)
+
+	// what's queued is written out before the connection is closed
+	c, peer = net.Pipe()
+	defer peer.Close()
+	cn = &conn{Conn: c, queue: make(chan []byte, 2), written: make(chan struct{})}
+	go cn.write()
+	token, _ := NewToken("a1")
+	is.NoErr(cn.send(Canceled{Token: token}))
+	read := make(chan Message, 1)
+	go func() {
+		m, _ := Read(peer)
+		read <- m
+	}()
+	cn.close()
+	m := <-read
+	is.Equal(m.(*Canceled).Token, token)
+	is.True(cn.send(Rejected{}) != nil) // nothing is queued once it's closed
+}
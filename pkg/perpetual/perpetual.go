@@ -0,0 +1,216 @@
+// Package perpetual runs perpetual swap markets on top of an orderbook.
+//
+// A perpetual market trades a contract asset that never expires, like
+// BTC-PERP, in a quote asset. Buying a contract opens a long position
+// and selling one that the account doesn't have opens a short, which
+// takes a margin account. To keep the contract's price close to the price
+// of what it tracks, longs and shorts pay each other funding: the engine
+// samples the premium of the book's mid price over an index price and at
+// the end of each funding interval the side that's been trading rich pays
+// the other side the average premium on the index value of its positions.
+package perpetual
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dylanlott/orderbook/pkg/accounts"
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+)
+
+// Config describes a perpetual market.
+type Config struct {
+	// Market is the book that the contract trades in. Its Base is the
+	// contract asset.
+	Market orderbook.Market
+	// Interval is how often funding is paid.
+	Interval time.Duration
+	// SampleInterval is how often the premium is sampled.
+	SampleInterval time.Duration
+	// MaxRate caps the funding rate of an interval in either direction.
+	MaxRate float64
+}
+
+// Funding is one funding payment of a market.
+type Funding struct {
+	Symbol string    `json:"symbol"`
+	Time   time.Time `json:"time"`
+	// Index is the index price that positions were valued at.
+	Index float64 `json:"index"`
+	// Premium is the average premium of the book over the index since
+	// the last funding and Rate is that premium after it's capped.
+	Premium float64 `json:"premium"`
+	Rate    float64 `json:"rate"`
+	// Payments is what each account paid, negative for what it was paid.
+	Payments []Payment `json:"payments"`
+}
+
+// Payment is what an account with a position paid in funding.
+type Payment struct {
+	Account  string  `json:"account"`
+	Position float64 `json:"position"`
+	Amount   float64 `json:"amount"`
+}
+
+// Engine samples the premium of a perpetual market and pays its funding.
+type Engine struct {
+	sync.RWMutex
+
+	config  Config
+	accts   accounts.AccountManager
+	reads   chan orderbook.OpRead
+	index   float64
+	samples []float64
+	history []Funding
+}
+
+// NewEngine returns an Engine for a perpetual market that's run by
+// orderbook.Start or orderbook.Run with the given read channel.
+func NewEngine(accts accounts.AccountManager, config Config, reads chan orderbook.OpRead) *Engine {
+	return &Engine{
+		config: config,
+		accts:  accts,
+		reads:  reads,
+	}
+}
+
+// SetIndex sets the index price that the contract tracks, in the quote asset.
+func (e *Engine) SetIndex(price float64) {
+	e.Lock()
+	defer e.Unlock()
+	e.index = price
+}
+
+// Run samples the premium and pays funding at the engine's intervals
+// until ctx is done. Errors and funding payments are sent on their
+// channels.
+func (e *Engine) Run(ctx context.Context, fundings chan Funding, errs chan error) {
+	sample := time.NewTicker(e.config.SampleInterval)
+	defer sample.Stop()
+	pay := time.NewTicker(e.config.Interval)
+	defer pay.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sample.C:
+			if _, err := e.Sample(); err != nil {
+				errs <- err
+			}
+		case <-pay.C:
+			f, err := e.Pay()
+			if err != nil {
+				errs <- err
+				continue
+			}
+			fundings <- f
+		}
+	}
+}
+
+// Sample records the premium of the book's mid price over the index price
+// and returns it. Books without both a bid and an ask can't be sampled.
+func (e *Engine) Sample() (float64, error) {
+	result := make(chan orderbook.ReadResult)
+	e.reads <- orderbook.OpRead{Result: result}
+	top := <-result
+	if top.Bid == 0 || top.Ask == 0 {
+		return 0, fmt.Errorf("%s has no mid price to sample", e.config.Market.Symbol)
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	if e.index <= 0 {
+		return 0, fmt.Errorf("%s has no index price", e.config.Market.Symbol)
+	}
+	mid := float64(top.Bid+top.Ask) / 2 / 100
+	premium := (mid - e.index) / e.index
+	e.samples = append(e.samples, premium)
+	return premium, nil
+}
+
+// Pay charges every position the funding rate of the interval that just
+// ended. Longs pay shorts when the rate is positive and shorts pay longs
+// when it's negative. Payments go through the exchange's funding account
+// and are posted to the ledger as one funding entry.
+func (e *Engine) Pay() (Funding, error) {
+	e.Lock()
+	defer e.Unlock()
+
+	if e.index <= 0 {
+		return Funding{}, fmt.Errorf("%s has no index price", e.config.Market.Symbol)
+	}
+	f := Funding{
+		Symbol:   e.config.Market.Symbol,
+		Time:     time.Now(),
+		Index:    e.index,
+		Payments: []Payment{},
+	}
+	for _, premium := range e.samples {
+		f.Premium += premium / float64(len(e.samples))
+	}
+	f.Rate = math.Max(-e.config.MaxRate, math.Min(e.config.MaxRate, f.Premium))
+
+	var accts []string
+	holders := e.accts.Ledger().Holders(e.config.Market.Base)
+	for id := range holders {
+		if !accounts.IsSystem(id) {
+			accts = append(accts, id)
+		}
+	}
+	sort.Strings(accts)
+
+	memo := fmt.Sprintf("%s funding at %v", f.Symbol, f.Rate)
+	var transfers []accounts.Transfer
+	for _, id := range accts {
+		amount := holders[id] * f.Index * f.Rate
+		f.Payments = append(f.Payments, Payment{Account: id, Position: holders[id], Amount: amount})
+		t := accounts.Transfer{
+			From:     id,
+			To:       accounts.FundingAccount,
+			Asset:    e.config.Market.Quote,
+			Amount:   amount,
+			Kind:     accounts.KindFunding,
+			Memo:     memo,
+			Overdraw: true,
+		}
+		if amount < 0 {
+			t.From, t.To, t.Amount = accounts.FundingAccount, id, -amount
+		}
+		if t.Amount > 0 {
+			transfers = append(transfers, t)
+		}
+	}
+	if len(transfers) > 0 {
+		if _, err := e.accts.Exchange(transfers...); err != nil {
+			return Funding{}, fmt.Errorf("failed to pay %s funding: %v", f.Symbol, err)
+		}
+	}
+
+	e.samples = nil
+	e.history = append(e.history, f)
+	return f, nil
+}
+
+// History returns the fundings paid in [from, to), oldest first.
+// A zero from or to leaves that end of the range open.
+func (e *Engine) History(from, to time.Time) []Funding {
+	e.RLock()
+	defer e.RUnlock()
+	history := []Funding{}
+	for _, f := range e.history {
+		if !from.IsZero() && f.Time.Before(from) {
+			continue
+		}
+		if !to.IsZero() && !f.Time.Before(to) {
+			continue
+		}
+		history = append(history, f)
+	}
+	return history
+}
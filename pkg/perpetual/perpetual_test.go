@@ -0,0 +1,85 @@
+package perpetual
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dylanlott/orderbook/pkg/accounts"
+	"github.com/dylanlott/orderbook/pkg/margin"
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+	"github.com/matryer/is"
+)
+
+var perp = orderbook.Market{Symbol: "BTC-PERP", Base: "BTC-PERP", Quote: accounts.USD}
+
+func TestFunding(t *testing.T) {
+	is := is.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	acc := accounts.NewAccountManager("")
+	for _, id := range []string{"long", "short"} {
+		_, err := acc.Create(id, map[string]float64{accounts.USD: 1000})
+		is.NoErr(err)
+	}
+	lender := margin.NewEngine(acc, margin.Config{Quote: accounts.USD, MaxLeverage: 5, Maintenance: 0.05})
+	lender.SetMark(perp.Base, 100)
+	is.NoErr(lender.Enable("short", 5))
+
+	writes := make(chan orderbook.OpWrite)
+	reads := make(chan orderbook.OpRead)
+	fills := make(chan orderbook.FillResult, 100)
+	errs := make(chan error, 100)
+	go orderbook.Start(ctx, perp, acc, writes, nil, reads, fills, nil, errs)
+
+	engine := NewEngine(acc, Config{Market: perp, Interval: time.Hour, SampleInterval: time.Minute, MaxRate: 0.01}, reads)
+	_, err := engine.Sample()
+	is.True(err != nil) // nothing in the book yet
+
+	// short sells 2 contracts to long, then they quote 101 / 103
+	is.NoErr(write(writes, orderbook.Order{ID: "s1", AccountID: "short", Side: "sell", Price: 10000, Open: 2}).Err)
+	is.NoErr(write(writes, orderbook.Order{ID: "l1", AccountID: "long", Side: "buy", Price: 10000, Open: 2}).Err)
+	is.NoErr(write(writes, orderbook.Order{ID: "s2", AccountID: "short", Side: "sell", Price: 10300, Open: 1}).Err)
+	is.NoErr(write(writes, orderbook.Order{ID: "l2", AccountID: "long", Side: "buy", Price: 10100, Open: 1}).Err)
+	is.Equal(acc.Ledger().Balance("short", perp.Base), float64(-2))
+
+	// the book trades 2% over the index, which is capped at 1%
+	_, err = engine.Sample()
+	is.True(err != nil) // no index yet
+	engine.SetIndex(100)
+	premium, err := engine.Sample()
+	is.NoErr(err)
+	is.Equal(premium, 0.02)
+
+	f, err := engine.Pay()
+	is.NoErr(err)
+	is.Equal(f.Premium, 0.02)
+	is.Equal(f.Rate, 0.01)
+	is.Equal(f.Payments, []Payment{
+		{Account: "long", Position: 2, Amount: 2},
+		{Account: "short", Position: -2, Amount: -2},
+	})
+
+	// longs paid shorts through the funding account
+	ledger := acc.Ledger()
+	is.Equal(ledger.Balance("long", accounts.USD), float64(798))
+	is.Equal(ledger.Balance("short", accounts.USD), float64(1202))
+	is.Equal(ledger.Balance(accounts.FundingAccount, accounts.USD), float64(0))
+	entries := ledger.Entries()
+	is.Equal(entries[len(entries)-1].Kind, accounts.KindFunding)
+
+	is.Equal(len(engine.History(time.Time{}, time.Time{})), 1)
+	is.Equal(len(engine.History(time.Now(), time.Time{})), 0)
+
+	// without samples there's no premium to pay
+	f, err = engine.Pay()
+	is.NoErr(err)
+	is.Equal(f.Rate, float64(0))
+}
+
+func write(writes chan orderbook.OpWrite, o orderbook.Order) orderbook.WriteResult {
+	result := make(chan orderbook.WriteResult)
+	writes <- orderbook.OpWrite{Order: o, Result: result}
+	return <-result
+}
@@ -0,0 +1,307 @@
+package positions
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+)
+
+// Method is how a closing fill picks the lots that it relieves.
+type Method string
+
+// Lot relief methods.
+const (
+	// FIFO relieves the oldest lots first.
+	FIFO Method = "fifo"
+	// LIFO relieves the newest lots first.
+	LIFO Method = "lifo"
+	// SpecificID relieves the lots listed in the closing order's
+	// LotsMetadataKey metadata in order, then falls back to FIFO.
+	SpecificID Method = "specific"
+)
+
+// LotsMetadataKey is the Order metadata key that holds a comma-separated
+// list of lot IDs for SpecificID relief.
+const LotsMetadataKey = "lots"
+
+// longTerm is how long a lot has to be held for its gain to be long term.
+var longTerm = 365 * 24 * time.Hour
+
+// Lot is a quantity of a market's base asset acquired in a single fill.
+// Long lots are opened by buys and short lots by sells that go past the
+// account's long lots. Cost is per unit in the quote asset and includes
+// the fee paid to open the lot.
+type Lot struct {
+	ID       string    `json:"id"`
+	Account  string    `json:"account"`
+	Symbol   string    `json:"symbol"`
+	Short    bool      `json:"short"`
+	Opened   time.Time `json:"opened"`
+	Quantity uint64    `json:"quantity"`
+	Cost     float64   `json:"cost"`
+}
+
+// Realization is the gain or loss from closing some or all of a lot.
+// Proceeds are net of the fee paid to close it.
+type Realization struct {
+	LotID    string    `json:"lotID"`
+	Account  string    `json:"account"`
+	Symbol   string    `json:"symbol"`
+	Short    bool      `json:"short"`
+	Opened   time.Time `json:"opened"`
+	Closed   time.Time `json:"closed"`
+	Quantity uint64    `json:"quantity"`
+	Cost     float64   `json:"cost"`
+	Proceeds float64   `json:"proceeds"`
+	Gain     float64   `json:"gain"`
+	LongTerm bool      `json:"longTerm"`
+}
+
+// GainsReport totals an account's realized gains over [From, To).
+type GainsReport struct {
+	Account      string        `json:"account"`
+	From         time.Time     `json:"from"`
+	To           time.Time     `json:"to"`
+	ShortTerm    float64       `json:"shortTerm"`
+	LongTerm     float64       `json:"longTerm"`
+	Total        float64       `json:"total"`
+	Realizations []Realization `json:"realizations"`
+}
+
+// Lots keeps the tax lots of every account and the gains realized by
+// closing them.
+type Lots struct {
+	sync.RWMutex
+
+	method   Method
+	methods  map[string]Method
+	open     map[string]map[string][]*Lot
+	opened   map[string]int
+	realized []Realization
+}
+
+// NewLots returns an empty Lots that relieves lots with method unless an
+// account chooses otherwise.
+func NewLots(method Method) *Lots {
+	return &Lots{
+		method:  method,
+		methods: make(map[string]Method),
+		open:    make(map[string]map[string][]*Lot),
+		opened:  make(map[string]int),
+	}
+}
+
+// SetMethod sets the lot relief method of an account.
+func (l *Lots) SetMethod(account string, method Method) error {
+	switch method {
+	case FIFO, LIFO, SpecificID:
+	default:
+		return fmt.Errorf("invalid lot relief method %q", method)
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.methods[account] = method
+	return nil
+}
+
+// Apply opens and relieves the buyer's and seller's lots with a match.
+func (l *Lots) Apply(symbol string, m orderbook.Match) {
+	l.Lock()
+	defer l.Unlock()
+	l.fill(symbol, m.Buy, m)
+	l.fill(symbol, m.Sell, m)
+}
+
+// Replay rebuilds lots from the Match history of orders. Each order's
+// matches only affect its own account, so a match is applied once even
+// when both of its orders are given. Matches are applied oldest first.
+func (l *Lots) Replay(symbol string, orders []*orderbook.Order) {
+	type fill struct {
+		order *orderbook.Order
+		match orderbook.Match
+	}
+	var fills []fill
+	for _, o := range orders {
+		for _, m := range o.History {
+			fills = append(fills, fill{o, m})
+		}
+	}
+	sort.SliceStable(fills, func(i, j int) bool {
+		return fills[i].match.Time.Before(fills[j].match.Time)
+	})
+
+	l.Lock()
+	defer l.Unlock()
+	for _, f := range fills {
+		l.fill(symbol, f.order, f.match)
+	}
+}
+
+// Open returns an account's open lots in a market, oldest first.
+func (l *Lots) Open(account, symbol string) []Lot {
+	l.RLock()
+	defer l.RUnlock()
+	lots := []Lot{}
+	for _, lot := range l.open[account][symbol] {
+		lots = append(lots, *lot)
+	}
+	return lots
+}
+
+// Report returns the gains an account realized over [from, to).
+// A zero from or to leaves that end of the period open.
+func (l *Lots) Report(account string, from, to time.Time) GainsReport {
+	l.RLock()
+	defer l.RUnlock()
+
+	report := GainsReport{
+		Account:      account,
+		From:         from,
+		To:           to,
+		Realizations: []Realization{},
+	}
+	for _, r := range l.realized {
+		if r.Account != account {
+			continue
+		}
+		if !from.IsZero() && r.Closed.Before(from) {
+			continue
+		}
+		if !to.IsZero() && !r.Closed.Before(to) {
+			continue
+		}
+		report.Realizations = append(report.Realizations, r)
+		if r.LongTerm {
+			report.LongTerm += r.Gain
+		} else {
+			report.ShortTerm += r.Gain
+		}
+		report.Total += r.Gain
+	}
+	return report
+}
+
+// fill applies one side of a match to the account of order o. It closes
+// lots on the other side of the account's position first and opens a lot
+// with whatever is left. The lots must be locked.
+func (l *Lots) fill(symbol string, o *orderbook.Order, m orderbook.Match) {
+	// a match of nothing has no units to spread its fee over
+	if m.Quantity == 0 {
+		return
+	}
+	short := o.Side == "sell"
+	price := float64(m.Price) / 100
+	fee := m.MakerFee
+	if m.Taker == o.Side {
+		fee = m.TakerFee
+	}
+	perUnit := fee / float64(m.Quantity)
+
+	remaining := m.Quantity
+	for remaining > 0 {
+		lot := l.relieve(o, symbol, !short)
+		if lot == nil {
+			break
+		}
+		closed := remaining
+		if lot.Quantity < closed {
+			closed = lot.Quantity
+		}
+
+		// a long lot is sold to close it and a short lot is bought back
+		cost, proceeds := lot.Cost*float64(closed), (price-perUnit)*float64(closed)
+		if lot.Short {
+			cost, proceeds = (price+perUnit)*float64(closed), lot.Cost*float64(closed)
+		}
+		l.realized = append(l.realized, Realization{
+			LotID:    lot.ID,
+			Account:  o.AccountID,
+			Symbol:   symbol,
+			Short:    lot.Short,
+			Opened:   lot.Opened,
+			Closed:   m.Time,
+			Quantity: closed,
+			Cost:     cost,
+			Proceeds: proceeds,
+			Gain:     proceeds - cost,
+			LongTerm: m.Time.Sub(lot.Opened) >= longTerm,
+		})
+
+		lot.Quantity -= closed
+		remaining -= closed
+		if lot.Quantity == 0 {
+			l.remove(o.AccountID, symbol, lot)
+		}
+	}
+	if remaining == 0 {
+		return
+	}
+
+	// long lots cost what was paid for them and short lots are worth
+	// what they were sold for
+	cost := price + perUnit
+	if short {
+		cost = price - perUnit
+	}
+	l.opened[o.ID]++
+	lot := &Lot{
+		ID:       fmt.Sprintf("%s/%d", o.ID, l.opened[o.ID]),
+		Account:  o.AccountID,
+		Symbol:   symbol,
+		Short:    short,
+		Opened:   m.Time,
+		Quantity: remaining,
+		Cost:     cost,
+	}
+	if l.open[o.AccountID] == nil {
+		l.open[o.AccountID] = make(map[string][]*Lot)
+	}
+	l.open[o.AccountID][symbol] = append(l.open[o.AccountID][symbol], lot)
+}
+
+// relieve picks the next lot that order o closes, or nil if the account
+// has no open lots on the given side.
+func (l *Lots) relieve(o *orderbook.Order, symbol string, short bool) *Lot {
+	var candidates []*Lot
+	for _, lot := range l.open[o.AccountID][symbol] {
+		if lot.Short == short {
+			candidates = append(candidates, lot)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	method, ok := l.methods[o.AccountID]
+	if !ok {
+		method = l.method
+	}
+	switch method {
+	case LIFO:
+		return candidates[len(candidates)-1]
+	case SpecificID:
+		for _, id := range strings.Split(o.Metadata[LotsMetadataKey], ",") {
+			for _, lot := range candidates {
+				if lot.ID == strings.TrimSpace(id) {
+					return lot
+				}
+			}
+		}
+	}
+	return candidates[0]
+}
+
+// remove drops a closed lot from an account's open lots.
+func (l *Lots) remove(account, symbol string, closed *Lot) {
+	lots := l.open[account][symbol]
+	for i, lot := range lots {
+		if lot == closed {
+			l.open[account][symbol] = append(lots[:i], lots[i+1:]...)
+			return
+		}
+	}
+}
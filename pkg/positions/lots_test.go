@@ -0,0 +1,102 @@
+package positions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+	"github.com/matryer/is"
+)
+
+// trade fills buy against sell at price and records the match on both
+// orders the way the engine does.
+func trade(buy, sell *orderbook.Order, price, quantity uint64, at time.Time) orderbook.Match {
+	m := orderbook.Match{Buy: buy, Sell: sell, Price: price, Quantity: quantity, Time: at}
+	buy.History = append(buy.History, m)
+	sell.History = append(sell.History, m)
+	return m
+}
+
+func TestLots(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		method Method
+		lots   string
+		gain   float64
+		left   string
+	}{
+		{method: FIFO, gain: 50, left: "b2/1"},  // sells the lot bought at 100
+		{method: LIFO, gain: -50, left: "b1/1"}, // sells the lot bought at 200
+		{method: SpecificID, lots: "b2/1", gain: -50, left: "b1/1"},
+	} {
+		t.Run(string(tt.method), func(t *testing.T) {
+			is := is.New(t)
+			lots := NewLots(FIFO)
+			is.NoErr(lots.SetMethod("alice", tt.method))
+
+			b1 := &orderbook.Order{ID: "b1", AccountID: "alice", Side: "buy"}
+			b2 := &orderbook.Order{ID: "b2", AccountID: "alice", Side: "buy"}
+			s1 := &orderbook.Order{ID: "s1", AccountID: "alice", Side: "sell",
+				Metadata: map[string]string{LotsMetadataKey: tt.lots}}
+			bob := &orderbook.Order{ID: "bob", AccountID: "bob", Side: "sell"}
+			carol := &orderbook.Order{ID: "carol", AccountID: "carol", Side: "buy"}
+
+			lots.Apply("BTC-USD", trade(b1, bob, 10000, 1, start))
+			lots.Apply("BTC-USD", trade(b2, bob, 20000, 1, start.Add(time.Hour)))
+			lots.Apply("BTC-USD", trade(carol, s1, 15000, 1, start.AddDate(1, 0, 1)))
+
+			report := lots.Report("alice", time.Time{}, time.Time{})
+			is.Equal(len(report.Realizations), 1)
+			is.Equal(report.Total, tt.gain)
+			is.Equal(report.LongTerm, tt.gain)
+
+			open := lots.Open("alice", "BTC-USD")
+			is.Equal(len(open), 1)
+			is.Equal(open[0].ID, tt.left)
+
+			// the same lots come out of the orders' history
+			replayed := NewLots(FIFO)
+			is.NoErr(replayed.SetMethod("alice", tt.method))
+			replayed.Replay("BTC-USD", []*orderbook.Order{s1, b2, b1})
+			is.Equal(replayed.Open("alice", "BTC-USD"), open)
+			is.Equal(replayed.Report("alice", time.Time{}, time.Time{}), report)
+		})
+	}
+}
+
+func TestLotsShortAndFees(t *testing.T) {
+	is := is.New(t)
+	lots := NewLots(FIFO)
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// alice sells 2 she doesn't have at 100, paying 1 in fees as the taker
+	alice := &orderbook.Order{ID: "a1", AccountID: "alice", Side: "sell"}
+	bob := &orderbook.Order{ID: "b1", AccountID: "bob", Side: "buy"}
+	m := trade(bob, alice, 10000, 2, start)
+	m.Taker, m.TakerFee = "sell", 1
+	lots.Apply("BTC-USD", m)
+
+	open := lots.Open("alice", "BTC-USD")
+	is.Equal(len(open), 1)
+	is.True(open[0].Short)
+	is.Equal(open[0].Cost, 99.5)
+
+	// and buys them back at 90 in two periods
+	cover := &orderbook.Order{ID: "a2", AccountID: "alice", Side: "buy"}
+	carol := &orderbook.Order{ID: "c1", AccountID: "carol", Side: "sell"}
+	lots.Apply("BTC-USD", trade(cover, carol, 9000, 1, start.Add(time.Hour)))
+	lots.Apply("BTC-USD", trade(cover, carol, 9000, 1, start.AddDate(0, 1, 0)))
+
+	january := lots.Report("alice", start, start.AddDate(0, 1, 0))
+	is.Equal(len(january.Realizations), 1)
+	is.Equal(january.ShortTerm, 9.5)
+	is.Equal(lots.Report("alice", time.Time{}, time.Time{}).Total, float64(19))
+	is.Equal(len(lots.Open("alice", "BTC-USD")), 0)
+
+	// a match of nothing with a fee opens and closes nothing
+	m = trade(cover, carol, 9000, 0, start.AddDate(0, 2, 0))
+	m.Taker, m.TakerFee = "buy", 1
+	lots.Apply("BTC-USD", m)
+	is.Equal(len(lots.Open("alice", "BTC-USD")), 0)
+	is.Equal(lots.Report("alice", time.Time{}, time.Time{}).Total, float64(19))
+}
@@ -0,0 +1,186 @@
+// Package positions tracks what each account holds in every market
+// and how much it has made or lost doing it.
+package positions
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+)
+
+// Position is an account's net holding of a market's base asset.
+// Prices and PnL are in the market's quote asset.
+type Position struct {
+	Account string `json:"account"`
+	Symbol  string `json:"symbol"`
+	// Quantity is positive when the account is long and negative when it's short.
+	Quantity int64 `json:"quantity"`
+	// AvgPrice is the average price the open quantity was entered at.
+	AvgPrice float64 `json:"avgPrice"`
+	// Realized is the PnL locked in by reducing the position, before fees.
+	Realized float64 `json:"realized"`
+	// Fees is what the account has paid in fees, net of rebates.
+	Fees float64 `json:"fees"`
+}
+
+// Valuation is a Position marked to a price.
+type Valuation struct {
+	Position
+	Mark       float64 `json:"mark"`
+	Unrealized float64 `json:"unrealized"`
+}
+
+// Unrealized returns the PnL of the open quantity if it were closed at mark.
+func (p Position) Unrealized(mark float64) float64 {
+	return (mark - p.AvgPrice) * float64(p.Quantity)
+}
+
+// Tracker builds positions from matches as they settle.
+type Tracker struct {
+	sync.RWMutex
+
+	positions map[string]map[string]*Position
+	last      map[string]float64
+	marks     map[string]float64
+}
+
+// NewTracker returns a Tracker without any positions.
+func NewTracker() *Tracker {
+	return &Tracker{
+		positions: make(map[string]map[string]*Position),
+		last:      make(map[string]float64),
+		marks:     make(map[string]float64),
+	}
+}
+
+// Apply updates the buyer's and seller's positions in a market with a match.
+func (t *Tracker) Apply(symbol string, m orderbook.Match) {
+	t.Lock()
+	defer t.Unlock()
+
+	price := float64(m.Price) / 100
+	buyFee, sellFee := m.MakerFee, m.TakerFee
+	if m.Taker == "buy" {
+		buyFee, sellFee = m.TakerFee, m.MakerFee
+	}
+
+	buy := t.position(m.Buy.AccountID, symbol)
+	buy.trade(int64(m.Quantity), price)
+	buy.Fees += buyFee
+
+	sell := t.position(m.Sell.AccountID, symbol)
+	sell.trade(-int64(m.Quantity), price)
+	sell.Fees += sellFee
+
+	t.last[symbol] = price
+}
+
+// SetMark sets the price that a market's positions are valued at.
+// Markets without a mark are valued at their last traded price.
+func (t *Tracker) SetMark(symbol string, price float64) {
+	t.Lock()
+	defer t.Unlock()
+	t.marks[symbol] = price
+}
+
+// Mark returns the price that a market's positions are valued at and
+// whether there is one.
+func (t *Tracker) Mark(symbol string) (float64, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	return t.mark(symbol)
+}
+
+// Position returns an account's position in a market.
+func (t *Tracker) Position(account, symbol string) (Position, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	p, ok := t.positions[account][symbol]
+	if !ok {
+		return Position{}, false
+	}
+	return *p, true
+}
+
+// Positions values every position an account has held, sorted by symbol.
+// Closed positions are included so their realized PnL isn't lost.
+func (t *Tracker) Positions(account string) []Valuation {
+	t.RLock()
+	defer t.RUnlock()
+
+	valuations := []Valuation{}
+	for symbol, p := range t.positions[account] {
+		v := Valuation{Position: *p}
+		if mark, ok := t.mark(symbol); ok {
+			v.Mark = mark
+			v.Unrealized = p.Unrealized(mark)
+		}
+		valuations = append(valuations, v)
+	}
+	sort.Slice(valuations, func(i, j int) bool {
+		return valuations[i].Symbol < valuations[j].Symbol
+	})
+	return valuations
+}
+
+func (t *Tracker) mark(symbol string) (float64, bool) {
+	if mark, ok := t.marks[symbol]; ok {
+		return mark, true
+	}
+	mark, ok := t.last[symbol]
+	return mark, ok
+}
+
+// position returns an account's position in a market, opening an empty
+// one if it doesn't have one yet. The tracker must be locked.
+func (t *Tracker) position(account, symbol string) *Position {
+	if t.positions[account] == nil {
+		t.positions[account] = make(map[string]*Position)
+	}
+	p, ok := t.positions[account][symbol]
+	if !ok {
+		p = &Position{Account: account, Symbol: symbol}
+		t.positions[account][symbol] = p
+	}
+	return p
+}
+
+// trade adds a signed quantity at price to the position. Trades in the
+// direction of the position average into its entry price and trades
+// against it realize PnL on the quantity they close. A trade that flips
+// the position opens the remainder at price.
+func (p *Position) trade(quantity int64, price float64) {
+	if p.Quantity == 0 || (p.Quantity > 0) == (quantity > 0) {
+		open := abs(p.Quantity)
+		p.AvgPrice = (p.AvgPrice*float64(open) + price*float64(abs(quantity))) / float64(open+abs(quantity))
+		p.Quantity += quantity
+		return
+	}
+
+	closed := abs(quantity)
+	if abs(p.Quantity) < closed {
+		closed = abs(p.Quantity)
+	}
+	direction := float64(1)
+	if p.Quantity < 0 {
+		direction = -1
+	}
+	p.Realized += (price - p.AvgPrice) * float64(closed) * direction
+
+	flipped := abs(quantity) > abs(p.Quantity)
+	p.Quantity += quantity
+	switch {
+	case p.Quantity == 0:
+		p.AvgPrice = 0
+	case flipped:
+		p.AvgPrice = price
+	}
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
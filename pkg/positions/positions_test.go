@@ -0,0 +1,74 @@
+package positions
+
+import (
+	"testing"
+
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+	"github.com/matryer/is"
+)
+
+func match(buyer, seller string, price, quantity uint64) orderbook.Match {
+	return orderbook.Match{
+		Buy:      &orderbook.Order{AccountID: buyer, Side: "buy"},
+		Sell:     &orderbook.Order{AccountID: seller, Side: "sell"},
+		Price:    price,
+		Quantity: quantity,
+	}
+}
+
+func TestTracker(t *testing.T) {
+	is := is.New(t)
+	tracker := NewTracker()
+
+	// alice buys 10 at 100 and 10 at 120 for an average of 110
+	tracker.Apply("BTC-USD", match("alice", "bob", 10000, 10))
+	tracker.Apply("BTC-USD", match("alice", "bob", 12000, 10))
+	alice, ok := tracker.Position("alice", "BTC-USD")
+	is.True(ok)
+	is.Equal(alice.Quantity, int64(20))
+	is.Equal(alice.AvgPrice, float64(110))
+
+	// bob is short the other side
+	bob, _ := tracker.Position("bob", "BTC-USD")
+	is.Equal(bob.Quantity, int64(-20))
+	is.Equal(bob.AvgPrice, float64(110))
+
+	// selling 5 at 130 realizes 20 a unit and leaves the entry price alone
+	tracker.Apply("BTC-USD", match("carol", "alice", 13000, 5))
+	alice, _ = tracker.Position("alice", "BTC-USD")
+	is.Equal(alice.Quantity, int64(15))
+	is.Equal(alice.AvgPrice, float64(110))
+	is.Equal(alice.Realized, float64(100))
+
+	// valued at the last trade until a mark is set
+	v := tracker.Positions("alice")
+	is.Equal(len(v), 1)
+	is.Equal(v[0].Mark, float64(130))
+	is.Equal(v[0].Unrealized, float64(300))
+	tracker.SetMark("BTC-USD", 100)
+	v = tracker.Positions("alice")
+	is.Equal(v[0].Unrealized, float64(-150))
+
+	// selling 20 at 90 closes the long and opens a short of 5 at 90
+	tracker.Apply("BTC-USD", match("carol", "alice", 9000, 20))
+	alice, _ = tracker.Position("alice", "BTC-USD")
+	is.Equal(alice.Quantity, int64(-5))
+	is.Equal(alice.AvgPrice, float64(90))
+	is.Equal(alice.Realized, float64(100-300))
+}
+
+func TestTrackerFees(t *testing.T) {
+	is := is.New(t)
+	tracker := NewTracker()
+
+	m := match("alice", "bob", 10000, 1)
+	m.Taker = "sell"
+	m.MakerFee = -0.1
+	m.TakerFee = 0.2
+	tracker.Apply("BTC-USD", m)
+
+	alice, _ := tracker.Position("alice", "BTC-USD")
+	is.Equal(alice.Fees, -0.1)
+	bob, _ := tracker.Position("bob", "BTC-USD")
+	is.Equal(bob.Fees, 0.2)
+}
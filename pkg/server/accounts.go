@@ -0,0 +1,243 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dylanlott/orderbook/pkg/accounts"
+
+	"github.com/labstack/echo/v4"
+)
+
+// GetTransactions serves a page of an account's ledger activity as JSON.
+// Pages hold at most accounts.MaxLimit entries and the next one starts at
+// the statement's next offset.
+func (eng *Engine) GetTransactions(c echo.Context) error {
+	id, q, err := eng.query(c, accounts.DefaultLimit)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, eng.accounts.Ledger().History(id, q))
+}
+
+// GetStatement serves an account's ledger activity as a CSV statement.
+// It isn't paged like GetTransactions: every entry from the offset on is
+// written, up to the limit if there is one. The ledger is read a page of
+// accounts.MaxLimit at a time so that it isn't held up while the
+// statement is written out.
+func (eng *Engine) GetStatement(c echo.Context) error {
+	id, q, err := eng.query(c, 0)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderContentType, "text/csv")
+	c.Response().Header().Set(echo.HeaderContentDisposition,
+		fmt.Sprintf("attachment; filename=%q", id+".csv"))
+	c.Response().WriteHeader(http.StatusOK)
+
+	out := accounts.NewCSVWriter(c.Response())
+	limit, written := q.Limit, 0
+	for {
+		q.Limit = accounts.MaxLimit
+		if limit > 0 && limit-written < q.Limit {
+			q.Limit = limit - written
+		}
+		s := eng.accounts.Ledger().History(id, q)
+		if err := out.Write(s); err != nil {
+			return err
+		}
+		written += len(s.Activity)
+		if s.Next == 0 || (limit > 0 && written >= limit) {
+			break
+		}
+		q.Offset = s.Next
+	}
+	return out.Flush()
+}
+
+// query reads the account in the path, which the request has to own, and
+// a query of its activity from the query string: kind (repeatable), asset,
+// from and to (RFC3339), offset and limit.
+func (eng *Engine) query(c echo.Context, limit int) (string, accounts.Query, error) {
+	id, err := eng.owned(c)
+	if err != nil {
+		return "", accounts.Query{}, err
+	}
+
+	q := accounts.Query{
+		Kinds: c.QueryParams()["kind"],
+		Asset: c.QueryParam("asset"),
+		Limit: limit,
+	}
+	if q.From, err = queryTime(c, "from"); err != nil {
+		return "", accounts.Query{}, err
+	}
+	if q.To, err = queryTime(c, "to"); err != nil {
+		return "", accounts.Query{}, err
+	}
+	if q.Offset, err = queryInt(c, "offset", 0); err != nil {
+		return "", accounts.Query{}, err
+	}
+	if q.Limit, err = queryInt(c, "limit", q.Limit); err != nil {
+		return "", accounts.Query{}, err
+	}
+	return id, q, nil
+}
+
+// queryTime parses an optional RFC3339 timestamp from the query string.
+func queryTime(c echo.Context, name string) (time.Time, error) {
+	v := c.QueryParam(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("%s must be an RFC3339 timestamp: %v", name, err))
+	}
+	return t, nil
+}
+
+// queryInt parses an optional integer from the query string.
+func queryInt(c echo.Context, name string, fallback int) (int, error) {
+	v := c.QueryParam(name)
+	if v == "" {
+		return fallback, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("%s must be an integer: %v", name, err))
+	}
+	return i, nil
+}
+
+// fundingRequest is the body of a deposit or withdrawal request.
+type fundingRequest struct {
+	Asset  string  `json:"asset"`
+	Amount float64 `json:"amount"`
+}
+
+// CreateAccount opens an empty account. Accounts are funded with deposits.
+func (eng *Engine) CreateAccount(c echo.Context) error {
+	body := struct {
+		ID string `json:"id"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if body.ID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id is required")
+	}
+	if _, err := eng.accounts.Get(body.ID); err == nil {
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("account %s already exists", body.ID))
+	}
+	acct, err := eng.accounts.Create(body.ID, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(http.StatusCreated, acct)
+}
+
+// GetAccount returns an account's balances and holds.
+func (eng *Engine) GetAccount(c echo.Context) error {
+	acct, err := eng.accounts.Get(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	return c.JSON(http.StatusOK, acct)
+}
+
+// CreateDeposit opens a pending deposit into an account. Only the
+// account's owner can open one.
+func (eng *Engine) CreateDeposit(c echo.Context) error {
+	id, err := eng.owned(c)
+	if err != nil {
+		return err
+	}
+	body := fundingRequest{}
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	r, err := eng.accounts.Deposit(id, body.Asset, body.Amount)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(http.StatusCreated, r)
+}
+
+// CreateWithdrawal opens a pending withdrawal out of an account. Only the
+// account's owner can open one.
+func (eng *Engine) CreateWithdrawal(c echo.Context) error {
+	id, err := eng.owned(c)
+	if err != nil {
+		return err
+	}
+	body := fundingRequest{}
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	r, err := eng.accounts.Withdraw(id, body.Asset, body.Amount)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(http.StatusCreated, r)
+}
+
+// SetWithdrawalLimit caps an account's withdrawals of an asset.
+func (eng *Engine) SetWithdrawalLimit(c echo.Context) error {
+	body := struct {
+		Limit float64 `json:"limit"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := eng.accounts.SetWithdrawalLimit(c.Param("id"), c.Param("asset"), body.Limit); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GetFundingRequest returns a deposit or withdrawal by ID.
+func (eng *Engine) GetFundingRequest(c echo.Context) error {
+	r, err := eng.accounts.FundingRequest(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	return c.JSON(http.StatusOK, r)
+}
+
+// ApproveFundingRequest approves a pending deposit or withdrawal.
+func (eng *Engine) ApproveFundingRequest(c echo.Context) error {
+	r, err := eng.accounts.Approve(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(http.StatusOK, r)
+}
+
+// CompleteFundingRequest posts an approved deposit or withdrawal.
+func (eng *Engine) CompleteFundingRequest(c echo.Context) error {
+	r, err := eng.accounts.Complete(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(http.StatusOK, r)
+}
+
+// RejectFundingRequest rejects a deposit or withdrawal that hasn't completed.
+func (eng *Engine) RejectFundingRequest(c echo.Context) error {
+	body := struct {
+		Reason string `json:"reason"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	r, err := eng.accounts.Reject(c.Param("id"), body.Reason)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(http.StatusOK, r)
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dylanlott/orderbook/pkg/candles"
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+	"github.com/labstack/echo/v4"
+)
+
+// GetDepth returns a snapshot of a market's aggregated depth, best price
+// first, tagged with the sequence number of the last level delta it
+// reflects. The limit query parameter caps the number of levels on each
+// side and group merges prices into levels that many hundredths wide.
+func (eng *Engine) GetDepth(c echo.Context) error {
+	if symbol := c.Param("symbol"); symbol != eng.market.Symbol {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("market %s not found", symbol))
+	}
+	limit, err := queryInt(c, "limit", 0)
+	if err != nil {
+		return err
+	}
+	group, err := queryInt(c, "group", 1)
+	if err != nil {
+		return err
+	}
+	if limit < 0 || group < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "limit can't be negative and group must be positive")
+	}
+
+	return c.JSON(http.StatusOK, eng.depth.Snapshot(limit, uint64(group)))
+}
+
+// GetOrders returns the orders resting in the book, bids then asks, best
+// price first and in queue order at each price, tagged with the sequence
+// number of the last change to the book they reflect.
+func (eng *Engine) GetOrders(c echo.Context) error {
+	eng.mboMu.Lock()
+	snapshot := BookSnapshot{Seq: eng.mbo.Seq, Orders: eng.mbo.Orders()}
+	eng.mboMu.Unlock()
+	return c.JSON(http.StatusOK, snapshot)
+}
+
+// InsertOrder places an order for the account of the API key that the
+// request carries as a bearer token. It answers with the order as it was
+// once it was done matching, or with why the book rejected it.
+func (eng *Engine) InsertOrder(c echo.Context) error {
+	account, err := eng.authenticate(bearer(c))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "an API key is required to place orders")
+	}
+	o := orderbook.Order{}
+	if err := c.Bind(&o); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if o.AccountID != "" && o.AccountID != account {
+		return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("key is for account %s, not %s", account, o.AccountID))
+	}
+	o.AccountID = account
+	o.Filled, o.History = 0, nil
+	eng.srv.Logger.Infof("order received: %+v", o)
+
+	u, err := eng.place(o)
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, u)
+	}
+	return c.JSON(http.StatusCreated, u)
+}
+
+// maxTrades is the most trades that GetTrades returns at once.
+const maxTrades = 1000
+
+// GetTrades returns a page of a market's trades, newest first. The limit
+// query parameter sets the size of the page, 100 by default, and before
+// starts it after the trade with that ID, so the next page starts before
+// the last trade of this one.
+func (eng *Engine) GetTrades(c echo.Context) error {
+	if symbol := c.Param("symbol"); symbol != eng.market.Symbol {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("market %s not found", symbol))
+	}
+	limit, err := queryInt(c, "limit", 100)
+	if err != nil {
+		return err
+	}
+	before, err := queryInt(c, "before", 0)
+	if err != nil {
+		return err
+	}
+	if limit < 1 || limit > maxTrades || before < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("limit must be from 1 to %d and before can't be negative", maxTrades))
+	}
+
+	return c.JSON(http.StatusOK, eng.tape.Trades(uint64(before), limit))
+}
+
+// MarketTicker is a market's best prices and its statistics over the last
+// 24 hours.
+type MarketTicker struct {
+	Symbol string    `json:"symbol"`
+	Bid    uint64    `json:"bid"`
+	Ask    uint64    `json:"ask"`
+	Time   time.Time `json:"time"`
+	orderbook.TapeStats
+}
+
+// GetTicker returns a market's last price, best prices and statistics over
+// the last 24 hours.
+func (eng *Engine) GetTicker(c echo.Context) error {
+	if symbol := c.Param("symbol"); symbol != eng.market.Symbol {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("market %s not found", symbol))
+	}
+	now := time.Now()
+	bid, ask := eng.depth.Top()
+	return c.JSON(http.StatusOK, MarketTicker{
+		Symbol:    eng.market.Symbol,
+		Bid:       bid,
+		Ask:       ask,
+		Time:      now,
+		TapeStats: eng.tape.Stats(now, 24*time.Hour),
+	})
+}
+
+// maxCandles is the most candles that GetCandles returns at once.
+const maxCandles = 1000
+
+// GetCandles returns a market's candles for an interval, 1m by default,
+// oldest first. The candles that started from the from timestamp up to
+// but not including the to timestamp are returned, both RFC3339. to
+// defaults to now and from to 1000 intervals before it. No more than 1000
+// are returned, so a longer range is fetched a page at a time.
+func (eng *Engine) GetCandles(c echo.Context) error {
+	if symbol := c.Param("symbol"); symbol != eng.market.Symbol {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("market %s not found", symbol))
+	}
+	interval := c.QueryParam("interval")
+	if interval == "" {
+		interval = "1m"
+	}
+	width, ok := candles.Intervals[interval]
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unknown interval %q", interval))
+	}
+	to, err := queryTime(c, "to")
+	if err != nil {
+		return err
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	from, err := queryTime(c, "from")
+	if err != nil {
+		return err
+	}
+	if from.IsZero() {
+		from = to.Add(-maxCandles * width)
+	}
+	if !from.Before(to) {
+		return echo.NewHTTPError(http.StatusBadRequest, "from must be before to")
+	}
+
+	bars, err := eng.candles.Candles(interval, from, to, maxCandles)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, bars)
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/dylanlott/orderbook/pkg/positions"
+	"github.com/labstack/echo/v4"
+)
+
+// GetPositions returns an account's positions valued at their mark prices.
+// Only the account's owner can read them.
+func (eng *Engine) GetPositions(c echo.Context) error {
+	id, err := eng.owned(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, eng.positions.Positions(id))
+}
+
+// SetMark sets the price that a market's positions are valued at, which
+// is also the mark of its base asset for margin. It's an admin request.
+func (eng *Engine) SetMark(c echo.Context) error {
+	body := struct {
+		Price float64 `json:"price"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if body.Price <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid mark price %v", body.Price))
+	}
+	eng.positions.SetMark(c.Param("symbol"), body.Price)
+	if eng.margin != nil && c.Param("symbol") == eng.market.Symbol {
+		eng.margin.SetMark(eng.market.Base, body.Price)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GetMargin returns an account's margin at the current mark prices. Only
+// the account's owner can read it.
+func (eng *Engine) GetMargin(c echo.Context) error {
+	id, err := eng.owned(c)
+	if err != nil {
+		return err
+	}
+	if eng.margin == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "margin trading is off")
+	}
+	status, err := eng.margin.Status(id)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
+// SetLeverage lets an account trade on margin at a leverage of its
+// choosing, up to the margin engine's most. Only the account's owner can
+// set it.
+func (eng *Engine) SetLeverage(c echo.Context) error {
+	id, err := eng.owned(c)
+	if err != nil {
+		return err
+	}
+	if eng.margin == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "margin trading is off")
+	}
+	body := struct {
+		Leverage float64 `json:"leverage"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := eng.margin.Enable(id, body.Leverage); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GetLots returns an account's open tax lots in the engine's market. Only
+// the account's owner can read them.
+func (eng *Engine) GetLots(c echo.Context) error {
+	id, err := eng.owned(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, eng.lots.Open(id, eng.market.Symbol))
+}
+
+// SetLotMethod sets how an account's closing fills relieve its lots. Only
+// the account's owner can set it.
+func (eng *Engine) SetLotMethod(c echo.Context) error {
+	id, err := eng.owned(c)
+	if err != nil {
+		return err
+	}
+	body := struct {
+		Method positions.Method `json:"method"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := eng.lots.SetMethod(id, body.Method); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GetGains returns the gains an account realized between the from and to
+// query parameters. Only the account's owner can read them.
+func (eng *Engine) GetGains(c echo.Context) error {
+	id, err := eng.owned(c)
+	if err != nil {
+		return err
+	}
+	from, err := queryTime(c, "from")
+	if err != nil {
+		return err
+	}
+	to, err := queryTime(c, "to")
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, eng.lots.Report(id, from, to))
+}
@@ -1,16 +1,22 @@
 package server
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
 	"net/http"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/VictoriaMetrics/metrics"
 	"github.com/dylanlott/orderbook/pkg/accounts"
+	"github.com/dylanlott/orderbook/pkg/candles"
+	"github.com/dylanlott/orderbook/pkg/margin"
 	"github.com/dylanlott/orderbook/pkg/orderbook"
+	"github.com/dylanlott/orderbook/pkg/positions"
 
 	"github.com/labstack/echo/v4"
 )
@@ -20,14 +26,54 @@ var interval = time.Millisecond * 500
 var pushProcessMetrics = false
 var metricsEnabled bool = false
 
+// defaultMarket is the market that the engine's book trades.
+// TODO: hook this up to a configuration value
+var defaultMarket = orderbook.Market{Symbol: "BTC-USD", Base: "BTC", Quote: accounts.USD}
+
 // Engine is a fully-plumbed orderbook and account system
 // hooked up to an echo server with a metrics client plugged in.
 type Engine struct {
-	srv    *echo.Echo
-	state  []*orderbook.Order
-	in     chan *orderbook.Order
-	out    chan *orderbook.Match
-	status chan []*orderbook.Order
+	srv       *echo.Echo
+	accounts  accounts.AccountManager
+	market    orderbook.Market
+	positions *positions.Tracker
+	lots      *positions.Lots
+
+	// margin lends to the accounts that trade with leverage, and is nil
+	// if the engine doesn't lend.
+	margin *margin.Engine
+
+	// depth is the book's depth, rebuilt from the engine's level deltas,
+	// tape is every trade the engine has made and candles aggregates them.
+	depth   *orderbook.DepthView
+	tape    *orderbook.Tape
+	candles *candles.Aggregator
+
+	// mbo is the book's orders, rebuilt from its market-by-order feed.
+	mboMu sync.Mutex
+	mbo   *orderbook.MarketByOrder
+
+	// hub streams market data and account updates to WebSocket clients.
+	// published is the ticker that was last streamed.
+	hub       *hub
+	tickerMu  sync.Mutex
+	published Ticker
+
+	// keys maps the API keys that log streaming sessions in to their
+	// accounts.
+	keysMu sync.RWMutex
+	keys   map[string]string
+
+	// adminToken is the bearer token of admin requests. Admin routes
+	// are refused while it's empty.
+	adminToken string
+
+	writes  chan orderbook.OpWrite
+	cancels chan orderbook.OpCancel
+	amends  chan orderbook.OpAmend
+	reads   chan orderbook.OpRead
+	out     chan *orderbook.Match
+	deltas  chan orderbook.LevelDelta
 }
 
 // Template holds a specific instance of a rendered Template
@@ -44,17 +90,39 @@ func (t *Template) Render(w io.Writer, name string, data interface{}, c echo.Con
 // API requests to the orderbook.
 // startingx
 func NewServer(
-	accounts accounts.AccountManager,
-	in chan *orderbook.Order,
+	accts accounts.AccountManager,
+	writes chan orderbook.OpWrite,
+	cancels chan orderbook.OpCancel,
+	amends chan orderbook.OpAmend,
+	reads chan orderbook.OpRead,
 	out chan *orderbook.Match,
 	fills chan []*orderbook.Order,
-	status chan []*orderbook.Order,
+	deltas chan orderbook.LevelDelta,
+	events chan orderbook.OrderEvent,
+	rejects chan orderbook.WriteResult,
 ) *Engine {
 	e := echo.New()
+	aggregator, err := candles.New(candles.Config{})
+	if err != nil {
+		log.Fatalf("failed to aggregate candles: %+v", err)
+	}
 	engine := &Engine{
-		in:     in,
-		out:    out,
-		status: status,
+		accounts:  accts,
+		market:    defaultMarket,
+		positions: positions.NewTracker(),
+		lots:      positions.NewLots(positions.FIFO),
+		depth:     orderbook.NewDepthView(),
+		tape:      orderbook.NewTape(),
+		candles:   aggregator,
+		mbo:       orderbook.NewMarketByOrder(),
+		hub:       newHub(),
+		keys:      make(map[string]string),
+		writes:    writes,
+		cancels:   cancels,
+		amends:    amends,
+		reads:     reads,
+		out:       out,
+		deltas:    deltas,
 	}
 
 	// TODO hook this all up to a configuration value
@@ -97,47 +165,250 @@ func NewServer(
 		return nil
 	})
 
-	GetOrders := func(c echo.Context) error {
-		return c.JSON(http.StatusOK, engine.state)
-	}
+	e.GET("/orders", engine.GetOrders)
+	e.POST("/orders", engine.InsertOrder)
+	e.GET("/stream", engine.Stream)
 
-	InsertOrder := func(c echo.Context) error {
-		o := new(orderbook.Order)
-		if err := c.Bind(o); err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
-		}
-		e.Logger.Infof("order received: %+v", o)
-		engine.in <- o
-		return nil
-	}
+	e.POST("/accounts", engine.CreateAccount)
+	e.GET("/accounts/:id", engine.GetAccount)
+	e.POST("/accounts/:id/keys", engine.CreateKey)
+	e.GET("/accounts/:id/transactions", engine.GetTransactions)
+	e.GET("/accounts/:id/statement.csv", engine.GetStatement)
+	e.POST("/accounts/:id/deposits", engine.CreateDeposit)
+	e.POST("/accounts/:id/withdrawals", engine.CreateWithdrawal)
+	e.PUT("/accounts/:id/withdrawal-limits/:asset", engine.SetWithdrawalLimit, engine.admin)
+	e.GET("/accounts/:id/positions", engine.GetPositions)
+	e.GET("/accounts/:id/lots", engine.GetLots)
+	e.PUT("/accounts/:id/lot-method", engine.SetLotMethod)
+	e.GET("/accounts/:id/gains", engine.GetGains)
+	e.GET("/accounts/:id/margin", engine.GetMargin)
+	e.PUT("/accounts/:id/leverage", engine.SetLeverage)
 
-	e.GET("/orders", GetOrders)
-	e.POST("/orders", InsertOrder)
+	e.GET("/funding/:id", engine.GetFundingRequest)
+	e.POST("/funding/:id/approve", engine.ApproveFundingRequest, engine.admin)
+	e.POST("/funding/:id/complete", engine.CompleteFundingRequest, engine.admin)
+	e.POST("/funding/:id/reject", engine.RejectFundingRequest, engine.admin)
+	e.PUT("/markets/:symbol/mark", engine.SetMark, engine.admin)
+	e.GET("/markets/:symbol/depth", engine.GetDepth)
+	e.GET("/markets/:symbol/trades", engine.GetTrades)
+	e.GET("/markets/:symbol/ticker", engine.GetTicker)
+	e.GET("/markets/:symbol/candles", engine.GetCandles)
 
 	engine.srv = e
 
 	engine.srv.Logger.Debugf("server created")
 
 	// handle state updates
-	handleState(engine, status)
+	handleDeltas(engine, deltas)
+	handleEvents(engine, events)
+	handleMatches(engine, out, fills)
+	handleRejects(engine, rejects)
 
 	return engine
 }
 
+// SetFees sets the fee schedule of the engine's market. It has to be
+// called before the market is handed to the book.
+func (eng *Engine) SetFees(fees *orderbook.FeeSchedule) {
+	eng.market.Fees = fees
+}
+
+// SetMargin lends to the engine's accounts with m, which has to be the
+// Lender of its AccountManager. The engine's positions are handed to m
+// for deleveraging, and the mark of the engine's market is passed on to
+// it. It has to be called before the engine is run.
+func (eng *Engine) SetMargin(m *margin.Engine) {
+	m.SetPositions(eng.positions)
+	eng.margin = m
+}
+
+// Market returns the market that the engine's book trades.
+func (eng *Engine) Market() orderbook.Market {
+	return eng.market
+}
+
+// LoadHistory keeps the market's trades and candles in dir from now on,
+// so that they outlive the process. The trades already there are read
+// back and any candles that weren't saved are rebuilt from them. It has
+// to be called before the engine's book makes any matches.
+func (eng *Engine) LoadHistory(dir string) error {
+	dir = filepath.Join(dir, eng.market.Symbol)
+	tape, err := orderbook.OpenTape(filepath.Join(dir, "trades"))
+	if err != nil {
+		return err
+	}
+	aggregator, err := candles.New(candles.Config{Dir: dir})
+	if err != nil {
+		tape.Close()
+		return err
+	}
+	if err := aggregator.Rebuild(tape.Since(time.Time{})); err != nil {
+		tape.Close()
+		aggregator.Close()
+		return fmt.Errorf("failed to rebuild candles: %v", err)
+	}
+	eng.tape, eng.candles = tape, aggregator
+	return nil
+}
+
+// SetAdminToken sets the bearer token that admin requests, like approving
+// funding requests, have to carry. It has to be called before the engine
+// is run.
+func (eng *Engine) SetAdminToken(token string) {
+	eng.adminToken = token
+}
+
 // Run starts the engine at defaultPort
 func (eng *Engine) Run() error {
 	return eng.srv.Start(defaultPort)
 }
 
-// handleState updates the Engine's view of the Orderbooks
-// so that it can be fetched by the server.
-func handleState(e *Engine, status chan []*orderbook.Order) {
-	go func(e *Engine, status chan []*orderbook.Order) {
-		for stats := range status {
-			e.state = stats
-			e.srv.Logger.Debugf("state: %+v\n", e.state)
+// handleDeltas updates the Engine's view of the Orderbook's depth
+// so that it can be fetched by the server. If deltas are missed, the
+// view is resynced from a snapshot of the book and the deltas that come
+// in meanwhile are held back and applied on top of it.
+func handleDeltas(e *Engine, deltas chan orderbook.LevelDelta) {
+	go func(e *Engine, deltas chan orderbook.LevelDelta) {
+		var held []orderbook.LevelDelta
+		var snapshots chan orderbook.Depth
+		for {
+			select {
+			case d, ok := <-deltas:
+				if !ok {
+					return
+				}
+				if snapshots != nil {
+					held = append(held, d)
+					continue
+				}
+				if err := e.depth.Apply(d); err != nil {
+					e.srv.Logger.Errorf("failed to apply delta: %v", err)
+					if e.reads != nil {
+						held = append(held, d)
+						snapshots = e.resync()
+					}
+					continue
+				}
+				e.hub.publish(channelDepth, "", d)
+				e.publishTicker()
+			case snapshot := <-snapshots:
+				e.depth.Load(snapshot)
+				for _, d := range held {
+					if err := e.depth.Apply(d); err != nil {
+						e.srv.Logger.Errorf("failed to apply delta after resync: %v", err)
+					}
+				}
+				held, snapshots = nil, nil
+				e.hub.broadcast(channelDepth, e.depth.Snapshot(0, 1))
+				e.publishTicker()
+			}
+		}
+	}(e, deltas)
+}
+
+// resync reads a snapshot of the book's depth. It's sent on the channel
+// that's returned once it's read, so that deltas can still be taken from
+// the book while it waits.
+func (e *Engine) resync() chan orderbook.Depth {
+	snapshots := make(chan orderbook.Depth, 1)
+	go func() {
+		result := make(chan orderbook.ReadResult, 1)
+		e.reads <- orderbook.OpRead{Levels: -1, Group: 1, Result: result}
+		snapshots <- (<-result).Depth
+	}()
+	return snapshots
+}
+
+// handleEvents rebuilds the engine's view of the Orderbook's orders from
+// its market-by-order feed and streams the feed.
+func handleEvents(e *Engine, events chan orderbook.OrderEvent) {
+	go func(e *Engine, events chan orderbook.OrderEvent) {
+		for ev := range events {
+			e.mboMu.Lock()
+			err := e.mbo.Apply(ev)
+			e.mboMu.Unlock()
+			if err != nil {
+				e.srv.Logger.Errorf("failed to apply event: %v", err)
+				continue
+			}
+			e.hub.publish(channelBook, "", ev)
+		}
+	}(e, events)
+}
+
+// handleMatches records the engine's matches on the tape and in candles,
+// applies them to account positions and lots and streams them as trades
+// and as fills to the accounts that made them.
+// Filled orders are streamed to their accounts.
+func handleMatches(e *Engine, out chan *orderbook.Match, fills chan []*orderbook.Order) {
+	go func(e *Engine, out chan *orderbook.Match) {
+		for m := range out {
+			trade, err := e.tape.Record(*m)
+			if err != nil {
+				e.srv.Logger.Errorf("failed to record trade: %v", err)
+			}
+			if err := e.candles.Add(trade); err != nil {
+				e.srv.Logger.Errorf("failed to add trade to candles: %v", err)
+			}
+			e.positions.Apply(e.market.Symbol, *m)
+			e.lots.Apply(e.market.Symbol, *m)
+
+			e.hub.publish(channelTrades, "", Trade{
+				ID:       trade.ID,
+				Symbol:   e.market.Symbol,
+				Price:    trade.Price,
+				Quantity: trade.Quantity,
+				Side:     trade.Side,
+				Time:     trade.Time,
+			})
+			for _, o := range []*orderbook.Order{m.Buy, m.Sell} {
+				e.hub.publish(channelFills, o.AccountID, Fill{
+					Symbol:   e.market.Symbol,
+					OrderID:  o.ID,
+					Side:     o.Side,
+					Price:    m.Price,
+					Quantity: m.Quantity,
+					Time:     m.Time,
+				})
+			}
+			e.publishTicker()
 		}
-	}(e, status)
+	}(e, out)
+	go func(e *Engine, fills chan []*orderbook.Order) {
+		for f := range fills {
+			e.srv.Logger.Debugf("fills: %+v\n", f)
+			for _, o := range f {
+				e.hub.publish(channelOrders, o.AccountID, orderUpdate("filled", *o))
+			}
+		}
+	}(e, fills)
+}
+
+// handleRejects streams the orders that the engine couldn't take, like
+// ones that their accounts can't fund, to their accounts.
+func handleRejects(e *Engine, rejects chan orderbook.WriteResult) {
+	go func(e *Engine, rejects chan orderbook.WriteResult) {
+		for r := range rejects {
+			u := orderUpdate("rejected", r.Order)
+			u.Reason = r.Err.Error()
+			e.hub.publish(channelOrders, r.Order.AccountID, u)
+		}
+	}(e, rejects)
+}
+
+// admin only lets requests through that carry the admin token as a
+// bearer token.
+func (eng *Engine) admin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if eng.adminToken == "" {
+			return echo.NewHTTPError(http.StatusForbidden, "admin requests are disabled")
+		}
+		token := bearer(c)
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(eng.adminToken)) != 1 {
+			return echo.NewHTTPError(http.StatusUnauthorized, "invalid admin token")
+		}
+		return next(c)
+	}
 }
 
 func count(next echo.HandlerFunc) echo.HandlerFunc {
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dylanlott/orderbook/pkg/accounts"
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+	"github.com/dylanlott/orderbook/pkg/positions"
+	"github.com/labstack/echo/v4"
+	"github.com/matryer/is"
+)
+
+func TestAdmin(t *testing.T) {
+	is := is.New(t)
+	eng := &Engine{}
+	e := echo.New()
+	e.POST("/funding/:id/approve", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}, eng.admin)
+
+	approve := func(auth string) int {
+		req := httptest.NewRequest(http.MethodPost, "/funding/1/approve", nil)
+		if auth != "" {
+			req.Header.Set(echo.HeaderAuthorization, auth)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// without a token nobody is an admin
+	is.Equal(approve(""), http.StatusForbidden)
+	is.Equal(approve("Bearer "), http.StatusForbidden)
+
+	eng.SetAdminToken("secret")
+	is.Equal(approve(""), http.StatusUnauthorized)
+	is.Equal(approve("Bearer wrong"), http.StatusUnauthorized)
+	is.Equal(approve("secret"), http.StatusUnauthorized)
+	is.Equal(approve("Bearer secret"), http.StatusOK)
+}
+
+func TestDeltasResync(t *testing.T) {
+	is := is.New(t)
+	eng := &Engine{
+		srv:   echo.New(),
+		depth: orderbook.NewDepthView(),
+		tape:  orderbook.NewTape(),
+		hub:   newHub(),
+		reads: make(chan orderbook.OpRead),
+	}
+	deltas := make(chan orderbook.LevelDelta)
+	handleDeltas(eng, deltas)
+
+	deltas <- orderbook.LevelDelta{Seq: 1, Side: "buy", Price: 100, Quantity: 5, Orders: 1}
+	// delta 2 is missed, so the view reads a snapshot of the book
+	deltas <- orderbook.LevelDelta{Seq: 3, Side: "buy", Price: 99, Quantity: 2, Orders: 1}
+	var r orderbook.OpRead
+	select {
+	case r = <-eng.reads:
+	case <-time.After(time.Second):
+		t.Fatal("the view didn't resync")
+	}
+	// deltas that come in before the snapshot are held back
+	deltas <- orderbook.LevelDelta{Seq: 4, Side: "sell", Price: 101, Quantity: 1, Orders: 1}
+	r.Result <- orderbook.ReadResult{Depth: orderbook.Depth{
+		Seq:  3,
+		Bids: []orderbook.Level{{Price: 100, Quantity: 4, Orders: 1}, {Price: 99, Quantity: 2, Orders: 1}},
+	}}
+
+	deadline := time.Now().Add(time.Second)
+	for eng.depth.Seq() != 4 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	snapshot := eng.depth.Snapshot(0, 1)
+	is.Equal(snapshot.Seq, uint64(4))
+	is.Equal(snapshot.Bids, []orderbook.Level{{Price: 100, Quantity: 4, Orders: 1}, {Price: 99, Quantity: 2, Orders: 1}})
+	is.Equal(snapshot.Asks, []orderbook.Level{{Price: 101, Quantity: 1, Orders: 1}})
+	close(deltas)
+}
+
+func TestStatement(t *testing.T) {
+	is := is.New(t)
+	eng := testEngine()
+	eng.accounts = accounts.NewAccountManager("")
+	_, err := eng.accounts.Create("alice", map[string]float64{accounts.USD: 10000})
+	is.NoErr(err)
+	for i := 0; i < accounts.MaxLimit+500; i++ {
+		_, err := eng.accounts.Tx("alice", accounts.FeeAccount, accounts.USD, 1)
+		is.NoErr(err)
+	}
+	eng.keys["key"] = "alice"
+	e := echo.New()
+	e.GET("/accounts/:id/transactions", eng.GetTransactions)
+	e.GET("/accounts/:id/statement.csv", eng.GetStatement)
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer key")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// only alice's keys can read her activity
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/accounts/alice/statement.csv", nil))
+	is.Equal(rec.Code, http.StatusUnauthorized)
+
+	// pages of transactions point at the next one
+	var page accounts.Statement
+	is.NoErr(json.Unmarshal(get("/accounts/alice/transactions?limit=5000").Body.Bytes(), &page))
+	is.Equal(page.Total, accounts.MaxLimit+501)
+	is.Equal(len(page.Activity), accounts.MaxLimit)
+	is.Equal(page.Next, accounts.MaxLimit)
+	is.NoErr(json.Unmarshal(get("/accounts/alice/transactions?offset=1000").Body.Bytes(), &page))
+	is.Equal(len(page.Activity), 100)
+	is.Equal(page.Next, 1100)
+
+	// statements aren't paged: a header and every entry
+	lines := strings.Split(strings.TrimSpace(get("/accounts/alice/statement.csv").Body.String()), "\n")
+	is.Equal(len(lines), accounts.MaxLimit+502)
+	is.True(strings.HasSuffix(lines[len(lines)-1], ",USD,-1,8500"))
+
+	// unless they're given a limit
+	lines = strings.Split(strings.TrimSpace(get("/accounts/alice/statement.csv?offset=1&limit=1200").Body.String()), "\n")
+	is.Equal(len(lines), 1201)
+	is.True(strings.HasSuffix(lines[1], ",USD,-1,9999"))
+}
+
+func TestFundingOwner(t *testing.T) {
+	is := is.New(t)
+	eng := testEngine()
+	eng.accounts = accounts.NewAccountManager("")
+	for _, id := range []string{"alice", "bob"} {
+		_, err := eng.accounts.Create(id, map[string]float64{accounts.USD: 100})
+		is.NoErr(err)
+	}
+	eng.keys["alice-key"] = "alice"
+	eng.keys["bob-key"] = "bob"
+	e := echo.New()
+	e.POST("/accounts/:id/deposits", eng.CreateDeposit)
+	e.POST("/accounts/:id/withdrawals", eng.CreateWithdrawal)
+	post := func(path, key string) int {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"asset": "USD", "amount": 10}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if key != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+key)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, path := range []string{"/accounts/alice/deposits", "/accounts/alice/withdrawals"} {
+		is.Equal(post(path, ""), http.StatusUnauthorized)
+		is.Equal(post(path, "bob-key"), http.StatusUnauthorized)
+		is.Equal(post(path, "alice-key"), http.StatusCreated)
+	}
+	is.Equal(post("/accounts/carol/deposits", "alice-key"), http.StatusNotFound)
+}
+
+func TestPositionsOwner(t *testing.T) {
+	is := is.New(t)
+	eng := testEngine()
+	eng.accounts = accounts.NewAccountManager("")
+	eng.positions = positions.NewTracker()
+	for _, id := range []string{"alice", "bob"} {
+		_, err := eng.accounts.Create(id, nil)
+		is.NoErr(err)
+	}
+	eng.keys["alice-key"] = "alice"
+	eng.keys["bob-key"] = "bob"
+	e := echo.New()
+	e.GET("/accounts/:id/positions", eng.GetPositions)
+	get := func(key string) int {
+		req := httptest.NewRequest(http.MethodGet, "/accounts/alice/positions", nil)
+		if key != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+key)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	is.Equal(get(""), http.StatusUnauthorized)
+	is.Equal(get("bob-key"), http.StatusUnauthorized)
+	is.Equal(get("alice-key"), http.StatusOK)
+}
+
+func TestLotsOwner(t *testing.T) {
+	is := is.New(t)
+	eng := testEngine()
+	eng.accounts = accounts.NewAccountManager("")
+	eng.lots = positions.NewLots(positions.FIFO)
+	for _, id := range []string{"alice", "bob"} {
+		_, err := eng.accounts.Create(id, nil)
+		is.NoErr(err)
+	}
+	eng.keys["alice-key"] = "alice"
+	eng.keys["bob-key"] = "bob"
+	e := echo.New()
+	e.GET("/accounts/:id/lots", eng.GetLots)
+	e.PUT("/accounts/:id/lot-method", eng.SetLotMethod)
+	e.GET("/accounts/:id/gains", eng.GetGains)
+	request := func(method, path, key string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(`{"method": "lifo"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if key != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+key)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, r := range []struct {
+		method, path string
+		ok           int
+	}{
+		{http.MethodGet, "/accounts/alice/lots", http.StatusOK},
+		{http.MethodPut, "/accounts/alice/lot-method", http.StatusNoContent},
+		{http.MethodGet, "/accounts/alice/gains", http.StatusOK},
+	} {
+		is.Equal(request(r.method, r.path, ""), http.StatusUnauthorized)
+		is.Equal(request(r.method, r.path, "bob-key"), http.StatusUnauthorized)
+		is.Equal(request(r.method, r.path, "alice-key"), r.ok)
+	}
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+	"github.com/labstack/echo/v4"
+)
+
+// CreateKey issues an API key that logs streaming sessions in to an account.
+// Only the account's owner can issue keys: the request has to carry one of
+// the account's keys as a bearer token, or the admin token, which is how
+// an account gets its first key.
+func (eng *Engine) CreateKey(c echo.Context) error {
+	id := c.Param("id")
+	if _, err := eng.accounts.Get(id); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if !eng.owns(c, id) {
+		return echo.NewHTTPError(http.StatusUnauthorized, fmt.Sprintf("a key of account %s or the admin token is required", id))
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	key := hex.EncodeToString(b)
+
+	eng.keysMu.Lock()
+	eng.keys[key] = id
+	eng.keysMu.Unlock()
+	return c.JSON(http.StatusCreated, map[string]string{"account": id, "key": key})
+}
+
+// owns reports whether a request carries a bearer token that speaks for an
+// account: one of its keys or the admin token.
+func (eng *Engine) owns(c echo.Context, account string) bool {
+	token := bearer(c)
+	if token == "" {
+		return false
+	}
+	if eng.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(eng.adminToken)) == 1 {
+		return true
+	}
+	owner, err := eng.authenticate(token)
+	return err == nil && owner == account
+}
+
+// owned returns the account in a request's path, or an error if there's
+// no such account or the request doesn't carry a bearer token that speaks
+// for it.
+func (eng *Engine) owned(c echo.Context) (string, error) {
+	id := c.Param("id")
+	if _, err := eng.accounts.Get(id); err != nil {
+		return "", echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if !eng.owns(c, id) {
+		return "", echo.NewHTTPError(http.StatusUnauthorized, fmt.Sprintf("a key of account %s or the admin token is required", id))
+	}
+	return id, nil
+}
+
+// bearer returns a request's bearer token, or nothing if it has none.
+func bearer(c echo.Context) string {
+	auth := c.Request().Header.Get(echo.HeaderAuthorization)
+	if token := strings.TrimPrefix(auth, "Bearer "); token != auth {
+		return token
+	}
+	return ""
+}
+
+// authenticate returns the account that an API key was issued for.
+func (eng *Engine) authenticate(key string) (string, error) {
+	eng.keysMu.RLock()
+	defer eng.keysMu.RUnlock()
+	account, ok := eng.keys[key]
+	if !ok {
+		return "", fmt.Errorf("invalid key")
+	}
+	return account, nil
+}
+
+// session returns the account that the client is logged in to, if any.
+func (c *client) session() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.account
+}
+
+// handleSession handles an order entry op from a streaming client. Every
+// op is answered with an ack or an error that echoes the request's ID.
+// Orders are entered for the account that the client logged in to, and
+// the ack of an order op carries the order update that's published to
+// the account's orders channel. Orders are only acked once the book has
+// taken them, and one that it won't take, like one its account can't
+// fund, is failed with the reason.
+func (eng *Engine) handleSession(c *client, req streamRequest) {
+	ack := func(data interface{}) {
+		c.reply(streamMessage{Type: "ack", ID: req.ID, Data: data})
+	}
+	fail := func(err error) {
+		c.reply(streamMessage{Type: "error", ID: req.ID, Error: err.Error()})
+	}
+
+	if req.Op == "login" {
+		account, err := eng.authenticate(req.Key)
+		if err != nil {
+			fail(err)
+			return
+		}
+		c.Lock()
+		if c.account != "" && c.account != account {
+			c.Unlock()
+			fail(fmt.Errorf("already logged in to account %s", c.account))
+			return
+		}
+		c.account = account
+		c.cancelOnDisconnect = req.CancelOnDisconnect
+		c.Unlock()
+		ack(map[string]interface{}{"account": account, "cancel_on_disconnect": req.CancelOnDisconnect})
+		return
+	}
+
+	account := c.session()
+	switch {
+	case account == "":
+		fail(fmt.Errorf("log in to %s orders", req.Op))
+		return
+	case req.Order == nil || req.Order.ID == "":
+		fail(fmt.Errorf("order ID is required"))
+		return
+	case req.Order.AccountID != "" && req.Order.AccountID != account:
+		fail(fmt.Errorf("session is logged in to account %s, not %s", account, req.Order.AccountID))
+		return
+	}
+
+	switch req.Op {
+	case "place":
+		o := *req.Order
+		o.AccountID = account
+		o.Filled, o.History = 0, nil
+		if o.Side != "buy" && o.Side != "sell" {
+			fail(fmt.Errorf("invalid side %q", o.Side))
+			return
+		}
+		if o.Open == 0 {
+			fail(fmt.Errorf("order must be for more than 0"))
+			return
+		}
+		c.Lock()
+		placed := c.orders[o.ID]
+		c.orders[o.ID] = true
+		c.Unlock()
+		if placed {
+			fail(fmt.Errorf("order %s was already placed", o.ID))
+			return
+		}
+		u, err := eng.place(o)
+		if err != nil {
+			c.forget(o.ID)
+			fail(err)
+			return
+		}
+		ack(u)
+
+	case "amend":
+		// the order keeps its place in the queue if it only shrinks
+		o, err := eng.amend(account, *req.Order)
+		if err != nil {
+			fail(err)
+			return
+		}
+		if req.Order.Open != 0 && req.Order.Open <= o.Filled {
+			// nothing was left to rest, so the amend canceled it
+			c.forget(o.ID)
+			ack(eng.canceled(o))
+			return
+		}
+		u := orderUpdate("amended", o)
+		eng.hub.publish(channelOrders, o.AccountID, u)
+		ack(u)
+
+	case "cancel":
+		o, err := eng.cancel(account, req.Order.ID)
+		if err != nil {
+			fail(err)
+			return
+		}
+		c.forget(o.ID)
+		ack(eng.canceled(o))
+	}
+}
+
+// forget stops tracking an order that's no longer open.
+func (c *client) forget(id string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.orders, id)
+}
+
+// place sends an order to the engine and publishes it to its account as
+// accepted, as it was once it was done matching, or as rejected if the
+// book wouldn't take it. It returns the update that was published and
+// why the order was rejected.
+func (eng *Engine) place(o orderbook.Order) (OrderUpdate, error) {
+	result := make(chan orderbook.WriteResult, 1)
+	eng.writes <- orderbook.OpWrite{Order: o, Result: result}
+	r := <-result
+	u := orderUpdate("accepted", r.Order)
+	if r.Err != nil {
+		u.Status, u.Reason = "rejected", r.Err.Error()
+	}
+	eng.hub.publish(channelOrders, r.Order.AccountID, u)
+	return u, r.Err
+}
+
+// cancel takes one of an account's open orders out of the engine.
+func (eng *Engine) cancel(account, id string) (orderbook.Order, error) {
+	result := make(chan orderbook.CancelResult, 1)
+	eng.cancels <- orderbook.OpCancel{OrderID: id, AccountID: account, Result: result}
+	r := <-result
+	return r.Order, r.Err
+}
+
+// amend changes the price or quantity of one of an account's open orders
+// in the engine and returns the order as it was amended.
+func (eng *Engine) amend(account string, o orderbook.Order) (orderbook.Order, error) {
+	result := make(chan orderbook.WriteResult, 1)
+	eng.amends <- orderbook.OpAmend{OrderID: o.ID, AccountID: account, Price: o.Price, Open: o.Open, Result: result}
+	r := <-result
+	return r.Order, r.Err
+}
+
+// canceled publishes a canceled order to its account and returns the
+// update that was published.
+func (eng *Engine) canceled(o orderbook.Order) OrderUpdate {
+	u := orderUpdate("canceled", o)
+	eng.hub.publish(channelOrders, o.AccountID, u)
+	return u
+}
+
+// disconnect cancels every order that a session placed if it asked for
+// its orders to be canceled when it disconnects. Orders that were filled
+// in the meantime are left alone.
+func (eng *Engine) disconnect(c *client) {
+	c.Lock()
+	account, orders := c.account, c.orders
+	if !c.cancelOnDisconnect {
+		c.Unlock()
+		return
+	}
+	c.orders = make(map[string]bool)
+	c.Unlock()
+
+	for id := range orders {
+		if o, err := eng.cancel(account, id); err == nil {
+			eng.canceled(o)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dylanlott/orderbook/pkg/accounts"
+	"github.com/dylanlott/orderbook/pkg/margin"
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+	"github.com/dylanlott/orderbook/pkg/positions"
+	"github.com/labstack/echo/v4"
+	"github.com/matryer/is"
+)
+
+// bookEngine returns a testEngine with a book run behind it for funded
+// accounts.
+func bookEngine(t *testing.T, ids ...string) *Engine {
+	eng := testEngine()
+	eng.accounts = accounts.NewAccountManager("")
+	for _, id := range ids {
+		if _, err := eng.accounts.Create(id, map[string]float64{eng.market.Base: 1e6, eng.market.Quote: 1e9}); err != nil {
+			t.Fatalf("failed to create account %s: %v", id, err)
+		}
+	}
+	eng.writes = make(chan orderbook.OpWrite)
+	eng.cancels = make(chan orderbook.OpCancel)
+	eng.amends = make(chan orderbook.OpAmend)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go orderbook.Run(ctx, eng.market, eng.accounts, nil, eng.writes, eng.cancels, eng.amends, nil, nil, nil, nil, nil, nil)
+	return eng
+}
+
+// update reads the order update that an ack carries.
+func update(t *testing.T, m message) OrderUpdate {
+	t.Helper()
+	if m.Type != "ack" {
+		t.Fatalf("expected an ack, got %s: %s", m.Type, m.Error)
+	}
+	var u OrderUpdate
+	if err := json.Unmarshal(m.Data, &u); err != nil {
+		t.Fatalf("failed to read order update: %v", err)
+	}
+	return u
+}
+
+func TestCreateKey(t *testing.T) {
+	is := is.New(t)
+	eng := testEngine()
+	eng.accounts = accounts.NewAccountManager("")
+	for _, id := range []string{"alice", "bob"} {
+		_, err := eng.accounts.Create(id, nil)
+		is.NoErr(err)
+	}
+	eng.SetAdminToken("secret")
+	e := echo.New()
+	e.POST("/accounts/:id/keys", eng.CreateKey)
+
+	create := func(id, auth string) (int, string) {
+		req := httptest.NewRequest(http.MethodPost, "/accounts/"+id+"/keys", nil)
+		if auth != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+auth)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		var body map[string]string
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		return rec.Code, body["key"]
+	}
+
+	code, _ := create("alice", "")
+	is.Equal(code, http.StatusUnauthorized) // anyone can't take over an account
+	code, _ = create("alice", "wrong")
+	is.Equal(code, http.StatusUnauthorized)
+	code, _ = create("carol", "secret")
+	is.Equal(code, http.StatusNotFound)
+
+	// the admin issues the first key and the owner issues the rest with it
+	code, alice := create("alice", "secret")
+	is.Equal(code, http.StatusCreated)
+	code, another := create("alice", alice)
+	is.Equal(code, http.StatusCreated)
+	is.True(another != alice)
+	code, bob := create("bob", "secret")
+	is.Equal(code, http.StatusCreated)
+	code, _ = create("alice", bob)
+	is.Equal(code, http.StatusUnauthorized)
+
+	account, err := eng.authenticate(another)
+	is.NoErr(err)
+	is.Equal(account, "alice")
+}
+
+func TestSession(t *testing.T) {
+	is := is.New(t)
+	eng := bookEngine(t, "alice")
+	eng.keys["key"] = "alice"
+	conn := dial(t, eng)
+
+	order := &orderbook.Order{ID: "o1", Side: "buy", Price: 1000, Open: 5}
+	send(t, conn, streamRequest{Op: "place", ID: "1", Order: order})
+	m := receive(t, conn)
+	is.Equal(m.Type, "error") // not logged in
+	is.Equal(m.ID, "1")
+	send(t, conn, streamRequest{Op: "login", ID: "2", Key: "nope"})
+	is.Equal(receive(t, conn).Type, "error")
+	send(t, conn, streamRequest{Op: "login", ID: "3", Key: "key"})
+	is.Equal(receive(t, conn).Type, "ack")
+
+	send(t, conn, streamRequest{Op: "place", ID: "4", Order: order})
+	u := update(t, receive(t, conn))
+	is.Equal(u.Status, "accepted")
+	is.Equal(u.Order.AccountID, "alice")
+	send(t, conn, streamRequest{Op: "place", ID: "5", Order: order})
+	is.Equal(receive(t, conn).Type, "error") // o1 was already placed
+	// an order that alice can't fund is failed rather than acked
+	send(t, conn, streamRequest{Op: "place", ID: "5a", Order: &orderbook.Order{ID: "big", Side: "buy", Price: 1000, Open: 1e12}})
+	m = receive(t, conn)
+	is.Equal(m.Type, "error")
+	is.True(strings.Contains(m.Error, "insufficient"))
+	send(t, conn, streamRequest{Op: "place", ID: "6", Order: &orderbook.Order{ID: "o2", AccountID: "bob", Side: "buy", Price: 1000, Open: 5}})
+	is.Equal(receive(t, conn).Type, "error") // the session can't trade for bob
+
+	send(t, conn, streamRequest{Op: "amend", ID: "7", Order: &orderbook.Order{ID: "o1", Price: 990, Open: 3}})
+	u = update(t, receive(t, conn))
+	is.Equal(u.Status, "amended")
+	is.Equal(u.Order.Price, uint64(990))
+	is.Equal(u.Order.Open, uint64(3))
+
+	send(t, conn, streamRequest{Op: "cancel", ID: "8", Order: &orderbook.Order{ID: "o1"}})
+	u = update(t, receive(t, conn))
+	is.Equal(u.Status, "canceled")
+	send(t, conn, streamRequest{Op: "cancel", ID: "9", Order: &orderbook.Order{ID: "o1"}})
+	is.Equal(receive(t, conn).Type, "error") // it's gone
+
+	acct, err := eng.accounts.Get("alice")
+	is.NoErr(err)
+	is.Equal(acct.Available(eng.market.Quote), acct.Balance(eng.market.Quote)) // nothing is held
+}
+
+func TestSessionCancelOnDisconnect(t *testing.T) {
+	is := is.New(t)
+	eng := bookEngine(t, "alice", "bob")
+	eng.keys["alice"] = "alice"
+	eng.keys["bob"] = "bob"
+
+	// alice asks for her orders to be canceled when she disconnects and bob doesn't
+	for _, account := range []string{"alice", "bob"} {
+		conn := dial(t, eng)
+		send(t, conn, streamRequest{Op: "login", Key: account, CancelOnDisconnect: account == "alice"})
+		is.Equal(receive(t, conn).Type, "ack")
+		send(t, conn, streamRequest{Op: "place", Order: &orderbook.Order{ID: account, Side: "buy", Price: 1000, Open: 5}})
+		is.Equal(update(t, receive(t, conn)).Status, "accepted")
+		conn.Close()
+	}
+	is.True(connected(eng, 0))
+
+	_, err := eng.cancel("alice", "alice")
+	is.True(err != nil) // already canceled
+	o, err := eng.cancel("bob", "bob")
+	is.NoErr(err)
+	is.Equal(o.ID, "bob")
+}
+
+func TestInsertOrder(t *testing.T) {
+	is := is.New(t)
+	eng := bookEngine(t, "alice", "bob")
+	eng.keys["key"] = "alice"
+	eng.keys["bob-key"] = "bob"
+	e := echo.New()
+	e.POST("/orders", eng.InsertOrder)
+
+	insert := func(key, body string) (int, OrderUpdate) {
+		req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if key != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+key)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		var u OrderUpdate
+		json.Unmarshal(rec.Body.Bytes(), &u)
+		return rec.Code, u
+	}
+
+	order := `{"ID": "o1", "Side": "buy", "Price": 1000, "Open": 5}`
+	code, _ := insert("", order)
+	is.Equal(code, http.StatusUnauthorized)
+	code, _ = insert("nope", order)
+	is.Equal(code, http.StatusUnauthorized)
+	code, _ = insert("key", `{"ID": "o1", "AccountID": "bob", "Side": "buy", "Price": 1000, "Open": 5}`)
+	is.Equal(code, http.StatusForbidden) // the key can't spend bob's funds
+
+	code, u := insert("key", order)
+	is.Equal(code, http.StatusCreated)
+	is.Equal(u.Status, "accepted")
+	is.Equal(u.Order.AccountID, "alice")
+
+	code, u = insert("key", `{"ID": "o2", "Side": "buy", "Price": 1000, "Open": 1000000000000}`)
+	is.Equal(code, http.StatusUnprocessableEntity)
+	is.Equal(u.Status, "rejected")
+	is.True(strings.Contains(u.Reason, "insufficient"))
+
+	// an order that fills comes back filled
+	code, u = insert("bob-key", `{"ID": "b1", "Side": "sell", "Price": 1000, "Open": 5}`)
+	is.Equal(code, http.StatusCreated)
+	is.Equal(u.Order.Filled, uint64(5))
+}
+
+func TestMargin(t *testing.T) {
+	is := is.New(t)
+	eng := testEngine()
+	eng.accounts = accounts.NewAccountManager("")
+	for id, balances := range map[string]map[string]float64{
+		"alice": {eng.market.Quote: 100},
+		"maker": {eng.market.Base: 10},
+	} {
+		_, err := eng.accounts.Create(id, balances)
+		is.NoErr(err)
+	}
+	eng.positions = positions.NewTracker()
+	eng.keys["key"] = "alice"
+	eng.keys["maker-key"] = "maker"
+	eng.SetAdminToken("secret")
+	lender := margin.NewEngine(eng.accounts, margin.Config{Quote: eng.market.Quote, MaxLeverage: 5, Maintenance: 0.1})
+	eng.writes = make(chan orderbook.OpWrite)
+	eng.cancels = make(chan orderbook.OpCancel)
+	is.NoErr(lender.AddMarket(eng.market, eng.writes, eng.cancels))
+	eng.SetMargin(lender)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go orderbook.Run(ctx, eng.market, eng.accounts, nil, eng.writes, eng.cancels, nil, nil, nil, nil, nil, nil, nil)
+
+	e := echo.New()
+	e.POST("/orders", eng.InsertOrder)
+	e.GET("/accounts/:id/margin", eng.GetMargin)
+	e.PUT("/accounts/:id/leverage", eng.SetLeverage)
+	e.PUT("/markets/:symbol/mark", eng.SetMark)
+	request := func(method, path, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if key != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+key)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	is.Equal(request(http.MethodPut, "/markets/"+eng.market.Symbol+"/mark", "secret", `{"price": 100}`).Code, http.StatusNoContent)
+	is.Equal(request(http.MethodPut, "/accounts/alice/leverage", "", `{"leverage": 5}`).Code, http.StatusUnauthorized)
+	is.Equal(request(http.MethodPut, "/accounts/alice/leverage", "key", `{"leverage": 20}`).Code, http.StatusBadRequest)
+	is.Equal(request(http.MethodPut, "/accounts/alice/leverage", "key", `{"leverage": 5}`).Code, http.StatusNoContent)
+
+	// 100 of equity at 5x buys 4 at 100
+	is.Equal(request(http.MethodPost, "/orders", "maker-key", `{"ID": "m1", "Side": "sell", "Price": 10000, "Open": 4}`).Code, http.StatusCreated)
+	is.Equal(request(http.MethodPost, "/orders", "key", `{"ID": "a1", "Side": "buy", "Price": 10000, "Open": 4}`).Code, http.StatusCreated)
+	is.Equal(eng.accounts.Ledger().Balance("alice", eng.market.Quote), float64(-300))
+
+	is.Equal(request(http.MethodGet, "/accounts/alice/margin", "", "").Code, http.StatusUnauthorized)
+	rec := request(http.MethodGet, "/accounts/alice/margin", "key", "")
+	is.Equal(rec.Code, http.StatusOK)
+	var status margin.Status
+	is.NoErr(json.Unmarshal(rec.Body.Bytes(), &status))
+	is.Equal(status.Leverage, float64(5))
+	is.Equal(status.Positions, float64(400))
+}
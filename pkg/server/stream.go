@@ -0,0 +1,391 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+// heartbeatInterval is how often a streaming client is sent a heartbeat.
+// Clients that don't send anything for three intervals are disconnected.
+var heartbeatInterval = 15 * time.Second
+
+// writeWait is how long a write to a streaming client can take.
+var writeWait = 5 * time.Second
+
+// clientBuffer is how many messages can be queued for a streaming client.
+// Clients that fall further behind than that are disconnected.
+var clientBuffer = 256
+
+// Channels that streaming clients can subscribe to. The private order
+// and fill channels are per account.
+const (
+	channelTrades = "trades"
+	channelDepth  = "depth"
+	channelTicker = "ticker"
+	channelBook   = "book"
+	channelOrders = "orders"
+	channelFills  = "fills"
+)
+
+// streamRequest is a message from a streaming client. Op is one of
+// subscribe, unsubscribe, ping, or one of the order entry ops: login,
+// place, amend or cancel. ID is echoed back in the reply to an order
+// entry op.
+type streamRequest struct {
+	Op      string `json:"op"`
+	ID      string `json:"id,omitempty"`
+	Channel string `json:"channel"`
+	Account string `json:"account,omitempty"`
+
+	// Key and CancelOnDisconnect log a session in.
+	Key                string `json:"key,omitempty"`
+	CancelOnDisconnect bool   `json:"cancel_on_disconnect,omitempty"`
+
+	Order *orderbook.Order `json:"order,omitempty"`
+}
+
+// streamMessage is a message to a streaming client. Type is one of
+// subscribed, unsubscribed, snapshot, update, heartbeat, pong, ack or
+// error.
+type streamMessage struct {
+	Type    string      `json:"type"`
+	ID      string      `json:"id,omitempty"`
+	Channel string      `json:"channel,omitempty"`
+	Account string      `json:"account,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+	Error   string      `json:"error,omitempty"`
+	Time    time.Time   `json:"time"`
+}
+
+// Trade is a match as it's streamed to the trades channel. ID is its ID
+// on the market's tape and Side is the side that crossed the book.
+type Trade struct {
+	ID       uint64    `json:"id"`
+	Symbol   string    `json:"symbol"`
+	Price    uint64    `json:"price"`
+	Quantity uint64    `json:"quantity"`
+	Side     string    `json:"side"`
+	Time     time.Time `json:"time"`
+}
+
+// Ticker is the last trade and best prices of a market.
+type Ticker struct {
+	Symbol string    `json:"symbol"`
+	Last   uint64    `json:"last"`
+	Bid    uint64    `json:"bid"`
+	Ask    uint64    `json:"ask"`
+	Time   time.Time `json:"time"`
+}
+
+// BookSnapshot is every order resting in the book as of the event
+// numbered Seq of its market-by-order feed. See MarketByOrder.Orders.
+type BookSnapshot struct {
+	Seq    uint64                  `json:"seq"`
+	Orders []orderbook.QueuedOrder `json:"orders"`
+}
+
+// OrderUpdate is a change to one of an account's orders.
+type OrderUpdate struct {
+	Status string          `json:"status"` // accepted, amended, rejected, canceled or filled
+	Order  orderbook.Order `json:"order"`
+	Reason string          `json:"reason,omitempty"` // why the order was rejected
+}
+
+// orderUpdate returns an update of o with status. The order's History is
+// left out: its matches point back at the order, which can't be encoded,
+// and fills are streamed on their own.
+func orderUpdate(status string, o orderbook.Order) OrderUpdate {
+	o.History = nil
+	return OrderUpdate{Status: status, Order: o}
+}
+
+// Fill is a match as it's streamed to the account of one of its orders.
+type Fill struct {
+	Symbol   string    `json:"symbol"`
+	OrderID  string    `json:"order_id"`
+	Side     string    `json:"side"`
+	Price    uint64    `json:"price"`
+	Quantity uint64    `json:"quantity"`
+	Time     time.Time `json:"time"`
+}
+
+// topic returns the topic that a channel is published on.
+func topic(channel, account string) string {
+	if account == "" {
+		return channel
+	}
+	return channel + ":" + account
+}
+
+// hub fans messages out to streaming clients by topic.
+type hub struct {
+	sync.RWMutex
+	clients map[*client]bool
+}
+
+func newHub() *hub {
+	return &hub{clients: make(map[*client]bool)}
+}
+
+// publish queues an update for every client subscribed to its topic.
+// Clients whose queues are full are disconnected instead of holding up
+// everyone else.
+func (h *hub) publish(channel, account string, data interface{}) {
+	h.send("update", channel, account, data)
+}
+
+// broadcast queues a fresh snapshot of a channel for its subscribers,
+// which start over from it.
+func (h *hub) broadcast(channel string, data interface{}) {
+	h.send("snapshot", channel, "", data)
+}
+
+// send queues a message of a type for every client subscribed to its
+// topic.
+func (h *hub) send(typ, channel, account string, data interface{}) {
+	b, err := json.Marshal(streamMessage{
+		Type:    typ,
+		Channel: channel,
+		Account: account,
+		Data:    data,
+		Time:    time.Now(),
+	})
+	if err != nil {
+		return
+	}
+
+	h.RLock()
+	defer h.RUnlock()
+	t := topic(channel, account)
+	for c := range h.clients {
+		if c.subscribed(t) {
+			c.queue(b)
+		}
+	}
+}
+
+func (h *hub) add(c *client) {
+	h.Lock()
+	defer h.Unlock()
+	h.clients[c] = true
+}
+
+func (h *hub) remove(c *client) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.clients, c)
+}
+
+// client is a streaming connection and its subscriptions. A client that
+// logs in is a session that can enter orders for its account.
+type client struct {
+	sync.Mutex
+
+	conn   *websocket.Conn
+	send   chan []byte
+	done   chan struct{}
+	once   sync.Once
+	topics map[string]bool
+
+	// heartbeat is how often the client is sent a heartbeat.
+	heartbeat time.Duration
+
+	account            string
+	cancelOnDisconnect bool
+	orders             map[string]bool
+}
+
+func newClient(conn *websocket.Conn) *client {
+	return &client{
+		conn:      conn,
+		send:      make(chan []byte, clientBuffer),
+		done:      make(chan struct{}),
+		topics:    make(map[string]bool),
+		heartbeat: heartbeatInterval,
+		orders:    make(map[string]bool),
+	}
+}
+
+func (c *client) subscribed(topic string) bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.topics[topic]
+}
+
+func (c *client) subscribe(topic string, on bool) {
+	c.Lock()
+	defer c.Unlock()
+	if on {
+		c.topics[topic] = true
+	} else {
+		delete(c.topics, topic)
+	}
+}
+
+// queue queues a message for the client or disconnects it if it's too
+// far behind.
+func (c *client) queue(b []byte) {
+	select {
+	case c.send <- b:
+	case <-c.done:
+	default:
+		c.close()
+	}
+}
+
+// reply queues a message of its own for the client.
+func (c *client) reply(m streamMessage) {
+	m.Time = time.Now()
+	if b, err := json.Marshal(m); err == nil {
+		c.queue(b)
+	}
+}
+
+func (c *client) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// write sends queued messages and heartbeats to the client until it's closed.
+func (c *client) write() {
+	heartbeat := time.NewTicker(c.heartbeat)
+	defer heartbeat.Stop()
+	defer c.close()
+
+	for {
+		var b []byte
+		select {
+		case <-c.done:
+			return
+		case b = <-c.send:
+		case now := <-heartbeat.C:
+			b, _ = json.Marshal(streamMessage{Type: "heartbeat", Time: now})
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := websocket.Message.Send(c.conn, string(b)); err != nil {
+			return
+		}
+	}
+}
+
+// Stream upgrades a request to a WebSocket that streams market data and
+// private account updates. Clients send JSON requests to subscribe to and
+// unsubscribe from channels and get JSON messages back. Subscribing to
+// depth sends a snapshot tagged with its sequence number first, and the
+// deltas after it can be applied on top of it. Private channels and order
+// entry are only open to a client that's logged in to the account.
+func (eng *Engine) Stream(c echo.Context) error {
+	// Any origin is accepted, the stream is meant for bots as much as browsers.
+	websocket.Server{Handler: eng.stream}.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+// stream serves a streaming connection until it's closed.
+func (eng *Engine) stream(conn *websocket.Conn) {
+	c := newClient(conn)
+	eng.hub.add(c)
+	defer eng.hub.remove(c)
+	defer c.close()
+	defer eng.disconnect(c)
+	go c.write()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(3 * c.heartbeat))
+		var req streamRequest
+		if err := websocket.JSON.Receive(conn, &req); err != nil {
+			if _, ok := err.(*json.SyntaxError); ok {
+				c.reply(streamMessage{Type: "error", Error: err.Error()})
+				continue
+			}
+			return
+		}
+		eng.handleStream(c, req)
+	}
+}
+
+// handleStream handles a request from a streaming client.
+func (eng *Engine) handleStream(c *client, req streamRequest) {
+	fail := func(err error) {
+		c.reply(streamMessage{Type: "error", Channel: req.Channel, Account: req.Account, Error: err.Error()})
+	}
+
+	switch req.Op {
+	case "ping":
+		c.reply(streamMessage{Type: "pong"})
+		return
+	case "login", "place", "amend", "cancel":
+		eng.handleSession(c, req)
+		return
+	case "subscribe", "unsubscribe":
+	default:
+		fail(fmt.Errorf("invalid op %q", req.Op))
+		return
+	}
+
+	switch req.Channel {
+	case channelTrades, channelDepth, channelTicker, channelBook:
+		req.Account = ""
+	case channelOrders, channelFills:
+		if account := c.session(); req.Account == "" || req.Account != account {
+			fail(fmt.Errorf("log in to account %q to subscribe to %s", req.Account, req.Channel))
+			return
+		}
+	default:
+		fail(fmt.Errorf("invalid channel %q", req.Channel))
+		return
+	}
+
+	t := topic(req.Channel, req.Account)
+	if req.Op == "unsubscribe" {
+		c.subscribe(t, false)
+		c.reply(streamMessage{Type: "unsubscribed", Channel: req.Channel, Account: req.Account})
+		return
+	}
+
+	// the hub can't publish while a depth or book subscriber gets its
+	// snapshot, so the updates it's sent next start where the snapshot
+	// ends or before.
+	eng.hub.Lock()
+	defer eng.hub.Unlock()
+	c.subscribe(t, true)
+	c.reply(streamMessage{Type: "subscribed", Channel: req.Channel, Account: req.Account})
+	switch req.Channel {
+	case channelDepth:
+		c.reply(streamMessage{Type: "snapshot", Channel: channelDepth, Data: eng.depth.Snapshot(0, 1)})
+	case channelTicker:
+		c.reply(streamMessage{Type: "snapshot", Channel: channelTicker, Data: eng.ticker()})
+	case channelBook:
+		eng.mboMu.Lock()
+		snapshot := BookSnapshot{Seq: eng.mbo.Seq, Orders: eng.mbo.Orders()}
+		eng.mboMu.Unlock()
+		c.reply(streamMessage{Type: "snapshot", Channel: channelBook, Data: snapshot})
+	}
+}
+
+// ticker returns the market's current ticker.
+func (eng *Engine) ticker() Ticker {
+	bid, ask := eng.depth.Top()
+	last, _ := eng.tape.Last()
+	return Ticker{Symbol: eng.market.Symbol, Last: last.Price, Bid: bid, Ask: ask, Time: time.Now()}
+}
+
+// publishTicker publishes the market's ticker if it changed since it was
+// last published.
+func (eng *Engine) publishTicker() {
+	t := eng.ticker()
+	eng.tickerMu.Lock()
+	defer eng.tickerMu.Unlock()
+	if t.Last == eng.published.Last && t.Bid == eng.published.Bid && t.Ask == eng.published.Ask {
+		return
+	}
+	eng.published = t
+	eng.hub.publish(channelTicker, "", t)
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dylanlott/orderbook/pkg/orderbook"
+	"github.com/labstack/echo/v4"
+	"github.com/matryer/is"
+	"golang.org/x/net/websocket"
+)
+
+// message is a streamMessage as a client reads it.
+type message struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id"`
+	Channel string          `json:"channel"`
+	Account string          `json:"account"`
+	Data    json.RawMessage `json:"data"`
+	Error   string          `json:"error"`
+}
+
+// testEngine returns an Engine that can stream without a book behind it.
+func testEngine() *Engine {
+	return &Engine{
+		srv:    echo.New(),
+		market: defaultMarket,
+		depth:  orderbook.NewDepthView(),
+		tape:   orderbook.NewTape(),
+		mbo:    orderbook.NewMarketByOrder(),
+		hub:    newHub(),
+		keys:   make(map[string]string),
+	}
+}
+
+// dial serves eng's stream and connects to it.
+func dial(t *testing.T, eng *Engine) *websocket.Conn {
+	t.Helper()
+	srv := httptest.NewServer(websocket.Server{Handler: eng.stream})
+	t.Cleanup(srv.Close)
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), "", "http://localhost/")
+	if err != nil {
+		t.Fatalf("failed to dial stream: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// send sends a request on the stream.
+func send(t *testing.T, conn *websocket.Conn, req streamRequest) {
+	t.Helper()
+	if err := websocket.JSON.Send(conn, req); err != nil {
+		t.Fatalf("failed to send %s: %v", req.Op, err)
+	}
+}
+
+// receive reads the next message from the stream.
+func receive(t *testing.T, conn *websocket.Conn) message {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var m message
+	if err := websocket.JSON.Receive(conn, &m); err != nil {
+		t.Fatalf("failed to receive: %v", err)
+	}
+	return m
+}
+
+// connected waits for eng's hub to have n clients.
+func connected(eng *Engine, n int) bool {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		eng.hub.RLock()
+		clients := len(eng.hub.clients)
+		eng.hub.RUnlock()
+		if clients == n {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
+
+func TestStreamSubscribe(t *testing.T) {
+	is := is.New(t)
+	eng := testEngine()
+	conn := dial(t, eng)
+
+	send(t, conn, streamRequest{Op: "subscribe", Channel: channelTrades})
+	m := receive(t, conn)
+	is.Equal(m.Type, "subscribed")
+	is.Equal(m.Channel, channelTrades)
+
+	eng.hub.publish(channelTrades, "", Trade{ID: 1, Price: 1000, Quantity: 5})
+	m = receive(t, conn)
+	is.Equal(m.Type, "update")
+	var trade Trade
+	is.NoErr(json.Unmarshal(m.Data, &trade))
+	is.Equal(trade.ID, uint64(1))
+
+	send(t, conn, streamRequest{Op: "unsubscribe", Channel: channelTrades})
+	is.Equal(receive(t, conn).Type, "unsubscribed")
+	eng.hub.publish(channelTrades, "", Trade{ID: 2})
+	send(t, conn, streamRequest{Op: "ping"})
+	is.Equal(receive(t, conn).Type, "pong") // the trade wasn't sent
+
+	// depth is sent as a snapshot first
+	is.NoErr(eng.depth.Apply(orderbook.LevelDelta{Seq: 1, Side: "buy", Price: 990, Quantity: 3, Orders: 1}))
+	send(t, conn, streamRequest{Op: "subscribe", Channel: channelDepth})
+	is.Equal(receive(t, conn).Type, "subscribed")
+	m = receive(t, conn)
+	is.Equal(m.Type, "snapshot")
+	var depth orderbook.Depth
+	is.NoErr(json.Unmarshal(m.Data, &depth))
+	is.Equal(depth.Seq, uint64(1))
+	is.Equal(depth.Bids, []orderbook.Level{{Price: 990, Quantity: 3, Orders: 1}})
+
+	// private channels need a session
+	send(t, conn, streamRequest{Op: "subscribe", Channel: channelOrders, Account: "alice"})
+	is.Equal(receive(t, conn).Type, "error")
+	send(t, conn, streamRequest{Op: "subscribe", Channel: "nope"})
+	is.Equal(receive(t, conn).Type, "error")
+}
+
+func TestStreamHeartbeat(t *testing.T) {
+	is := is.New(t)
+	eng := testEngine()
+	interval := heartbeatInterval
+	heartbeatInterval = 20 * time.Millisecond
+	defer func() { heartbeatInterval = interval }()
+	conn := dial(t, eng)
+
+	// the client isn't sent anything but heartbeats
+	is.Equal(receive(t, conn).Type, "heartbeat")
+	is.Equal(receive(t, conn).Type, "heartbeat")
+
+	// and it's disconnected for not sending anything for three of them
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var err error
+	for err == nil {
+		var m message
+		err = websocket.JSON.Receive(conn, &m)
+	}
+	is.True(connected(eng, 0))
+}
+
+func TestStreamSlowConsumer(t *testing.T) {
+	is := is.New(t)
+	eng := testEngine()
+
+	// a client that never writes out what's queued for it
+	slow := make(chan *client, 1)
+	srv := httptest.NewServer(websocket.Server{Handler: func(conn *websocket.Conn) {
+		c := newClient(conn)
+		c.subscribe(channelTrades, true)
+		eng.hub.add(c)
+		defer eng.hub.remove(c)
+		slow <- c
+		<-c.done
+	}})
+	defer srv.Close()
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), "", "http://localhost/")
+	is.NoErr(err)
+	defer conn.Close()
+	c := <-slow
+
+	for i := 0; i <= clientBuffer; i++ {
+		eng.hub.publish(channelTrades, "", Trade{ID: uint64(i)})
+	}
+	select {
+	case <-c.done:
+	case <-time.After(time.Second):
+		t.Fatal("the slow client wasn't disconnected")
+	}
+	is.True(connected(eng, 0))
+
+	// and the hub goes on publishing to everyone else
+	fast := dial(t, eng)
+	send(t, fast, streamRequest{Op: "subscribe", Channel: channelTrades})
+	is.Equal(receive(t, fast).Type, "subscribed")
+	eng.hub.publish(channelTrades, "", Trade{ID: 1})
+	is.Equal(receive(t, fast).Type, "update")
+}
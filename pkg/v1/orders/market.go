@@ -101,7 +101,7 @@ func (fm *market) handleWantLess(fillOrder, bookOrder Order) error {
 
 	// TODO: upgrade from float64 to integer-only handling
 	total := float64(wanted) * bookOrder.Price()
-	_, err := fm.Accounts.Tx(fillOrder.Owner().UserID(), bookOrder.Owner().UserID(), total)
+	_, err := fm.Accounts.Tx(fillOrder.Owner().UserID(), bookOrder.Owner().UserID(), accounts.USD, total)
 	if err != nil {
 		return fmt.Errorf("failed to transfer balances: %+v", err)
 	}
@@ -134,7 +134,7 @@ func (fm *market) handleEqualWant(fillOrder, bookOrder Order) error {
 
 	// TODO: upgrade form float64 to integer-only handling
 	total := float64(wanted) * bookOrder.Price()
-	_, err := fm.Accounts.Tx(fillOrder.Owner().UserID(), bookOrder.Owner().UserID(), total)
+	_, err := fm.Accounts.Tx(fillOrder.Owner().UserID(), bookOrder.Owner().UserID(), accounts.USD, total)
 	if err != nil {
 		return fmt.Errorf("failed to update fill order: %+v", err)
 	}
@@ -168,7 +168,7 @@ func (fm *market) handleWantMore(fill, book Order) error {
 	wanted := float64(book.Quantity()) * book.Price()
 
 	total := float64(wanted) * book.Price()
-	_, err := fm.Accounts.Tx(fill.Owner().UserID(), book.Owner().UserID(), total)
+	_, err := fm.Accounts.Tx(fill.Owner().UserID(), book.Owner().UserID(), accounts.USD, total)
 	if err != nil {
 		return fmt.Errorf("failed to update fill order: %+v", err)
 	}
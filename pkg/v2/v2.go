@@ -212,7 +212,7 @@ func (o *Orderbook) Match(buyOrder Order) (Order, error) {
 			total := available * uint64(sellOrder.Price())
 
 			// Attempt to transfer balances
-			_, err := o.Accounts.Tx(buyer.UserID(), seller.UserID(), float64(total))
+			_, err := o.Accounts.Tx(buyer.UserID(), seller.UserID(), accounts.USD, float64(total))
 			if err != nil {
 				return buyOrder, err
 			}
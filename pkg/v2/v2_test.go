@@ -283,12 +283,12 @@ func TestMatch(t *testing.T) {
 		Accounts: &accounts.InMemoryManager{
 			Accounts: map[string]*accounts.UserAccount{
 				"alice@test.com": {
-					Email:          "alice@test.com",
-					CurrentBalance: 1000,
+					Email:    "alice@test.com",
+					Balances: map[string]float64{accounts.USD: 1000},
 				},
 				"bob@test.com": {
-					Email:          "bob@test.com",
-					CurrentBalance: 1000,
+					Email:    "bob@test.com",
+					Balances: map[string]float64{accounts.USD: 1000},
 				},
 			},
 		},
@@ -331,7 +331,7 @@ func TestMatch(t *testing.T) {
 	// assert balances were adjusted
 	updatedBuyer, err := orderbook.Accounts.Get(buy.OwnerID())
 	is.NoErr(err)
-	is.Equal(updatedBuyer.Balance(), float64(900))
+	is.Equal(updatedBuyer.Balance(accounts.USD), float64(900))
 
 	// assert orders are removed from books
 	_, err = orderbook.Buy.Find(buy.price)